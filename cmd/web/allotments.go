@@ -0,0 +1,31 @@
+package main
+
+import (
+	"time"
+
+	"github.com/kons77/room-bookings-app/internal/handlers"
+)
+
+// releaseAllotments puts the rooms still held for allotments back on sale on their release date, once at
+// startup and then daily, and offers them to the waitlist
+func releaseAllotments() {
+	// execute in the background
+	go func() {
+		for {
+			now := time.Now()
+			today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+			n, err := handlers.Repo.DB.ReleaseAllotments(today)
+			if err != nil {
+				app.ErrorLog.Println("can't release allotments:", err)
+			} else if n > 0 {
+				app.InfoLog.Printf("Released %d rooms held for allotments\n", n)
+				handlers.Repo.NotifyWaitlist()
+			}
+
+			// wake up just after midnight for the next day's releases
+			tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 5, 0, 0, now.Location())
+			time.Sleep(time.Until(tomorrow))
+		}
+	}()
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"time"
+
+	"github.com/kons77/room-bookings-app/internal/handlers"
+)
+
+// releaseExpiredHolds gives back the rooms held for guests who didn't book them in time, every minute, and
+// offers them to the waitlist
+func releaseExpiredHolds() {
+	// execute in the background
+	go func() {
+		for {
+			n, err := handlers.Repo.DB.ReleaseExpiredHolds(time.Now())
+			if err != nil {
+				app.ErrorLog.Println("can't release expired holds:", err)
+			} else if n > 0 {
+				app.InfoLog.Printf("Released %d expired holds\n", n)
+				handlers.Repo.NotifyWaitlist()
+			}
+
+			time.Sleep(time.Minute)
+		}
+	}()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"time"
+
+	"github.com/kons77/room-bookings-app/internal/handlers"
+)
+
+// generateHousekeepingTasks makes the housekeeping list of the day and marks the rooms out of order,
+// once at startup and then daily
+func generateHousekeepingTasks() {
+	// execute in the background
+	go func() {
+		for {
+			now := time.Now()
+			today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+			n, err := handlers.Repo.DB.GenerateHousekeepingTasks(today)
+			if err != nil {
+				app.ErrorLog.Println("can't generate housekeeping tasks:", err)
+			} else if n > 0 {
+				app.InfoLog.Printf("Generated %d housekeeping tasks\n", n)
+			}
+
+			// work orders starting today take their rooms out of order
+			n, err = handlers.Repo.DB.MarkOutOfOrderRooms(today)
+			if err != nil {
+				app.ErrorLog.Println("can't mark rooms out of order:", err)
+			} else if n > 0 {
+				app.InfoLog.Printf("Marked %d rooms out of order\n", n)
+			}
+
+			// wake up just after midnight for the next day's list
+			tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 5, 0, 0, now.Location())
+			time.Sleep(time.Until(tomorrow))
+		}
+	}()
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/gob"
 	"flag"
 	"fmt"
@@ -15,6 +16,7 @@ import (
 	"github.com/kons77/room-bookings-app/internal/helpers"
 	"github.com/kons77/room-bookings-app/internal/models"
 	"github.com/kons77/room-bookings-app/internal/render"
+	"github.com/kons77/room-bookings-app/internal/sso"
 	"gopkg.in/yaml.v3"
 
 	"github.com/alexedwards/scs/v2"
@@ -68,6 +70,21 @@ func main() {
 	fmt.Println("Starting mail listener...")
 	listenForMail()
 
+	fmt.Println("Starting trash purge...")
+	purgeDeletedReservations()
+
+	fmt.Println("Starting housekeeping lists...")
+	generateHousekeepingTasks()
+
+	fmt.Println("Starting allotment releases...")
+	releaseAllotments()
+
+	fmt.Println("Starting waitlist offers...")
+	offerWaitlistRooms()
+
+	fmt.Println("Starting hold releases...")
+	releaseExpiredHolds()
+
 	fmt.Printf("Starting application on port %s \n", portNumber)
 
 	srv := &http.Server{
@@ -85,6 +102,7 @@ func run() (*driver.DB, error) {
 	gob.Register(models.Reservation{})
 	gob.Register(models.User{})
 	gob.Register(models.Room{})
+	gob.Register([]models.Room{})
 	gob.Register(models.Restriction{})
 	gob.Register(map[string]int{})
 
@@ -103,6 +121,15 @@ func run() (*driver.DB, error) {
 	dbPswd := flag.String("dbpswd", "", "Database password")
 	dbPort := flag.String("dbport", "", "Database port")
 	dbSSL := flag.String("dbssl", "disable", "Database SSL settings (disable, prefer, require)")
+	baseURL := flag.String("baseurl", "http://localhost:8080", "Public URL of the site, used for links in emails")
+	signingKey := flag.String("signingkey", "", "Secret for signed email links; a random one is used if empty")
+	retentionDays := flag.Int("retentiondays", 30, "Days deleted reservations can be restored before they are purged")
+	uploadDir := flag.String("uploaddir", "./uploads", "Directory for uploaded files such as work order photos")
+	oidcIssuer := flag.String("oidcissuer", "", "OpenID Connect issuer URL for admin single sign-on; disabled if empty")
+	oidcClientID := flag.String("oidcclientid", "", "OpenID Connect client id")
+	oidcClientSecret := flag.String("oidcclientsecret", "", "OpenID Connect client secret")
+	oidcGroupsClaim := flag.String("oidcgroupsclaim", "groups", "ID token claim listing the user's groups")
+	oidcGroups := flag.String("oidcgroups", "", "IdP groups mapped to access levels, e.g. staff:2,admins:3")
 
 	flag.Parse()
 
@@ -140,6 +167,41 @@ func run() (*driver.DB, error) {
 	// set up application configuration and logging
 	app.InProduction = *inProduction
 	app.UseCache = *useCache
+	app.BaseURL = *baseURL
+	app.RetentionDays = *retentionDays
+	app.UploadDir = *uploadDir
+
+	// without a configured key, links sent before a restart stop working
+	if *signingKey == "" {
+		key, err := helpers.RandomToken(32)
+		if err != nil {
+			return nil, err
+		}
+		*signingKey = key
+	}
+	app.SigningKey = []byte(*signingKey)
+
+	// set up admin single sign-on; the local login keeps working if the IdP is unreachable
+	if *oidcIssuer != "" {
+		groupLevels, err := sso.ParseGroupLevels(*oidcGroups)
+		if err != nil {
+			return nil, err
+		}
+
+		provider, err := sso.New(context.Background(), config.OIDCConfig{
+			Issuer:       *oidcIssuer,
+			ClientID:     *oidcClientID,
+			ClientSecret: *oidcClientSecret,
+			RedirectURL:  app.BaseURL + "/user/sso/callback",
+			GroupsClaim:  *oidcGroupsClaim,
+			GroupLevels:  groupLevels,
+		})
+		if err != nil {
+			log.Println("Cannot set up single sign-on:", err)
+		} else {
+			app.SSO = provider
+		}
+	}
 
 	infoLog = log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	app.InfoLog = infoLog
@@ -37,3 +37,27 @@ func Auth(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// GuestAuth is applied to routes that need a logged in guest account.
+func GuestAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !helpers.IsGuest(r) {
+			session.Put(r.Context(), "error", "Log in first!")
+			http.Redirect(w, r, "/guest/login", http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// MagicLinkAuth is applied to routes opened by a guest's magic link.
+func MagicLinkAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if helpers.MagicLinkEmail(r) == "" {
+			session.Put(r.Context(), "error", "Request a new link to see your reservations")
+			http.Redirect(w, r, "/my-reservations", http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"time"
+
+	"github.com/kons77/room-bookings-app/internal/handlers"
+)
+
+// purgeDeletedReservations removes reservations that stayed in the trash past the retention period,
+// once at startup and then daily
+func purgeDeletedReservations() {
+	// execute in the background
+	go func() {
+		for {
+			deletedBefore := time.Now().AddDate(0, 0, -app.RetentionDays)
+			n, err := handlers.Repo.DB.PurgeDeletedReservations(deletedBefore)
+			if err != nil {
+				app.ErrorLog.Println("can't purge deleted reservations:", err)
+			} else if n > 0 {
+				app.InfoLog.Printf("Purged %d deleted reservations\n", n)
+			}
+
+			time.Sleep(24 * time.Hour)
+		}
+	}()
+}
@@ -28,8 +28,19 @@ func routes(app *config.AppConfig) http.Handler {
 	mux.Get("/search-availability", handlers.Repo.Availability)
 	mux.Post("/search-availability", handlers.Repo.PostAvailability)
 	mux.Post("/search-availability-json", handlers.Repo.AvailabilityJSON)
+	mux.Get("/availability-calendar", handlers.Repo.AvailabilityCalendar)
+	mux.Get("/flexible-search", handlers.Repo.FlexibleSearch)
+	mux.Post("/flexible-search", handlers.Repo.PostFlexibleSearch)
 	mux.Get("/choose-room/{id}", handlers.Repo.ChooseRoom)
+	mux.Get("/choose-split", handlers.Repo.ChooseSplit)
+	mux.Post("/choose-rooms", handlers.Repo.ChooseRooms)
+	mux.Get("/cart/remove/{id}", handlers.Repo.CartRemove)
+	mux.Get("/group-booking", handlers.Repo.GroupBooking)
+	mux.Post("/group-booking", handlers.Repo.PostGroupBooking)
 	mux.Get("/book-room", handlers.Repo.BookRoom)
+	mux.Get("/waitlist", handlers.Repo.Waitlist)
+	mux.Post("/waitlist", handlers.Repo.PostWaitlist)
+	mux.Get("/waitlist/offer", handlers.Repo.WaitlistOffer)
 
 	mux.Get("/contact", handlers.Repo.Contact)
 
@@ -40,6 +51,31 @@ func routes(app *config.AppConfig) http.Handler {
 	mux.Get("/user/login", handlers.Repo.ShowLogin)
 	mux.Post("/user/login", handlers.Repo.PostShowLogin)
 	mux.Get("/user/logout", handlers.Repo.Logout)
+	mux.Get("/user/sso/login", handlers.Repo.SSOLogin)
+	mux.Get("/user/sso/callback", handlers.Repo.SSOCallback)
+
+	mux.Get("/guest/register", handlers.Repo.ShowGuestRegister)
+	mux.Post("/guest/register", handlers.Repo.PostGuestRegister)
+	mux.Get("/guest/verify", handlers.Repo.GuestVerify)
+	mux.Get("/guest/login", handlers.Repo.ShowGuestLogin)
+	mux.Post("/guest/login", handlers.Repo.PostGuestLogin)
+	mux.Get("/guest/logout", handlers.Repo.GuestLogout)
+
+	mux.Get("/my-reservations", handlers.Repo.ShowMyReservations)
+	mux.Post("/my-reservations", handlers.Repo.PostMyReservations)
+	mux.Get("/my-reservations/access", handlers.Repo.MagicLinkAccess)
+
+	mux.Route("/my-reservations", func(mux chi.Router) {
+		mux.Use(MagicLinkAuth)
+		mux.Get("/list", handlers.Repo.MyReservationsList)
+		mux.Get("/{id}/confirmation", handlers.Repo.MyReservationConfirmation)
+		mux.Post("/{id}/cancel", handlers.Repo.PostMyReservationCancel)
+	})
+
+	mux.Route("/guest", func(mux chi.Router) {
+		mux.Use(GuestAuth)
+		mux.Get("/bookings", handlers.Repo.GuestBookings)
+	})
 
 	// tell our app where to find static files
 	fileServer := http.FileServer(http.Dir("./static/"))
@@ -48,15 +84,57 @@ func routes(app *config.AppConfig) http.Handler {
 	mux.Route("/admin", func(mux chi.Router) {
 		// mux.Use(Auth)
 		mux.Get("/dashboard", handlers.Repo.AdminDashboard)
+		mux.Get("/front-desk", handlers.Repo.AdminFrontDesk)
+		mux.Get("/front-desk/arrivals", handlers.Repo.AdminFrontDeskArrivals)
+		mux.Get("/check-in/{id}/do", handlers.Repo.AdminCheckIn)
+		mux.Get("/check-out/{id}/do", handlers.Repo.AdminCheckOut)
+		mux.Post("/assign-unit/{id}", handlers.Repo.AdminAssignUnit)
+		mux.Get("/housekeeping", handlers.Repo.AdminHousekeeping)
+		mux.Post("/housekeeping/generate", handlers.Repo.AdminPostGenerateHousekeeping)
+		mux.Post("/housekeeping/{id}/done", handlers.Repo.AdminCompleteHousekeepingTask)
+		mux.Post("/rooms/{id}", handlers.Repo.AdminPostRoom)
+		mux.Post("/rooms/{id}/status", handlers.Repo.AdminSetRoomStatus)
+		mux.Get("/room-types", handlers.Repo.AdminRoomTypes)
+		mux.Post("/room-types", handlers.Repo.AdminPostRoomType)
+		mux.Post("/room-types/{id}/units", handlers.Repo.AdminPostRoomTypeUnit)
+		mux.Get("/amenities", handlers.Repo.AdminAmenities)
+		mux.Post("/amenities", handlers.Repo.AdminPostAmenity)
+		mux.Post("/rooms/{id}/amenities", handlers.Repo.AdminPostRoomAmenities)
+		mux.Get("/work-orders", handlers.Repo.AdminWorkOrders)
+		mux.Get("/work-orders/new", handlers.Repo.AdminNewWorkOrder)
+		mux.Post("/work-orders/new", handlers.Repo.AdminPostNewWorkOrder)
+		mux.Get("/work-orders/photos/{file}", handlers.Repo.AdminWorkOrderPhoto)
+		mux.Get("/work-orders/{id}", handlers.Repo.AdminShowWorkOrder)
+		mux.Post("/work-orders/{id}", handlers.Repo.AdminPostWorkOrder)
+		mux.Post("/work-orders/{id}/close", handlers.Repo.AdminCloseWorkOrder)
+		mux.Get("/allotments", handlers.Repo.AdminAllotments)
+		mux.Get("/allotments/new", handlers.Repo.AdminNewAllotment)
+		mux.Post("/allotments/new", handlers.Repo.AdminPostNewAllotment)
+		mux.Get("/allotments/{id}", handlers.Repo.AdminShowAllotment)
 		mux.Get("/reservations/{src}", handlers.Repo.AdminReservationsGrid)
+		mux.Get("/reservations-json", handlers.Repo.AdminReservationsJSON)
+		mux.Get("/reservations-export", handlers.Repo.AdminExportReservations)
+		mux.Get("/reservations/import", handlers.Repo.AdminReservationsImport)
+		mux.Post("/reservations/import", handlers.Repo.AdminPostReservationsImport)
+		mux.Post("/reservations/import/commit", handlers.Repo.AdminCommitReservationsImport)
+		mux.Get("/reservations/book", handlers.Repo.AdminNewReservation)
+		mux.Post("/reservations/book", handlers.Repo.AdminPostNewReservation)
+		mux.Get("/reservations-availability", handlers.Repo.AdminReservationAvailability)
 		mux.Get("/reservations/cal", handlers.Repo.AdminReservationsCalendar)
 		mux.Post("/reservations/cal", handlers.Repo.AdminPostReservationsCalendar)
 		mux.Get("/process-reservation/{src}/{id}/do", handlers.Repo.AdminProcessReservation)
 		mux.Get("/delete-reservation/{src}/{id}/do", handlers.Repo.AdminDeleteReservation)
+		mux.Post("/move-reservation/{id}", handlers.Repo.AdminMoveReservation)
+		mux.Post("/split-reservation/{id}", handlers.Repo.AdminSplitReservation)
+		mux.Post("/cancel-group/{id}", handlers.Repo.AdminCancelGroup)
+		mux.Get("/reservations/trash", handlers.Repo.AdminReservationsTrash)
+		mux.Get("/restore-reservation/{id}/do", handlers.Repo.AdminRestoreReservation)
 
 		mux.Get("/reservations/{src}/{id}/show", handlers.Repo.AdminShowReservation)
 		mux.Post("/reservations/{src}/{id}", handlers.Repo.AdminPostShowReservation)
 
+		mux.Get("/audit", handlers.Repo.AdminAuditLog)
+
 		mux.Get("/generate-hashed-password", handlers.Repo.AdminHashPassword)
 		mux.Post("/generate-hashed-password", handlers.Repo.AdminPostHashPassword)
 	})
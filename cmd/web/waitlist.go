@@ -0,0 +1,20 @@
+package main
+
+import (
+	"time"
+
+	"github.com/kons77/room-bookings-app/internal/handlers"
+)
+
+// offerWaitlistRooms offers rooms to the guests on the waitlist, once at startup and then hourly, so a room
+// whose offer expired unbooked goes to the next guest waiting
+func offerWaitlistRooms() {
+	// execute in the background
+	go func() {
+		for {
+			handlers.Repo.NotifyWaitlist()
+
+			time.Sleep(time.Hour)
+		}
+	}()
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"context"
 	"log"
 	"text/template"
 
@@ -20,4 +21,25 @@ type AppConfig struct {
 	InProduction  bool
 	Session       *scs.SessionManager
 	MailChan      chan models.MailData
+	BaseURL       string
+	SigningKey    []byte
+	SSO           SingleSignOn // nil unless OIDC login is configured
+	RetentionDays int          // how long deleted reservations can be restored before they are purged
+	UploadDir     string       // where uploaded files such as work order photos are kept
+}
+
+// OIDCConfig holds the per deployment settings of the admin single sign-on
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	GroupsClaim  string         // name of the ID token claim listing the user's groups
+	GroupLevels  map[string]int // IdP group to users.access_level; the highest match wins
+}
+
+// SingleSignOn is an identity provider staff can log in with
+type SingleSignOn interface {
+	AuthCodeURL(state, nonce string) string
+	Exchange(ctx context.Context, code, nonce string) (models.SSOIdentity, error)
 }
@@ -0,0 +1,233 @@
+package export
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// RowWriter streams a table row by row, so an export never holds the whole table in memory
+type RowWriter interface {
+	WriteRow(cells []string) error
+	Close() error
+}
+
+// Column is a column of an export. Only numeric columns are written as numbers; everything else, phone
+// numbers included, stays text as it is
+type Column struct {
+	Name    string
+	Numeric bool
+}
+
+// New returns a row writer for format, csv or xlsx, that has written the header row of columns
+func New(format string, w io.Writer, columns []Column) (RowWriter, error) {
+	var rw RowWriter
+	var err error
+
+	switch format {
+	case "csv":
+		rw = NewCSV(w, columns)
+	case "xlsx":
+		rw, err = NewXLSX(w, columns)
+	default:
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]string, len(columns))
+	for i, c := range columns {
+		header[i] = c.Name
+	}
+	if err := rw.WriteRow(header); err != nil {
+		return nil, err
+	}
+
+	return rw, nil
+}
+
+// numericColumns tells for each column whether it holds numbers
+func numericColumns(columns []Column) []bool {
+	numeric := make([]bool, len(columns))
+	for i, c := range columns {
+		numeric[i] = c.Numeric
+	}
+	return numeric
+}
+
+// isNumber reports whether cell i of a row goes out as a number, a whole one or one with decimals like an amount
+func isNumber(numeric []bool, i int, cell string) bool {
+	if i >= len(numeric) || !numeric[i] {
+		return false
+	}
+	whole, decimals, _ := strings.Cut(cell, ".")
+	if _, err := strconv.ParseInt(whole, 10, 64); err != nil {
+		return false
+	}
+	return strings.Trim(decimals, "0123456789") == ""
+}
+
+// escapeFormula keeps a spreadsheet from running text a guest typed in as a formula, by starting text that
+// looks like one with a quote
+func escapeFormula(cell string) string {
+	if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+// ContentType returns the mime type of format
+func ContentType(format string) string {
+	if format == "xlsx" {
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+// CSVWriter writes rows as comma separated values
+type CSVWriter struct {
+	w       *csv.Writer
+	numeric []bool
+}
+
+// NewCSV returns a csv row writer for columns
+func NewCSV(w io.Writer, columns []Column) *CSVWriter {
+	return &CSVWriter{w: csv.NewWriter(w), numeric: numericColumns(columns)}
+}
+
+// WriteRow writes one row, with text that looks like a formula escaped
+func (c *CSVWriter) WriteRow(cells []string) error {
+	row := make([]string, len(cells))
+	for i, cell := range cells {
+		row[i] = cell
+		if !isNumber(c.numeric, i, cell) {
+			row[i] = escapeFormula(cell)
+		}
+	}
+	return c.w.Write(row)
+}
+
+// Close flushes the buffered rows
+func (c *CSVWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// XLSXWriter writes rows to a single sheet workbook. The zip entries are written in order,
+// with the sheet streamed last, so nothing but the current row is buffered
+type XLSXWriter struct {
+	zw      *zip.Writer
+	sheet   *bufio.Writer
+	row     int
+	numeric []bool
+}
+
+// the fixed parts of a minimal workbook with one sheet
+const (
+	xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`
+	xlsxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`
+	xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="Reservations" sheetId="1" r:id="rId1"/></sheets>` +
+		`</workbook>`
+	xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`
+	xlsxSheetStart = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`
+	xlsxSheetEnd = `</sheetData></worksheet>`
+)
+
+// NewXLSX writes the workbook parts and opens the sheet for rows of columns
+func NewXLSX(w io.Writer, columns []Column) (*XLSXWriter, error) {
+	zw := zip.NewWriter(w)
+
+	parts := []struct{ name, body string }{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRels},
+		{"xl/workbook.xml", xlsxWorkbook},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+	}
+	for _, p := range parts {
+		f, err := zw.Create(p.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(f, p.body); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+
+	x := &XLSXWriter{zw: zw, sheet: bufio.NewWriter(f), numeric: numericColumns(columns)}
+	if _, err := x.sheet.WriteString(xlsxSheetStart); err != nil {
+		return nil, err
+	}
+
+	return x, nil
+}
+
+// WriteRow writes one row; numbers in numeric columns become number cells, the rest inline strings
+// with text that looks like a formula escaped
+func (x *XLSXWriter) WriteRow(cells []string) error {
+	x.row++
+	fmt.Fprintf(x.sheet, `<row r="%d">`, x.row)
+
+	for i, cell := range cells {
+		ref := columnName(i) + strconv.Itoa(x.row)
+		if isNumber(x.numeric, i, cell) {
+			fmt.Fprintf(x.sheet, `<c r="%s"><v>%s</v></c>`, ref, cell)
+			continue
+		}
+
+		fmt.Fprintf(x.sheet, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">`, ref)
+		if err := xml.EscapeText(x.sheet, []byte(escapeFormula(cell))); err != nil {
+			return err
+		}
+		x.sheet.WriteString(`</t></is></c>`)
+	}
+
+	_, err := x.sheet.WriteString(`</row>`)
+	return err
+}
+
+// Close ends the sheet and the zip archive
+func (x *XLSXWriter) Close() error {
+	if _, err := x.sheet.WriteString(xlsxSheetEnd); err != nil {
+		return err
+	}
+	if err := x.sheet.Flush(); err != nil {
+		return err
+	}
+	return x.zw.Close()
+}
+
+// columnName returns the spreadsheet name of the zero based column i: A, B, ..., Z, AA, ...
+func columnName(i int) string {
+	name := ""
+	for i >= 0 {
+		name = string(rune('A'+i%26)) + name
+		i = i/26 - 1
+	}
+	return name
+}
@@ -0,0 +1,117 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// testColumns are the columns the writers are tested with
+var testColumns = []Column{{Name: "ID", Numeric: true}, {Name: "Last Name"}, {Name: "Phone"}}
+
+func TestCSVWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := New("csv", &buf, testColumns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.WriteRow([]string{"1", "Smith, Jr.", "0123"})
+	w.WriteRow([]string{"-2", "=HYPERLINK(\"http://x\")", "+44 20"})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "ID,Last Name,Phone\n1,\"Smith, Jr.\",0123\n-2,\"'=HYPERLINK(\"\"http://x\"\")\",'+44 20\n"
+	if buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestXLSXWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := New("xlsx", &buf, testColumns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.WriteRow([]string{"7", "O'Brien & <Sons>", "0123456"})
+	w.WriteRow([]string{"8", "@SUM(A1:A2)", "+4420"})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("not a zip archive: %s", err)
+	}
+
+	var sheet string
+	for _, f := range zr.File {
+		if f.Name == "xl/worksheets/sheet1.xml" {
+			rc, _ := f.Open()
+			b, _ := io.ReadAll(rc)
+			rc.Close()
+			sheet = string(b)
+		}
+	}
+
+	if !strings.Contains(sheet, `<c r="A2"><v>7</v></c>`) {
+		t.Error("expected a number cell for the id")
+	}
+	if !strings.Contains(sheet, `O&#39;Brien &amp; &lt;Sons&gt;`) {
+		t.Errorf("expected escaped text, got %s", sheet)
+	}
+	if !strings.Contains(sheet, `<c r="C2" t="inlineStr"><is><t xml:space="preserve">0123456</t>`) {
+		t.Error("expected the phone number as text, leading zero kept")
+	}
+	if !strings.Contains(sheet, `<t xml:space="preserve">&#39;@SUM(A1:A2)</t>`) ||
+		!strings.Contains(sheet, `<t xml:space="preserve">&#39;+4420</t>`) {
+		t.Errorf("expected text that looks like a formula escaped, got %s", sheet)
+	}
+	if !strings.HasSuffix(sheet, "</sheetData></worksheet>") {
+		t.Error("sheet is not closed")
+	}
+}
+
+func TestNew_UnknownFormat(t *testing.T) {
+	if _, err := New("pdf", io.Discard, testColumns); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func Test_columnName(t *testing.T) {
+	tests := map[int]string{0: "A", 25: "Z", 26: "AA", 27: "AB", 701: "ZZ", 702: "AAA"}
+	for i, expected := range tests {
+		if got := columnName(i); got != expected {
+			t.Errorf("column %d: expected %s, got %s", i, expected, got)
+		}
+	}
+}
+
+func Test_isNumber(t *testing.T) {
+	numeric := []bool{true, false}
+	tests := []struct {
+		i        int
+		cell     string
+		expected bool
+	}{
+		{0, "12", true},
+		{0, "-3", true},
+		{0, "490.50", true},
+		{0, "1e5", false},
+		{0, "12.", true},
+		{0, ".5", false},
+		{0, "1.2.3", false},
+		{0, "NaN", false},
+		{1, "12", false},
+		{2, "12", false},
+	}
+	for _, tc := range tests {
+		if got := isNumber(numeric, tc.i, tc.cell); got != tc.expected {
+			t.Errorf("cell %d %q: expected %t, got %t", tc.i, tc.cell, tc.expected, got)
+		}
+	}
+}
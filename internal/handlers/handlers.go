@@ -1,11 +1,20 @@
 package handlers
 
 import (
+	"bytes"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
+	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -13,6 +22,7 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/kons77/room-bookings-app/internal/config"
 	"github.com/kons77/room-bookings-app/internal/driver"
+	"github.com/kons77/room-bookings-app/internal/export"
 	"github.com/kons77/room-bookings-app/internal/forms"
 	"github.com/kons77/room-bookings-app/internal/helpers"
 	"github.com/kons77/room-bookings-app/internal/models"
@@ -82,6 +92,22 @@ func (m *Repository) Reservation(w http.ResponseWriter, r *http.Request) {
 
 	res.Room.RoomName = room.RoomName
 
+	// only for the extra guest charge, a party that doesn't fit is told when booking
+	cart, _ := m.App.Session.Get(r.Context(), "cart").([]models.Room)
+	partyFromForm(nil, &res)
+	m.fitParty(&res, cart)
+
+	// prefill the form for a logged in guest
+	if helpers.IsGuest(r) && res.Email == "" {
+		guest, err := m.DB.GetGuestByID(m.App.Session.GetInt(r.Context(), "guest_id"))
+		if err == nil {
+			res.FirstName = guest.FirstName
+			res.LastName = guest.LastName
+			res.Email = guest.Email
+			res.Phone = guest.Phone
+		}
+	}
+
 	m.App.Session.Put(r.Context(), "reservation", res)
 
 	// may change format to another one like Thursday, the 2th of January
@@ -94,6 +120,10 @@ func (m *Repository) Reservation(w http.ResponseWriter, r *http.Request) {
 
 	data := make(map[string]interface{})
 	data["reservation"] = res
+	data["cart"] = m.App.Session.Get(r.Context(), "cart")
+	if m.holdLasts(r) {
+		data["hold_expires"] = m.App.Session.GetInt64(r.Context(), "hold_expires")
+	}
 
 	render.Template(w, r, "make-reservation.page.tmpl", &models.TemplateData{
 		Form:      forms.New(nil),
@@ -124,6 +154,7 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 	reservation.LastName = r.Form.Get("last_name")
 	reservation.Email = r.Form.Get("email")
 	reservation.Phone = r.Form.Get("phone")
+	reservation.GuestID = m.App.Session.GetInt(r.Context(), "guest_id")
 
 	sd := reservation.StartDate.Format("2006-01-02")
 	ed := reservation.EndDate.Format("2006-01-02")
@@ -138,9 +169,21 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 	form.MinLength("first_name", 3) // I don't agree with length 3 - Ng - chineese last name
 	form.IsEmail("email")
 
+	cart, _ := m.App.Session.Get(r.Context(), "cart").([]models.Room)
+	var group []models.Reservation
+	if err := partyFromForm(r.Form, &reservation); err != nil {
+		form.Errors.Add("adults", err.Error())
+	} else if group, err = m.fitParty(&reservation, cart); err != nil {
+		form.Errors.Add("adults", err.Error())
+	}
+
 	if !form.Valid() {
 		data := make(map[string]interface{})
 		data["reservation"] = reservation
+		data["cart"] = m.App.Session.Get(r.Context(), "cart")
+		if m.holdLasts(r) {
+			data["hold_expires"] = m.App.Session.GetInt64(r.Context(), "hold_expires")
+		}
 		render.Template(w, r, "make-reservation.page.tmpl", &models.TemplateData{ // render form right from here
 			Form:      form,
 			Data:      data,
@@ -149,78 +192,263 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	newReservationID, err := m.DB.InsertReservation(reservation)
-	if err != nil {
-		// helpers.ServerError(w, err)
-		m.App.Session.Put(r.Context(), "error", "can't insert reservation into database")
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+	// the stay may come from a link or an offer made a while ago
+	if broken := stayRuleViolations(reservation.StartDate, reservation.EndDate); len(broken) > 0 {
+		m.releaseHolds(r)
+		m.App.Session.Put(r.Context(), "error", "Can't book: "+strings.Join(broken, ", "))
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	// the rooms held for the guest become the booking, in the same transaction; once the hold expired they
+	// are booked only if no one took them meanwhile
+	if !m.holdLasts(r) {
+		m.releaseHolds(r)
+	}
+	holds, _ := m.App.Session.Get(r.Context(), "holds").([]int)
+
+	if reservation.AllotmentID > 0 {
+		m.releaseHolds(r)
+		m.postAllotmentReservation(w, r, reservation)
 		return
 	}
 
-	// need to insert the reservation restrictions
-	restriction := models.RoomRestriction{
-		StartDate:     reservation.StartDate,
-		EndDate:       reservation.EndDate,
-		RoomID:        reservation.RoomID,
-		ReservationID: newReservationID,
-		RestrictionID: 1, // just for now
+	if len(group) > 1 {
+		m.postGroupReservation(w, r, reservation, group, holds)
+		return
 	}
 
-	err = m.DB.InsertRoomRestriction(restriction)
+	// the reservation and the rooms of every night of a split stay are saved together, or not at all
+	newReservationID, err := m.DB.InsertReservationStays(reservation, reservationStays(reservation, nil), holds)
+	if errors.Is(err, repository.ErrRoomTaken) {
+		m.releaseHolds(r)
+		m.App.Session.Put(r.Context(), "error", "Your hold on the room expired and it was booked meanwhile, please search again")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
 	if err != nil {
-		// helpers.ServerError(w, err)
-		m.App.Session.Put(r.Context(), "error", "can't insert room restriction")
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "can't insert reservation into database")
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
 	}
+	reservation.ID = newReservationID
+	m.releaseHolds(r)
+
+	m.bookWaitlistOffer(r, reservation)
 
 	// send notifications - first to guest
+	m.App.MailChan <- confirmationMail(reservation)
+
+	// send notifications - second to owner
 	htmlMessage := fmt.Sprintf(`
-		<strong>Reservation Confirmation</strong><br>
-		Dear %s! <br> 
-		This is to confir your reservation from %s to %s.
-	`, reservation.FirstName, reservation.StartDate.Format("2006-01-02"), reservation.EndDate.Format("2006-01-02"))
+		<strong>New Reservation</strong><br>
+		A reservation has been made for %s from %s to %s		
+	`, reservation.Room.RoomName, reservation.StartDate.Format("2006-01-02"), reservation.EndDate.Format("2006-01-02"))
 
 	msg := models.MailData{
-		To:       reservation.Email,
-		From:     "me@fortsmythe.com",
-		Subject:  "Reservation Confirmation",
-		Content:  htmlMessage,
-		Template: "basic.html",
+		To:      "admin@fortsmythe.com",
+		From:    "me@fortsmythe.com",
+		Subject: "Reservation Notification",
+		Content: htmlMessage,
 	}
 	m.App.MailChan <- msg
 
-	// send notifications - second to owner
-	htmlMessage = fmt.Sprintf(`
+	m.App.Session.Put(r.Context(), "reservation", reservation)
+
+	http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+}
+
+// postGroupReservation books every room in the cart, each with its share of the party, as one booking group
+// and sends a single confirmation
+func (m *Repository) postGroupReservation(w http.ResponseWriter, r *http.Request, reservation models.Reservation, group []models.Reservation, holds []int) {
+	var names []string
+	for _, res := range group {
+		names = append(names, res.Room.RoomName)
+	}
+
+	groupID, err := m.DB.InsertBookingGroup(group, holds)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.releaseHolds(r)
+		m.App.Session.Put(r.Context(), "error", "Some of these rooms are no longer available, please search again")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+	reservation.GroupID = groupID
+	m.releaseHolds(r)
+
+	m.App.MailChan <- groupConfirmationMail(reservation, names)
+
+	htmlMessage := fmt.Sprintf(`
+		<strong>New Group Reservation</strong><br>
+		A reservation has been made for %s from %s to %s
+	`, strings.Join(names, ", "), reservation.StartDate.Format("2006-01-02"), reservation.EndDate.Format("2006-01-02"))
+
+	m.App.MailChan <- models.MailData{
+		To:      "admin@fortsmythe.com",
+		From:    "me@fortsmythe.com",
+		Subject: "Reservation Notification",
+		Content: htmlMessage,
+	}
+
+	m.App.Session.Put(r.Context(), "reservation", reservation)
+
+	http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+}
+
+// postAllotmentReservation books one of the rooms an allotment still holds for a guest of the group
+func (m *Repository) postAllotmentReservation(w http.ResponseWriter, r *http.Request, reservation models.Reservation) {
+	id, roomID, err := m.DB.BookFromAllotment(reservation.AllotmentID, reservation)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't book: "+err.Error())
+		http.Redirect(w, r, "/group-booking", http.StatusSeeOther)
+		return
+	}
+	reservation.ID = id
+	reservation.RoomID = roomID
+	if room, err := m.DB.GetRoomByID(roomID); err == nil {
+		reservation.Room = room
+		reservation.ExtraCharge = extraGuestCharge(room, reservation.Adults+reservation.Children,
+			reservation.StartDate, reservation.EndDate)
+	}
+
+	m.App.MailChan <- confirmationMail(reservation)
+
+	htmlMessage := fmt.Sprintf(`
 		<strong>New Reservation</strong><br>
-		A reservation has been made for %s from %s to %s		
+		A reservation has been made from an allotment for %s from %s to %s
 	`, reservation.Room.RoomName, reservation.StartDate.Format("2006-01-02"), reservation.EndDate.Format("2006-01-02"))
 
-	msg = models.MailData{
+	m.App.MailChan <- models.MailData{
 		To:      "admin@fortsmythe.com",
 		From:    "me@fortsmythe.com",
 		Subject: "Reservation Notification",
 		Content: htmlMessage,
 	}
-	m.App.MailChan <- msg
 
 	m.App.Session.Put(r.Context(), "reservation", reservation)
 
 	http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
 }
 
+// groupConfirmationMail is the one mail confirming all the rooms of a booking group to the guest
+func groupConfirmationMail(res models.Reservation, rooms []string) models.MailData {
+	htmlMessage := fmt.Sprintf(`
+		<strong>Reservation Confirmation</strong><br>
+		Dear %s! <br>
+		This is to confirm your reservation of %s from %s to %s for %s.%s
+	`, res.FirstName, strings.Join(rooms, ", "), res.StartDate.Format("2006-01-02"), res.EndDate.Format("2006-01-02"),
+		partyText(res), extraChargeText(res))
+
+	return models.MailData{
+		To:       res.Email,
+		From:     "me@fortsmythe.com",
+		Subject:  "Reservation Confirmation",
+		Content:  htmlMessage,
+		Template: "basic.html",
+	}
+}
+
+// confirmationMail is the mail confirming a reservation to the guest
+func confirmationMail(res models.Reservation) models.MailData {
+	htmlMessage := fmt.Sprintf(`
+		<strong>Reservation Confirmation</strong><br>
+		Dear %s! <br> 
+		This is to confir your reservation from %s to %s for %s.%s
+	`, res.FirstName, res.StartDate.Format("2006-01-02"), res.EndDate.Format("2006-01-02"),
+		partyText(res), extraChargeText(res))
+
+	return models.MailData{
+		To:       res.Email,
+		From:     "me@fortsmythe.com",
+		Subject:  "Reservation Confirmation",
+		Content:  htmlMessage,
+		Template: "basic.html",
+	}
+}
+
+// partyText is the guests of a reservation in words, as the party template puts them
+func partyText(res models.Reservation) string {
+	text := fmt.Sprintf("%d adults", res.Adults)
+	if res.Adults == 1 {
+		text = "1 adult"
+	}
+	switch {
+	case res.Children == 1:
+		text += ", 1 child"
+	case res.Children > 1:
+		text += fmt.Sprintf(", %d children", res.Children)
+	}
+	return text
+}
+
+// extraChargeText mentions the extra guest charge of a reservation in the confirmation, if there is one
+func extraChargeText(res models.Reservation) string {
+	if res.ExtraCharge == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" <br>The extra guests add %s to your stay.", render.Money(res.ExtraCharge))
+}
+
+// changeMail tells the guest their reservation was moved to another room or other dates
+func changeMail(res models.Reservation) models.MailData {
+	htmlMessage := fmt.Sprintf(`
+		<strong>Reservation Changed</strong><br>
+		Dear %s! <br>
+		Your reservation has been changed to %s from %s to %s.
+	`, res.FirstName, res.Room.RoomName, res.StartDate.Format("2006-01-02"), res.EndDate.Format("2006-01-02"))
+
+	return models.MailData{
+		To:       res.Email,
+		From:     "me@fortsmythe.com",
+		Subject:  "Reservation Changed",
+		Content:  htmlMessage,
+		Template: "basic.html",
+	}
+}
+
 // Generals renders the room page
 func (m *Repository) Generals(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "generals.page.tmpl", &models.TemplateData{})
+	render.Template(w, r, "generals.page.tmpl", &models.TemplateData{
+		Data: m.roomAmenities(1),
+	})
 }
 
 // Majors renders the room page
 func (m *Repository) Majors(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "majors.page.tmpl", &models.TemplateData{})
+	render.Template(w, r, "majors.page.tmpl", &models.TemplateData{
+		Data: m.roomAmenities(2),
+	})
+}
+
+// roomAmenities is the data of a room page listing the amenities of the room
+func (m *Repository) roomAmenities(roomID int) map[string]interface{} {
+	data := make(map[string]interface{})
+
+	byRoom, err := m.DB.AmenitiesByRoom()
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+	}
+	data["amenities"] = byRoom[roomID]
+
+	return data
 }
 
 // Availability renders the availability page
 func (m *Repository) Availability(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "search-availability.page.tmpl", &models.TemplateData{})
+	amenities, err := m.DB.AllAmenities()
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+	}
+
+	data := make(map[string]interface{})
+	data["amenities"] = amenities
+	data["categories"] = models.AmenityCategories
+
+	render.Template(w, r, "search-availability.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
 }
 
 // PostAvailability renders the availability page
@@ -253,7 +481,30 @@ func (m *Repository) PostAvailability(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rooms, err := m.DB.SearchAvailabilityForAllRooms(startDate, endDate)
+	if broken := stayRuleViolations(startDate, endDate); len(broken) > 0 {
+		m.App.Session.Put(r.Context(), "error", "Can't book: "+strings.Join(broken, ", "))
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	// searching again gives up the rooms held for the last choice
+	m.releaseHolds(r)
+
+	// new reservation
+	res := models.Reservation{
+		StartDate: startDate,
+		EndDate:   endDate,
+	}
+
+	if err := partyFromForm(r.Form, &res); err != nil {
+		m.App.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+	guests := res.Adults + res.Children
+	amenityIDs := amenitiesFromForm(r.Form)
+
+	types, err := m.DB.SearchAvailabilityByRoomType(startDate, endDate, guests, amenityIDs)
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "can't get availability for rooms")
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
@@ -264,22 +515,78 @@ func (m *Repository) PostAvailability(w http.ResponseWriter, r *http.Request) {
 	//		m.App.InfoLog.Println("ROOM:", i.ID, i.RoomName)
 	//	}
 
-	if len(rooms) == 0 {
-		// no availability
+	var splits [][]models.StaySegment
+	if len(types) == 0 {
+		// no room is free for the whole stay, but a few may be one after the other
+		splits, err = m.splitStaySuggestions(startDate, endDate, guests, amenityIDs)
+		if err != nil {
+			m.App.ErrorLog.Println(err)
+		}
+	}
+
+	// a party no free room sleeps may still fit in several rooms booked together
+	spread := false
+	if len(types) == 0 && len(splits) == 0 && guests > 1 {
+		all, err := m.DB.SearchAvailabilityByRoomType(startDate, endDate, 0, amenityIDs)
+		if err != nil {
+			m.App.ErrorLog.Println(err)
+		}
+
+		sleeps := 0
+		for _, rt := range all {
+			sleeps += rt.Sleeps
+		}
+		if len(all) > 1 && sleeps >= guests {
+			types = all
+			spread = true
+		}
+	}
+
+	// nothing for the dates asked for, but maybe for nearby or fewer ones
+	var shifted, partial []models.StaySegment
+	if len(types) == 0 && len(splits) == 0 {
+		shifted, partial = m.alternativeStays(startDate, endDate, guests, amenityIDs)
+	}
+
+	if len(types) == 0 && len(splits) == 0 && len(shifted) == 0 && len(partial) == 0 {
+		// no availability, but the guest can wait for a room to free up
+		waitlist := url.Values{}
+		waitlist.Set("start", start)
+		waitlist.Set("end", end)
+		waitlist.Set("adults", strconv.Itoa(res.Adults))
+		waitlist.Set("children", strconv.Itoa(res.Children))
+
 		m.App.Session.Put(r.Context(), "error", "No availability")
-		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		http.Redirect(w, r, "/waitlist?"+waitlist.Encode(), http.StatusSeeOther)
 		return
 	}
 
+	// the amenities shown for a type are those every unit has, whichever the guest gets
+	if rooms, err := m.DB.AllRooms(); err != nil {
+		m.App.ErrorLog.Println(err)
+	} else if byRoom, err := m.DB.AmenitiesByRoom(); err != nil {
+		m.App.ErrorLog.Println(err)
+	} else {
+		shared := typeAmenities(rooms, byRoom)
+		for i := range types {
+			types[i].Amenities = shared[types[i].ID]
+		}
+	}
+
 	data := make(map[string]interface{})
-	data["rooms"] = rooms
+	data["rooms"] = types
+	data["splits"] = splits
+	data["shifted"] = shifted
+	data["partial"] = partial
+	data["spread"] = spread
+	data["guests"] = guests
 
 	type RoomInfo struct {
 		Image       string
 		Description string
 	}
 
-	//roomInfo to hold image and description for rooms by roomID - don't want to add this info to db for now
+	//roomInfo to hold image and description for room types by ID - don't want to add this info to db for now
 	roomInfo := map[int]RoomInfo{
 		1: {Image: "generals-quarters.png",
 			Description: "A sanctuary of strength and wisdom, The General's Quarters exudes an air of commanding authority, with its rich mahogany tones and relics of triumph that seem to echo the weight of history. Here, beneath the glow of a steadfast hearth, every detail invites you to reflect upon the grandeur of leadership and the resolve of a steadfast soul.",
@@ -290,14 +597,14 @@ func (m *Repository) PostAvailability(w http.ResponseWriter, r *http.Request) {
 	}
 	data["roomInfo"] = roomInfo
 
-	// new reservation
-	res := models.Reservation{
-		StartDate: startDate,
-		EndDate:   endDate,
-	}
-
 	// store res wit start and end dates in the session to put to the next page
 	m.App.Session.Put(r.Context(), "reservation", res)
+	m.App.Session.Remove(r.Context(), "cart")
+	if len(amenityIDs) > 0 {
+		m.App.Session.Put(r.Context(), "amenities", amenityIDs)
+	} else {
+		m.App.Session.Remove(r.Context(), "amenities")
+	}
 
 	render.Template(w, r, "choose-room.page.tmpl", &models.TemplateData{
 		Data: data,
@@ -305,6 +612,146 @@ func (m *Repository) PostAvailability(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// maxFlexibleDays is the longest date range a flexible search looks through
+const maxFlexibleDays = 92
+
+// FlexibleSearch shows the search for a stay of some nights at any time in a month or a date range
+func (m *Repository) FlexibleSearch(w http.ResponseWriter, r *http.Request) {
+	amenities, err := m.DB.AllAmenities()
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+	}
+
+	data := make(map[string]interface{})
+	data["amenities"] = amenities
+	data["categories"] = models.AmenityCategories
+
+	render.Template(w, r, "flexible-search.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// PostFlexibleSearch lists every room type and arrival date free for the stay, with its price. The guest
+// books one through ChooseRoom, like a room type found by the search for dates
+func (m *Repository) PostFlexibleSearch(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	from, to, err := flexibleRange(r.Form)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, "/flexible-search", http.StatusSeeOther)
+		return
+	}
+
+	nights, err := strconv.Atoi(r.Form.Get("nights"))
+	if err != nil || nights < 1 || nights > maxStayNights {
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("Choose a stay of 1 to %d nights", maxStayNights))
+		http.Redirect(w, r, "/flexible-search", http.StatusSeeOther)
+		return
+	}
+
+	// months already under way are searched from today
+	today, _ := parseDate(time.Now().Format("2006-01-02"))
+	if from.Before(today) {
+		from = today
+	}
+	if to.Sub(from) < time.Duration(nights)*24*time.Hour {
+		m.App.Session.Put(r.Context(), "error", "The dates are too close together for the stay")
+		http.Redirect(w, r, "/flexible-search", http.StatusSeeOther)
+		return
+	}
+
+	res := models.Reservation{}
+	if err := partyFromForm(r.Form, &res); err != nil {
+		m.App.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, "/flexible-search", http.StatusSeeOther)
+		return
+	}
+	guests := res.Adults + res.Children
+	amenityIDs := amenitiesFromForm(r.Form)
+	weekends := r.Form.Get("weekends") != ""
+
+	stays, err := m.DB.FlexibleStays(from, to, nights, guests, weekends, amenityIDs)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get availability for rooms")
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	// arrivals whose minimum stay is longer than the nights asked for can't be booked
+	bookable := stays[:0]
+	for _, s := range stays {
+		if nights < minStayNights(s.StartDate) {
+			continue
+		}
+		s.Price = s.Room.NightlyRate*nights + extraGuestCharge(s.Room, guests, s.StartDate, s.EndDate)
+		bookable = append(bookable, s)
+	}
+	stays = bookable
+
+	amenities, err := m.DB.AllAmenities()
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+	}
+
+	data := make(map[string]interface{})
+	data["amenities"] = amenities
+	data["categories"] = models.AmenityCategories
+	data["stays"] = stays
+	data["searched"] = true
+
+	stringMap := make(map[string]string)
+	stringMap["from"] = from.Format("2006-01-02")
+	stringMap["to"] = to.Format("2006-01-02")
+	stringMap["nights"] = strconv.Itoa(nights)
+
+	// the party and amenities go on to the room the guest books, searching again gives up the rooms held before
+	m.releaseHolds(r)
+	m.App.Session.Put(r.Context(), "reservation", res)
+	m.App.Session.Remove(r.Context(), "cart")
+	if len(amenityIDs) > 0 {
+		m.App.Session.Put(r.Context(), "amenities", amenityIDs)
+	} else {
+		m.App.Session.Remove(r.Context(), "amenities")
+	}
+
+	render.Template(w, r, "flexible-search.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+	})
+}
+
+// flexibleRange reads the dates a flexible search looks through: a month, or a start and an end date
+func flexibleRange(form url.Values) (time.Time, time.Time, error) {
+	var from, to time.Time
+
+	if month := form.Get("month"); month != "" {
+		first, err := time.Parse("2006-01", month)
+		if err != nil {
+			return from, to, errors.New("can't parse month")
+		}
+		return first, first.AddDate(0, 1, 0), nil
+	}
+
+	from, err := parseDate(form.Get("start"))
+	if err != nil {
+		return from, to, errors.New("Choose a month or the dates to search")
+	}
+	to, err = parseDate(form.Get("end"))
+	if err != nil {
+		return from, to, errors.New("Choose a month or the dates to search")
+	}
+	if to.Sub(from) > maxFlexibleDays*24*time.Hour {
+		return from, to, fmt.Errorf("Search at most %d days at a time", maxFlexibleDays)
+	}
+
+	return from, to, nil
+}
+
 // jsonResponse
 type jsonResponse struct {
 	OK        bool   `json:"ok"`
@@ -355,16 +802,34 @@ func (m *Repository) AvailabilityJSON(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if broken := stayRuleViolations(startDate, endDate); len(broken) > 0 {
+		sendJSONError(w, "Can't book: "+strings.Join(broken, ", "))
+		return
+	}
+
 	available, err := m.DB.SearchAvailabilityByDatesByRoomID(startDate, endDate, roomID)
 	if err != nil {
 		sendJSONError(w, "error querying database")
 		return
 	}
 
+	message := ""
+	if amenityIDs := amenitiesFromForm(r.Form); available && len(amenityIDs) > 0 {
+		byRoom, err := m.DB.AmenitiesByRoom()
+		if err != nil {
+			sendJSONError(w, "error querying database")
+			return
+		}
+		if !hasAmenities(byRoom[roomID], amenityIDs) {
+			available = false
+			message = "The room doesn't have all the amenities asked for"
+		}
+	}
+
 	// Prepare and send successful response
 	resp := jsonResponse{
 		OK:        available,
-		Message:   "",
+		Message:   message,
 		StardDate: sd,
 		EndDate:   ed,
 		RoomID:    strconv.Itoa(roomID),
@@ -376,15 +841,104 @@ func (m *Repository) AvailabilityJSON(w http.ResponseWriter, r *http.Request) {
 	w.Write(out)
 }
 
-// Contacts renders the contact page
-func (m *Repository) Contact(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "contact.page.tmpl", &models.TemplateData{})
+// maxCalendarMonths is the most months the availability calendar returns at once
+const maxCalendarMonths = 12
+
+// calendarNight is one night of the availability calendar
+type calendarNight struct {
+	Date      string `json:"date"`
+	Available bool   `json:"available"`
+	MinStay   int    `json:"min_stay"` // the fewest nights a stay arriving this night can book
+	Price     int    `json:"price"`    // in cents, for the guests asked for
 }
 
-// ReservationSummary displays the reservation summary page
-func (m *Repository) ReservationSummary(w http.ResponseWriter, r *http.Request) {
-	reservation, ok := m.App.Session.Get(r.Context(), "reservation").(models.Reservation)
-	if !ok {
+// calendarResponse is the availability calendar of a room
+type calendarResponse struct {
+	OK      bool            `json:"ok"`
+	Message string          `json:"message,omitempty"`
+	RoomID  string          `json:"room_id"`
+	Nights  []calendarNight `json:"nights"`
+}
+
+// AvailabilityCalendar sends the nights of a room from the month from through the month to as JSON, with
+// whether each night is free, its minimum stay and its price, so the date picker can grey out booked nights
+func (m *Repository) AvailabilityCalendar(w http.ResponseWriter, r *http.Request) {
+	roomID, err := strconv.Atoi(r.URL.Query().Get("room_id"))
+	if err != nil {
+		sendJSONError(w, "invalid room id")
+		return
+	}
+
+	from, err := time.Parse("2006-01", r.URL.Query().Get("from"))
+	if err != nil {
+		sendJSONError(w, "invalid from month")
+		return
+	}
+
+	to := from
+	if month := r.URL.Query().Get("to"); month != "" {
+		if to, err = time.Parse("2006-01", month); err != nil || to.Before(from) {
+			sendJSONError(w, "invalid to month")
+			return
+		}
+	}
+	to = to.AddDate(0, 1, 0)
+	if to.After(from.AddDate(0, maxCalendarMonths, 0)) {
+		sendJSONError(w, fmt.Sprintf("at most %d months at a time", maxCalendarMonths))
+		return
+	}
+
+	guests, _ := strconv.Atoi(r.URL.Query().Get("guests"))
+
+	room, err := m.DB.GetRoomByID(roomID)
+	if err != nil {
+		sendJSONError(w, "room not found")
+		return
+	}
+
+	restrictions, err := m.DB.GetRestrictionsForRoomByDate(roomID, from, to)
+	if err != nil {
+		sendJSONError(w, "error querying database")
+		return
+	}
+
+	taken := make(map[string]bool)
+	for _, rr := range restrictions {
+		for d := rr.StartDate; d.Before(rr.EndDate); d = d.AddDate(0, 0, 1) {
+			taken[d.Format("2006-01-02")] = true
+		}
+	}
+
+	resp := calendarResponse{
+		OK:     true,
+		RoomID: strconv.Itoa(roomID),
+	}
+
+	today, _ := parseDate(time.Now().Format("2006-01-02"))
+	for d := from; d.Before(to); d = d.AddDate(0, 0, 1) {
+		date := d.Format("2006-01-02")
+		resp.Nights = append(resp.Nights, calendarNight{
+			Date:      date,
+			Available: !d.Before(today) && !taken[date],
+			MinStay:   minStayNights(d),
+			Price:     room.NightlyRate + extraGuestCharge(room, guests, d, d.AddDate(0, 0, 1)),
+		})
+	}
+
+	out, _ := json.MarshalIndent(resp, "", "     ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+// Contacts renders the contact page
+func (m *Repository) Contact(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "contact.page.tmpl", &models.TemplateData{})
+}
+
+// ReservationSummary displays the reservation summary page
+func (m *Repository) ReservationSummary(w http.ResponseWriter, r *http.Request) {
+	reservation, ok := m.App.Session.Get(r.Context(), "reservation").(models.Reservation)
+	if !ok {
 		// m.App.ErrorLog.Println("cannot get item from session")
 		m.App.Session.Put(r.Context(), "error", "Can't get reservation from session")
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
@@ -395,6 +949,7 @@ func (m *Repository) ReservationSummary(w http.ResponseWriter, r *http.Request)
 
 	data := make(map[string]interface{})
 	data["reservation"] = reservation
+	data["cart"] = m.App.Session.Pop(r.Context(), "cart")
 
 	sd := reservation.StartDate.Format("2006-01-02")
 	ed := reservation.EndDate.Format("2006-01-02")
@@ -409,11 +964,13 @@ func (m *Repository) ReservationSummary(w http.ResponseWriter, r *http.Request)
 	})
 }
 
-// ChooseRoom diaplays list of available rooms
+// ChooseRoom diaplays list of available rooms. A flexible search picks the dates with the room type, in the
+// s and e parameters
 func (m *Repository) ChooseRoom(w http.ResponseWriter, r *http.Request) {
 	// changed to this, so we can test it more easily , get rid of  chi.URLParam(r, "id")
 	// split the URL up by /, and grab the 3rd element
-	exploded := strings.Split(r.RequestURI, "/")
+	path, _, _ := strings.Cut(r.RequestURI, "?")
+	exploded := strings.Split(path, "/")
 	roomID, err := strconv.Atoi(exploded[2]) // Atoi = ASCII to Integer
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "missing url parameter")
@@ -429,144 +986,3138 @@ func (m *Repository) ChooseRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res.RoomID = roomID
+	if sd, ed := r.URL.Query().Get("s"), r.URL.Query().Get("e"); sd != "" || ed != "" {
+		startDate, startErr := parseDate(sd)
+		endDate, endErr := parseDate(ed)
+		if startErr != nil || endErr != nil {
+			m.App.Session.Put(r.Context(), "error", "can't parse the dates of the stay")
+			http.Redirect(w, r, "/flexible-search", http.StatusSeeOther)
+			return
+		}
+		res.StartDate = startDate
+		res.EndDate = endDate
+
+		if broken := stayRuleViolations(res.StartDate, res.EndDate); len(broken) > 0 {
+			m.App.Session.Put(r.Context(), "error", "Can't book: "+strings.Join(broken, ", "))
+			http.Redirect(w, r, "/flexible-search", http.StatusSeeOther)
+			return
+		}
+	}
+
+	// the guest books a room type, the unit is only provisional until the front desk assigns it
+	m.releaseHolds(r)
+	amenityIDs, _ := m.App.Session.Get(r.Context(), "amenities").([]int)
+	unit, err := m.unitForStay(roomID, res.StartDate, res.EndDate, res.Adults+res.Children, amenityIDs, nil)
+	if err == nil {
+		err = m.holdRooms(r, []models.StaySegment{{RoomID: unit.ID, Room: unit, StartDate: res.StartDate, EndDate: res.EndDate}})
+	}
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "This room is no longer available for your party, please search again")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	res.RoomID = unit.ID
+	res.Segments = nil
 
 	m.App.Session.Put(r.Context(), "reservation", res)
+	m.App.Session.Remove(r.Context(), "cart")
 	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther) // code 303
 
 }
 
-// BookRoom takes URL parameters, builds a sessional variable, and takes user to make res screen
-func (m *Repository) BookRoom(w http.ResponseWriter, r *http.Request) {
-	roomID, _ := strconv.Atoi(r.URL.Query().Get("id"))
-	sd := r.URL.Query().Get("s")
-	ed := r.URL.Query().Get("e")
+// holdTTL is how long the rooms a guest chose are held while they fill in the reservation form
+const holdTTL = 15 * time.Minute
 
-	StartDate, _ := parseDate(sd)
-	/* if err != nil {
+// holdRooms holds the rooms of stays for the session until holdTTL from now, instead of any it held before.
+// If one of them isn't free any more, none is held
+func (m *Repository) holdRooms(r *http.Request, stays []models.StaySegment) error {
+	m.releaseHolds(r)
+
+	expires := time.Now().Add(holdTTL)
+	var ids []int
+	for _, stay := range stays {
+		id, err := m.DB.HoldRoom(stay.RoomID, stay.StartDate, stay.EndDate, expires)
+		if err != nil {
+			for _, id := range ids {
+				m.DB.ReleaseHold(id)
+			}
+			return err
+		}
+		ids = append(ids, id)
+	}
+
+	m.App.Session.Put(r.Context(), "holds", ids)
+	m.App.Session.Put(r.Context(), "hold_expires", expires.Unix())
+	return nil
+}
+
+// releaseHolds gives back the rooms the session holds, once they are booked or the guest moves on, and
+// offers them to the waitlist
+func (m *Repository) releaseHolds(r *http.Request) {
+	ids, _ := m.App.Session.Pop(r.Context(), "holds").([]int)
+	for _, id := range ids {
+		if err := m.DB.ReleaseHold(id); err != nil {
+			m.App.ErrorLog.Println(err)
+		}
+	}
+	m.App.Session.Remove(r.Context(), "hold_expires")
+
+	if len(ids) > 0 {
+		m.NotifyWaitlist()
+	}
+}
+
+// holdLasts reports whether the session still holds the rooms chosen
+func (m *Repository) holdLasts(r *http.Request) bool {
+	return m.App.Session.GetInt64(r.Context(), "hold_expires") > time.Now().Unix()
+}
+
+// reservationStays is what a reservation books: the rooms of a split stay, every room of a cart for the
+// whole stay, or else its room
+func reservationStays(res models.Reservation, cart []models.Room) []models.StaySegment {
+	if len(res.Segments) > 0 {
+		return res.Segments
+	}
+
+	if len(cart) > 1 {
+		stays := make([]models.StaySegment, len(cart))
+		for i, room := range cart {
+			stays[i] = models.StaySegment{RoomID: room.ID, Room: room, StartDate: res.StartDate, EndDate: res.EndDate}
+		}
+		return stays
+	}
+
+	return []models.StaySegment{{RoomID: res.RoomID, Room: res.Room, StartDate: res.StartDate, EndDate: res.EndDate}}
+}
+
+// unitForStay finds a unit of a room type sleeping the guests, with the amenities they asked for, free for
+// the whole stay, but those in skip. The guest booked one room, so units one after the other don't do: a
+// guest who wants to change rooms books the split stay offered for it
+func (m *Repository) unitForStay(typeID int, start, end time.Time, guests int, amenityIDs []int, skip map[int]bool) (models.Room, error) {
+	all, err := m.DB.RoomsByType(typeID)
+	if err != nil {
+		return models.Room{}, err
+	}
+
+	byRoom := make(map[int][]models.Amenity)
+	if len(amenityIDs) > 0 {
+		if byRoom, err = m.DB.AmenitiesByRoom(); err != nil {
+			return models.Room{}, err
+		}
+	}
+
+	for _, unit := range all {
+		if skip[unit.ID] || unit.MaxOccupancy < guests || !hasAmenities(byRoom[unit.ID], amenityIDs) {
+			continue
+		}
+
+		taken, err := m.DB.GetRestrictionsForRoomByDate(unit.ID, start, end)
+		if err != nil {
+			return models.Room{}, err
+		}
+
+		free := true
+		for _, rr := range taken {
+			if rr.StartDate.Before(end) && rr.EndDate.After(start) {
+				free = false
+			}
+		}
+		if free {
+			return unit, nil
+		}
+	}
+
+	return models.Room{}, errors.New("no room of this type is free for the whole stay")
+}
+
+// maxPartySize is the most guests one booking takes
+const maxPartySize = 10
+
+// partyFromForm reads the adults and children of a search or reservation form into res. A form without them
+// keeps the party res already has, or one adult
+func partyFromForm(form url.Values, res *models.Reservation) error {
+	var err error
+	if res.Adults == 0 {
+		res.Adults = 1
+	}
+
+	if v := form.Get("adults"); v != "" {
+		if res.Adults, err = strconv.Atoi(v); err != nil {
+			return errors.New("Enter the number of adults")
+		}
+	}
+	if v := form.Get("children"); v != "" {
+		if res.Children, err = strconv.Atoi(v); err != nil {
+			return errors.New("Enter the number of children")
+		}
+	}
+
+	if res.Adults < 1 || res.Children < 0 {
+		return errors.New("At least one adult must stay")
+	}
+	if res.Adults+res.Children > maxPartySize {
+		return fmt.Errorf("A booking takes at most %d guests", maxPartySize)
+	}
+	return nil
+}
+
+// extraGuestCharge is what the guests over the base occupancy of a room pay for their nights in it, in cents
+func extraGuestCharge(room models.Room, guests int, start, end time.Time) int {
+	if guests <= room.BaseOccupancy {
+		return 0
+	}
+	nights := int(end.Sub(start).Hours() / 24)
+	return (guests - room.BaseOccupancy) * room.ExtraPersonRate * nights
+}
+
+// fitParty checks that the party of a reservation fits the rooms it takes and works out its extra guest
+// charge. The whole party stays in every room of a split stay, but spreads over the rooms of a cart, so for
+// a cart it returns a reservation for every room. Rooms that can't be found are left to fail the booking
+func (m *Repository) fitParty(res *models.Reservation, cart []models.Room) ([]models.Reservation, error) {
+	guests := res.Adults + res.Children
+	res.ExtraCharge = 0
+
+	// the guests of an allotment get a room their group holds, one that sleeps them, picked and charged
+	// for as it's booked
+	if res.AllotmentID > 0 {
+		return nil, nil
+	}
+
+	if len(cart) > 1 {
+		rooms := make([]models.Room, len(cart))
+		capacity := 0
+		for i, room := range cart {
+			rooms[i] = room
+			if found, err := m.DB.GetRoomByID(room.ID); err == nil {
+				rooms[i] = found
+			}
+			capacity += rooms[i].MaxOccupancy
+		}
+
+		group, ok := spreadParty(*res, rooms)
+		if !ok {
+			return nil, fmt.Errorf("These rooms sleep at most %d guests", capacity)
+		}
+		for i := range group {
+			group[i].ExtraCharge = extraGuestCharge(group[i].Room, group[i].Adults+group[i].Children, res.StartDate, res.EndDate)
+			res.ExtraCharge += group[i].ExtraCharge
+		}
+		return group, nil
+	}
+
+	segments := res.Segments
+	if len(segments) == 0 {
+		segments = []models.StaySegment{{RoomID: res.RoomID, StartDate: res.StartDate, EndDate: res.EndDate}}
+	}
+	for _, seg := range segments {
+		room, err := m.DB.GetRoomByID(seg.RoomID)
+		if err != nil {
+			continue
+		}
+		if guests > room.MaxOccupancy {
+			return nil, fmt.Errorf("%s sleeps at most %d guests", room.RoomName, room.MaxOccupancy)
+		}
+		res.ExtraCharge += extraGuestCharge(room, guests, seg.StartDate, seg.EndDate)
+	}
+	return nil, nil
+}
+
+// spreadParty puts the party of res in the rooms of a cart, an adult in every room first and then filling the
+// rooms in order. It returns a reservation for every room, and false if the party doesn't fit
+func spreadParty(res models.Reservation, rooms []models.Room) ([]models.Reservation, bool) {
+	group := make([]models.Reservation, len(rooms))
+	adults, children := res.Adults, res.Children
+
+	for i, room := range rooms {
+		group[i] = res
+		group[i].RoomID = room.ID
+		group[i].Room = room
+		group[i].Adults, group[i].Children = 0, 0
+		if adults > 0 && room.MaxOccupancy > 0 {
+			group[i].Adults = 1
+			adults--
+		}
+	}
+
+	for i, room := range rooms {
+		free := room.MaxOccupancy - group[i].Adults
+		n := min(free, adults)
+		group[i].Adults += n
+		adults -= n
+		free -= n
+
+		n = min(free, children)
+		group[i].Children += n
+		children -= n
+	}
+
+	return group, adults == 0 && children == 0
+}
+
+// amenitiesFromForm reads the amenities a search asks for, each once
+func amenitiesFromForm(form url.Values) []int {
+	var ids []int
+	seen := make(map[int]bool)
+	for _, v := range form["amenity"] {
+		id, err := strconv.Atoi(v)
+		if err != nil || seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// hasAmenities tells whether a room with the amenities have has every amenity of ids
+func hasAmenities(have []models.Amenity, ids []int) bool {
+	for _, id := range ids {
+		found := false
+		for _, a := range have {
+			if a.ID == id {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// typeAmenities works out the amenities every unit of a room type has, by room type id
+func typeAmenities(rooms []models.Room, byRoom map[int][]models.Amenity) map[int][]models.Amenity {
+	shared := make(map[int][]models.Amenity)
+	seen := make(map[int]bool)
+
+	for _, room := range rooms {
+		if !seen[room.RoomTypeID] {
+			seen[room.RoomTypeID] = true
+			shared[room.RoomTypeID] = byRoom[room.ID]
+			continue
+		}
+
+		var kept []models.Amenity
+		for _, a := range shared[room.RoomTypeID] {
+			if hasAmenities(byRoom[room.ID], []int{a.ID}) {
+				kept = append(kept, a)
+			}
+		}
+		shared[room.RoomTypeID] = kept
+	}
+
+	return shared
+}
+
+// ChooseRooms puts as many units of each room type as the guest asked for on the choose room page in the
+// cart, each a different unit, to book them together for the dates of the search
+func (m *Repository) ChooseRooms(w http.ResponseWriter, r *http.Request) {
+	res, ok := m.App.Session.Get(r.Context(), "reservation").(models.Reservation)
+	if !ok {
 		m.App.Session.Put(r.Context(), "error", "can't get session")
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 		return
-	}*/
+	}
 
-	EndDate, _ := parseDate(ed)
-	/* if err != nil {
+	if err := r.ParseForm(); err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	amenityIDs, _ := m.App.Session.Get(r.Context(), "amenities").([]int)
+	m.releaseHolds(r)
+
+	// every room type comes with the number of its rooms wanted; without quantities each type listed is
+	// one room
+	quantities := r.Form["quantity"]
+	wanted := make(map[int]int)
+	var types []int
+	total := 0
+	for i, v := range r.Form["room_id"] {
+		typeID, err := strconv.Atoi(v)
+		if err != nil {
+			continue
+		}
+		quantity := 1
+		if i < len(quantities) {
+			if quantity, err = strconv.Atoi(quantities[i]); err != nil || quantity < 0 {
+				quantity = 0
+			}
+		}
+		if wanted[typeID] == 0 && quantity > 0 {
+			types = append(types, typeID)
+		}
+		wanted[typeID] += quantity
+		total += quantity
+	}
+
+	if total == 0 {
+		m.App.Session.Put(r.Context(), "error", "Choose at least one room")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+	if total > maxPartySize {
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("Choose at most %d rooms", maxPartySize))
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	var cart []models.Room
+	inCart := make(map[int]bool)
+	capacity := 0
+	for _, typeID := range types {
+		for n := 0; n < wanted[typeID]; n++ {
+			// a room of a group stays in one unit, of any size as the party spreads over the rooms
+			unit, err := m.unitForStay(typeID, res.StartDate, res.EndDate, 0, amenityIDs, inCart)
+			if err != nil {
+				m.App.Session.Put(r.Context(), "error", "These rooms are no longer available, please search again")
+				http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+				return
+			}
+			inCart[unit.ID] = true
+			cart = append(cart, unit)
+			capacity += unit.MaxOccupancy
+		}
+	}
+
+	if guests := res.Adults + res.Children; guests > capacity {
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("These rooms sleep %d guests, not %d, please search again", capacity, guests))
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	res.RoomID = cart[0].ID
+	res.Segments = nil
+
+	if err := m.holdRooms(r, reservationStays(res, cart)); err != nil {
+		m.App.Session.Put(r.Context(), "error", "These rooms are no longer available, please search again")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "reservation", res)
+	if len(cart) > 1 {
+		m.App.Session.Put(r.Context(), "cart", cart)
+	} else {
+		m.App.Session.Remove(r.Context(), "cart")
+	}
+	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
+}
+
+// CartRemove takes a room out of the cart; with one room left the booking is an ordinary one again
+func (m *Repository) CartRemove(w http.ResponseWriter, r *http.Request) {
+	res, ok := m.App.Session.Get(r.Context(), "reservation").(models.Reservation)
+	if !ok {
 		m.App.Session.Put(r.Context(), "error", "can't get session")
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 		return
-	}*/
+	}
 
-	room, err := m.DB.GetRoomByID(roomID)
+	roomID, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "can't get room from db")
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		m.App.Session.Put(r.Context(), "error", "invalid room id")
+		http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
+		return
+	}
+
+	cart, _ := m.App.Session.Get(r.Context(), "cart").([]models.Room)
+	var kept []models.Room
+	for _, room := range cart {
+		if room.ID != roomID {
+			kept = append(kept, room)
+		}
+	}
+
+	if len(kept) == len(cart) {
+		m.App.Session.Put(r.Context(), "error", "That room isn't in your cart")
+		http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
+		return
+	}
+
+	res.RoomID = kept[0].ID
+
+	// the room taken out is given back
+	if err := m.holdRooms(r, reservationStays(res, kept)); err != nil {
+		m.App.Session.Put(r.Context(), "error", "These rooms are no longer available, please search again")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "reservation", res)
+	if len(kept) > 1 {
+		m.App.Session.Put(r.Context(), "cart", kept)
+	} else {
+		m.App.Session.Remove(r.Context(), "cart")
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Room removed")
+	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
+}
+
+// maxSplitSegments is the most rooms a suggested split stay takes the guest through
+const maxSplitSegments = 3
+
+// splitStays suggests ways to cover the nights from start to end with rooms one after the other, taken holding
+// the restrictions of every room. Each suggestion starts in another room and then always changes to the room
+// that stays free the longest, which takes the fewest room changes. Stays in a single room aren't suggested
+func splitStays(start, end time.Time, rooms []models.Room, taken map[int][]models.RoomRestriction) [][]models.StaySegment {
+	var splits [][]models.StaySegment
+
+	nights := int(end.Sub(start).Hours() / 24)
+	free := make(map[int][]bool)
+	for _, room := range rooms {
+		free[room.ID] = make([]bool, nights)
+		for n := 0; n < nights; n++ {
+			night := start.AddDate(0, 0, n)
+			free[room.ID][n] = true
+			for _, rr := range taken[room.ID] {
+				if !night.Before(rr.StartDate) && night.Before(rr.EndDate) {
+					free[room.ID][n] = false
+				}
+			}
+		}
+	}
+
+	// freeFrom counts the nights a room stays free from night n on
+	freeFrom := func(roomID, n int) int {
+		count := 0
+		for n+count < nights && free[roomID][n+count] {
+			count++
+		}
+		return count
+	}
+
+	seen := make(map[string]bool)
+	for _, room := range rooms {
+		var segments []models.StaySegment
+		var key strings.Builder
+
+		n := 0
+		for n < nights && len(segments) < maxSplitSegments {
+			length := freeFrom(room.ID, n)
+			if length == 0 {
+				break
+			}
+			segments = append(segments, models.StaySegment{
+				RoomID:    room.ID,
+				Room:      room,
+				StartDate: start.AddDate(0, 0, n),
+				EndDate:   start.AddDate(0, 0, n+length),
+			})
+			fmt.Fprintf(&key, "%d@%d,", room.ID, n)
+			n += length
+
+			longest := 0
+			for _, next := range rooms {
+				if l := freeFrom(next.ID, n); l > longest {
+					longest = l
+					room = next
+				}
+			}
+		}
+
+		if n < nights || len(segments) < 2 || seen[key.String()] {
+			continue
+		}
+		seen[key.String()] = true
+		splits = append(splits, segments)
+	}
+
+	sort.SliceStable(splits, func(i, j int) bool {
+		return len(splits[i]) < len(splits[j])
+	})
+
+	return splits
+}
+
+// alternativeDays is how many days earlier or later a search looks for the same stay
+const alternativeDays = 7
+
+// maxAlternatives is the most stays of each kind a search suggests
+const maxAlternatives = 5
+
+// alternativeStays suggests the same stay on nearby dates and the shorter stays free within it, for rooms
+// that sleep the guests and have the amenities asked for
+func (m *Repository) alternativeStays(start, end time.Time, guests int, amenityIDs []int) ([]models.StaySegment, []models.StaySegment) {
+	shifted, err := m.DB.ShiftedStays(start, end, alternativeDays, guests, amenityIDs)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+	}
+
+	all, err := m.DB.PartialStays(start, end, guests, amenityIDs)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+	}
+
+	// one room is enough for the same dates
+	var partial []models.StaySegment
+	seen := make(map[string]bool)
+	for _, s := range all {
+		key := s.StartDate.Format("2006-01-02") + s.EndDate.Format("2006-01-02")
+		if !seen[key] {
+			seen[key] = true
+			partial = append(partial, s)
+		}
+	}
+
+	return shifted[:min(len(shifted), maxAlternatives)], partial[:min(len(partial), maxAlternatives)]
+}
+
+// splitStaySuggestions looks for split stays from start to end in all the rooms that sleep the guests and
+// have the amenities asked for
+func (m *Repository) splitStaySuggestions(start, end time.Time, guests int, amenityIDs []int) ([][]models.StaySegment, error) {
+	all, err := m.DB.AllRooms()
+	if err != nil {
+		return nil, err
+	}
+
+	byRoom := make(map[int][]models.Amenity)
+	if len(amenityIDs) > 0 {
+		if byRoom, err = m.DB.AmenitiesByRoom(); err != nil {
+			return nil, err
+		}
+	}
+
+	var rooms []models.Room
+	for _, room := range all {
+		if room.MaxOccupancy >= guests && hasAmenities(byRoom[room.ID], amenityIDs) {
+			rooms = append(rooms, room)
+		}
+	}
+
+	taken := make(map[int][]models.RoomRestriction)
+	for _, room := range rooms {
+		taken[room.ID], err = m.DB.GetRestrictionsForRoomByDate(room.ID, start, end)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return splitStays(start, end, rooms, taken), nil
+}
+
+// segmentsFromQuery builds the segments of a stay from start to end out of its rooms in order and the days
+// the guest changes rooms, one change fewer than rooms
+func segmentsFromQuery(start, end time.Time, rooms, changes []string) ([]models.StaySegment, error) {
+	var segments []models.StaySegment
+
+	if len(rooms) < 2 || len(changes) != len(rooms)-1 {
+		return segments, errors.New("a split stay needs a change day between every two rooms")
+	}
+
+	from := start
+	for i, room := range rooms {
+		roomID, err := strconv.Atoi(room)
+		if err != nil {
+			return segments, errors.New("invalid room id")
+		}
+
+		until := end
+		if i < len(changes) {
+			until, err = parseDate(changes[i])
+			if err != nil {
+				return segments, errors.New("invalid change day")
+			}
+		}
+		if !until.After(from) || until.After(end) {
+			return segments, errors.New("the rooms must follow each other within the stay")
+		}
+		if i > 0 && segments[i-1].RoomID == roomID {
+			return segments, errors.New("a split stay changes rooms")
+		}
+
+		segments = append(segments, models.StaySegment{RoomID: roomID, StartDate: from, EndDate: until})
+		from = until
+	}
+
+	return segments, nil
+}
+
+// ChooseSplit takes the split stay suggestion the guest chose, its rooms in order and the days of the
+// room changes, and moves on to the reservation form
+func (m *Repository) ChooseSplit(w http.ResponseWriter, r *http.Request) {
+	res, ok := m.App.Session.Get(r.Context(), "reservation").(models.Reservation)
+	if !ok {
+		m.App.Session.Put(r.Context(), "error", "can't get session")
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	segments, err := segmentsFromQuery(res.StartDate, res.EndDate, r.URL.Query()["room"], r.URL.Query()["change"])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	// the suggestion may be stale by now
+	m.releaseHolds(r)
+	for i, seg := range segments {
+		available, err := m.DB.SearchAvailabilityByDatesByRoomID(seg.StartDate, seg.EndDate, seg.RoomID)
+		if err != nil || !available {
+			m.App.Session.Put(r.Context(), "error", "These rooms are no longer available, please search again")
+			http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+			return
+		}
+
+		room, err := m.DB.GetRoomByID(seg.RoomID)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "can't get room from db")
+			http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+			return
+		}
+		segments[i].Room = room
+	}
+
+	res.RoomID = segments[0].RoomID
+	res.Segments = segments
+
+	if err := m.holdRooms(r, segments); err != nil {
+		m.App.Session.Put(r.Context(), "error", "These rooms are no longer available, please search again")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "reservation", res)
+	m.App.Session.Remove(r.Context(), "cart")
+	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
+}
+
+// BookRoom takes URL parameters, builds a sessional variable, and takes user to make res screen
+func (m *Repository) BookRoom(w http.ResponseWriter, r *http.Request) {
+	roomID, _ := strconv.Atoi(r.URL.Query().Get("id"))
+	sd := r.URL.Query().Get("s")
+	ed := r.URL.Query().Get("e")
+
+	StartDate, _ := parseDate(sd)
+	/* if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get session")
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}*/
+
+	EndDate, _ := parseDate(ed)
+	/* if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get session")
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}*/
+
+	if broken := stayRuleViolations(StartDate, EndDate); len(broken) > 0 {
+		m.App.Session.Put(r.Context(), "error", "Can't book: "+strings.Join(broken, ", "))
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	room, err := m.DB.GetRoomByID(roomID)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get room from db")
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	res := models.Reservation{
+		RoomID:    roomID,
+		StartDate: StartDate,
+		EndDate:   EndDate,
+	}
+
+	res.Room.RoomName = room.RoomName
+
+	// the party of the search the room was picked from
+	if searched, ok := m.App.Session.Get(r.Context(), "reservation").(models.Reservation); ok {
+		res.Adults = searched.Adults
+		res.Children = searched.Children
+	}
+
+	if err := m.holdRooms(r, reservationStays(res, nil)); err != nil {
+		m.App.Session.Put(r.Context(), "error", "This room is no longer available for these dates, please search again")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "reservation", res)
+	m.App.Session.Remove(r.Context(), "cart")
+
+	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
+}
+
+// waitlistOfferTTL is how long a guest on the waitlist has to book the room offered to them
+const waitlistOfferTTL = 24 * time.Hour
+
+// Waitlist shows the form where guests join the waitlist for dates that are fully booked
+func (m *Repository) Waitlist(w http.ResponseWriter, r *http.Request) {
+	m.renderWaitlist(w, r, forms.New(r.URL.Query()))
+}
+
+// renderWaitlist shows the waitlist form with the room types guests can prefer
+func (m *Repository) renderWaitlist(w http.ResponseWriter, r *http.Request, form *forms.Form) {
+	types, err := m.DB.AllRoomTypes()
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+	}
+
+	data := make(map[string]interface{})
+	data["types"] = types
+
+	render.Template(w, r, "waitlist.page.tmpl", &models.TemplateData{
+		Form: form,
+		Data: data,
+	})
+}
+
+// PostWaitlist puts a guest on the waitlist
+func (m *Repository) PostWaitlist(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/waitlist", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("email", "start", "end")
+	form.IsEmail("email")
+
+	entry := models.WaitlistEntry{
+		Email: strings.ToLower(strings.TrimSpace(r.Form.Get("email"))),
+	}
+	entry.RoomTypeID, _ = strconv.Atoi(r.Form.Get("room_type_id"))
+
+	var err error
+	if entry.StartDate, err = parseDate(r.Form.Get("start")); err != nil {
+		form.Errors.Add("start", "Invalid arrival date")
+	}
+	if entry.EndDate, err = parseDate(r.Form.Get("end")); err != nil {
+		form.Errors.Add("end", "Invalid departure date")
+	}
+	if form.Errors.Get("start") == "" && form.Errors.Get("end") == "" {
+		if broken := stayRuleViolations(entry.StartDate, entry.EndDate); len(broken) > 0 {
+			form.Errors.Add("start", "Can't wait for this stay: "+strings.Join(broken, ", "))
+		}
+	}
+
+	party := models.Reservation{}
+	if err := partyFromForm(r.Form, &party); err != nil {
+		form.Errors.Add("adults", err.Error())
+	}
+	entry.Adults = party.Adults
+	entry.Children = party.Children
+
+	if !form.Valid() {
+		m.renderWaitlist(w, r, form)
+		return
+	}
+
+	if _, err := m.DB.InsertWaitlistEntry(entry); err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't add you to the waitlist")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "You're on the waitlist. We'll email you if a room frees up")
+	http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+}
+
+// NotifyWaitlist offers the rooms that freed up to the guests waiting for them and emails each a booking
+// link valid until the offer expires. A failure is logged, as the change that freed the rooms is already done
+func (m *Repository) NotifyWaitlist() {
+	offered, err := m.DB.OfferWaitlistRooms(time.Now().Add(waitlistOfferTTL))
+	if err != nil {
+		m.App.ErrorLog.Println("can't offer rooms to the waitlist:", err)
+		return
+	}
+
+	for _, e := range offered {
+		link := fmt.Sprintf("%s/waitlist/offer?token=%s", m.App.BaseURL,
+			helpers.SignToken(strconv.Itoa(e.ID), waitlistOfferTTL))
+		htmlMessage := fmt.Sprintf(`
+			<strong>A room is free for your dates</strong><br>
+			%s is free from %s to %s. <a href="%s">Book it now</a>; the link is valid for %d hours.
+		`, e.Room.RoomName, e.StartDate.Format("2006-01-02"), e.EndDate.Format("2006-01-02"), link,
+			int(waitlistOfferTTL.Hours()))
+
+		m.App.MailChan <- models.MailData{
+			To:       e.Email,
+			From:     "me@fortsmythe.com",
+			Subject:  "A room is free for your dates",
+			Content:  htmlMessage,
+			Template: "basic.html",
+		}
+	}
+}
+
+// WaitlistOffer opens the booking of the room offered to a guest on the waitlist, while the offer lasts
+func (m *Repository) WaitlistOffer(w http.ResponseWriter, r *http.Request) {
+	subject, err := helpers.ParseToken(r.URL.Query().Get("token"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "This link is invalid or has expired")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	id, _ := strconv.Atoi(subject)
+	entry, err := m.DB.GetWaitlistEntryByID(id)
+	if err != nil || entry.RoomID == 0 || !entry.BookedAt.IsZero() || entry.OfferExpiresAt.Before(time.Now()) {
+		m.App.Session.Put(r.Context(), "error", "This offer is no longer available")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	res := models.Reservation{
+		RoomID:    entry.RoomID,
+		Room:      entry.Room,
+		StartDate: entry.StartDate,
+		EndDate:   entry.EndDate,
+		Email:     entry.Email,
+		Adults:    entry.Adults,
+		Children:  entry.Children,
+	}
+
+	// the room was held for the guest when it was offered; that hold becomes theirs and the booking while the
+	// offer lasts. An offer whose hold is gone holds the room again if it's still free
+	if entry.HoldID > 0 {
+		m.releaseHolds(r)
+		m.App.Session.Put(r.Context(), "holds", []int{entry.HoldID})
+		m.App.Session.Put(r.Context(), "hold_expires", entry.OfferExpiresAt.Unix())
+	} else if err := m.holdRooms(r, reservationStays(res, nil)); err != nil {
+		m.App.Session.Put(r.Context(), "error", "This offer is no longer available")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "reservation", res)
+	m.App.Session.Put(r.Context(), "waitlist_id", entry.ID)
+	m.App.Session.Remove(r.Context(), "cart")
+
+	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
+}
+
+// bookWaitlistOffer marks the waitlist offer opened in the session as booked, if res is the room it offered
+func (m *Repository) bookWaitlistOffer(r *http.Request, res models.Reservation) {
+	id := m.App.Session.PopInt(r.Context(), "waitlist_id")
+	if id == 0 {
+		return
+	}
+
+	entry, err := m.DB.GetWaitlistEntryByID(id)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		return
+	}
+
+	if entry.RoomID == res.RoomID && entry.StartDate.Equal(res.StartDate) && entry.EndDate.Equal(res.EndDate) {
+		if err := m.DB.BookWaitlistEntry(id); err != nil {
+			m.App.ErrorLog.Println(err)
+		}
+	}
+}
+
+// GroupBooking shows the form where the guests of a group enter their booking code
+func (m *Repository) GroupBooking(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "group-booking.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostGroupBooking starts a reservation in one of the rooms held for the allotment of the booking code
+func (m *Repository) PostGroupBooking(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("code")
+
+	var a models.Allotment
+	if form.Valid() {
+		var err error
+		a, err = m.DB.GetAllotmentByCode(strings.ToUpper(strings.TrimSpace(form.Get("code"))))
+		if err != nil {
+			form.Errors.Add("code", "Unknown or expired booking code")
+		} else if len(a.Held) == 0 {
+			form.Errors.Add("code", "All the rooms held for "+a.Name+" are booked")
+		}
+	}
+
+	if !form.Valid() {
+		render.Template(w, r, "group-booking.page.tmpl", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	res := models.Reservation{
+		StartDate:   a.StartDate,
+		EndDate:     a.EndDate,
+		RoomID:      a.Held[0].ID,
+		AllotmentID: a.ID,
+	}
+
+	m.App.Session.Put(r.Context(), "reservation", res)
+	m.App.Session.Remove(r.Context(), "cart")
+
+	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
+}
+
+// parseDate parses date string using the specified layout  - move to helpers?
+func parseDate(dateStr string) (time.Time, error) {
+	// 01/02 03:04:05PM '06 -0700  go time format
+	layout := "2006-01-02" // string describes my date format yyyy-mm-dd
+	return time.Parse(layout, dateStr)
+}
+
+// ShowLogin shows the login screen
+func (m *Repository) ShowLogin(w http.ResponseWriter, r *http.Request) {
+	stringMap := make(map[string]string)
+	if m.App.SSO != nil {
+		stringMap["sso"] = "1"
+	}
+
+	render.Template(w, r, "login.page.tmpl", &models.TemplateData{
+		Form:      forms.New(nil),
+		StringMap: stringMap,
+	})
+}
+
+// PostShowLogin handles logging the user in
+func (m *Repository) PostShowLogin(w http.ResponseWriter, r *http.Request) {
+	_ = m.App.Session.RenewToken(r.Context()) // prevents a session fixation attack
+
+	err := r.ParseForm()
+	if err != nil {
+		log.Println("can't parse form")
+	}
+
+	email := r.Form.Get("email")
+	password := r.Form.Get("password")
+
+	form := forms.New(r.PostForm)
+	form.Required("email", "password")
+	form.IsEmail("email")
+
+	if !form.Valid() {
+		render.Template(w, r, "login.page.tmpl", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	id, _, err := m.DB.Authenticate(email, password)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid login credentials")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "user_id", id)
+	m.App.Session.Put(r.Context(), "flash", "Logged in successfully")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+
+	// http.Redirect(w, r, "/user/login", http.StatusSeeOther) // code 303
+}
+
+// SSOLogin sends a staff user to the identity provider to log in
+func (m *Repository) SSOLogin(w http.ResponseWriter, r *http.Request) {
+	if m.App.SSO == nil {
+		m.App.Session.Put(r.Context(), "error", "Single sign-on is not configured")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	state, err := helpers.RandomToken(16)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	nonce, err := helpers.RandomToken(16)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "sso_state", state)
+	m.App.Session.Put(r.Context(), "sso_nonce", nonce)
+
+	http.Redirect(w, r, m.App.SSO.AuthCodeURL(state, nonce), http.StatusFound)
+}
+
+// SSOCallback logs in the staff user returned by the identity provider, creating the user on first login
+func (m *Repository) SSOCallback(w http.ResponseWriter, r *http.Request) {
+	if m.App.SSO == nil {
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	state := m.App.Session.PopString(r.Context(), "sso_state")
+	nonce := m.App.Session.PopString(r.Context(), "sso_nonce")
+
+	if r.URL.Query().Get("error") != "" {
+		m.App.Session.Put(r.Context(), "error", "Single sign-on was cancelled")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	// the state ties the callback to the login started in this session
+	if state == "" || r.URL.Query().Get("state") != state {
+		m.App.Session.Put(r.Context(), "error", "Single sign-on session expired, try again")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	identity, err := m.App.SSO.Exchange(r.Context(), r.URL.Query().Get("code"), nonce)
+	if err != nil {
+		m.App.ErrorLog.Println("single sign-on:", err)
+		m.App.Session.Put(r.Context(), "error", "Single sign-on failed")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	// an unverified email could belong to anyone, so it can't identify a staff member
+	if !identity.EmailVerified {
+		m.App.Session.Put(r.Context(), "error", "Your email address isn't verified by the identity provider")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	id, err := m.DB.UpsertSSOUser(models.User{
+		FirstName:   identity.FirstName,
+		LastName:    identity.LastName,
+		Email:       strings.ToLower(identity.Email),
+		AccessLevel: identity.AccessLevel,
+	}, identity.Issuer, identity.Subject)
+	if errors.Is(err, repository.ErrSSOEmailTaken) {
+		m.App.Session.Put(r.Context(), "error", "An account with this email already exists and can't sign in with single sign-on")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	// the user's access level was updated from the groups first, so one removed from them loses it
+	if identity.AccessLevel == 0 {
+		m.App.Session.Put(r.Context(), "error", "Your account has no access to the admin area")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	_ = m.App.Session.RenewToken(r.Context())
+	m.App.Session.Put(r.Context(), "user_id", id)
+	m.App.Session.Put(r.Context(), "flash", "Logged in successfully")
+	http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+}
+
+// Logout logs a user out
+func (m *Repository) Logout(w http.ResponseWriter, r *http.Request) {
+	_ = m.App.Session.Destroy(r.Context())
+	_ = m.App.Session.RenewToken(r.Context())
+
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+
+}
+
+// ShowGuestRegister shows the guest registration screen
+func (m *Repository) ShowGuestRegister(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "guest-register.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostGuestRegister creates a guest account and sends the email verification link
+func (m *Repository) PostGuestRegister(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/guest/register", http.StatusSeeOther)
+		return
+	}
+
+	guest := models.Guest{
+		FirstName: r.Form.Get("first_name"),
+		LastName:  r.Form.Get("last_name"),
+		Email:     strings.ToLower(strings.TrimSpace(r.Form.Get("email"))),
+		Phone:     r.Form.Get("phone"),
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("first_name", "last_name", "email", "password")
+	form.IsEmail("email")
+	form.MinLength("password", 8)
+
+	if !form.Valid() {
+		data := make(map[string]interface{})
+		data["guest"] = guest
+		render.Template(w, r, "guest-register.page.tmpl", &models.TemplateData{
+			Form: form,
+			Data: data,
+		})
+		return
+	}
+
+	hashedPassword, err := helpers.HashPassword(r.Form.Get("password"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	guest.Password = string(hashedPassword)
+
+	guest.VerifyToken, err = helpers.RandomToken(32)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	_, err = m.DB.InsertGuest(guest)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't create an account with this email")
+		http.Redirect(w, r, "/guest/register", http.StatusSeeOther)
+		return
+	}
+
+	htmlMessage := fmt.Sprintf(`
+		<strong>Confirm your email</strong><br>
+		Dear %s! <br>
+		Please <a href="%s/guest/verify?token=%s">confirm your email address</a> to see all your bookings in one place.
+	`, guest.FirstName, m.App.BaseURL, guest.VerifyToken)
+
+	msg := models.MailData{
+		To:       guest.Email,
+		From:     "me@fortsmythe.com",
+		Subject:  "Confirm your email",
+		Content:  htmlMessage,
+		Template: "basic.html",
+	}
+	m.App.MailChan <- msg
+
+	m.App.Session.Put(r.Context(), "flash", "Account created, check your email to confirm it")
+	http.Redirect(w, r, "/guest/login", http.StatusSeeOther)
+}
+
+// GuestVerify confirms a guest email and links earlier reservations made with it
+func (m *Repository) GuestVerify(w http.ResponseWriter, r *http.Request) {
+	guest, err := m.DB.VerifyGuestEmail(r.URL.Query().Get("token"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid or expired confirmation link")
+		http.Redirect(w, r, "/guest/login", http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.LinkReservationsToGuest(guest.ID, guest.Email)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Email confirmed")
+	http.Redirect(w, r, "/guest/login", http.StatusSeeOther)
+}
+
+// ShowGuestLogin shows the guest login screen
+func (m *Repository) ShowGuestLogin(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "guest-login.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostGuestLogin handles logging the guest in; staff logins stay in PostShowLogin
+func (m *Repository) PostGuestLogin(w http.ResponseWriter, r *http.Request) {
+	_ = m.App.Session.RenewToken(r.Context())
+
+	err := r.ParseForm()
+	if err != nil {
+		log.Println("can't parse form")
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("email", "password")
+	form.IsEmail("email")
+
+	if !form.Valid() {
+		render.Template(w, r, "guest-login.page.tmpl", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	email := strings.ToLower(strings.TrimSpace(r.Form.Get("email")))
+	id, err := m.DB.AuthenticateGuest(email, r.Form.Get("password"))
+	if errors.Is(err, repository.ErrGuestNotVerified) {
+		m.App.Session.Put(r.Context(), "error", "Confirm your email with the link we sent you before logging in")
+		http.Redirect(w, r, "/guest/login", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid login credentials")
+		http.Redirect(w, r, "/guest/login", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "guest_id", id)
+	m.App.Session.Put(r.Context(), "flash", "Logged in successfully")
+	http.Redirect(w, r, "/guest/bookings", http.StatusSeeOther)
+}
+
+// GuestLogout logs a guest out
+func (m *Repository) GuestLogout(w http.ResponseWriter, r *http.Request) {
+	m.App.Session.Remove(r.Context(), "guest_id")
+	_ = m.App.Session.RenewToken(r.Context())
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// GuestBookings shows past and upcoming reservations of the logged in guest
+func (m *Repository) GuestBookings(w http.ResponseWriter, r *http.Request) {
+	guestID := m.App.Session.GetInt(r.Context(), "guest_id")
+
+	guest, err := m.DB.GetGuestByID(guestID)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't find your account")
+		http.Redirect(w, r, "/guest/login", http.StatusSeeOther)
+		return
+	}
+
+	reservations, err := m.DB.ReservationsByGuestID(guestID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	// a stay is upcoming until its departure day has passed
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	var upcoming, past []models.Reservation
+	for _, x := range reservations {
+		if x.EndDate.Before(today) {
+			past = append(past, x)
+		} else {
+			upcoming = append(upcoming, x)
+		}
+	}
+
+	data := make(map[string]interface{})
+	data["guest"] = guest
+	data["upcoming"] = upcoming
+	data["past"] = past
+
+	render.Template(w, r, "guest-bookings.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+const (
+	// magicLinkTTL is how long an emailed magic link can be opened
+	magicLinkTTL = 15 * time.Minute
+	// magicSessionTTL is how long the reservations of the email stay unlocked after opening the link
+	magicSessionTTL = time.Hour
+	// cancelCutoffDays is how many days before arrival a guest can still cancel online
+	cancelCutoffDays = 2
+)
+
+// canCancel reports whether a guest may still cancel the reservation themselves
+func canCancel(res models.Reservation) bool {
+	cutoff := time.Now().AddDate(0, 0, cancelCutoffDays)
+	return !res.Cancelled && res.StartDate.After(cutoff)
+}
+
+// ShowMyReservations shows the form where a guest asks for a magic link
+func (m *Repository) ShowMyReservations(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "my-reservations.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostMyReservations emails a magic link to the reservations made with the posted email
+func (m *Repository) PostMyReservations(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/my-reservations", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("email")
+	form.IsEmail("email")
+
+	if !form.Valid() {
+		render.Template(w, r, "my-reservations.page.tmpl", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	email := strings.ToLower(strings.TrimSpace(r.Form.Get("email")))
+
+	reservations, err := m.DB.ReservationsByEmail(email)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't look up reservations right now")
+		http.Redirect(w, r, "/my-reservations", http.StatusSeeOther)
+		return
+	}
+
+	// only mail addresses we know, but answer the same way so the form can't be used to probe emails
+	if len(reservations) > 0 {
+		link := fmt.Sprintf("%s/my-reservations/access?token=%s", m.App.BaseURL, helpers.SignToken(email, magicLinkTTL))
+		htmlMessage := fmt.Sprintf(`
+			<strong>Your reservations</strong><br>
+			<a href="%s">Open your reservations</a>. The link is valid for %d minutes.
+		`, link, int(magicLinkTTL.Minutes()))
+
+		msg := models.MailData{
+			To:       email,
+			From:     "me@fortsmythe.com",
+			Subject:  "Access your reservations",
+			Content:  htmlMessage,
+			Template: "basic.html",
+		}
+		m.App.MailChan <- msg
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "If we have reservations for this email, a link is on its way")
+	http.Redirect(w, r, "/my-reservations", http.StatusSeeOther)
+}
+
+// MagicLinkAccess opens a session scoped to the reservations of the email carried by the link
+func (m *Repository) MagicLinkAccess(w http.ResponseWriter, r *http.Request) {
+	email, err := helpers.ParseToken(r.URL.Query().Get("token"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "This link is invalid or has expired")
+		http.Redirect(w, r, "/my-reservations", http.StatusSeeOther)
+		return
+	}
+
+	_ = m.App.Session.RenewToken(r.Context())
+	m.App.Session.Put(r.Context(), "magic_email", email)
+	m.App.Session.Put(r.Context(), "magic_expires", time.Now().Add(magicSessionTTL).Unix())
+
+	http.Redirect(w, r, "/my-reservations/list", http.StatusSeeOther)
+}
+
+// MyReservationsList lists the reservations unlocked by a magic link
+func (m *Repository) MyReservationsList(w http.ResponseWriter, r *http.Request) {
+	email := helpers.MagicLinkEmail(r)
+	if email == "" {
+		m.App.Session.Put(r.Context(), "error", "Request a new link to see your reservations")
+		http.Redirect(w, r, "/my-reservations", http.StatusSeeOther)
+		return
+	}
+
+	reservations, err := m.DB.ReservationsByEmail(email)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	cancellable := make(map[int]bool)
+	for _, x := range reservations {
+		cancellable[x.ID] = canCancel(x)
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["email"] = email
+
+	data := make(map[string]interface{})
+	data["reservations"] = reservations
+	data["cancellable"] = cancellable
+
+	render.Template(w, r, "my-reservations-list.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+	})
+}
+
+// magicLinkReservation returns the reservation in the url if it belongs to the email unlocked by a magic link
+func (m *Repository) magicLinkReservation(r *http.Request) (models.Reservation, error) {
+	var res models.Reservation
+
+	email := helpers.MagicLinkEmail(r)
+	if email == "" {
+		return res, errors.New("no magic link access")
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return res, err
+	}
+
+	res, err = m.DB.GetReseravtionByID(id)
+	if err != nil {
+		return res, err
+	}
+
+	if !strings.EqualFold(res.Email, email) {
+		return res, errors.New("reservation belongs to another email")
+	}
+
+	return res, nil
+}
+
+// MyReservationConfirmation sends a reservation confirmation as a downloadable file
+func (m *Repository) MyReservationConfirmation(w http.ResponseWriter, r *http.Request) {
+	res, err := m.magicLinkReservation(r)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't find this reservation")
+		http.Redirect(w, r, "/my-reservations", http.StatusSeeOther)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := confirmationDocument.Execute(&buf, res); err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="reservation-%d.html"`, res.ID))
+	w.Write(buf.Bytes())
+}
+
+// confirmationDocument is the reservation confirmation guests download; the guest typed the names in,
+// so html/template escapes them
+var confirmationDocument = template.Must(template.New("confirmation").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Reservation {{.ID}}</title></head>
+<body>
+	<h1>Fort Smythe Bed and Breakfast</h1>
+	<h2>Reservation Confirmation #{{.ID}}</h2>
+	<p>
+		Name: {{.FirstName}} {{.LastName}}<br>
+		Room: {{if .Segments}}{{range $i, $s := .Segments}}{{if $i}}, then {{end}}{{$s.Room.RoomName}} {{$s.StartDate.Format "2006-01-02"}} - {{$s.EndDate.Format "2006-01-02"}}{{end}}{{else}}{{.Room.RoomName}}{{end}}<br>
+		Arrival: {{.StartDate.Format "2006-01-02"}}<br>
+		Departure: {{.EndDate.Format "2006-01-02"}}<br>
+		Status: {{if .Cancelled}}Cancelled{{else}}Confirmed{{end}}
+	</p>
+</body>
+</html>
+`))
+
+// PostMyReservationCancel cancels a reservation unlocked by a magic link
+func (m *Repository) PostMyReservationCancel(w http.ResponseWriter, r *http.Request) {
+	res, err := m.magicLinkReservation(r)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't find this reservation")
+		http.Redirect(w, r, "/my-reservations", http.StatusSeeOther)
+		return
+	}
+
+	if !canCancel(res) {
+		m.App.Session.Put(r.Context(), "error",
+			fmt.Sprintf("Reservations can only be cancelled online up to %d days before arrival", cancelCutoffDays))
+		http.Redirect(w, r, "/my-reservations/list", http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.CancelReservation(res.ID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.NotifyWaitlist()
+	m.refreshHousekeeping()
+
+	htmlMessage := fmt.Sprintf(`
+		<strong>Reservation Cancelled</strong><br>
+		Reservation #%d for %s from %s to %s was cancelled by the guest
+	`, res.ID, res.Room.RoomName, res.StartDate.Format("2006-01-02"), res.EndDate.Format("2006-01-02"))
+
+	msg := models.MailData{
+		To:      "admin@fortsmythe.com",
+		From:    "me@fortsmythe.com",
+		Subject: "Reservation Cancelled",
+		Content: htmlMessage,
+	}
+	m.App.MailChan <- msg
+
+	m.App.Session.Put(r.Context(), "flash", "Reservation cancelled")
+	http.Redirect(w, r, "/my-reservations/list", http.StatusSeeOther)
+}
+
+// audit appends an admin action to the audit log; before and after are stored as JSON, nil for none.
+// A failure is logged but doesn't stop the action that was already done
+func (m *Repository) audit(r *http.Request, action, entity string, entityID int, before, after interface{}) {
+	toJSON := func(v interface{}) string {
+		if v == nil {
+			return ""
+		}
+		out, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		return string(out)
+	}
+
+	err := m.DB.InsertAuditEntry(models.AuditEntry{
+		UserID:   m.App.Session.GetInt(r.Context(), "user_id"),
+		Action:   action,
+		Entity:   entity,
+		EntityID: entityID,
+		Before:   toJSON(before),
+		After:    toJSON(after),
+		IP:       helpers.ClientIP(r),
+	})
+	if err != nil {
+		m.App.ErrorLog.Println("can't write audit log:", err)
+	}
+}
+
+// AdminAuditLog shows the audit log filtered by user, entity and date
+func (m *Repository) AdminAuditLog(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var filter models.AuditFilter
+	filter.UserID, _ = strconv.Atoi(q.Get("user_id"))
+	filter.Entity = q.Get("entity")
+
+	// an invalid date leaves the zero time, which doesn't filter
+	if from := q.Get("from"); from != "" {
+		t, err := parseDate(from)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "warning", "Invalid from date ignored")
+		}
+		filter.From = t
+	}
+	if to := q.Get("to"); to != "" {
+		t, err := parseDate(to)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "warning", "Invalid to date ignored")
+		}
+		filter.To = t
+	}
+
+	entries, err := m.DB.AuditEntries(filter)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	users, err := m.DB.AllStaffUsers()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["user_id"] = q.Get("user_id")
+	stringMap["entity"] = filter.Entity
+	stringMap["from"] = q.Get("from")
+	stringMap["to"] = q.Get("to")
+
+	data := make(map[string]interface{})
+	data["entries"] = entries
+	data["users"] = users
+
+	render.Template(w, r, "admin-audit-log.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+	})
+}
+
+// maxReportDays caps the period of the dashboard report
+const maxReportDays = 366
+
+// occupancySummary is the totals of an occupancy report over the rooms it covers
+type occupancySummary struct {
+	BookedNights    int
+	AvailableNights int
+	Revenue         int     // in cents
+	Occupancy       float64 // percent of the available nights that were booked
+	ADR             int     // average daily rate, revenue per booked night in cents
+	RevPAR          int     // revenue per available room night in cents
+	Cancellations   int
+}
+
+// summarizeOccupancy adds up the rooms of a report and derives the rates
+func summarizeOccupancy(report models.OccupancyReport) occupancySummary {
+	var s occupancySummary
+	for _, ro := range report.Rooms {
+		s.BookedNights += ro.BookedNights
+		s.AvailableNights += ro.AvailableNights
+		s.Revenue += ro.Revenue
+	}
+	s.Cancellations = report.Cancellations
+
+	if s.AvailableNights > 0 {
+		s.Occupancy = float64(s.BookedNights) * 100 / float64(s.AvailableNights)
+		s.RevPAR = s.Revenue / s.AvailableNights
+	}
+	if s.BookedNights > 0 {
+		s.ADR = s.Revenue / s.BookedNights
+	}
+	return s
+}
+
+// dashboardMetric is one line of the dashboard, this period against the same period last year
+type dashboardMetric struct {
+	Name     string
+	Current  string
+	LastYear string
+	Change   string
+}
+
+// percentChange formats the change from last to current, or a dash when there is nothing to compare with
+func percentChange(current, last float64) string {
+	if last == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%+.1f%%", (current-last)*100/last)
+}
+
+// AdminDashboard shows occupancy and revenue for a period, compared with the same period last year
+func (m *Repository) AdminDashboard(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	// the current month unless a period is asked for
+	now := time.Now()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+
+	if q.Get("from") != "" || q.Get("to") != "" {
+		f, errFrom := parseDate(q.Get("from"))
+		t, errTo := parseDate(q.Get("to"))
+		switch {
+		case errFrom != nil || errTo != nil:
+			m.App.Session.Put(r.Context(), "warning", "Invalid dates, showing the current month")
+		case !t.After(f):
+			m.App.Session.Put(r.Context(), "warning", "The period must end after it starts, showing the current month")
+		case t.Sub(f).Hours()/24 > maxReportDays:
+			m.App.Session.Put(r.Context(), "warning", fmt.Sprintf("The period can be at most %d days, showing the current month", maxReportDays))
+		default:
+			// the period is shown inclusive of its last day
+			from, to = f, t.AddDate(0, 0, 1)
+		}
+	}
+
+	roomID, _ := strconv.Atoi(q.Get("room"))
+
+	report, err := m.DB.OccupancyReport(from, to, roomID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	lastYear, err := m.DB.OccupancyReport(from.AddDate(-1, 0, 0), to.AddDate(-1, 0, 0), roomID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	cur, prev := summarizeOccupancy(report), summarizeOccupancy(lastYear)
+	metrics := []dashboardMetric{
+		{"Occupancy", fmt.Sprintf("%.1f%%", cur.Occupancy), fmt.Sprintf("%.1f%%", prev.Occupancy),
+			percentChange(cur.Occupancy, prev.Occupancy)},
+		{"ADR", render.Money(cur.ADR), render.Money(prev.ADR), percentChange(float64(cur.ADR), float64(prev.ADR))},
+		{"RevPAR", render.Money(cur.RevPAR), render.Money(prev.RevPAR), percentChange(float64(cur.RevPAR), float64(prev.RevPAR))},
+		{"Revenue", render.Money(cur.Revenue), render.Money(prev.Revenue), percentChange(float64(cur.Revenue), float64(prev.Revenue))},
+		{"Booked nights", strconv.Itoa(cur.BookedNights), strconv.Itoa(prev.BookedNights),
+			percentChange(float64(cur.BookedNights), float64(prev.BookedNights))},
+		{"Cancellations", strconv.Itoa(cur.Cancellations), strconv.Itoa(prev.Cancellations),
+			percentChange(float64(cur.Cancellations), float64(prev.Cancellations))},
+	}
+
+	// chart data, last year's nights lined up with this year's by their place in the period
+	roomCount := len(report.Rooms)
+	chart := struct {
+		Labels    []string  `json:"labels"`
+		Current   []float64 `json:"current"`
+		LastYear  []float64 `json:"last_year"`
+		LeadTimes []string  `json:"lead_time_labels"`
+		LeadCount []int     `json:"lead_times"`
+	}{LeadTimes: models.LeadTimeBuckets}
+	for i, d := range report.Daily {
+		chart.Labels = append(chart.Labels, d.Date.Format("2006-01-02"))
+		if roomCount > 0 {
+			chart.Current = append(chart.Current, float64(d.Occupied)*100/float64(roomCount))
+			if i < len(lastYear.Daily) {
+				chart.LastYear = append(chart.LastYear, float64(lastYear.Daily[i].Occupied)*100/float64(roomCount))
+			}
+		}
+	}
+	for _, bucket := range models.LeadTimeBuckets {
+		chart.LeadCount = append(chart.LeadCount, report.LeadTimes[bucket])
+	}
+	chartJSON, _ := json.Marshal(chart)
+
+	stringMap := make(map[string]string)
+	stringMap["from"] = from.Format("2006-01-02")
+	stringMap["to"] = to.AddDate(0, 0, -1).Format("2006-01-02")
+	stringMap["room"] = q.Get("room")
+	stringMap["chart"] = string(chartJSON)
+
+	data := make(map[string]interface{})
+	data["metrics"] = metrics
+	data["report"] = report
+	data["rooms"] = rooms
+
+	render.Template(w, r, "admin-dashboard.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+	})
+}
+
+// maxGridPageSize caps the rows one grid request may ask for
+const maxGridPageSize = 100
+
+// reservationFilterFromQuery reads the grid filter from the url query, ignoring values that don't parse
+func reservationFilterFromQuery(q url.Values) models.ReservationFilter {
+	f := models.ReservationFilter{
+		Sort:   q.Get("sort"),
+		Desc:   q.Get("dir") == "desc",
+		Status: q.Get("status"),
+		Search: strings.TrimSpace(q.Get("q")),
+	}
+
+	f.Page, _ = strconv.Atoi(q.Get("page"))
+	if f.Page < 1 {
+		f.Page = 1
+	}
+
+	f.PageSize, _ = strconv.Atoi(q.Get("size"))
+	if f.PageSize < 1 {
+		f.PageSize = 25
+	}
+	if f.PageSize > maxGridPageSize {
+		f.PageSize = maxGridPageSize
+	}
+
+	f.RoomID, _ = strconv.Atoi(q.Get("room"))
+
+	if from, err := parseDate(q.Get("from")); err == nil {
+		f.From = from
+	}
+	if to, err := parseDate(q.Get("to")); err == nil {
+		f.To = to
+	}
+
+	return f
+}
+
+// gridQuery returns the grid url query, with the status the src implies when none is given
+func gridQuery(r *http.Request, src string) url.Values {
+	q := r.URL.Query()
+	if src == "new" && !q.Has("status") {
+		q.Set("status", "new")
+	}
+	return q
+}
+
+// AdminReservationsGrid shows all or new reservations in admin tool depends on src
+func (m *Repository) AdminReservationsGrid(w http.ResponseWriter, r *http.Request) {
+	src := chi.URLParam(r, "src")
+	q := gridQuery(r, src)
+
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	// the filter form is prefilled from the url, so a filtered view can be bookmarked
+	stringMap := make(map[string]string)
+	stringMap["src"] = src
+	for _, key := range []string{"from", "to", "room", "status", "q", "sort", "dir", "page", "size"} {
+		stringMap[key] = q.Get(key)
+	}
+
+	data := make(map[string]interface{})
+	data["rooms"] = rooms
+
+	render.Template(w, r, "admin-reservations-grid.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+	})
+}
+
+// gridRow is one reservation as the admin grid shows it
+type gridRow struct {
+	ID        int    `json:"id"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Email     string `json:"email"`
+	Phone     string `json:"phone"`
+	Room      string `json:"room"`
+	StartDate string `json:"start_date"`
+	EndDate   string `json:"end_date"`
+	Status    string `json:"status"`
+}
+
+// gridResponse is one page of the admin grid
+type gridResponse struct {
+	OK       bool      `json:"ok"`
+	Message  string    `json:"message,omitempty"`
+	Total    int       `json:"total"`
+	Page     int       `json:"page"`
+	PageSize int       `json:"page_size"`
+	Rows     []gridRow `json:"rows"`
+}
+
+// AdminReservationsJSON sends one page of filtered and sorted reservations for the admin grid
+func (m *Repository) AdminReservationsJSON(w http.ResponseWriter, r *http.Request) {
+	f := reservationFilterFromQuery(gridQuery(r, r.URL.Query().Get("src")))
+
+	resp := gridResponse{
+		Page:     f.Page,
+		PageSize: f.PageSize,
+		Rows:     []gridRow{},
+	}
+
+	reservations, total, err := m.DB.SearchReservations(f)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		resp.Message = "error querying database"
+	} else {
+		resp.OK = true
+		resp.Total = total
+		for _, res := range reservations {
+			status := "new"
+			if res.Cancelled {
+				status = "cancelled"
+			} else if res.Processed == 1 {
+				status = "processed"
+			}
+
+			resp.Rows = append(resp.Rows, gridRow{
+				ID:        res.ID,
+				FirstName: res.FirstName,
+				LastName:  res.LastName,
+				Email:     res.Email,
+				Phone:     res.Phone,
+				Room:      res.Room.RoomName,
+				StartDate: res.StartDate.Format("2006-01-02"),
+				EndDate:   res.EndDate.Format("2006-01-02"),
+				Status:    status,
+			})
+		}
+	}
+
+	out, _ := json.MarshalIndent(resp, "", "    ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+// piiAccessLevel is the lowest access level allowed to export guests' names and contacts
+const piiAccessLevel = 2
+
+// AdminExportReservations streams the filtered reservation list as csv or xlsx
+func (m *Repository) AdminExportReservations(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	src := q.Get("src")
+	format := q.Get("format")
+
+	if format != "csv" && format != "xlsx" {
+		m.App.Session.Put(r.Context(), "error", "Unknown export format")
+		http.Redirect(w, r, "/admin/reservations/all", http.StatusSeeOther)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(m.App.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	withPII := user.AccessLevel >= piiAccessLevel
+
+	f := reservationFilterFromQuery(gridQuery(r, src))
+
+	w.Header().Set("Content-Type", export.ContentType(format))
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="reservations-%s.%s"`, time.Now().Format("2006-01-02"), format))
+
+	columns := []export.Column{{Name: "ID", Numeric: true}}
+	if withPII {
+		columns = append(columns, export.Column{Name: "First Name"}, export.Column{Name: "Last Name"},
+			export.Column{Name: "Email"}, export.Column{Name: "Phone"})
+	}
+	columns = append(columns, export.Column{Name: "Room"}, export.Column{Name: "Arrival"},
+		export.Column{Name: "Departure"}, export.Column{Name: "Nights", Numeric: true},
+		export.Column{Name: "Amount", Numeric: true}, export.Column{Name: "Status"}, export.Column{Name: "Created"})
+
+	out, err := export.New(format, w, columns)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	count, nights, amount := 0, 0, 0
+	err = m.DB.ExportReservations(f, func(res models.Reservation) error {
+		n := int(res.EndDate.Sub(res.StartDate).Hours() / 24)
+		charge := res.RoomCharge + res.ExtraCharge
+		count++
+		nights += n
+		amount += charge
+
+		status := "new"
+		if res.Cancelled {
+			status = "cancelled"
+		} else if res.Processed == 1 {
+			status = "processed"
+		}
+
+		row := []string{strconv.Itoa(res.ID)}
+		if withPII {
+			row = append(row, res.FirstName, res.LastName, res.Email, res.Phone)
+		}
+		row = append(row, res.Room.RoomName, res.StartDate.Format("2006-01-02"), res.EndDate.Format("2006-01-02"),
+			strconv.Itoa(n), exportAmount(charge), status, res.CreatedAt.Format("2006-01-02 15:04"))
+		return out.WriteRow(row)
+	})
+	if err != nil {
+		// the file is already partly sent, so it's cut off for the client to see it failed rather than
+		// get a truncated file that looks complete
+		m.App.ErrorLog.Println("reservation export:", err)
+		panic(http.ErrAbortHandler)
+	}
+
+	// a totals row the bookkeeper can check the sheet against, each sum under the column it adds up
+	totals := make([]string, len(columns))
+	totals[0] = "Total"
+	for i, c := range columns {
+		switch c.Name {
+		case "Nights":
+			totals[i] = strconv.Itoa(nights)
+		case "Amount":
+			totals[i] = exportAmount(amount)
+		case "Status":
+			totals[i] = fmt.Sprintf("%d reservations", count)
+		}
+	}
+	if err := out.WriteRow(totals); err != nil {
+		m.App.ErrorLog.Println("reservation export:", err)
+		panic(http.ErrAbortHandler)
+	}
+
+	if err := out.Close(); err != nil {
+		m.App.ErrorLog.Println("reservation export:", err)
+	}
+}
+
+// exportAmount writes an amount in cents as a plain number with two decimals, which a spreadsheet can add up
+func exportAmount(cents int) string {
+	return fmt.Sprintf("%d.%02d", cents/100, cents%100)
+}
+
+// maxImportSize caps the size of an uploaded reservation import
+const maxImportSize = 5 << 20
+
+// importColumns maps the accepted csv headers to reservation fields
+var importColumns = map[string]string{
+	"first_name": "first_name",
+	"last_name":  "last_name",
+	"email":      "email",
+	"phone":      "phone",
+	"room":       "room",
+	"room_id":    "room",
+	"room_name":  "room",
+	"start_date": "start_date",
+	"arrival":    "start_date",
+	"end_date":   "end_date",
+	"departure":  "end_date",
+}
+
+// importRow is one line of a reservation import with the reasons it can't be imported, if any
+type importRow struct {
+	Line        int
+	Reservation models.Reservation
+	Errors      []string
+}
+
+// parseReservationImport reads a reservation csv, validating every row the way a booking is validated
+// and checking it against the rooms' restrictions and the rows before it
+func (m *Repository) parseReservationImport(in io.Reader) ([]importRow, error) {
+	var rows []importRow
+
+	reader := csv.NewReader(in)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return rows, errors.New("can't read the csv header")
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ReplaceAll(strings.ToLower(strings.TrimSpace(name)), " ", "_")
+		if field, ok := importColumns[name]; ok {
+			columns[field] = i
+		}
+	}
+	for _, field := range []string{"first_name", "last_name", "email", "phone", "room", "start_date", "end_date"} {
+		if _, ok := columns[field]; !ok {
+			return rows, fmt.Errorf("the csv has no %s column", field)
+		}
+	}
+
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		return rows, err
+	}
+
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return rows, fmt.Errorf("line %d: %s", line, err)
+		}
+
+		values := url.Values{}
+		for field, i := range columns {
+			if i < len(record) {
+				values.Set(field, strings.TrimSpace(record[i]))
+			}
+		}
+
+		row := importRow{Line: line}
+
+		form := forms.New(values)
+		form.Required("first_name", "last_name", "email", "phone", "room", "start_date", "end_date")
+		form.MinLength("first_name", 3)
+		form.IsEmail("email")
+		for _, field := range []string{"first_name", "last_name", "email", "phone", "room", "start_date", "end_date"} {
+			if msg := form.Errors.Get(field); msg != "" {
+				row.Errors = append(row.Errors, fmt.Sprintf("%s: %s", field, msg))
+			}
+		}
+
+		res := models.Reservation{
+			FirstName: values.Get("first_name"),
+			LastName:  values.Get("last_name"),
+			Email:     values.Get("email"),
+			Phone:     values.Get("phone"),
+		}
+
+		for _, room := range rooms {
+			if values.Get("room") == strconv.Itoa(room.ID) || strings.EqualFold(values.Get("room"), room.RoomName) {
+				res.RoomID = room.ID
+				res.Room = room
+			}
+		}
+		if res.RoomID == 0 && values.Get("room") != "" {
+			row.Errors = append(row.Errors, "room: no such room")
+		}
+
+		startDate, startErr := parseDate(values.Get("start_date"))
+		endDate, endErr := parseDate(values.Get("end_date"))
+		if startErr != nil && values.Get("start_date") != "" {
+			row.Errors = append(row.Errors, "start_date: use the yyyy-mm-dd format")
+		}
+		if endErr != nil && values.Get("end_date") != "" {
+			row.Errors = append(row.Errors, "end_date: use the yyyy-mm-dd format")
+		}
+		res.StartDate = startDate
+		res.EndDate = endDate
+
+		if startErr == nil && endErr == nil && !endDate.After(startDate) {
+			row.Errors = append(row.Errors, "end_date: departure must be after arrival")
+		}
+
+		// only a row that is otherwise fine is worth a trip to the database
+		if len(row.Errors) == 0 {
+			available, err := m.DB.SearchAvailabilityByDatesByRoomID(startDate, endDate, res.RoomID)
+			if err != nil {
+				return rows, err
+			}
+			if !available {
+				row.Errors = append(row.Errors, "the room is not available for these dates")
+			}
+
+			for _, other := range rows {
+				o := other.Reservation
+				if len(other.Errors) == 0 && o.RoomID == res.RoomID && startDate.Before(o.EndDate) && endDate.After(o.StartDate) {
+					row.Errors = append(row.Errors, fmt.Sprintf("overlaps line %d for the same room", other.Line))
+					break
+				}
+			}
+		}
+
+		row.Reservation = res
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// AdminReservationsImport shows the reservation import form
+func (m *Repository) AdminReservationsImport(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "admin-reservations-import.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// AdminPostReservationsImport previews an uploaded reservation csv without importing anything
+func (m *Repository) AdminPostReservationsImport(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	if err := r.ParseMultipartForm(maxImportSize); err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't read the upload, the file may be too large")
+		http.Redirect(w, r, "/admin/reservations/import", http.StatusSeeOther)
+		return
+	}
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Choose a csv file to import")
+		http.Redirect(w, r, "/admin/reservations/import", http.StatusSeeOther)
+		return
+	}
+	defer file.Close()
+
+	rows, err := m.parseReservationImport(file)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, "/admin/reservations/import", http.StatusSeeOther)
+		return
+	}
+
+	var accepted []models.Reservation
+	for _, row := range rows {
+		if len(row.Errors) == 0 {
+			accepted = append(accepted, row.Reservation)
+		}
+	}
+
+	// the accepted rows wait in a file for the commit, the session only keeps the token naming it
+	m.discardImport(m.App.Session.PopString(r.Context(), "reservation_import"))
+	if len(accepted) > 0 {
+		token, err := m.saveImport(accepted)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		m.App.Session.Put(r.Context(), "reservation_import", token)
+	}
+
+	intMap := make(map[string]int)
+	intMap["accepted"] = len(accepted)
+	intMap["rejected"] = len(rows) - len(accepted)
+
+	data := make(map[string]interface{})
+	data["rows"] = rows
+
+	render.Template(w, r, "admin-reservations-import.page.tmpl", &models.TemplateData{
+		Form:   forms.New(nil),
+		IntMap: intMap,
+		Data:   data,
+	})
+}
+
+// AdminCommitReservationsImport imports the accepted rows of the previewed csv in one transaction
+func (m *Repository) AdminCommitReservationsImport(w http.ResponseWriter, r *http.Request) {
+	token := m.App.Session.PopString(r.Context(), "reservation_import")
+	accepted, err := m.loadImport(token)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			m.App.ErrorLog.Println("reservation import:", err)
+		}
+		m.App.Session.Put(r.Context(), "error", "Upload the file again, there is no import to confirm")
+		http.Redirect(w, r, "/admin/reservations/import", http.StatusSeeOther)
+		return
+	}
+
+	if len(accepted) == 0 {
+		m.App.Session.Put(r.Context(), "error", "There are no rows to import")
+		http.Redirect(w, r, "/admin/reservations/import", http.StatusSeeOther)
+		return
+	}
+
+	// the rows are checked again for conflicts in the import's transaction
+	ids, err := m.DB.ImportReservations(accepted)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Nothing was imported: "+err.Error())
+		http.Redirect(w, r, "/admin/reservations/import", http.StatusSeeOther)
+		return
+	}
+
+	for i, id := range ids {
+		m.audit(r, "import", "reservation", id, nil, accepted[i])
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Imported %d reservations", len(ids)))
+	http.Redirect(w, r, "/admin/reservations/all", http.StatusSeeOther)
+}
+
+// importPath is the file the accepted rows of a previewed import are kept in until they're committed
+func (m *Repository) importPath(token string) (string, error) {
+	if token == "" || token != filepath.Base(token) {
+		return "", os.ErrNotExist
+	}
+	return filepath.Join(m.App.UploadDir, "imports", token+".json"), nil
+}
+
+// saveImport keeps the accepted rows of a previewed import and returns the token naming them
+func (m *Repository) saveImport(rows []models.Reservation) (string, error) {
+	dir := filepath.Join(m.App.UploadDir, "imports")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	token, err := helpers.RandomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	content, err := json.Marshal(rows)
+	if err != nil {
+		return "", err
+	}
+
+	path, _ := m.importPath(token)
+	return token, os.WriteFile(path, content, 0o600)
+}
+
+// loadImport returns the rows saved under token and removes them, so an import can only be committed once
+func (m *Repository) loadImport(token string) ([]models.Reservation, error) {
+	path, err := m.importPath(token)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(path)
+
+	var rows []models.Reservation
+	if err := json.Unmarshal(content, &rows); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// discardImport removes the rows of a preview that was replaced before it was committed
+func (m *Repository) discardImport(token string) {
+	if path, err := m.importPath(token); err == nil {
+		os.Remove(path)
+	}
+}
+
+// maxStayNights is the longest stay guests can book themselves
+const maxStayNights = 30
+
+// weekendMinStayNights is the shortest stay guests arriving on a Friday or a Saturday can book themselves
+const weekendMinStayNights = 2
+
+// minStayNights is the shortest stay guests can book themselves for an arrival on date
+func minStayNights(date time.Time) int {
+	if date.Weekday() == time.Friday || date.Weekday() == time.Saturday {
+		return weekendMinStayNights
+	}
+	return 1
+}
+
+// stayRuleViolations lists the stay rules a booking from start to end breaks. Every way guests book
+// online checks them; staff can book past them by giving a reason
+func stayRuleViolations(start, end time.Time) []string {
+	var broken []string
+
+	today, _ := parseDate(time.Now().Format("2006-01-02"))
+	if start.Before(today) {
+		broken = append(broken, "the arrival is in the past")
+	}
+	if !end.After(start) {
+		broken = append(broken, "the departure isn't after the arrival")
+	} else if min := minStayNights(start); end.Sub(start) < time.Duration(min)*24*time.Hour {
+		broken = append(broken, fmt.Sprintf("arrivals on %s stay at least %d nights", start.Weekday(), min))
+	}
+	if end.Sub(start) > maxStayNights*24*time.Hour {
+		broken = append(broken, fmt.Sprintf("the stay is longer than %d nights", maxStayNights))
+	}
+
+	return broken
+}
+
+// renderNewReservation shows the staff reservation form
+func (m *Repository) renderNewReservation(w http.ResponseWriter, r *http.Request, res models.Reservation, form *forms.Form, broken []string) {
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	stringMap := make(map[string]string)
+	if !res.StartDate.IsZero() {
+		stringMap["start_date"] = res.StartDate.Format("2006-01-02")
+	}
+	if !res.EndDate.IsZero() {
+		stringMap["end_date"] = res.EndDate.Format("2006-01-02")
+	}
+
+	data := make(map[string]interface{})
+	data["reservation"] = res
+	data["rooms"] = rooms
+	data["sources"] = models.ReservationSources
+	data["broken"] = broken
+
+	render.Template(w, r, "admin-reservations-book.page.tmpl", &models.TemplateData{
+		Form:      form,
+		Data:      data,
+		StringMap: stringMap,
+	})
+}
+
+// AdminNewReservation shows the form staff use for phone and walk-in bookings
+func (m *Repository) AdminNewReservation(w http.ResponseWriter, r *http.Request) {
+	res := models.Reservation{Source: models.ReservationSources[0], Adults: 1}
+	res.RoomID, _ = strconv.Atoi(r.URL.Query().Get("room"))
+	res.StartDate, _ = parseDate(r.URL.Query().Get("start"))
+	res.EndDate, _ = parseDate(r.URL.Query().Get("end"))
+
+	m.renderNewReservation(w, r, res, forms.New(nil), nil)
+}
+
+// AdminPostNewReservation books a room on behalf of a guest. The room must be free, but staff may
+// break the stay rules if they say why
+func (m *Repository) AdminPostNewReservation(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/admin/reservations/book", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("first_name", "last_name", "phone", "room_id", "start_date", "end_date", "source")
+	form.MinLength("first_name", 3)
+
+	// walk-ins don't always leave an email, but a confirmation needs one
+	sendConfirmation := form.Has("send_confirmation")
+	if sendConfirmation || form.Has("email") {
+		form.IsEmail("email")
+	}
+
+	res := models.Reservation{
+		FirstName:      form.Get("first_name"),
+		LastName:       form.Get("last_name"),
+		Email:          strings.TrimSpace(form.Get("email")),
+		Phone:          form.Get("phone"),
+		Source:         form.Get("source"),
+		OverrideReason: strings.TrimSpace(form.Get("override_reason")),
+	}
+	res.RoomID, _ = strconv.Atoi(form.Get("room_id"))
+
+	if err := partyFromForm(r.PostForm, &res); err != nil {
+		form.Errors.Add("adults", err.Error())
+	}
+
+	known := false
+	for _, source := range models.ReservationSources {
+		if source == res.Source {
+			known = true
+		}
+	}
+	if !known && res.Source != "" {
+		form.Errors.Add("source", "Unknown source")
+	}
+
+	var broken []string
+	start, errStart := parseDate(form.Get("start_date"))
+	end, errEnd := parseDate(form.Get("end_date"))
+	res.StartDate, res.EndDate = start, end
+	switch {
+	case errStart != nil || errEnd != nil:
+		if form.Has("start_date") && form.Has("end_date") {
+			form.Errors.Add("start_date", "Use the yyyy-mm-dd format")
+		}
+	case !end.After(start):
+		form.Errors.Add("end_date", "Departure must be after arrival")
+	default:
+		broken = stayRuleViolations(start, end)
+	}
+
+	if len(broken) == 0 {
+		res.OverrideReason = ""
+	} else if res.OverrideReason == "" {
+		form.Errors.Add("override_reason", "Give a reason to book outside the stay rules")
+	}
+
+	if form.Valid() {
+		if _, err := m.fitParty(&res, nil); err != nil {
+			form.Errors.Add("adults", err.Error())
+		}
+	}
+
+	if !form.Valid() {
+		m.renderNewReservation(w, r, res, form, broken)
+		return
+	}
+
+	id, err := m.DB.CreateReservation(res)
+	if err != nil {
+		form.Errors.Add("room_id", err.Error())
+		m.renderNewReservation(w, r, res, form, broken)
+		return
+	}
+	res.ID = id
+
+	m.audit(r, "create", "reservation", id, nil, res)
+
+	if sendConfirmation {
+		m.App.MailChan <- confirmationMail(res)
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Reservation saved")
+	http.Redirect(w, r, fmt.Sprintf("/admin/reservations/all/%d/show", id), http.StatusSeeOther)
+}
+
+// roomAvailability is a room of the staff reservation form and whether it is free on the chosen dates
+type roomAvailability struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	Available bool   `json:"available"`
+}
+
+// availabilityResponse is the live availability shown on the staff reservation form
+type availabilityResponse struct {
+	OK      bool               `json:"ok"`
+	Message string             `json:"message"`
+	Rooms   []roomAvailability `json:"rooms"`
+	Broken  []string           `json:"broken"`
+}
+
+// AdminReservationAvailability tells the staff reservation form which rooms sleeping the guests are free
+// between start and end and which stay rules the dates break
+func (m *Repository) AdminReservationAvailability(w http.ResponseWriter, r *http.Request) {
+	resp := availabilityResponse{
+		Rooms:  []roomAvailability{},
+		Broken: []string{},
+	}
+
+	start, errStart := parseDate(r.URL.Query().Get("start"))
+	end, errEnd := parseDate(r.URL.Query().Get("end"))
+	guests, _ := strconv.Atoi(r.URL.Query().Get("guests"))
+
+	if errStart != nil || errEnd != nil || !end.After(start) {
+		resp.Message = "choose an arrival and a later departure"
+	} else if rooms, err := m.DB.AllRooms(); err != nil {
+		m.App.ErrorLog.Println(err)
+		resp.Message = "error querying database"
+	} else if free, err := m.DB.SearchAvailabilityForAllRooms(start, end, guests); err != nil {
+		m.App.ErrorLog.Println(err)
+		resp.Message = "error querying database"
+	} else {
+		resp.OK = true
+		if broken := stayRuleViolations(start, end); broken != nil {
+			resp.Broken = broken
+		}
+		for _, room := range rooms {
+			ra := roomAvailability{ID: room.ID, Name: room.RoomName}
+			for _, f := range free {
+				if f.ID == room.ID {
+					ra.Available = true
+				}
+			}
+			resp.Rooms = append(resp.Rooms, ra)
+		}
+	}
+
+	out, _ := json.MarshalIndent(resp, "", "    ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+// dayFromQuery reads the date of the daily admin pages, today when none or an invalid one is given
+func (m *Repository) dayFromQuery(r *http.Request) time.Time {
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	d := r.URL.Query().Get("date")
+	if d == "" {
+		return today
+	}
+
+	date, err := parseDate(d)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "warning", "Invalid date, showing today")
+		return today
+	}
+	return date
+}
+
+// AdminFrontDesk shows the arrivals, departures, stay-overs and vacant rooms of a date
+func (m *Repository) AdminFrontDesk(w http.ResponseWriter, r *http.Request) {
+	date := m.dayFromQuery(r)
+
+	day, err := m.DB.FrontDesk(date)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	// the units of every room type, to assign to the arrivals
+	units := make(map[int][]models.Room)
+	for _, room := range rooms {
+		units[room.RoomTypeID] = append(units[room.RoomTypeID], room)
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["date"] = date.Format("2006-01-02")
+	stringMap["prev"] = date.AddDate(0, 0, -1).Format("2006-01-02")
+	stringMap["next"] = date.AddDate(0, 0, 1).Format("2006-01-02")
+
+	data := make(map[string]interface{})
+	data["day"] = day
+	data["units"] = units
+
+	render.Template(w, r, "admin-front-desk.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+	})
+}
+
+// AdminFrontDeskArrivals shows a printable list of the arrivals of a date
+func (m *Repository) AdminFrontDeskArrivals(w http.ResponseWriter, r *http.Request) {
+	date := m.dayFromQuery(r)
+
+	day, err := m.DB.FrontDesk(date)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["date"] = date.Format("2006-01-02")
+
+	data := make(map[string]interface{})
+	data["arrivals"] = day.Arrivals
+
+	render.Template(w, r, "admin-front-desk-arrivals.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+	})
+}
+
+// AdminCheckIn marks a guest as arrived
+func (m *Repository) AdminCheckIn(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	redirect := "/admin/front-desk?date=" + url.QueryEscape(r.URL.Query().Get("date"))
+
+	if err := m.DB.CheckInReservation(id); errors.Is(err, repository.ErrBeforeArrival) {
+		m.App.Session.Put(r.Context(), "error", "The guest can't check in before the arrival date")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	} else if err != nil {
+		m.App.Session.Put(r.Context(), "error", "The reservation can't be checked in")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	m.audit(r, "check_in", "reservation", id, nil, nil)
+
+	m.App.Session.Put(r.Context(), "flash", "Checked in")
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// AdminAssignUnit puts a guest who booked a room type in the unit the front desk chose, for the whole stay
+func (m *Repository) AdminAssignUnit(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	if err := r.ParseForm(); err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	redirect := "/admin/front-desk?date=" + url.QueryEscape(r.Form.Get("date"))
+
+	roomID, err := strconv.Atoi(r.Form.Get("room_id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Choose the unit")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	before, err := m.DB.GetReseravtionByID(id)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't find the reservation")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	if err := m.DB.AssignUnit(id, roomID); err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't assign the unit: "+err.Error())
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	m.audit(r, "assign_unit", "reservation", id,
+		map[string]int{"room_id": before.RoomID}, map[string]int{"room_id": roomID})
+	m.NotifyWaitlist()
+	m.refreshHousekeeping()
+
+	m.App.Session.Put(r.Context(), "flash", "Unit assigned")
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// AdminCheckOut marks a guest as departed
+func (m *Repository) AdminCheckOut(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	redirect := "/admin/front-desk?date=" + url.QueryEscape(r.URL.Query().Get("date"))
+
+	if err := m.DB.CheckOutReservation(id); err != nil {
+		m.App.Session.Put(r.Context(), "error", "The reservation can't be checked out, is the guest checked in?")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	m.audit(r, "check_out", "reservation", id, nil, nil)
+
+	m.App.Session.Put(r.Context(), "flash", "Checked out")
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// AdminHousekeeping lists the rooms to make up on a date and the status of every room
+func (m *Repository) AdminHousekeeping(w http.ResponseWriter, r *http.Request) {
+	date := m.dayFromQuery(r)
+
+	tasks, err := m.DB.HousekeepingTasks(date)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["date"] = date.Format("2006-01-02")
+
+	data := make(map[string]interface{})
+	data["tasks"] = tasks
+	data["rooms"] = rooms
+	data["statuses"] = models.RoomStatuses
+
+	render.Template(w, r, "admin-housekeeping.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+	})
+}
+
+// AdminPostGenerateHousekeeping makes the housekeeping list of a day, the daily job only makes today's
+func (m *Repository) AdminPostGenerateHousekeeping(w http.ResponseWriter, r *http.Request) {
+	redirect := "/admin/housekeeping?date=" + url.QueryEscape(r.FormValue("date"))
+
+	date, err := parseDate(r.FormValue("date"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid date")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	n, err := m.DB.GenerateHousekeepingTasks(date)
+	if err != nil {
+		m.App.ErrorLog.Println("can't generate housekeeping tasks:", err)
+		m.App.Session.Put(r.Context(), "error", "Can't make the list, please try again")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%d rooms to make up", n))
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// refreshHousekeeping makes today's housekeeping list again after a stay changed. A failure is logged,
+// as the change is already done and the daily job makes the list anew
+func (m *Repository) refreshHousekeeping() {
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	if _, err := m.DB.GenerateHousekeepingTasks(today); err != nil {
+		m.App.ErrorLog.Println("can't refresh housekeeping tasks:", err)
+	}
+}
+
+// AdminCompleteHousekeepingTask marks a room as made up
+func (m *Repository) AdminCompleteHousekeepingTask(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	redirect := "/admin/housekeeping?date=" + url.QueryEscape(r.FormValue("date"))
+
+	err := m.DB.CompleteHousekeepingTask(id, m.App.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "The task is already done")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	m.audit(r, "complete", "housekeeping_task", id, nil, nil)
+
+	m.App.Session.Put(r.Context(), "flash", "Room done")
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// AdminSetRoomStatus changes the housekeeping status of a room
+func (m *Repository) AdminSetRoomStatus(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	redirect := "/admin/housekeeping?date=" + url.QueryEscape(r.FormValue("date"))
+
+	status := r.FormValue("status")
+	valid := false
+	for _, s := range models.RoomStatuses {
+		if s == status {
+			valid = true
+		}
+	}
+	if !valid {
+		m.App.Session.Put(r.Context(), "error", "Unknown room status")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	if err := m.DB.SetRoomStatus(id, status); err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't change the room status")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	m.audit(r, "set_status", "room", id, nil, map[string]string{"status": status})
+
+	m.App.Session.Put(r.Context(), "flash", "Room status changed")
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// maxWorkOrderUpload caps the photos uploaded with one work order form
+const maxWorkOrderUpload = 20 << 20
+
+// workOrderPhotoTypes are the accepted photo formats and the extension they are saved with
+var workOrderPhotoTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// workOrderFromForm validates a work order form and returns the work order it describes
+func workOrderFromForm(form *forms.Form) models.WorkOrder {
+	form.Required("room_id", "title", "priority")
+
+	w := models.WorkOrder{
+		Title:       strings.TrimSpace(form.Get("title")),
+		Description: strings.TrimSpace(form.Get("description")),
+		Priority:    form.Get("priority"),
+	}
+	w.RoomID, _ = strconv.Atoi(form.Get("room_id"))
+	w.AssigneeID, _ = strconv.Atoi(form.Get("assignee_id"))
+
+	known := false
+	for _, p := range models.WorkOrderPriorities {
+		if p == w.Priority {
+			known = true
+		}
+	}
+	if !known && w.Priority != "" {
+		form.Errors.Add("priority", "Unknown priority")
+	}
+
+	// the dates are optional, together they put the room out of order
+	sd, ed := form.Get("start_date"), form.Get("end_date")
+	if sd != "" || ed != "" {
+		start, errStart := parseDate(sd)
+		end, errEnd := parseDate(ed)
+		switch {
+		case errStart != nil:
+			form.Errors.Add("start_date", "Enter both dates, or neither")
+		case errEnd != nil:
+			form.Errors.Add("end_date", "Enter both dates, or neither")
+		case !end.After(start):
+			form.Errors.Add("end_date", "The end must be after the start")
+		default:
+			w.StartDate, w.EndDate = start, end
+		}
+	}
+
+	return w
+}
+
+// saveWorkOrderPhotos stores the photos uploaded with a work order form
+func (m *Repository) saveWorkOrderPhotos(r *http.Request, workOrderID int) error {
+	if r.MultipartForm == nil {
+		return nil
+	}
+
+	dir := filepath.Join(m.App.UploadDir, "work-orders")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	for _, header := range r.MultipartForm.File["photos"] {
+		if err := m.saveWorkOrderPhoto(dir, header, workOrderID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveWorkOrderPhoto stores one photo under a random name, refusing anything that isn't an image
+func (m *Repository) saveWorkOrderPhoto(dir string, header *multipart.FileHeader, workOrderID int) error {
+	in, err := header.Open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	sniff := make([]byte, 512)
+	n, _ := io.ReadFull(in, sniff)
+	ext, ok := workOrderPhotoTypes[http.DetectContentType(sniff[:n])]
+	if !ok {
+		return fmt.Errorf("%s is not a photo", header.Filename)
+	}
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	token, err := helpers.RandomToken(16)
+	if err != nil {
+		return err
+	}
+	name := token + ext
+
+	path := filepath.Join(dir, name)
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = m.DB.InsertWorkOrderPhoto(models.WorkOrderPhoto{
+			WorkOrderID:  workOrderID,
+			FileName:     name,
+			OriginalName: filepath.Base(header.Filename),
+		})
+	}
+
+	// a photo that isn't recorded would never be shown or cleaned up
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// renderWorkOrder shows the work order form, for a new work order when w.ID is 0
+func (m *Repository) renderWorkOrder(w http.ResponseWriter, r *http.Request, wo models.WorkOrder, form *forms.Form) {
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	users, err := m.DB.AllStaffUsers()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["work_order"] = wo
+	data["rooms"] = rooms
+	data["users"] = users
+	data["priorities"] = models.WorkOrderPriorities
+
+	render.Template(w, r, "admin-work-order.page.tmpl", &models.TemplateData{
+		Form: form,
+		Data: data,
+	})
+}
+
+// AdminWorkOrders lists the work orders, of one room if asked for
+func (m *Repository) AdminWorkOrders(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	roomID, _ := strconv.Atoi(q.Get("room"))
+
+	status := "open"
+	if q.Has("status") {
+		status = q.Get("status")
+	}
+
+	orders, err := m.DB.WorkOrders(roomID, status)
+	if err != nil {
+		helpers.ServerError(w, err)
 		return
 	}
 
-	res := models.Reservation{
-		RoomID:    roomID,
-		StartDate: StartDate,
-		EndDate:   EndDate,
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
 	}
 
-	res.Room.RoomName = room.RoomName
+	stringMap := make(map[string]string)
+	stringMap["room"] = q.Get("room")
+	stringMap["status"] = status
 
-	m.App.Session.Put(r.Context(), "reservation", res)
+	data := make(map[string]interface{})
+	data["work_orders"] = orders
+	data["rooms"] = rooms
 
-	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
+	render.Template(w, r, "admin-work-orders.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+	})
 }
 
-// parseDate parses date string using the specified layout  - move to helpers?
-func parseDate(dateStr string) (time.Time, error) {
-	// 01/02 03:04:05PM '06 -0700  go time format
-	layout := "2006-01-02" // string describes my date format yyyy-mm-dd
-	return time.Parse(layout, dateStr)
+// workOrderError is what staff are told when a work order can't be saved; anything but the room being taken
+// is logged for us
+func workOrderError(m *Repository, err error) string {
+	if errors.Is(err, repository.ErrRoomTaken) {
+		return "The room is booked or blocked on some of these dates, move those first"
+	}
+	m.App.ErrorLog.Println("work order:", err)
+	return "Can't save the work order, please try again"
 }
 
-// ShowLogin shows the login screen
-func (m *Repository) ShowLogin(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "login.page.tmpl", &models.TemplateData{
-		Form: forms.New(nil),
-	})
-}
+// AdminNewWorkOrder shows the form for a new work order
+func (m *Repository) AdminNewWorkOrder(w http.ResponseWriter, r *http.Request) {
+	wo := models.WorkOrder{Priority: "normal"}
+	wo.RoomID, _ = strconv.Atoi(r.URL.Query().Get("room"))
 
-// PostShowLogin handles logging the user in
-func (m *Repository) PostShowLogin(w http.ResponseWriter, r *http.Request) {
-	_ = m.App.Session.RenewToken(r.Context()) // prevents a session fixation attack
+	m.renderWorkOrder(w, r, wo, forms.New(nil))
+}
 
-	err := r.ParseForm()
-	if err != nil {
-		log.Println("can't parse form")
+// AdminPostNewWorkOrder creates a work order, putting the room out of order if it has dates
+func (m *Repository) AdminPostNewWorkOrder(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxWorkOrderUpload)
+	if err := r.ParseMultipartForm(maxWorkOrderUpload); err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't read the form, the photos may be too large")
+		http.Redirect(w, r, "/admin/work-orders/new", http.StatusSeeOther)
+		return
 	}
 
-	email := r.Form.Get("email")
-	password := r.Form.Get("password")
-
 	form := forms.New(r.PostForm)
-	form.Required("email", "password")
-	form.IsEmail("email")
-
+	wo := workOrderFromForm(form)
 	if !form.Valid() {
-		render.Template(w, r, "login.page.tmpl", &models.TemplateData{
-			Form: form,
-		})
+		m.renderWorkOrder(w, r, wo, form)
 		return
 	}
 
-	id, _, err := m.DB.Authenticate(email, password)
+	id, err := m.DB.InsertWorkOrder(wo)
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "Invalid login credentials")
-		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		form.Errors.Add("start_date", workOrderError(m, err))
+		m.renderWorkOrder(w, r, wo, form)
 		return
 	}
+	wo.ID = id
 
-	m.App.Session.Put(r.Context(), "user_id", id)
-	m.App.Session.Put(r.Context(), "flash", "Logged in successfully")
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	m.audit(r, "create", "work_order", id, nil, wo)
 
-	// http.Redirect(w, r, "/user/login", http.StatusSeeOther) // code 303
+	if err := m.saveWorkOrderPhotos(r, id); err != nil {
+		m.App.Session.Put(r.Context(), "warning", "The work order was saved, but not all photos: "+err.Error())
+	} else {
+		m.App.Session.Put(r.Context(), "flash", "Work order saved")
+	}
+	http.Redirect(w, r, fmt.Sprintf("/admin/work-orders/%d", id), http.StatusSeeOther)
 }
 
-// Logout logs a user out
-func (m *Repository) Logout(w http.ResponseWriter, r *http.Request) {
-	_ = m.App.Session.Destroy(r.Context())
-	_ = m.App.Session.RenewToken(r.Context())
+// AdminShowWorkOrder shows a work order for editing
+func (m *Repository) AdminShowWorkOrder(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
 
-	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+	wo, err := m.DB.GetWorkOrderByID(id)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't find the work order")
+		http.Redirect(w, r, "/admin/work-orders", http.StatusSeeOther)
+		return
+	}
 
+	m.renderWorkOrder(w, r, wo, forms.New(nil))
 }
 
-// AdminDashboard
-func (m *Repository) AdminDashboard(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "admin-dashboard.page.tmpl", &models.TemplateData{})
-}
+// AdminPostWorkOrder updates an open work order and adds any uploaded photos
+func (m *Repository) AdminPostWorkOrder(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	redirect := fmt.Sprintf("/admin/work-orders/%d", id)
 
-// AdminReservationsGrid shows all or new reservations in admin tool depends on src
-func (m *Repository) AdminReservationsGrid(w http.ResponseWriter, r *http.Request) {
-	exploded := strings.Split(r.RequestURI, "/")
-	src := exploded[3]
+	r.Body = http.MaxBytesReader(w, r.Body, maxWorkOrderUpload)
+	if err := r.ParseMultipartForm(maxWorkOrderUpload); err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't read the form, the photos may be too large")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
 
-	stringMap := make(map[string]string)
-	stringMap["src"] = src
+	before, err := m.DB.GetWorkOrderByID(id)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't find the work order")
+		http.Redirect(w, r, "/admin/work-orders", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	wo := workOrderFromForm(form)
+	wo.ID = id
+	// the room of a work order doesn't change, a ticket for another room is a new ticket
+	wo.RoomID = before.RoomID
+	wo.Room = before.Room
+	wo.Status = before.Status
+	wo.Photos = before.Photos
 
-	displaysAllReservations := 0
-	if src == "all" {
-		displaysAllReservations = 1
+	if !form.Valid() {
+		m.renderWorkOrder(w, r, wo, form)
+		return
 	}
 
-	reservations, err := m.DB.ReservationsForGrid(displaysAllReservations)
-	if err != nil {
-		helpers.ServerError(w, err)
+	if err := m.DB.UpdateWorkOrder(wo); err != nil {
+		form.Errors.Add("start_date", workOrderError(m, err))
+		m.renderWorkOrder(w, r, wo, form)
 		return
 	}
 
-	data := make(map[string]interface{})
-	data["reservations"] = reservations
+	m.audit(r, "update", "work_order", id, before, wo)
+	// the room may be out of order for fewer nights than before
+	m.NotifyWaitlist()
 
-	render.Template(w, r, "admin-reservations-grid.page.tmpl", &models.TemplateData{
-		StringMap: stringMap,
-		Data:      data,
-	})
+	if err := m.saveWorkOrderPhotos(r, id); err != nil {
+		m.App.Session.Put(r.Context(), "warning", "The work order was saved, but not all photos: "+err.Error())
+	} else {
+		m.App.Session.Put(r.Context(), "flash", "Work order saved")
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// AdminCloseWorkOrder closes a work order, which puts its room back in service
+func (m *Repository) AdminCloseWorkOrder(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	if err := m.DB.CloseWorkOrder(id); err != nil {
+		m.App.Session.Put(r.Context(), "error", "The work order is already closed")
+		http.Redirect(w, r, fmt.Sprintf("/admin/work-orders/%d", id), http.StatusSeeOther)
+		return
+	}
+
+	m.audit(r, "close", "work_order", id, nil, nil)
+	m.NotifyWaitlist()
+
+	m.App.Session.Put(r.Context(), "flash", "Work order closed, the room is back in service")
+	http.Redirect(w, r, "/admin/work-orders", http.StatusSeeOther)
+}
+
+// AdminWorkOrderPhoto sends a work order photo; photos are kept out of the public static files
+func (m *Repository) AdminWorkOrderPhoto(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "file")
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		http.NotFound(w, r)
+		return
+	}
+
+	http.ServeFile(w, r, filepath.Join(m.App.UploadDir, "work-orders", name))
 }
 
 // AdminShowReservation shows the reservation in the admin tool
@@ -596,8 +4147,24 @@ func (m *Repository) AdminShowReservation(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
 	data := make(map[string]interface{})
 	data["reservation"] = res
+	data["rooms"] = rooms
+
+	if res.GroupID > 0 {
+		group, err := m.DB.GroupReservations(res.GroupID)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		data["group"] = group
+	}
 
 	render.Template(w, r, "admin-reservations-show.page.tmpl", &models.TemplateData{
 		StringMap: stringMap,
@@ -632,6 +4199,8 @@ func (m *Repository) AdminPostShowReservation(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	before := res
+
 	res.FirstName = r.Form.Get("first_name")
 	res.LastName = r.Form.Get("last_name")
 	res.Email = r.Form.Get("email")
@@ -643,6 +4212,8 @@ func (m *Repository) AdminPostShowReservation(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	m.audit(r, "update", "reservation", id, before, res)
+
 	year := r.FormValue("y")
 	month := r.FormValue("m")
 	log.Println(year, month)
@@ -730,10 +4301,16 @@ func (m *Repository) AdminReservationsCalendar(w http.ResponseWriter, r *http.Re
 
 	data["rooms"] = rooms
 
+	// the dates of every stay on the calendar, to move them by dragging; split stays stay put
+	stays := make(map[int]models.RoomRestriction)
+	split := make(map[int]bool)
+
 	for _, x := range rooms {
 		// create maps
 		reservationMap := make(map[string]int)
 		blockMap := make(map[string]int)
+		maintenanceMap := make(map[string]int)
+		allotmentMap := make(map[string]int)
 
 		// iterate through dates
 		for d := firstOfMonth; !d.After(lastOfMonth); d = d.AddDate(0, 0, 1) {
@@ -752,9 +4329,26 @@ func (m *Repository) AdminReservationsCalendar(w http.ResponseWriter, r *http.Re
 		for _, y := range restrictions {
 			if y.ReservationID > 0 {
 				// it's a reservation
+				if stay, ok := stays[y.ReservationID]; ok && stay.ID != y.ID {
+					split[y.ReservationID] = true
+				}
+				stays[y.ReservationID] = y
 				for d := y.StartDate; !d.After(y.EndDate); d = d.AddDate(0, 0, 1) {
 					reservationMap[d.Format("2006-01-2")] = y.ReservationID
 				}
+			} else if y.RestrictionID == models.RestrictionAllotment {
+				// held for an allotment until a guest books it or it's released
+				for d := y.StartDate; d.Before(y.EndDate); d = d.AddDate(0, 0, 1) {
+					allotmentMap[d.Format("2006-01-2")] = y.AllotmentID
+				}
+			} else if y.RestrictionID == models.RestrictionHold {
+				// held for a guest booking online, released on its own
+				continue
+			} else if y.RestrictionID == models.RestrictionOutOfOrder {
+				// a work order keeps the room out of order, released by closing the work order
+				for d := y.StartDate; d.Before(y.EndDate); d = d.AddDate(0, 0, 1) {
+					maintenanceMap[d.Format("2006-01-2")] = y.ID
+				}
 			} else {
 				// it's a block
 				blockMap[y.StartDate.Format("2006-01-2")] = y.ID
@@ -762,10 +4356,14 @@ func (m *Repository) AdminReservationsCalendar(w http.ResponseWriter, r *http.Re
 		}
 		data[fmt.Sprintf("reservation_map_%d", x.ID)] = reservationMap
 		data[fmt.Sprintf("block_map_%d", x.ID)] = blockMap
+		data[fmt.Sprintf("maintenance_map_%d", x.ID)] = maintenanceMap
+		data[fmt.Sprintf("allotment_map_%d", x.ID)] = allotmentMap
 
 		// put blockMap to the session for every room
 		m.App.Session.Put(r.Context(), fmt.Sprintf("block_map_%d", x.ID), blockMap)
 	}
+	data["stays"] = stays
+	data["split"] = split
 
 	render.Template(w, r, "admin-reservations-calendar.page.tmpl", &models.TemplateData{
 		StringMap: stringMap,
@@ -774,6 +4372,153 @@ func (m *Repository) AdminReservationsCalendar(w http.ResponseWriter, r *http.Re
 	})
 }
 
+// AdminMoveReservation moves a reservation dropped on the calendar to another room and/or other dates
+func (m *Repository) AdminMoveReservation(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	if err := r.ParseForm(); err != nil {
+		sendJSONError(w, "can't parse form")
+		return
+	}
+
+	roomID, err := strconv.Atoi(r.Form.Get("room_id"))
+	if err != nil {
+		sendJSONError(w, "invalid room id")
+		return
+	}
+
+	start, err := parseDate(r.Form.Get("start_date"))
+	if err != nil {
+		sendJSONError(w, "invalid start date")
+		return
+	}
+
+	end, err := parseDate(r.Form.Get("end_date"))
+	if err != nil || !end.After(start) {
+		sendJSONError(w, "invalid end date")
+		return
+	}
+
+	before, err := m.DB.GetReseravtionByID(id)
+	if err != nil {
+		sendJSONError(w, "can't find the reservation")
+		return
+	}
+
+	room, err := m.DB.GetRoomByID(roomID)
+	if err != nil {
+		sendJSONError(w, "can't find the room")
+		return
+	}
+
+	if err := m.DB.MoveReservation(id, roomID, start, end); err != nil {
+		sendJSONError(w, err.Error())
+		return
+	}
+
+	after := before
+	after.RoomID = roomID
+	after.Room = room
+	after.StartDate = start
+	after.EndDate = end
+	m.audit(r, "move", "reservation", id, before, after)
+	m.NotifyWaitlist()
+	m.refreshHousekeeping()
+
+	if r.Form.Get("notify") != "" && after.Email != "" {
+		m.App.MailChan <- changeMail(after)
+	}
+
+	// the calendar reloads after a move and shows this
+	m.App.Session.Put(r.Context(), "flash", "Reservation moved")
+
+	resp := jsonResponse{
+		OK:        true,
+		RoomID:    strconv.Itoa(roomID),
+		StardDate: start.Format("2006-01-02"),
+		EndDate:   end.Format("2006-01-02"),
+	}
+
+	out, _ := json.MarshalIndent(resp, "", "    ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+// AdminSplitReservation moves the guest to another room from a night of the stay on, such as a room change
+// on the third day
+func (m *Repository) AdminSplitReservation(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	if err := r.ParseForm(); err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	src := r.Form.Get("src")
+	if src == "" {
+		src = "all"
+	}
+	redirect := fmt.Sprintf("/admin/reservations/%s/%d/show?y=%s&m=%s", src, id, r.Form.Get("y"), r.Form.Get("m"))
+
+	on, err := parseDate(r.Form.Get("date"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Choose the day of the room change")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	roomID, err := strconv.Atoi(r.Form.Get("room_id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Choose the room to move to")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	if err := m.DB.SplitReservation(id, on, roomID); err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't change rooms: "+err.Error())
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	m.audit(r, "split", "reservation", id, nil, map[string]interface{}{"room_id": roomID, "date": on.Format("2006-01-02")})
+	m.NotifyWaitlist()
+	m.refreshHousekeeping()
+
+	m.App.Session.Put(r.Context(), "flash", "Room changed")
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// AdminCancelGroup cancels every reservation of a booking group at once and goes back to the reservation
+// it was cancelled from
+func (m *Repository) AdminCancelGroup(w http.ResponseWriter, r *http.Request) {
+	groupID, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	if err := r.ParseForm(); err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	src := r.Form.Get("src")
+	if src == "" {
+		src = "all"
+	}
+	redirect := fmt.Sprintf("/admin/reservations/%s/%s/show?y=%s&m=%s",
+		src, r.Form.Get("reservation_id"), r.Form.Get("y"), r.Form.Get("m"))
+
+	if err := m.DB.CancelBookingGroup(groupID); err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't cancel the group: "+err.Error())
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	m.audit(r, "cancel", "booking_group", groupID, nil, nil)
+	m.NotifyWaitlist()
+	m.refreshHousekeeping()
+
+	m.App.Session.Put(r.Context(), "flash", "Group cancelled")
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
 // AdminProcessReservation marks reservation as processed
 func (m *Repository) AdminProcessReservation(w http.ResponseWriter, r *http.Request) {
 	// ! maybe rewrite later
@@ -785,11 +4530,57 @@ func (m *Repository) AdminProcessReservation(w http.ResponseWriter, r *http.Requ
 
 	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
 	src := chi.URLParam(r, "src")
-	err := m.DB.UpdateProcessedForReservation(id, 1)
+	before, err := m.DB.GetReseravtionByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.DB.UpdateProcessedForReservation(id, 1)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.audit(r, "process", "reservation", id,
+		map[string]int{"processed": before.Processed}, map[string]int{"processed": 1})
+
+	year := r.URL.Query().Get("y")
+	month := r.URL.Query().Get("m")
+
+	url := ""
+
+	if year != "" {
+		url = fmt.Sprintf("/admin/reservations/%s?y=%s&m=%s", src, year, month)
+	} else {
+		url = fmt.Sprintf("/admin/reservations/%s", src)
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Reservati0n marked as pr0cessed")
+	http.Redirect(w, r, url, http.StatusSeeOther)
+
+}
+
+// AdminProcessReservation delete reservation
+func (m *Repository) AdminDeleteReservation(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	src := chi.URLParam(r, "src")
+	before, err := m.DB.GetReseravtionByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.DB.DeleteReservation(id, m.App.Session.GetInt(r.Context(), "user_id"))
 	if err != nil {
 		helpers.ServerError(w, err)
+		return
 	}
 
+	m.audit(r, "delete", "reservation", id, before, nil)
+	m.NotifyWaitlist()
+	m.refreshHousekeeping()
+
 	year := r.URL.Query().Get("y")
 	month := r.URL.Query().Get("m")
 
@@ -801,33 +4592,72 @@ func (m *Repository) AdminProcessReservation(w http.ResponseWriter, r *http.Requ
 		url = fmt.Sprintf("/admin/reservations/%s", src)
 	}
 
-	m.App.Session.Put(r.Context(), "flash", "Reservati0n marked as pr0cessed")
-	http.Redirect(w, r, url, http.StatusSeeOther)
+	m.App.Session.Put(r.Context(), "flash", "Reservation moved to trash")
+	http.Redirect(w, r, url, http.StatusSeeOther)
+}
+
+// AdminReservationsTrash shows deleted reservations that can still be restored
+func (m *Repository) AdminReservationsTrash(w http.ResponseWriter, r *http.Request) {
+	reservations, err := m.DB.DeletedReservations()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	// the day each reservation will be purged for good
+	purgeOn := make(map[int]string)
+	for _, x := range reservations {
+		purgeOn[x.ID] = x.DeletedAt.AddDate(0, 0, m.App.RetentionDays).Format("2006-01-02")
+	}
+
+	intMap := make(map[string]int)
+	intMap["retention_days"] = m.App.RetentionDays
+
+	data := make(map[string]interface{})
+	data["reservations"] = reservations
+	data["purge_on"] = purgeOn
 
+	render.Template(w, r, "admin-reservations-trash.page.tmpl", &models.TemplateData{
+		IntMap: intMap,
+		Data:   data,
+	})
 }
 
-// AdminProcessReservation delete reservation
-func (m *Repository) AdminDeleteReservation(w http.ResponseWriter, r *http.Request) {
+// AdminRestoreReservation takes a reservation out of the trash if its room is still free
+func (m *Repository) AdminRestoreReservation(w http.ResponseWriter, r *http.Request) {
 	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
-	src := chi.URLParam(r, "src")
-	err := m.DB.DeleteReservation(id)
+
+	res, err := m.DB.GetDeletedReservationByID(id)
 	if err != nil {
-		helpers.ServerError(w, err)
+		m.App.Session.Put(r.Context(), "error", "Can't find this reservation in the trash")
+		http.Redirect(w, r, "/admin/reservations/trash", http.StatusSeeOther)
+		return
 	}
 
-	year := r.URL.Query().Get("y")
-	month := r.URL.Query().Get("m")
-
-	url := ""
+	if time.Since(res.DeletedAt) > time.Duration(m.App.RetentionDays)*24*time.Hour {
+		m.App.Session.Put(r.Context(), "error", "This reservation is past the retention period")
+		http.Redirect(w, r, "/admin/reservations/trash", http.StatusSeeOther)
+		return
+	}
 
-	if year != "" {
-		url = fmt.Sprintf("/admin/reservations/%s?y=%s&m=%s", src, year, month)
-	} else {
-		url = fmt.Sprintf("/admin/reservations/%s", src)
+	// every room of the stay is checked again as it is booked
+	err = m.DB.RestoreReservation(id)
+	if errors.Is(err, repository.ErrRoomTaken) {
+		m.App.Session.Put(r.Context(), "error", "The room is no longer available for these dates")
+		http.Redirect(w, r, "/admin/reservations/trash", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't restore reservation: "+err.Error())
+		http.Redirect(w, r, "/admin/reservations/trash", http.StatusSeeOther)
+		return
 	}
 
-	m.App.Session.Put(r.Context(), "flash", "Reservati0n deleted")
-	http.Redirect(w, r, url, http.StatusSeeOther)
+	m.audit(r, "restore", "reservation", id, nil, res)
+	m.refreshHousekeeping()
+
+	m.App.Session.Put(r.Context(), "flash", "Reservation restored")
+	http.Redirect(w, r, fmt.Sprintf("/admin/reservations/all/%d/show", id), http.StatusSeeOther)
 }
 
 // AdminPostReservationsCalendar handles post of reservation calendar
@@ -856,6 +4686,7 @@ func (m *Repository) AdminPostReservationsCalendar(w http.ResponseWriter, r *htt
 	}
 
 	form := forms.New(r.PostForm)
+	removed := false
 
 	for _, x := range rooms {
 		// get block map from the session. Loop through entire map, if we have an entry in the map
@@ -873,8 +4704,11 @@ func (m *Repository) AdminPostReservationsCalendar(w http.ResponseWriter, r *htt
 						err := m.DB.DeleteBlockByID(value)
 						if err != nil {
 							helpers.ServerError(w, err)
-							//return
+							return
 						}
+						m.audit(r, "remove_block", "room_restriction", value,
+							map[string]interface{}{"room_id": x.ID, "date": name}, nil)
+						removed = true
 					}
 				}
 			}
@@ -888,14 +4722,21 @@ func (m *Repository) AdminPostReservationsCalendar(w http.ResponseWriter, r *htt
 			roomID, _ := strconv.Atoi(exploded[2])
 			t, _ := time.Parse("2006-01-2", exploded[3])
 			// insert a new block
-			err := m.DB.InsertBlockForRoom(roomID, t)
+			blockID, err := m.DB.InsertBlockForRoom(roomID, t)
 			if err != nil {
 				helpers.ServerError(w, err)
-				//return
+				return
 			}
+			m.audit(r, "add_block", "room_restriction", blockID,
+				nil, map[string]interface{}{"room_id": roomID, "date": exploded[3]})
 		}
 	}
 
+	// the nights of removed blocks may be what guests on the waitlist wait for
+	if removed {
+		m.NotifyWaitlist()
+	}
+
 	m.App.Session.Put(r.Context(), "flash", "Changed saved")
 	http.Redirect(w, r, fmt.Sprintf("/admin/reservations/cal?y=%d&m=%d", year, month), http.StatusSeeOther)
 }
@@ -947,3 +4788,422 @@ func (m *Repository) AdminPostHashPassword(w http.ResponseWriter, r *http.Reques
 	json.NewEncoder(w).Encode(resp) // writes directly to http.ResponseWriter: No need for intermediate variables.
 
 }
+
+// allotmentFromForm reads the allotment form and the rooms ticked in it
+func allotmentFromForm(form *forms.Form) (models.Allotment, []int) {
+	form.Required("name", "start_date", "end_date", "release_date")
+
+	a := models.Allotment{Name: strings.TrimSpace(form.Get("name"))}
+
+	start, errStart := parseDate(form.Get("start_date"))
+	end, errEnd := parseDate(form.Get("end_date"))
+	release, errRelease := parseDate(form.Get("release_date"))
+	switch {
+	case errStart != nil:
+		form.Errors.Add("start_date", "Invalid date")
+	case errEnd != nil:
+		form.Errors.Add("end_date", "Invalid date")
+	case !end.After(start):
+		form.Errors.Add("end_date", "The end must be after the start")
+	case errRelease != nil:
+		form.Errors.Add("release_date", "Invalid date")
+	case release.After(start):
+		form.Errors.Add("release_date", "The rooms must be released by the start")
+	case !release.After(time.Now()):
+		form.Errors.Add("release_date", "The release date must be in the future")
+	}
+	a.StartDate, a.EndDate, a.ReleaseDate = start, end, release
+
+	var roomIDs []int
+	for _, v := range form.Values["room_id"] {
+		if id, err := strconv.Atoi(v); err == nil {
+			roomIDs = append(roomIDs, id)
+		}
+	}
+	if len(roomIDs) == 0 {
+		form.Errors.Add("room_id", "Choose the rooms to hold")
+	}
+
+	return a, roomIDs
+}
+
+// renderNewAllotment shows the form for a new allotment with the rooms ticked before
+func (m *Repository) renderNewAllotment(w http.ResponseWriter, r *http.Request, a models.Allotment, roomIDs []int, form *forms.Form) {
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	checked := make(map[int]bool)
+	for _, id := range roomIDs {
+		checked[id] = true
+	}
+
+	stringMap := make(map[string]string)
+	if !a.StartDate.IsZero() {
+		stringMap["start_date"] = a.StartDate.Format("2006-01-02")
+		stringMap["end_date"] = a.EndDate.Format("2006-01-02")
+	}
+	if !a.ReleaseDate.IsZero() {
+		stringMap["release_date"] = a.ReleaseDate.Format("2006-01-02")
+	}
+
+	data := make(map[string]interface{})
+	data["allotment"] = a
+	data["rooms"] = rooms
+	data["checked"] = checked
+
+	render.Template(w, r, "admin-allotment-new.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Form:      form,
+		Data:      data,
+	})
+}
+
+// AdminAllotments lists the allotments with how many of their rooms were booked
+func (m *Repository) AdminAllotments(w http.ResponseWriter, r *http.Request) {
+	allotments, err := m.DB.Allotments()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["allotments"] = allotments
+
+	render.Template(w, r, "admin-allotments.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminNewAllotment shows the form for a new allotment
+func (m *Repository) AdminNewAllotment(w http.ResponseWriter, r *http.Request) {
+	m.renderNewAllotment(w, r, models.Allotment{}, nil, forms.New(nil))
+}
+
+// AdminPostNewAllotment holds the rooms for a new allotment and gives it a booking code for the guests
+func (m *Repository) AdminPostNewAllotment(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	a, roomIDs := allotmentFromForm(form)
+	if !form.Valid() {
+		m.renderNewAllotment(w, r, a, roomIDs, form)
+		return
+	}
+
+	token, err := helpers.RandomToken(4)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	a.Code = strings.ToUpper(token)
+
+	id, err := m.DB.InsertAllotment(a, roomIDs)
+	if err != nil {
+		form.Errors.Add("room_id", err.Error())
+		m.renderNewAllotment(w, r, a, roomIDs, form)
+		return
+	}
+	a.ID = id
+	a.Rooms = len(roomIDs)
+
+	m.audit(r, "create", "allotment", id, nil, a)
+
+	m.App.Session.Put(r.Context(), "flash", "Allotment saved, the booking code is "+a.Code)
+	http.Redirect(w, r, fmt.Sprintf("/admin/allotments/%d", id), http.StatusSeeOther)
+}
+
+// AdminShowAllotment shows the pickup report of an allotment, to share with the organiser of the group
+func (m *Repository) AdminShowAllotment(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	a, err := m.DB.GetAllotmentByID(id)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't find the allotment")
+		http.Redirect(w, r, "/admin/allotments", http.StatusSeeOther)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["allotment"] = a
+
+	render.Template(w, r, "admin-allotment.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminRoomTypes lists the room types and their units, with forms to add either
+func (m *Repository) AdminRoomTypes(w http.ResponseWriter, r *http.Request) {
+	m.renderRoomTypes(w, r, forms.New(nil))
+}
+
+// renderRoomTypes shows the room types page with the errors of the form posted last
+func (m *Repository) renderRoomTypes(w http.ResponseWriter, r *http.Request, form *forms.Form) {
+	types, err := m.DB.AllRoomTypes()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	units := make(map[int][]models.Room)
+	for _, room := range rooms {
+		units[room.RoomTypeID] = append(units[room.RoomTypeID], room)
+	}
+
+	data := make(map[string]interface{})
+	data["room_types"] = types
+	data["units"] = units
+
+	render.Template(w, r, "admin-room-types.page.tmpl", &models.TemplateData{
+		Form: form,
+		Data: data,
+	})
+}
+
+// AdminPostRoomType adds a room type, which takes bookings once it has units
+func (m *Repository) AdminPostRoomType(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("type_name")
+	if !form.Valid() {
+		m.renderRoomTypes(w, r, form)
+		return
+	}
+
+	rt := models.RoomType{
+		TypeName:    strings.TrimSpace(form.Get("type_name")),
+		Description: strings.TrimSpace(form.Get("description")),
+	}
+
+	id, err := m.DB.InsertRoomType(rt)
+	if err != nil {
+		form.Errors.Add("type_name", err.Error())
+		m.renderRoomTypes(w, r, form)
+		return
+	}
+	rt.ID = id
+
+	m.audit(r, "create", "room_type", id, nil, rt)
+
+	m.App.Session.Put(r.Context(), "flash", "Room type added")
+	http.Redirect(w, r, "/admin/room-types", http.StatusSeeOther)
+}
+
+// AdminPostRoomTypeUnit adds a unit to a room type
+func (m *Repository) AdminPostRoomTypeUnit(w http.ResponseWriter, r *http.Request) {
+	typeID, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	if err := r.ParseForm(); err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	roomName := strings.TrimSpace(r.Form.Get("room_name"))
+	if roomName == "" {
+		m.App.Session.Put(r.Context(), "error", "Name the unit")
+		http.Redirect(w, r, "/admin/room-types", http.StatusSeeOther)
+		return
+	}
+
+	room := models.Room{RoomName: roomName, RoomTypeID: typeID, MaxOccupancy: 2, BaseOccupancy: 2}
+	roomRatesFromForm(r.Form, &room)
+
+	id, err := m.DB.InsertRoom(room)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't add the unit")
+		http.Redirect(w, r, "/admin/room-types", http.StatusSeeOther)
+		return
+	}
+	room.ID = id
+
+	m.audit(r, "create", "room", id, nil, room)
+
+	m.App.Session.Put(r.Context(), "flash", "Unit added")
+	http.Redirect(w, r, "/admin/room-types", http.StatusSeeOther)
+}
+
+// AdminPostRoom changes the name, rates and occupancy of a unit. Stays already booked keep the price they
+// were booked at
+func (m *Repository) AdminPostRoom(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	if err := r.ParseForm(); err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	before, err := m.DB.GetRoomByID(id)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't find the unit")
+		http.Redirect(w, r, "/admin/room-types", http.StatusSeeOther)
+		return
+	}
+
+	room := before
+	if name := strings.TrimSpace(r.Form.Get("room_name")); name != "" {
+		room.RoomName = name
+	}
+	roomRatesFromForm(r.Form, &room)
+
+	if err := m.DB.UpdateRoom(room); err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't save the unit")
+		http.Redirect(w, r, "/admin/room-types", http.StatusSeeOther)
+		return
+	}
+
+	m.audit(r, "update", "room", id, before, room)
+
+	m.App.Session.Put(r.Context(), "flash", "Unit saved")
+	http.Redirect(w, r, "/admin/room-types", http.StatusSeeOther)
+}
+
+// roomRatesFromForm reads the nightly rate, occupancy and extra guest rate of a unit from a form into room,
+// the rates in whole units of money. A field left blank keeps what room has
+func roomRatesFromForm(form url.Values, room *models.Room) {
+	if n, err := strconv.Atoi(form.Get("nightly_rate")); err == nil && n >= 0 {
+		room.NightlyRate = n * 100
+	}
+	if n, err := strconv.Atoi(form.Get("max_occupancy")); err == nil && n > 0 {
+		room.MaxOccupancy = n
+	}
+	if n, err := strconv.Atoi(form.Get("base_occupancy")); err == nil && n > 0 {
+		room.BaseOccupancy = n
+	}
+	room.BaseOccupancy = min(room.BaseOccupancy, room.MaxOccupancy)
+	if n, err := strconv.Atoi(form.Get("extra_person_rate")); err == nil && n >= 0 {
+		room.ExtraPersonRate = n * 100
+	}
+}
+
+// AdminAmenities shows the amenity catalogue and which rooms have which amenities
+func (m *Repository) AdminAmenities(w http.ResponseWriter, r *http.Request) {
+	m.renderAmenities(w, r, forms.New(nil))
+}
+
+// renderAmenities shows the amenities page with the errors of the form posted last
+func (m *Repository) renderAmenities(w http.ResponseWriter, r *http.Request, form *forms.Form) {
+	amenities, err := m.DB.AllAmenities()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	rooms, err := m.DB.AllRooms()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	byRoom, err := m.DB.AmenitiesByRoom()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	// the amenities of every room keyed by room and amenity id, to tick the boxes
+	has := make(map[int]map[int]bool)
+	for _, room := range rooms {
+		has[room.ID] = make(map[int]bool)
+		for _, a := range byRoom[room.ID] {
+			has[room.ID][a.ID] = true
+		}
+	}
+
+	data := make(map[string]interface{})
+	data["amenities"] = amenities
+	data["categories"] = models.AmenityCategories
+	data["rooms"] = rooms
+	data["has"] = has
+
+	render.Template(w, r, "admin-amenities.page.tmpl", &models.TemplateData{
+		Form: form,
+		Data: data,
+	})
+}
+
+// AdminPostAmenity adds an amenity to the catalogue
+func (m *Repository) AdminPostAmenity(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("name", "category")
+
+	a := models.Amenity{
+		Name:     strings.TrimSpace(form.Get("name")),
+		Category: form.Get("category"),
+	}
+
+	known := false
+	for _, category := range models.AmenityCategories {
+		if category == a.Category {
+			known = true
+		}
+	}
+	if !known && a.Category != "" {
+		form.Errors.Add("category", "Unknown category")
+	}
+
+	if !form.Valid() {
+		m.renderAmenities(w, r, form)
+		return
+	}
+
+	id, err := m.DB.InsertAmenity(a)
+	if err != nil {
+		form.Errors.Add("name", err.Error())
+		m.renderAmenities(w, r, form)
+		return
+	}
+	a.ID = id
+
+	m.audit(r, "create", "amenity", id, nil, a)
+
+	m.App.Session.Put(r.Context(), "flash", "Amenity added")
+	http.Redirect(w, r, "/admin/amenities", http.StatusSeeOther)
+}
+
+// AdminPostRoomAmenities sets the amenities of a room to those ticked
+func (m *Repository) AdminPostRoomAmenities(w http.ResponseWriter, r *http.Request) {
+	roomID, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	if err := r.ParseForm(); err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	byRoom, err := m.DB.AmenitiesByRoom()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	amenityIDs := amenitiesFromForm(r.PostForm)
+	if err := m.DB.SetRoomAmenities(roomID, amenityIDs); err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't set the amenities of the room")
+		http.Redirect(w, r, "/admin/amenities", http.StatusSeeOther)
+		return
+	}
+
+	m.audit(r, "update", "room_amenities", roomID, byRoom[roomID], amenityIDs)
+
+	m.App.Session.Put(r.Context(), "flash", "Amenities saved")
+	http.Redirect(w, r, "/admin/amenities", http.StatusSeeOther)
+}
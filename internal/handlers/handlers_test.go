@@ -1,19 +1,26 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/kons77/room-bookings-app/internal/driver"
+	"github.com/kons77/room-bookings-app/internal/helpers"
 	"github.com/kons77/room-bookings-app/internal/models"
 )
 
@@ -29,16 +36,56 @@ var testGET = []struct {
 	{"gq", "/generals-quarters", "GET", http.StatusOK},
 	{"ms", "/majors-suite", "GET", http.StatusOK},
 	{"sa", "/search-availability", "GET", http.StatusOK},
+	{"flexible search", "/flexible-search", "GET", http.StatusOK},
+	{"waitlist", "/waitlist?start=2050-01-01&end=2050-01-02&adults=2", "GET", http.StatusOK},
 	{"contact", "/contact", "GET", http.StatusOK},
 	{"non-existent", "/green/eggs/and/ham", "GET", http.StatusNotFound},
 	// new routes
 	{"login", "/user/login", "GET", http.StatusOK},
 	{"logout", "/user/login", "GET", http.StatusOK},
 	{"dashboard", "/admin/dashboard", "GET", http.StatusOK},
+	{"front desk", "/admin/front-desk", "GET", http.StatusOK},
+	{"front desk date", "/admin/front-desk?date=2025-03-01", "GET", http.StatusOK},
+	{"front desk invalid date", "/admin/front-desk?date=tomorrow", "GET", http.StatusOK},
+	{"front desk error", "/admin/front-desk?date=2060-01-01", "GET", http.StatusInternalServerError},
+	{"arrivals list", "/admin/front-desk/arrivals?date=2025-03-01", "GET", http.StatusOK},
+	{"housekeeping", "/admin/housekeeping", "GET", http.StatusOK},
+	{"housekeeping error", "/admin/housekeeping?date=2060-01-01", "GET", http.StatusInternalServerError},
+	{"book a room", "/admin/reservations/book", "GET", http.StatusOK},
+	{"book a room prefilled", "/admin/reservations/book?room=1&start=2040-01-01&end=2040-01-03", "GET", http.StatusOK},
+	{"work orders", "/admin/work-orders", "GET", http.StatusOK},
+	{"work orders of room", "/admin/work-orders?room=1&status=", "GET", http.StatusOK},
+	{"work orders error", "/admin/work-orders?room=3", "GET", http.StatusInternalServerError},
+	{"new work order", "/admin/work-orders/new?room=1", "GET", http.StatusOK},
+	{"show work order", "/admin/work-orders/1", "GET", http.StatusOK},
+	{"show closed work order", "/admin/work-orders/2", "GET", http.StatusOK},
+	{"missing work order", "/admin/work-orders/5", "GET", http.StatusOK},
+	{"missing photo", "/admin/work-orders/photos/none.jpg", "GET", http.StatusNotFound},
+	{"room types", "/admin/room-types", "GET", http.StatusOK},
+	{"amenities", "/admin/amenities", "GET", http.StatusOK},
+	{"allotments", "/admin/allotments", "GET", http.StatusOK},
+	{"new allotment", "/admin/allotments/new", "GET", http.StatusOK},
+	{"pickup report", "/admin/allotments/1", "GET", http.StatusOK},
+	{"missing allotment", "/admin/allotments/5", "GET", http.StatusOK},
+	{"group booking", "/group-booking", "GET", http.StatusOK},
+	{"dashboard period", "/admin/dashboard?from=2025-01-01&to=2025-01-31&room=1", "GET", http.StatusOK},
+	{"dashboard invalid period", "/admin/dashboard?from=2025-02-01&to=2025-01-01", "GET", http.StatusOK},
+	{"dashboard report error", "/admin/dashboard?room=3", "GET", http.StatusInternalServerError},
 	{"new res", "/admin/reservations/new", "GET", http.StatusOK},
 	{"all res", "/admin/reservations/all", "GET", http.StatusOK},
+	{"import res", "/admin/reservations/import", "GET", http.StatusOK},
+	{"filtered res", "/admin/reservations/all?q=smith&room=1&from=2050-01-01&to=2050-01-31&sort=room&dir=desc&page=2", "GET", http.StatusOK},
 	{"cal", "/admin/reservations/cal", "GET", http.StatusOK},
 	{"show res", "/admin/reservations/new/1/show", "GET", http.StatusOK},
+	{"show group res", "/admin/reservations/all/6/show", "GET", http.StatusOK},
+	{"guest register", "/guest/register", "GET", http.StatusOK},
+	{"guest login", "/guest/login", "GET", http.StatusOK},
+	{"my reservations", "/my-reservations", "GET", http.StatusOK},
+	{"audit log", "/admin/audit", "GET", http.StatusOK},
+	{"filtered audit log", "/admin/audit?user_id=1&entity=reservation&from=2025-01-01&to=2025-12-31", "GET", http.StatusOK},
+	{"audit log with invalid date", "/admin/audit?from=yesterday", "GET", http.StatusOK},
+	{"audit log query fails", "/admin/audit?entity=fail", "GET", http.StatusInternalServerError},
+	{"trash", "/admin/reservations/trash", "GET", http.StatusOK},
 }
 
 // TestHandlers runs table-driven tests for all GET handlers
@@ -137,6 +184,9 @@ func TestRepository_Reservation(t *testing.T) {
 
 // TestRepository_PostReservation tests the PostReservation handler
 func TestRepository_PostReservation(t *testing.T) {
+	listened := app.MailChan
+	app.MailChan = make(chan models.MailData, 2)
+	defer func() { app.MailChan = listened }()
 
 	testPostReservation := []struct {
 		name           string //test name
@@ -145,6 +195,7 @@ func TestRepository_PostReservation(t *testing.T) {
 		resInSession   bool
 		expectedStatus int
 		errMessage     string
+		booked         bool
 	}{
 		{
 			name: "everytnig is ok",
@@ -167,6 +218,7 @@ func TestRepository_PostReservation(t *testing.T) {
 			expectedStatus: http.StatusSeeOther,
 			errMessage:     "PostReservation handler returned wrong response code when everything must be ok: ",
 			resInSession:   true,
+			booked:         true,
 		},
 		{
 			name: "missing post body",
@@ -202,6 +254,49 @@ func TestRepository_PostReservation(t *testing.T) {
 			errMessage:     "PostReservation handler returned wrong response code: ",
 			resInSession:   false,
 		},
+		{
+			name: "the room doesn't sleep the party",
+			postedData: url.Values{
+				"first_name": {"John"},
+				"last_name":  {"Joe"},
+				"email":      {"jo@jo.com"},
+				"phone":      {"555-555-5555"},
+				"adults":     {"2"},
+				"children":   {"2"},
+			},
+			resrv: models.Reservation{
+				RoomID: 1,
+				Room: models.Room{
+					ID:       1,
+					RoomName: "General's Quarters",
+				},
+			},
+			expectedStatus: http.StatusOK,
+			errMessage:     "PostReservation handler returned wrong response code for a party the room doesn't sleep: ",
+			resInSession:   true,
+		},
+		{
+			name: "arrival in the past",
+			postedData: url.Values{
+				"start":      {"2020-01-01"},
+				"end":        {"2020-01-02"},
+				"first_name": {"John"},
+				"last_name":  {"Joe"},
+				"email":      {"jo@jo.com"},
+				"phone":      {"555-555-5555"},
+				"room_id":    {"1"},
+			},
+			resrv: models.Reservation{
+				RoomID: 1,
+				Room: models.Room{
+					ID:       1,
+					RoomName: "General's Quarters",
+				},
+			},
+			expectedStatus: http.StatusSeeOther,
+			errMessage:     "PostReservation handler returned wrong response code for an arrival in the past: ",
+			resInSession:   true,
+		},
 		{
 			name: "failure to insert reservation into db",
 			postedData: url.Values{
@@ -224,6 +319,51 @@ func TestRepository_PostReservation(t *testing.T) {
 			errMessage:     "PostReservation handler returned wrong response code: ",
 			resInSession:   true,
 		},
+		{
+			name: "split stay",
+			postedData: url.Values{
+				"start":      {"2040-01-01"},
+				"end":        {"2040-01-03"},
+				"first_name": {"John"},
+				"last_name":  {"Joe"},
+				"email":      {"jo@jo.com"},
+				"phone":      {"555-555-5555"},
+				"room_id":    {"1"},
+			},
+			resrv: models.Reservation{
+				RoomID: 1,
+				Segments: []models.StaySegment{
+					{RoomID: 1, StartDate: time.Date(2040, 1, 1, 0, 0, 0, 0, time.UTC), EndDate: time.Date(2040, 1, 2, 0, 0, 0, 0, time.UTC)},
+					{RoomID: 2, StartDate: time.Date(2040, 1, 2, 0, 0, 0, 0, time.UTC), EndDate: time.Date(2040, 1, 3, 0, 0, 0, 0, time.UTC)},
+				},
+			},
+			expectedStatus: http.StatusSeeOther,
+			errMessage:     "PostReservation handler returned wrong response code for a split stay: ",
+			resInSession:   true,
+			booked:         true,
+		},
+		{
+			name: "failure to insert the second room of a split stay",
+			postedData: url.Values{
+				"start":      {"2040-01-01"},
+				"end":        {"2040-01-03"},
+				"first_name": {"John"},
+				"last_name":  {"Joe"},
+				"email":      {"jo@jo.com"},
+				"phone":      {"555-555-5555"},
+				"room_id":    {"1"},
+			},
+			resrv: models.Reservation{
+				RoomID: 1,
+				Segments: []models.StaySegment{
+					{RoomID: 1, StartDate: time.Date(2040, 1, 1, 0, 0, 0, 0, time.UTC), EndDate: time.Date(2040, 1, 2, 0, 0, 0, 0, time.UTC)},
+					{RoomID: 1000, StartDate: time.Date(2040, 1, 2, 0, 0, 0, 0, time.UTC), EndDate: time.Date(2040, 1, 3, 0, 0, 0, 0, time.UTC)},
+				},
+			},
+			expectedStatus: http.StatusTemporaryRedirect,
+			errMessage:     "PostReservation handler returned wrong response code: ",
+			resInSession:   true,
+		},
 		{
 			name: "failure to insert  room restrictions into db",
 			postedData: url.Values{
@@ -276,6 +416,18 @@ func TestRepository_PostReservation(t *testing.T) {
 			if rr.Code != e.expectedStatus {
 				t.Errorf(e.errMessage+"got %d, wanted  %d", rr.Code, e.expectedStatus)
 			}
+
+			// a reservation that failed to save, even partly, is neither kept nor confirmed
+			res, _ := session.Get(ctx, "reservation").(models.Reservation)
+			if booked := res.ID > 0; booked != e.booked {
+				t.Errorf("failed %s: expected booked to be %t", e.name, e.booked)
+			}
+			if mailed := len(app.MailChan) > 0; mailed != e.booked {
+				t.Errorf("failed %s: expected confirmation sent to be %t", e.name, e.booked)
+			}
+			for len(app.MailChan) > 0 {
+				<-app.MailChan
+			}
 		})
 	}
 }
@@ -287,6 +439,7 @@ func TestRepository_PostAvailability(t *testing.T) {
 		postedData     url.Values // req body
 		expectedStatus int
 		errMessage     string
+		expectedInBody string
 	}{
 		{
 			name: "room is available",
@@ -315,6 +468,96 @@ func TestRepository_PostAvailability(t *testing.T) {
 			expectedStatus: http.StatusTemporaryRedirect,
 			errMessage:     "Post availability when database query fails gave wrong status code: ",
 		},
+		{
+			name: "only a split stay is available",
+			postedData: url.Values{
+				"start": {"2050-01-01"},
+				"end":   {"2050-01-06"},
+			},
+			expectedStatus: http.StatusOK,
+			errMessage:     "Post availability when two rooms together cover the stay gave wrong status code: ",
+		},
+		{
+			name: "a room sleeps the party",
+			postedData: url.Values{
+				"start":    {"2040-01-01"},
+				"end":      {"2040-01-02"},
+				"adults":   {"2"},
+				"children": {"1"},
+			},
+			expectedStatus: http.StatusOK,
+			errMessage:     "Post availability when a room sleeps the party gave wrong status code: ",
+		},
+		{
+			name: "the party spreads over several rooms",
+			postedData: url.Values{
+				"start":  {"2040-01-01"},
+				"end":    {"2040-01-02"},
+				"adults": {"6"},
+			},
+			expectedStatus: http.StatusOK,
+			errMessage:     "Post availability when only several rooms together sleep the party gave wrong status code: ",
+		},
+		{
+			name: "no rooms sleep the party",
+			postedData: url.Values{
+				"start":    {"2040-01-01"},
+				"end":      {"2040-01-02"},
+				"adults":   {"5"},
+				"children": {"2"},
+			},
+			expectedStatus: http.StatusSeeOther,
+			errMessage:     "Post availability when no rooms sleep the party gave wrong status code: ",
+		},
+		{
+			name: "a room has the amenities",
+			postedData: url.Values{
+				"start":   {"2040-01-01"},
+				"end":     {"2040-01-02"},
+				"amenity": {"1", "2"},
+			},
+			expectedStatus: http.StatusOK,
+			errMessage:     "Post availability when a room has the amenities gave wrong status code: ",
+		},
+		{
+			name: "no room has the amenities",
+			postedData: url.Values{
+				"start":   {"2040-01-01"},
+				"end":     {"2040-01-02"},
+				"amenity": {"1", "4"},
+			},
+			expectedStatus: http.StatusSeeOther,
+			errMessage:     "Post availability when no room has the amenities gave wrong status code: ",
+		},
+		{
+			name: "no adult",
+			postedData: url.Values{
+				"start":    {"2040-01-01"},
+				"end":      {"2040-01-02"},
+				"adults":   {"0"},
+				"children": {"2"},
+			},
+			expectedStatus: http.StatusSeeOther,
+			errMessage:     "Post availability without an adult gave wrong status code: ",
+		},
+		{
+			name: "stay too long",
+			postedData: url.Values{
+				"start": {"2040-01-01"},
+				"end":   {"2040-03-01"},
+			},
+			expectedStatus: http.StatusSeeOther,
+			errMessage:     "Post availability for a stay longer than the stay rules allow gave wrong status code: ",
+		},
+		{
+			name: "arrival in the past",
+			postedData: url.Values{
+				"start": {"2020-01-01"},
+				"end":   {"2020-01-02"},
+			},
+			expectedStatus: http.StatusSeeOther,
+			errMessage:     "Post availability for an arrival in the past gave wrong status code: ",
+		},
 		{
 			name: "invalid start date",
 			postedData: url.Values{
@@ -339,6 +582,45 @@ func TestRepository_PostAvailability(t *testing.T) {
 			expectedStatus: http.StatusTemporaryRedirect,
 			errMessage:     "Post availability with empty request body (nil) gave wrong status code:  ",
 		},
+		{
+			name: "the stay has no nights",
+			postedData: url.Values{
+				"start": {"2040-01-01"},
+				"end":   {"2040-01-01"},
+			},
+			expectedStatus: http.StatusSeeOther,
+			errMessage:     "Post availability for a stay of no nights gave wrong status code: ",
+		},
+		{
+			name: "only nearby dates are available",
+			postedData: url.Values{
+				"start": {"2055-01-01"},
+				"end":   {"2055-01-03"},
+			},
+			expectedStatus: http.StatusOK,
+			errMessage:     "Post availability when the stay is free on other dates gave wrong status code: ",
+			expectedInBody: "/book-room?id=1&s=2055-01-04&e=2055-01-06",
+		},
+		{
+			name: "part of the stay is available",
+			postedData: url.Values{
+				"start": {"2055-01-01"},
+				"end":   {"2055-01-03"},
+			},
+			expectedStatus: http.StatusOK,
+			errMessage:     "Post availability when part of the stay is free gave wrong status code: ",
+			expectedInBody: "/book-room?id=1&s=2055-01-01&e=2055-01-02",
+		},
+		{
+			name: "nearby dates don't sleep the party",
+			postedData: url.Values{
+				"start":  {"2055-01-01"},
+				"end":    {"2055-01-03"},
+				"adults": {"3"},
+			},
+			expectedStatus: http.StatusSeeOther,
+			errMessage:     "Post availability when no other dates sleep the party gave wrong status code: ",
+		},
 	}
 
 	// Iterate through test cases
@@ -370,6 +652,10 @@ func TestRepository_PostAvailability(t *testing.T) {
 		if rr.Code != e.expectedStatus {
 			t.Errorf(e.errMessage+"got %d, wanted  %d", rr.Code, e.expectedStatus)
 		}
+
+		if e.expectedInBody != "" && !strings.Contains(rr.Body.String(), e.expectedInBody) {
+			t.Errorf("%s: expected %s in the page", e.name, e.expectedInBody)
+		}
 	}
 }
 
@@ -392,11 +678,68 @@ func TestRepository_AvailabilityJSON(t *testing.T) {
 			jsonMessage: "",
 			errMessage:  "got no availability when some was expected in AvailabilityJSON",
 		},
+		{
+			name: "the room has the amenities",
+			postedData: url.Values{
+				"start":   {"2040-01-01"},
+				"end":     {"2040-01-02"},
+				"room_id": {"2"},
+				"amenity": {"4"},
+			},
+			jsonOK:      true,
+			jsonMessage: "",
+			errMessage:  "got no availability for a room with the amenities in AvailabilityJSON",
+		},
+		{
+			name: "the room lacks the amenities",
+			postedData: url.Values{
+				"start":   {"2040-01-01"},
+				"end":     {"2040-01-02"},
+				"room_id": {"1"},
+				"amenity": {"4"},
+			},
+			jsonOK:      false,
+			jsonMessage: "The room doesn't have all the amenities asked for",
+			errMessage:  "got availability for a room without the amenities in AvailabilityJSON",
+		},
+		{
+			name: "the stay is too long",
+			postedData: url.Values{
+				"start":   {"2040-01-01"},
+				"end":     {"2040-03-01"},
+				"room_id": {"1"},
+			},
+			jsonOK:      false,
+			jsonMessage: "Can't book: the stay is longer than 30 nights",
+			errMessage:  "got availability for a stay over the stay rules in AvailabilityJSON",
+		},
+		{
+			name: "departure before arrival",
+			postedData: url.Values{
+				"start":   {"2040-01-03"},
+				"end":     {"2040-01-01"},
+				"room_id": {"1"},
+			},
+			jsonOK:      false,
+			jsonMessage: "Can't book: the departure isn't after the arrival",
+			errMessage:  "got availability for a departure before the arrival in AvailabilityJSON",
+		},
+		{
+			name: "a weekend stay under the minimum",
+			postedData: url.Values{
+				"start":   {"2040-01-06"},
+				"end":     {"2040-01-07"},
+				"room_id": {"1"},
+			},
+			jsonOK:      false,
+			jsonMessage: "Can't book: arrivals on Friday stay at least 2 nights",
+			errMessage:  "got availability for a stay under the minimum in AvailabilityJSON",
+		},
 		{
 			name: "rooms are NOT available",
 			postedData: url.Values{
 				"start":   {"2050-01-01"},
-				"end":     {"2050-01-02"},
+				"end":     {"2050-01-03"},
 				"room_id": {"1"},
 			},
 			jsonOK:      false,
@@ -505,6 +848,7 @@ func TestRepository_ChooseRoom(t *testing.T) {
 		resrv          models.Reservation
 		resInSession   bool
 		urlParam       string
+		location       string
 	}{
 		{
 			name:           "There's a reservation IN the session",
@@ -527,6 +871,13 @@ func TestRepository_ChooseRoom(t *testing.T) {
 			resInSession:   false,
 			urlParam:       "/choose-room/1",
 		},
+		{
+			name:           "Room type without units",
+			expectedStatus: http.StatusSeeOther,
+			errMessage:     "room type without units: ",
+			resInSession:   true,
+			urlParam:       "/choose-room/3",
+		},
 		{
 			name:           "Wrong URL parameter",
 			expectedStatus: http.StatusTemporaryRedirect,
@@ -541,12 +892,36 @@ func TestRepository_ChooseRoom(t *testing.T) {
 			resInSession: true,
 			urlParam:     "/choose-room/hello",
 		},
+		{
+			name:           "Dates of a flexible search",
+			expectedStatus: http.StatusSeeOther,
+			errMessage:     "dates of a flexible search: ",
+			resInSession:   true,
+			urlParam:       "/choose-room/1?s=2040-03-10&e=2040-03-12",
+			location:       "/make-reservation",
+		},
+		{
+			name:           "Flexible dates in the past",
+			expectedStatus: http.StatusSeeOther,
+			errMessage:     "flexible dates in the past: ",
+			resInSession:   true,
+			urlParam:       "/choose-room/1?s=2020-03-10&e=2020-03-12",
+			location:       "/flexible-search",
+		},
+		{
+			name:           "Invalid flexible dates",
+			expectedStatus: http.StatusSeeOther,
+			errMessage:     "invalid flexible dates: ",
+			resInSession:   true,
+			urlParam:       "/choose-room/1?s=2040-03-10&e=march",
+			location:       "/flexible-search",
+		},
 	}
 
 	for _, tc := range testChooseRoom {
 		t.Run(tc.name, func(t *testing.T) {
 			// create new request
-			req, _ := http.NewRequest("GET", "/choose-room/1", nil)
+			req, _ := http.NewRequest("GET", tc.urlParam, nil)
 
 			// get context with session
 			ctx := getCtx(req)
@@ -572,6 +947,20 @@ func TestRepository_ChooseRoom(t *testing.T) {
 			if rr.Code != tc.expectedStatus {
 				t.Errorf(tc.errMessage+"got %d, wanted  %d", rr.Code, tc.expectedStatus)
 			}
+
+			if tc.location != "" {
+				actualLoc, _ := rr.Result().Location()
+				if actualLoc.String() != tc.location {
+					t.Errorf(tc.errMessage+"got location %s, wanted %s", actualLoc.String(), tc.location)
+				}
+			}
+
+			if tc.location == "/make-reservation" {
+				res, _ := session.Get(ctx, "reservation").(models.Reservation)
+				if res.StartDate.Format("2006-01-02") != "2040-03-10" || res.EndDate.Format("2006-01-02") != "2040-03-12" {
+					t.Errorf(tc.errMessage+"expected the stay picked, got %s to %s", res.StartDate, res.EndDate)
+				}
+			}
 		})
 	}
 }
@@ -606,6 +995,20 @@ func TestRepository_BookRoom(t *testing.T) {
 			resInSession:   false,
 			urlParam:       "/book-room/?s=2040-01-01&e=2040-01-02&id=4",
 		},
+		{
+			name:           "arrival in the past",
+			expectedStatus: http.StatusSeeOther,
+			errMessage:     "BookRoom handler for an arrival in the past returned wrong response code: ",
+			resInSession:   false,
+			urlParam:       "/book-room/?s=2020-01-01&e=2020-01-02&id=1",
+		},
+		{
+			name:           "someone else holds the room",
+			expectedStatus: http.StatusSeeOther,
+			errMessage:     "BookRoom handler for a room held by someone else returned wrong response code: ",
+			resInSession:   false,
+			urlParam:       "/book-room/?s=2045-01-01&e=2045-01-02&id=1",
+		},
 	}
 
 	for _, tc := range testBookRoom {
@@ -790,6 +1193,2498 @@ func Test_Login(t *testing.T) {
 	}
 }
 
+func TestRepository_PostGuestRegister(t *testing.T) {
+	testGuestRegister := []struct {
+		name             string
+		postedData       url.Values
+		expectedStatus   int
+		expectedLocation string
+	}{
+		{
+			name: "valid registration",
+			postedData: url.Values{
+				"first_name": {"John"},
+				"last_name":  {"Smith"},
+				"email":      {"john@here.com"},
+				"password":   {"password"},
+			},
+			expectedStatus:   http.StatusSeeOther,
+			expectedLocation: "/guest/login",
+		},
+		{
+			name: "email already registered",
+			postedData: url.Values{
+				"first_name": {"John"},
+				"last_name":  {"Smith"},
+				"email":      {"taken@here.com"},
+				"password":   {"password"},
+			},
+			expectedStatus:   http.StatusSeeOther,
+			expectedLocation: "/guest/register",
+		},
+		{
+			name: "password too short",
+			postedData: url.Values{
+				"first_name": {"John"},
+				"last_name":  {"Smith"},
+				"email":      {"john@here.com"},
+				"password":   {"pass"},
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "invalid email",
+			postedData: url.Values{
+				"first_name": {"John"},
+				"last_name":  {"Smith"},
+				"email":      {"john"},
+				"password":   {"password"},
+			},
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range testGuestRegister {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/guest/register", strings.NewReader(tc.postedData.Encode()))
+			ctx := getCtx(req)
+			req = req.WithContext(ctx)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(Repo.PostGuestRegister)
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("failed %s: expected code %d, but got %d", tc.name, tc.expectedStatus, rr.Code)
+			}
+
+			if tc.expectedLocation != "" {
+				actualLoc, _ := rr.Result().Location()
+				if actualLoc.String() != tc.expectedLocation {
+					t.Errorf("failed %s: expected location %s, but got location %s",
+						tc.name, tc.expectedLocation, actualLoc.String())
+				}
+			}
+		})
+	}
+}
+
+func TestRepository_GuestVerify(t *testing.T) {
+	testGuestVerify := []struct {
+		name      string
+		token     string
+		flashType string
+	}{
+		{"valid token", "valid", "flash"},
+		{"invalid token", "invalid", "error"},
+		{"missing token", "", "error"},
+	}
+
+	for _, tc := range testGuestVerify {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/guest/verify?token="+tc.token, nil)
+			ctx := getCtx(req)
+			req = req.WithContext(ctx)
+			rr := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(Repo.GuestVerify)
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusSeeOther {
+				t.Errorf("failed %s: expected code %d, but got %d", tc.name, http.StatusSeeOther, rr.Code)
+			}
+
+			if !session.Exists(ctx, tc.flashType) {
+				t.Errorf("failed %s: expected %s message in the session", tc.name, tc.flashType)
+			}
+		})
+	}
+}
+
+func TestRepository_PostGuestLogin(t *testing.T) {
+	testGuestLogin := []struct {
+		name             string
+		email            string
+		expectedStatus   int
+		expectedLocation string
+		loggedIn         bool
+	}{
+		{"valid credentials", "guest@here.com", http.StatusSeeOther, "/guest/bookings", true},
+		{"invalid credentials", "jack@nimble.com", http.StatusSeeOther, "/guest/login", false},
+		{"email not confirmed", "unverified@here.com", http.StatusSeeOther, "/guest/login", false},
+		{"invalid data", "j", http.StatusOK, "", false},
+	}
+
+	for _, tc := range testGuestLogin {
+		t.Run(tc.name, func(t *testing.T) {
+			postedData := url.Values{
+				"email":    {tc.email},
+				"password": {"password"},
+			}
+			req, _ := http.NewRequest("POST", "/guest/login", strings.NewReader(postedData.Encode()))
+			ctx := getCtx(req)
+			req = req.WithContext(ctx)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(Repo.PostGuestLogin)
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("failed %s: expected code %d, but got %d", tc.name, tc.expectedStatus, rr.Code)
+			}
+
+			if tc.expectedLocation != "" {
+				actualLoc, _ := rr.Result().Location()
+				if actualLoc.String() != tc.expectedLocation {
+					t.Errorf("failed %s: expected location %s, but got location %s",
+						tc.name, tc.expectedLocation, actualLoc.String())
+				}
+			}
+
+			if loggedIn := session.Exists(ctx, "guest_id"); loggedIn != tc.loggedIn {
+				t.Errorf("failed %s: expected logged in %v, but got %v", tc.name, tc.loggedIn, loggedIn)
+			}
+		})
+	}
+}
+
+func TestRepository_GuestBookings(t *testing.T) {
+	testGuestBookings := []struct {
+		name           string
+		guestID        int
+		expectedStatus int
+	}{
+		{"guest with bookings", 1, http.StatusOK},
+		{"bookings query fails", 2, http.StatusInternalServerError},
+		{"unknown guest", 5, http.StatusSeeOther},
+	}
+
+	for _, tc := range testGuestBookings {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/guest/bookings", nil)
+			ctx := getCtx(req)
+			req = req.WithContext(ctx)
+			session.Put(ctx, "guest_id", tc.guestID)
+			rr := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(Repo.GuestBookings)
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("failed %s: expected code %d, but got %d", tc.name, tc.expectedStatus, rr.Code)
+			}
+		})
+	}
+}
+
+func TestRepository_PostMyReservations(t *testing.T) {
+	testMyReservations := []struct {
+		name             string
+		email            string
+		expectedStatus   int
+		expectedLocation string
+	}{
+		{"known email", "guest@here.com", http.StatusSeeOther, "/my-reservations"},
+		{"unknown email", "nobody@here.com", http.StatusSeeOther, "/my-reservations"},
+		{"database error", "fail@here.com", http.StatusSeeOther, "/my-reservations"},
+		{"invalid email", "guest", http.StatusOK, ""},
+	}
+
+	for _, tc := range testMyReservations {
+		t.Run(tc.name, func(t *testing.T) {
+			postedData := url.Values{"email": {tc.email}}
+			req, _ := http.NewRequest("POST", "/my-reservations", strings.NewReader(postedData.Encode()))
+			ctx := getCtx(req)
+			req = req.WithContext(ctx)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(Repo.PostMyReservations)
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("failed %s: expected code %d, but got %d", tc.name, tc.expectedStatus, rr.Code)
+			}
+
+			if tc.expectedLocation != "" {
+				actualLoc, _ := rr.Result().Location()
+				if actualLoc.String() != tc.expectedLocation {
+					t.Errorf("failed %s: expected location %s, but got location %s",
+						tc.name, tc.expectedLocation, actualLoc.String())
+				}
+			}
+		})
+	}
+}
+
+func TestRepository_MagicLinkAccess(t *testing.T) {
+	valid := helpers.SignToken("guest@here.com", time.Minute)
+
+	testMagicLink := []struct {
+		name             string
+		token            string
+		expectedLocation string
+		expectedEmail    string
+	}{
+		{"valid link", valid, "/my-reservations/list", "guest@here.com"},
+		{"expired link", helpers.SignToken("guest@here.com", -time.Minute), "/my-reservations", ""},
+		{"tampered link", strings.Replace(valid, ".", ".x", 1), "/my-reservations", ""},
+		{"missing token", "", "/my-reservations", ""},
+	}
+
+	for _, tc := range testMagicLink {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/my-reservations/access?token="+url.QueryEscape(tc.token), nil)
+			ctx := getCtx(req)
+			req = req.WithContext(ctx)
+			rr := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(Repo.MagicLinkAccess)
+			handler.ServeHTTP(rr, req)
+
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != tc.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got location %s",
+					tc.name, tc.expectedLocation, actualLoc.String())
+			}
+
+			if email := helpers.MagicLinkEmail(req); email != tc.expectedEmail {
+				t.Errorf("failed %s: expected session email %q, but got %q", tc.name, tc.expectedEmail, email)
+			}
+		})
+	}
+}
+
+func TestRepository_MyReservationsList(t *testing.T) {
+	testMyReservationsList := []struct {
+		name           string
+		email          string
+		expectedStatus int
+	}{
+		{"unlocked by link", "guest@here.com", http.StatusOK},
+		{"database error", "fail@here.com", http.StatusInternalServerError},
+		{"no link opened", "", http.StatusSeeOther},
+	}
+
+	for _, tc := range testMyReservationsList {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/my-reservations/list", nil)
+			ctx := getCtx(req)
+			req = req.WithContext(ctx)
+			if tc.email != "" {
+				putMagicLinkEmail(ctx, tc.email)
+			}
+			rr := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(Repo.MyReservationsList)
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("failed %s: expected code %d, but got %d", tc.name, tc.expectedStatus, rr.Code)
+			}
+		})
+	}
+}
+
+func TestRepository_MyReservationConfirmation(t *testing.T) {
+	testConfirmation := []struct {
+		name           string
+		id             string
+		email          string
+		expectedStatus int
+	}{
+		{"own reservation", "1", "guest@here.com", http.StatusOK},
+		{"name with markup", "2", "guest@here.com", http.StatusOK},
+		{"someone else's reservation", "1", "other@here.com", http.StatusSeeOther},
+		{"missing reservation", "500", "guest@here.com", http.StatusSeeOther},
+		{"reservation in the trash", "7", "guest@here.com", http.StatusSeeOther},
+	}
+
+	for _, tc := range testConfirmation {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/my-reservations/"+tc.id+"/confirmation", nil)
+			ctx := addURLParams(getCtx(req), map[string]string{"id": tc.id})
+			req = req.WithContext(ctx)
+			putMagicLinkEmail(ctx, tc.email)
+			rr := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(Repo.MyReservationConfirmation)
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("failed %s: expected code %d, but got %d", tc.name, tc.expectedStatus, rr.Code)
+			}
+
+			if tc.expectedStatus == http.StatusOK && !strings.Contains(rr.Header().Get("Content-Disposition"), "attachment") {
+				t.Errorf("failed %s: confirmation is not sent as a download", tc.name)
+			}
+
+			if strings.Contains(rr.Body.String(), "<script>") {
+				t.Errorf("failed %s: the name is not escaped", tc.name)
+			}
+		})
+	}
+}
+
+func TestRepository_PostMyReservationCancel(t *testing.T) {
+	testCancel := []struct {
+		name             string
+		id               string
+		email            string
+		expectedLocation string
+		flashType        string
+	}{
+		{"upcoming reservation", "1", "guest@here.com", "/my-reservations/list", "flash"},
+		{"stay already started", "2", "guest@here.com", "/my-reservations/list", "error"},
+		{"someone else's reservation", "1", "other@here.com", "/my-reservations", "error"},
+		{"reservation in the trash", "7", "guest@here.com", "/my-reservations", "error"},
+	}
+
+	for _, tc := range testCancel {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/my-reservations/"+tc.id+"/cancel", nil)
+			ctx := addURLParams(getCtx(req), map[string]string{"id": tc.id})
+			req = req.WithContext(ctx)
+			putMagicLinkEmail(ctx, tc.email)
+			rr := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(Repo.PostMyReservationCancel)
+			handler.ServeHTTP(rr, req)
+
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != tc.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got location %s",
+					tc.name, tc.expectedLocation, actualLoc.String())
+			}
+
+			if !session.Exists(ctx, tc.flashType) {
+				t.Errorf("failed %s: expected %s message in the session", tc.name, tc.flashType)
+			}
+		})
+	}
+}
+
+func TestRepository_SSOLogin(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/user/sso/login", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(Repo.SSOLogin)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusFound {
+		t.Errorf("SSOLogin returned wrong response code: got %d, wanted %d", rr.Code, http.StatusFound)
+	}
+
+	state := session.GetString(ctx, "sso_state")
+	actualLoc, _ := rr.Result().Location()
+	if state == "" || actualLoc.Query().Get("state") != state {
+		t.Errorf("SSOLogin did not pass the session state to the identity provider, got %s", actualLoc.String())
+	}
+}
+
+func TestRepository_SSOCallback(t *testing.T) {
+	testSSOCallback := []struct {
+		name             string
+		query            string
+		stateInSession   string
+		expectedLocation string
+		loggedIn         bool
+		accessLevel      int
+	}{
+		{"mapped group", "?state=abc&code=admin", "abc", "/admin/dashboard", true, 3},
+		{"demoted at the IdP", "?state=abc&code=demoted", "abc", "/admin/dashboard", true, 1},
+		{"no mapped group", "?state=abc&code=no-group", "abc", "/user/login", false, 0},
+		{"unverified email", "?state=abc&code=unverified", "abc", "/user/login", false, 0},
+		{"email of an existing account", "?state=abc&code=taken", "abc", "/user/login", false, 0},
+		{"state mismatch", "?state=xyz&code=admin", "abc", "/user/login", false, 0},
+		{"no login started", "?state=abc&code=admin", "", "/user/login", false, 0},
+		{"invalid code", "?state=abc&code=bad", "abc", "/user/login", false, 0},
+		{"login cancelled at the IdP", "?state=abc&error=access_denied", "abc", "/user/login", false, 0},
+	}
+
+	for _, tc := range testSSOCallback {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/user/sso/callback"+tc.query, nil)
+			ctx := getCtx(req)
+			req = req.WithContext(ctx)
+			if tc.stateInSession != "" {
+				session.Put(ctx, "sso_state", tc.stateInSession)
+				session.Put(ctx, "sso_nonce", "nonce")
+			}
+			rr := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(Repo.SSOCallback)
+			handler.ServeHTTP(rr, req)
+
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != tc.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got location %s",
+					tc.name, tc.expectedLocation, actualLoc.String())
+			}
+
+			if session.Exists(ctx, "user_id") != tc.loggedIn {
+				t.Errorf("failed %s: expected logged in to be %t", tc.name, tc.loggedIn)
+			}
+
+			// the access level follows the groups on every login, not only the first
+			if tc.loggedIn {
+				u, _ := Repo.DB.GetUserByID(session.GetInt(ctx, "user_id"))
+				if u.AccessLevel != tc.accessLevel {
+					t.Errorf("failed %s: expected access level %d, got %d", tc.name, tc.accessLevel, u.AccessLevel)
+				}
+			}
+		})
+	}
+
+	// failing to provision the user is a server error
+	req, _ := http.NewRequest("GET", "/user/sso/callback?state=abc&code=db-fail", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	session.Put(ctx, "sso_state", "abc")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.SSOCallback).ServeHTTP(rr, req)
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("SSOCallback returned wrong response code when provisioning fails: got %d", rr.Code)
+	}
+}
+
+func TestRepository_AdminAuditedActions(t *testing.T) {
+	testAudited := []struct {
+		name             string
+		url              string
+		handler          http.HandlerFunc
+		expectedLocation string
+	}{
+		{"delete reservation", "/admin/delete-reservation/all/1/do", Repo.AdminDeleteReservation, "/admin/reservations/all"},
+		{"process reservation", "/admin/process-reservation/new/1/do?y=2025&m=01", Repo.AdminProcessReservation, "/admin/reservations/new?y=2025&m=01"},
+	}
+
+	for _, tc := range testAudited {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", tc.url, nil)
+			ctx := getCtx(req)
+			exploded := strings.Split(strings.Split(tc.url, "?")[0], "/")
+			ctx = addURLParams(ctx, map[string]string{"src": exploded[3], "id": exploded[4]})
+			req = req.WithContext(ctx)
+			session.Put(ctx, "user_id", 1)
+			rr := httptest.NewRecorder()
+
+			tc.handler.ServeHTTP(rr, req)
+
+			actualLoc, _ := rr.Result().Location()
+			if rr.Code != http.StatusSeeOther || actualLoc.String() != tc.expectedLocation {
+				t.Errorf("failed %s: expected redirect to %s, but got %d %s",
+					tc.name, tc.expectedLocation, rr.Code, actualLoc.String())
+			}
+		})
+	}
+}
+
+func TestRepository_AdminAuditedActionsFail(t *testing.T) {
+	testFailing := []struct {
+		name    string
+		url     string
+		handler http.HandlerFunc
+	}{
+		{"delete fails", "/admin/delete-reservation/all/2/do", Repo.AdminDeleteReservation},
+		{"delete missing reservation", "/admin/delete-reservation/all/500/do", Repo.AdminDeleteReservation},
+		{"process fails", "/admin/process-reservation/new/2/do", Repo.AdminProcessReservation},
+		{"process missing reservation", "/admin/process-reservation/new/500/do", Repo.AdminProcessReservation},
+	}
+
+	for _, tc := range testFailing {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", tc.url, nil)
+			ctx := getCtx(req)
+			exploded := strings.Split(tc.url, "/")
+			ctx = addURLParams(ctx, map[string]string{"src": exploded[3], "id": exploded[4]})
+			req = req.WithContext(ctx)
+			rr := httptest.NewRecorder()
+
+			tc.handler.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusInternalServerError {
+				t.Errorf("failed %s: expected code %d, but got %d", tc.name, http.StatusInternalServerError, rr.Code)
+			}
+			if _, err := rr.Result().Location(); err == nil {
+				t.Errorf("failed %s: expected no redirect after the error", tc.name)
+			}
+		})
+	}
+}
+
+func TestRepository_AdminRestoreReservation(t *testing.T) {
+	testRestore := []struct {
+		name             string
+		id               string
+		expectedLocation string
+		flashType        string
+	}{
+		{"restorable", "5", "/admin/reservations/all/5/show", "flash"},
+		{"room taken since", "4", "/admin/reservations/trash", "error"},
+		{"past retention period", "3", "/admin/reservations/trash", "error"},
+		{"not deleted", "1", "/admin/reservations/trash", "error"},
+		{"missing reservation", "500", "/admin/reservations/trash", "error"},
+	}
+
+	for _, tc := range testRestore {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/admin/restore-reservation/"+tc.id+"/do", nil)
+			ctx := addURLParams(getCtx(req), map[string]string{"id": tc.id})
+			req = req.WithContext(ctx)
+			rr := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(Repo.AdminRestoreReservation)
+			handler.ServeHTTP(rr, req)
+
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != tc.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got location %s",
+					tc.name, tc.expectedLocation, actualLoc.String())
+			}
+
+			if !session.Exists(ctx, tc.flashType) {
+				t.Errorf("failed %s: expected %s message in the session", tc.name, tc.flashType)
+			}
+		})
+	}
+}
+
+func TestRepository_AdminReservationsJSON(t *testing.T) {
+	testGrid := []struct {
+		name          string
+		query         string
+		expectedOK    bool
+		expectedTotal int
+		expectedPage  int
+		expectedSize  int
+	}{
+		{"defaults", "", true, 2, 1, 25},
+		{"paged and sorted", "?page=3&size=10&sort=room&dir=desc", true, 2, 3, 10},
+		{"page size capped", "?size=1000", true, 2, 1, maxGridPageSize},
+		{"invalid values", "?page=x&size=-5&from=bad&room=x", true, 2, 1, 25},
+		{"database error", "?q=fail", false, 0, 1, 25},
+	}
+
+	for _, tc := range testGrid {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/admin/reservations-json"+tc.query, nil)
+			req = req.WithContext(getCtx(req))
+			rr := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(Repo.AdminReservationsJSON)
+			handler.ServeHTTP(rr, req)
+
+			var resp gridResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed %s: can't parse json: %s", tc.name, err)
+			}
+
+			if resp.OK != tc.expectedOK || resp.Total != tc.expectedTotal {
+				t.Errorf("failed %s: expected ok %t with %d rows, got ok %t with %d rows",
+					tc.name, tc.expectedOK, tc.expectedTotal, resp.OK, resp.Total)
+			}
+
+			if resp.Page != tc.expectedPage || resp.PageSize != tc.expectedSize {
+				t.Errorf("failed %s: expected page %d of size %d, got page %d of size %d",
+					tc.name, tc.expectedPage, tc.expectedSize, resp.Page, resp.PageSize)
+			}
+
+			if len(resp.Rows) != tc.expectedTotal {
+				t.Errorf("failed %s: expected %d rows, got %d", tc.name, tc.expectedTotal, len(resp.Rows))
+			}
+		})
+	}
+}
+
+func TestRepository_AdminExportReservations(t *testing.T) {
+	testExport := []struct {
+		name             string
+		query            string
+		userID           int
+		expectedType     string
+		expectedLocation string
+		expectedText     []string
+		unexpectedText   []string
+		aborted          bool
+	}{
+		{"csv with guest details", "?format=csv&src=all", 1, "text/csv; charset=utf-8", "",
+			[]string{"ID,First Name,Last Name,Email,Phone,Room,Arrival,Departure,Nights,Amount,Status,Created", "guest@here.com",
+				",2,240.00,new,", ",2,250.50,new,", "Total,,,,,,,,4,490.50,2 reservations,\n"}, nil, false},
+		{"csv without guest details", "?format=csv&src=new", 2, "text/csv; charset=utf-8", "",
+			[]string{"ID,Room,Arrival,Departure,Nights,Amount,Status,Created", "Total,,,,4,490.50,2 reservations,\n"},
+			[]string{"guest@here.com", "Email"}, false},
+		{"xlsx", "?format=xlsx", 1, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "",
+			[]string{"xl/worksheets/sheet1.xml"}, nil, false},
+		{"database error", "?format=csv&q=fail", 1, "text/csv; charset=utf-8", "",
+			nil, []string{"Total,"}, true},
+		{"unknown format", "?format=pdf", 1, "", "/admin/reservations/all", nil, nil, false},
+	}
+
+	for _, tc := range testExport {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/admin/reservations-export"+tc.query, nil)
+			ctx := getCtx(req)
+			session.Put(ctx, "user_id", tc.userID)
+			req = req.WithContext(ctx)
+			rr := httptest.NewRecorder()
+
+			// a failed export aborts the response instead of ending a truncated file
+			aborted := func() (aborted bool) {
+				defer func() { aborted = recover() == http.ErrAbortHandler }()
+				http.HandlerFunc(Repo.AdminExportReservations).ServeHTTP(rr, req)
+				return false
+			}()
+			if aborted != tc.aborted {
+				t.Errorf("failed %s: expected the response aborted to be %t", tc.name, tc.aborted)
+			}
+
+			if tc.expectedLocation != "" {
+				actualLoc, _ := rr.Result().Location()
+				if actualLoc == nil || actualLoc.String() != tc.expectedLocation {
+					t.Errorf("failed %s: expected redirect to %s", tc.name, tc.expectedLocation)
+				}
+				return
+			}
+
+			if rr.Header().Get("Content-Type") != tc.expectedType {
+				t.Errorf("failed %s: expected content type %s, got %s", tc.name, tc.expectedType, rr.Header().Get("Content-Type"))
+			}
+
+			body := rr.Body.String()
+			for _, text := range tc.expectedText {
+				if !strings.Contains(body, text) {
+					t.Errorf("failed %s: expected %q in the export", tc.name, text)
+				}
+			}
+			for _, text := range tc.unexpectedText {
+				if strings.Contains(body, text) {
+					t.Errorf("failed %s: did not expect %q in the export", tc.name, text)
+				}
+			}
+		})
+	}
+}
+
+// importCSV is a reservation import with one good row and one row for each kind of error
+const importCSV = `First Name,Last Name,Email,Phone,Room,Arrival,Departure
+John,Smith,john@smith.com,555-555-5555,General's Quarters,2040-01-01,2040-01-05
+Jane,Smith,jane@smith.com,555-555-5555,1,2040-01-03,2040-01-04
+Al,Smith,al@smith.com,555-555-5555,2,2040-01-01,2040-01-02
+Mary,Smith,not-an-email,555-555-5555,2,2040-01-01,2040-01-02
+Peter,Smith,peter@smith.com,555-555-5555,Penthouse,2040-01-01,2040-01-02
+Lucy,Smith,lucy@smith.com,555-555-5555,2,2040-01-05,2040-01-01
+Frank,Smith,frank@smith.com,555-555-5555,2,2050-01-01,2050-01-02
+`
+
+func TestRepository_parseReservationImport(t *testing.T) {
+	rows, err := Repo.parseReservationImport(strings.NewReader(importCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"",
+		"overlaps line 2",
+		"first_name",
+		"email",
+		"no such room",
+		"departure must be after arrival",
+		"not available",
+	}
+	if len(rows) != len(expected) {
+		t.Fatalf("expected %d rows, got %d", len(expected), len(rows))
+	}
+
+	for i, row := range rows {
+		errs := strings.Join(row.Errors, "; ")
+		if expected[i] == "" && errs != "" {
+			t.Errorf("line %d: expected no errors, got %s", row.Line, errs)
+		}
+		if expected[i] != "" && !strings.Contains(errs, expected[i]) {
+			t.Errorf("line %d: expected an error about %q, got %q", row.Line, expected[i], errs)
+		}
+	}
+
+	if rows[0].Reservation.RoomID != 1 || rows[0].Line != 2 {
+		t.Errorf("expected the room name to map to room 1 on line 2, got room %d on line %d",
+			rows[0].Reservation.RoomID, rows[0].Line)
+	}
+
+	if _, err := Repo.parseReservationImport(strings.NewReader("first_name,last_name\nJohn,Smith\n")); err == nil {
+		t.Error("expected an error for missing columns")
+	}
+}
+
+func TestRepository_AdminPostReservationsImport(t *testing.T) {
+	testImport := []struct {
+		name             string
+		file             string
+		expectedStatus   int
+		expectedLocation string
+	}{
+		{"preview", importCSV, http.StatusOK, ""},
+		{"missing columns", "first_name,last_name\nJohn,Smith\n", http.StatusSeeOther, "/admin/reservations/import"},
+		{"no file", "", http.StatusSeeOther, "/admin/reservations/import"},
+	}
+
+	for _, tc := range testImport {
+		t.Run(tc.name, func(t *testing.T) {
+			body := &bytes.Buffer{}
+			mw := multipart.NewWriter(body)
+			if tc.file != "" {
+				part, _ := mw.CreateFormFile("file", "reservations.csv")
+				part.Write([]byte(tc.file))
+			}
+			mw.Close()
+
+			req, _ := http.NewRequest("POST", "/admin/reservations/import", body)
+			req.Header.Set("Content-Type", mw.FormDataContentType())
+			ctx := getCtx(req)
+			req = req.WithContext(ctx)
+			rr := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(Repo.AdminPostReservationsImport)
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("failed %s: expected code %d, but got %d", tc.name, tc.expectedStatus, rr.Code)
+			}
+
+			if tc.expectedLocation != "" {
+				actualLoc, _ := rr.Result().Location()
+				if actualLoc.String() != tc.expectedLocation {
+					t.Errorf("failed %s: expected location %s, but got %s", tc.name, tc.expectedLocation, actualLoc.String())
+				}
+			}
+
+			if tc.expectedStatus == http.StatusOK {
+				path, err := Repo.importPath(session.GetString(ctx, "reservation_import"))
+				if err != nil {
+					t.Fatalf("failed %s: expected the import token in the session", tc.name)
+				}
+				if _, err := os.Stat(path); err != nil {
+					t.Errorf("failed %s: expected the accepted rows to be kept for the commit: %v", tc.name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestRepository_AdminCommitReservationsImport(t *testing.T) {
+	testCommit := []struct {
+		name             string
+		file             string
+		token            string
+		expectedLocation string
+		flashType        string
+	}{
+		{"valid", importCSV, "", "/admin/reservations/all", "flash"},
+		{"nothing previewed", "", "", "/admin/reservations/import", "error"},
+		{"token without rows", "", "0123abcd", "/admin/reservations/import", "error"},
+		{"token outside the imports", "", "../secret", "/admin/reservations/import", "error"},
+		{"no acceptable rows", "first_name,last_name,email,phone,room,start_date,end_date\nAl,Smith,al@smith.com,5,1,2040-01-01,2040-01-02\n",
+			"", "/admin/reservations/import", "error"},
+		{"conflict on commit", "first_name,last_name,email,phone,room,start_date,end_date\nJohn,Smith,conflict@here.com,5,1,2040-01-01,2040-01-02\n",
+			"", "/admin/reservations/import", "error"},
+	}
+
+	for _, tc := range testCommit {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/admin/reservations/import/commit", nil)
+			ctx := getCtx(req)
+			if tc.file != "" {
+				rows, err := Repo.parseReservationImport(strings.NewReader(tc.file))
+				if err != nil {
+					t.Fatal(err)
+				}
+				var accepted []models.Reservation
+				for _, row := range rows {
+					if len(row.Errors) == 0 {
+						accepted = append(accepted, row.Reservation)
+					}
+				}
+				token, err := Repo.saveImport(accepted)
+				if err != nil {
+					t.Fatal(err)
+				}
+				session.Put(ctx, "reservation_import", token)
+			}
+			if tc.token != "" {
+				session.Put(ctx, "reservation_import", tc.token)
+			}
+			req = req.WithContext(ctx)
+			rr := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(Repo.AdminCommitReservationsImport)
+			handler.ServeHTTP(rr, req)
+
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != tc.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got %s", tc.name, tc.expectedLocation, actualLoc.String())
+			}
+
+			if !session.Exists(ctx, tc.flashType) {
+				t.Errorf("failed %s: expected %s message in the session", tc.name, tc.flashType)
+			}
+
+			if session.Exists(ctx, "reservation_import") {
+				t.Errorf("failed %s: the import should be removed from the session", tc.name)
+			}
+		})
+	}
+}
+
+func Test_summarizeOccupancy(t *testing.T) {
+	report := models.OccupancyReport{
+		Rooms: []models.RoomOccupancy{
+			{AvailableNights: 30, BookedNights: 15, Revenue: 150000},
+			{AvailableNights: 20, BookedNights: 5, Revenue: 100000},
+		},
+		Cancellations: 2,
+	}
+
+	s := summarizeOccupancy(report)
+	if s.BookedNights != 20 || s.AvailableNights != 50 || s.Revenue != 250000 || s.Cancellations != 2 {
+		t.Errorf("wrong totals %+v", s)
+	}
+	if s.Occupancy != 40 {
+		t.Errorf("expected occupancy 40%%, got %f", s.Occupancy)
+	}
+	if s.ADR != 12500 || s.RevPAR != 5000 {
+		t.Errorf("expected ADR 12500 and RevPAR 5000, got %d and %d", s.ADR, s.RevPAR)
+	}
+
+	empty := summarizeOccupancy(models.OccupancyReport{})
+	if empty.Occupancy != 0 || empty.ADR != 0 || empty.RevPAR != 0 {
+		t.Errorf("an empty report should have zero rates, got %+v", empty)
+	}
+
+	if percentChange(110, 100) != "+10.0%" || percentChange(5, 0) != "-" {
+		t.Error("wrong percent change")
+	}
+}
+
+func TestRepository_AdminCheckInOut(t *testing.T) {
+	testFrontDesk := []struct {
+		name      string
+		handler   http.HandlerFunc
+		id        string
+		flashType string
+	}{
+		{"check in", Repo.AdminCheckIn, "1", "flash"},
+		{"check in refused", Repo.AdminCheckIn, "2", "error"},
+		{"check in before the arrival date", Repo.AdminCheckIn, "3", "error"},
+		{"check out", Repo.AdminCheckOut, "2", "flash"},
+		{"check out refused", Repo.AdminCheckOut, "1", "error"},
+	}
+
+	for _, tc := range testFrontDesk {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/admin/check-in/"+tc.id+"/do?date=2025-03-01", nil)
+			ctx := addURLParams(getCtx(req), map[string]string{"id": tc.id})
+			req = req.WithContext(ctx)
+			rr := httptest.NewRecorder()
+
+			tc.handler.ServeHTTP(rr, req)
+
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != "/admin/front-desk?date=2025-03-01" {
+				t.Errorf("failed %s: expected to go back to the front desk, got %s", tc.name, actualLoc.String())
+			}
+
+			if !session.Exists(ctx, tc.flashType) {
+				t.Errorf("failed %s: expected %s message in the session", tc.name, tc.flashType)
+			}
+		})
+	}
+}
+
+func TestRepository_AdminPostGenerateHousekeeping(t *testing.T) {
+	testGenerate := []struct {
+		name      string
+		date      string
+		flashType string
+	}{
+		{"list made", "2025-03-01", "flash"},
+		{"invalid date", "tomorrow", "error"},
+		{"database error", "2060-01-01", "error"},
+	}
+
+	for _, tc := range testGenerate {
+		t.Run(tc.name, func(t *testing.T) {
+			postedData := url.Values{}
+			postedData.Add("date", tc.date)
+
+			req, _ := http.NewRequest("POST", "/admin/housekeeping/generate", strings.NewReader(postedData.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			ctx := getCtx(req)
+			req = req.WithContext(ctx)
+			rr := httptest.NewRecorder()
+
+			handler := http.HandlerFunc(Repo.AdminPostGenerateHousekeeping)
+			handler.ServeHTTP(rr, req)
+
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != "/admin/housekeeping?date="+url.QueryEscape(tc.date) {
+				t.Errorf("failed %s: expected to go back to housekeeping, got %s", tc.name, actualLoc.String())
+			}
+
+			if !session.Exists(ctx, tc.flashType) {
+				t.Errorf("failed %s: expected %s message in the session", tc.name, tc.flashType)
+			}
+		})
+	}
+}
+
+func TestRepository_AdminHousekeepingActions(t *testing.T) {
+	testHousekeeping := []struct {
+		name      string
+		handler   http.HandlerFunc
+		id        string
+		status    string
+		flashType string
+	}{
+		{"task done", Repo.AdminCompleteHousekeepingTask, "1", "", "flash"},
+		{"task already done", Repo.AdminCompleteHousekeepingTask, "2", "", "error"},
+		{"set status", Repo.AdminSetRoomStatus, "1", "out_of_order", "flash"},
+		{"unknown status", Repo.AdminSetRoomStatus, "1", "sparkling", "error"},
+		{"unknown room", Repo.AdminSetRoomStatus, "3", "clean", "error"},
+	}
+
+	for _, tc := range testHousekeeping {
+		t.Run(tc.name, func(t *testing.T) {
+			postedData := url.Values{}
+			postedData.Add("date", "2025-03-01")
+			postedData.Add("status", tc.status)
+
+			req, _ := http.NewRequest("POST", "/admin/housekeeping/"+tc.id+"/done", strings.NewReader(postedData.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			ctx := addURLParams(getCtx(req), map[string]string{"id": tc.id})
+			req = req.WithContext(ctx)
+			rr := httptest.NewRecorder()
+
+			tc.handler.ServeHTTP(rr, req)
+
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != "/admin/housekeeping?date=2025-03-01" {
+				t.Errorf("failed %s: expected to go back to housekeeping, got %s", tc.name, actualLoc.String())
+			}
+
+			if !session.Exists(ctx, tc.flashType) {
+				t.Errorf("failed %s: expected %s message in the session", tc.name, tc.flashType)
+			}
+		})
+	}
+}
+
+// pngHeader is enough of a png file for content sniffing
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func TestRepository_AdminPostWorkOrder(t *testing.T) {
+	testWorkOrders := []struct {
+		name             string
+		handler          http.HandlerFunc
+		id               string
+		fields           map[string]string
+		photo            []byte
+		expectedStatus   int
+		expectedLocation string
+		flashType        string
+	}{
+		{"new", Repo.AdminPostNewWorkOrder, "",
+			map[string]string{"room_id": "1", "title": "Leaking tap", "priority": "high", "start_date": "2040-01-01", "end_date": "2040-01-03"},
+			pngHeader, http.StatusSeeOther, "/admin/work-orders/1", "flash"},
+		{"new without dates", Repo.AdminPostNewWorkOrder, "",
+			map[string]string{"room_id": "1", "title": "Squeaky door", "priority": "low"},
+			nil, http.StatusSeeOther, "/admin/work-orders/1", "flash"},
+		{"new with a file that isn't a photo", Repo.AdminPostNewWorkOrder, "",
+			map[string]string{"room_id": "1", "title": "Leaking tap", "priority": "high"},
+			[]byte("just text"), http.StatusSeeOther, "/admin/work-orders/1", "warning"},
+		{"new without title", Repo.AdminPostNewWorkOrder, "",
+			map[string]string{"room_id": "1", "priority": "high"}, nil, http.StatusOK, "", ""},
+		{"new with one date", Repo.AdminPostNewWorkOrder, "",
+			map[string]string{"room_id": "1", "title": "Leaking tap", "priority": "high", "start_date": "2040-01-01"},
+			nil, http.StatusOK, "", ""},
+		{"new over a booking", Repo.AdminPostNewWorkOrder, "",
+			map[string]string{"room_id": "1", "title": "Leaking tap", "priority": "high", "start_date": "2050-01-01", "end_date": "2050-01-03"},
+			nil, http.StatusOK, "", ""},
+		{"update", Repo.AdminPostWorkOrder, "1",
+			map[string]string{"room_id": "1", "title": "Leaking tap", "priority": "urgent", "start_date": "2040-01-02", "end_date": "2040-01-04"},
+			nil, http.StatusSeeOther, "/admin/work-orders/1", "flash"},
+		{"update closed", Repo.AdminPostWorkOrder, "2",
+			map[string]string{"room_id": "1", "title": "Leaking tap", "priority": "urgent"}, nil, http.StatusOK, "", ""},
+		{"update missing", Repo.AdminPostWorkOrder, "5",
+			map[string]string{"room_id": "1", "title": "Leaking tap", "priority": "urgent"}, nil, http.StatusSeeOther, "/admin/work-orders", "error"},
+		{"update with unknown priority", Repo.AdminPostWorkOrder, "1",
+			map[string]string{"room_id": "1", "title": "Leaking tap", "priority": "whenever"}, nil, http.StatusOK, "", ""},
+	}
+
+	for _, tc := range testWorkOrders {
+		t.Run(tc.name, func(t *testing.T) {
+			body := &bytes.Buffer{}
+			mw := multipart.NewWriter(body)
+			for k, v := range tc.fields {
+				mw.WriteField(k, v)
+			}
+			if tc.photo != nil {
+				part, _ := mw.CreateFormFile("photos", "tap.png")
+				part.Write(tc.photo)
+			}
+			mw.Close()
+
+			req, _ := http.NewRequest("POST", "/admin/work-orders/new", body)
+			req.Header.Set("Content-Type", mw.FormDataContentType())
+			ctx := addURLParams(getCtx(req), map[string]string{"id": tc.id})
+			req = req.WithContext(ctx)
+			rr := httptest.NewRecorder()
+
+			tc.handler.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("failed %s: expected code %d, but got %d", tc.name, tc.expectedStatus, rr.Code)
+			}
+
+			if tc.expectedLocation != "" {
+				actualLoc, err := rr.Result().Location()
+				if err != nil {
+					t.Errorf("failed %s: expected a redirect to %s", tc.name, tc.expectedLocation)
+				} else if actualLoc.String() != tc.expectedLocation {
+					t.Errorf("failed %s: expected location %s, but got %s", tc.name, tc.expectedLocation, actualLoc.String())
+				}
+			}
+
+			if tc.flashType != "" && !session.Exists(ctx, tc.flashType) {
+				t.Errorf("failed %s: expected %s message in the session", tc.name, tc.flashType)
+			}
+		})
+	}
+
+	// the photo of the first case is kept under a generated name
+	saved, _ := filepath.Glob(filepath.Join(app.UploadDir, "work-orders", "*.png"))
+	if len(saved) == 0 {
+		t.Fatal("expected the photo to be saved")
+	}
+
+	req, _ := http.NewRequest("GET", "/admin/work-orders/photos/"+filepath.Base(saved[0]), nil)
+	req = req.WithContext(addURLParams(getCtx(req), map[string]string{"file": filepath.Base(saved[0])}))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.AdminWorkOrderPhoto).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected the saved photo to be served, got %d", rr.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/admin/work-orders/photos/x", nil)
+	req = req.WithContext(addURLParams(getCtx(req), map[string]string{"file": "../setup_test.go"}))
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(Repo.AdminWorkOrderPhoto).ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected a path outside the photos to be refused, got %d", rr.Code)
+	}
+
+	// a photo that can't be recorded isn't left on disk
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	mw.WriteField("room_id", "1")
+	mw.WriteField("title", "Leaking tap")
+	mw.WriteField("priority", "high")
+	part, _ := mw.CreateFormFile("photos", "fail.png")
+	part.Write(pngHeader)
+	mw.Close()
+
+	req, _ = http.NewRequest("POST", "/admin/work-orders/new", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(Repo.AdminPostNewWorkOrder).ServeHTTP(rr, req)
+
+	if !session.Exists(ctx, "warning") {
+		t.Error("expected a warning that the photo wasn't saved")
+	}
+	if after, _ := filepath.Glob(filepath.Join(app.UploadDir, "work-orders", "*.png")); len(after) != len(saved) {
+		t.Errorf("expected the unrecorded photo removed, got %d photos instead of %d", len(after), len(saved))
+	}
+}
+
+func TestRepository_AdminCloseWorkOrder(t *testing.T) {
+	testClose := []struct {
+		name             string
+		id               string
+		expectedLocation string
+		flashType        string
+	}{
+		{"open", "1", "/admin/work-orders", "flash"},
+		{"already closed", "2", "/admin/work-orders/2", "error"},
+	}
+
+	for _, tc := range testClose {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/admin/work-orders/"+tc.id+"/close", nil)
+			ctx := addURLParams(getCtx(req), map[string]string{"id": tc.id})
+			req = req.WithContext(ctx)
+			rr := httptest.NewRecorder()
+
+			http.HandlerFunc(Repo.AdminCloseWorkOrder).ServeHTTP(rr, req)
+
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != tc.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got %s", tc.name, tc.expectedLocation, actualLoc.String())
+			}
+
+			if !session.Exists(ctx, tc.flashType) {
+				t.Errorf("failed %s: expected %s message in the session", tc.name, tc.flashType)
+			}
+		})
+	}
+}
+
+func TestRepository_AdminPostNewReservation(t *testing.T) {
+	// a buffered channel keeps the mail around to be counted
+	listened := app.MailChan
+	app.MailChan = make(chan models.MailData, 1)
+	defer func() { app.MailChan = listened }()
+
+	guest := url.Values{
+		"first_name": {"John"},
+		"last_name":  {"Smith"},
+		"email":      {"john@smith.com"},
+		"phone":      {"555-555-5555"},
+		"room_id":    {"1"},
+		"start_date": {"2040-01-01"},
+		"end_date":   {"2040-01-03"},
+		"source":     {"phone"},
+	}
+
+	with := func(changes map[string]string) url.Values {
+		values := url.Values{}
+		for k, v := range guest {
+			values[k] = v
+		}
+		for k, v := range changes {
+			if v == "" {
+				values.Del(k)
+			} else {
+				values.Set(k, v)
+			}
+		}
+		return values
+	}
+
+	testBookings := []struct {
+		name             string
+		postedData       url.Values
+		expectedStatus   int
+		expectedLocation string
+		expectedMail     bool
+	}{
+		{"phone booking", with(nil), http.StatusSeeOther, "/admin/reservations/all/1/show", false},
+		{"with confirmation", with(map[string]string{"send_confirmation": "1"}), http.StatusSeeOther, "/admin/reservations/all/1/show", true},
+		{"walk-in without email", with(map[string]string{"source": "walk_in", "email": ""}), http.StatusSeeOther, "/admin/reservations/all/1/show", false},
+		{"confirmation without email", with(map[string]string{"send_confirmation": "1", "email": ""}), http.StatusOK, "", false},
+		{"invalid email", with(map[string]string{"email": "john"}), http.StatusOK, "", false},
+		{"unknown source", with(map[string]string{"source": "pigeon"}), http.StatusOK, "", false},
+		{"missing name", with(map[string]string{"first_name": ""}), http.StatusOK, "", false},
+		{"departure before arrival", with(map[string]string{"end_date": "2039-12-30"}), http.StatusOK, "", false},
+		{"invalid date", with(map[string]string{"start_date": "tomorrow"}), http.StatusOK, "", false},
+		{"too long without a reason", with(map[string]string{"end_date": "2040-03-01"}), http.StatusOK, "", false},
+		{"too long with a reason", with(map[string]string{"end_date": "2040-03-01", "override_reason": "long-term contract"}),
+			http.StatusSeeOther, "/admin/reservations/all/1/show", false},
+		{"room taken", with(map[string]string{"room_id": "2"}), http.StatusOK, "", false},
+	}
+
+	for _, tc := range testBookings {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/admin/reservations/book", strings.NewReader(tc.postedData.Encode()))
+			ctx := getCtx(req)
+			req = req.WithContext(ctx)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+
+			http.HandlerFunc(Repo.AdminPostNewReservation).ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("failed %s: expected code %d, but got %d", tc.name, tc.expectedStatus, rr.Code)
+			}
+
+			if tc.expectedLocation != "" {
+				actualLoc, err := rr.Result().Location()
+				if err != nil {
+					t.Errorf("failed %s: expected a redirect to %s", tc.name, tc.expectedLocation)
+				} else if actualLoc.String() != tc.expectedLocation {
+					t.Errorf("failed %s: expected location %s, but got %s", tc.name, tc.expectedLocation, actualLoc.String())
+				}
+			}
+
+			if mailed := len(app.MailChan) > 0; mailed != tc.expectedMail {
+				t.Errorf("failed %s: expected a confirmation mail %v, but got %v", tc.name, tc.expectedMail, mailed)
+			}
+			for len(app.MailChan) > 0 {
+				<-app.MailChan
+			}
+		})
+	}
+}
+
+func TestRepository_AdminReservationAvailability(t *testing.T) {
+	testAvailability := []struct {
+		name       string
+		query      string
+		expectedOK bool
+		free       int
+		broken     int
+	}{
+		{"free", "start=2040-01-01&end=2040-01-03", true, 1, 0},
+		{"booked up", "start=2050-01-01&end=2050-01-03", true, 0, 0},
+		{"too long", "start=2040-01-01&end=2040-03-01", true, 1, 1},
+		{"departure before arrival", "start=2040-01-03&end=2040-01-01", false, 0, 0},
+		{"no dates", "", false, 0, 0},
+		{"database error", "start=2060-01-01&end=2060-01-03", false, 0, 0},
+	}
+
+	for _, tc := range testAvailability {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/admin/reservations-availability?"+tc.query, nil)
+			req = req.WithContext(getCtx(req))
+			rr := httptest.NewRecorder()
+
+			http.HandlerFunc(Repo.AdminReservationAvailability).ServeHTTP(rr, req)
+
+			var resp availabilityResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed %s: can't parse json: %s", tc.name, err)
+			}
+
+			if resp.OK != tc.expectedOK {
+				t.Errorf("failed %s: expected ok %v, but got %v (%s)", tc.name, tc.expectedOK, resp.OK, resp.Message)
+			}
+
+			free := 0
+			for _, room := range resp.Rooms {
+				if room.Available {
+					free++
+				}
+			}
+			if free != tc.free {
+				t.Errorf("failed %s: expected %d free rooms, but got %d", tc.name, tc.free, free)
+			}
+
+			if len(resp.Broken) != tc.broken {
+				t.Errorf("failed %s: expected %d broken stay rules, but got %v", tc.name, tc.broken, resp.Broken)
+			}
+		})
+	}
+}
+
+func TestRepository_AdminMoveReservation(t *testing.T) {
+	// a buffered channel keeps the mail around to be counted
+	listened := app.MailChan
+	app.MailChan = make(chan models.MailData, 2)
+	defer func() { app.MailChan = listened }()
+
+	testMoves := []struct {
+		name         string
+		id           string
+		postedData   url.Values
+		expectedOK   bool
+		expectedMail bool
+	}{
+		{"other dates", "1", url.Values{"room_id": {"1"}, "start_date": {"2040-01-05"}, "end_date": {"2040-01-07"}}, true, false},
+		{"notify the guest", "1", url.Values{"room_id": {"1"}, "start_date": {"2040-01-05"}, "end_date": {"2040-01-07"}, "notify": {"1"}}, true, true},
+		{"room taken", "1", url.Values{"room_id": {"2"}, "start_date": {"2040-01-05"}, "end_date": {"2040-01-07"}, "notify": {"1"}}, false, false},
+		{"can't be moved", "2", url.Values{"room_id": {"1"}, "start_date": {"2040-01-05"}, "end_date": {"2040-01-07"}}, false, false},
+		{"missing reservation", "101", url.Values{"room_id": {"1"}, "start_date": {"2040-01-05"}, "end_date": {"2040-01-07"}}, false, false},
+		{"missing room", "1", url.Values{"room_id": {"3"}, "start_date": {"2040-01-05"}, "end_date": {"2040-01-07"}}, false, false},
+		{"invalid room", "1", url.Values{"room_id": {"x"}, "start_date": {"2040-01-05"}, "end_date": {"2040-01-07"}}, false, false},
+		{"invalid start", "1", url.Values{"room_id": {"1"}, "start_date": {"x"}, "end_date": {"2040-01-07"}}, false, false},
+		{"departure before arrival", "1", url.Values{"room_id": {"1"}, "start_date": {"2040-01-07"}, "end_date": {"2040-01-05"}}, false, false},
+	}
+
+	for _, tc := range testMoves {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/admin/move-reservation/"+tc.id, strings.NewReader(tc.postedData.Encode()))
+			ctx := addURLParams(getCtx(req), map[string]string{"id": tc.id})
+			req = req.WithContext(ctx)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+
+			http.HandlerFunc(Repo.AdminMoveReservation).ServeHTTP(rr, req)
+
+			var resp jsonResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed %s: can't parse json: %s", tc.name, err)
+			}
+
+			if resp.OK != tc.expectedOK {
+				t.Errorf("failed %s: expected ok %v, but got %v (%s)", tc.name, tc.expectedOK, resp.OK, resp.Message)
+			}
+
+			if tc.expectedOK && !session.Exists(ctx, "flash") {
+				t.Errorf("failed %s: expected a flash message for the calendar", tc.name)
+			}
+
+			// a room freed by the move is offered to the waitlist as well
+			mailed := false
+			for len(app.MailChan) > 0 {
+				if msg := <-app.MailChan; msg.To == "guest@here.com" {
+					mailed = true
+				}
+			}
+			if mailed != tc.expectedMail {
+				t.Errorf("failed %s: expected a mail to the guest %v, but got %v", tc.name, tc.expectedMail, mailed)
+			}
+		})
+	}
+}
+
+func Test_splitStays(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2040, 1, d, 0, 0, 0, 0, time.UTC) }
+	rooms := []models.Room{{ID: 1, RoomName: "General's Quarters"}, {ID: 2, RoomName: "Major's Suite"}, {ID: 3, RoomName: "Attic"}}
+
+	testSplits := []struct {
+		name     string
+		taken    map[int][]models.RoomRestriction
+		expected []string
+	}{
+		{"a room is free throughout", map[int][]models.RoomRestriction{}, nil},
+		{"two rooms one after the other",
+			map[int][]models.RoomRestriction{
+				1: {{StartDate: day(3), EndDate: day(5)}},
+				2: {{StartDate: day(1), EndDate: day(3)}},
+				3: {{StartDate: day(1), EndDate: day(6)}},
+			},
+			[]string{"1:1-3 2:3-6"},
+		},
+		{"the longest free room is taken next",
+			map[int][]models.RoomRestriction{
+				1: {{StartDate: day(2), EndDate: day(6)}},
+				2: {{StartDate: day(1), EndDate: day(2)}, {StartDate: day(3), EndDate: day(6)}},
+				3: {{StartDate: day(1), EndDate: day(2)}},
+			},
+			[]string{"1:1-2 3:2-6"},
+		},
+		{"three rooms",
+			map[int][]models.RoomRestriction{
+				1: {{StartDate: day(2), EndDate: day(6)}},
+				2: {{StartDate: day(1), EndDate: day(2)}, {StartDate: day(4), EndDate: day(6)}},
+				3: {{StartDate: day(1), EndDate: day(4)}},
+			},
+			[]string{"1:1-2 2:2-4 3:4-6"},
+		},
+		{"a night nobody has free",
+			map[int][]models.RoomRestriction{
+				1: {{StartDate: day(3), EndDate: day(4)}},
+				2: {{StartDate: day(3), EndDate: day(4)}},
+				3: {{StartDate: day(3), EndDate: day(4)}},
+			},
+			nil,
+		},
+	}
+
+	for _, tc := range testSplits {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, split := range splitStays(day(1), day(6), rooms, tc.taken) {
+				var parts []string
+				for _, seg := range split {
+					parts = append(parts, fmt.Sprintf("%d:%d-%d", seg.RoomID, seg.StartDate.Day(), seg.EndDate.Day()))
+				}
+				got = append(got, strings.Join(parts, " "))
+			}
+
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("failed %s: expected %v, but got %v", tc.name, tc.expected, got)
+			}
+		})
+	}
+}
+
+func Test_fitParty(t *testing.T) {
+	start := time.Date(2040, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2040, 1, 3, 0, 0, 0, 0, time.UTC)
+	cart := []models.Room{{ID: 1}, {ID: 2}}
+
+	testParties := []struct {
+		name          string
+		res           models.Reservation
+		cart          []models.Room
+		expectedRooms []string
+		expectedExtra int
+		expectedError bool
+	}{
+		{"fits the room", models.Reservation{RoomID: 1, Adults: 2}, nil, nil, 0, false},
+		{"too many for the room", models.Reservation{RoomID: 1, Adults: 2, Children: 1}, nil, nil, 0, true},
+		{"guests over the rate pay extra", models.Reservation{RoomID: 2, Adults: 2, Children: 1}, nil, nil, 5000, false},
+		{"every room of a split stay sleeps the party",
+			models.Reservation{RoomID: 2, Adults: 3, Segments: []models.StaySegment{
+				{RoomID: 2, StartDate: start, EndDate: start.AddDate(0, 0, 1)},
+				{RoomID: 1, StartDate: start.AddDate(0, 0, 1), EndDate: end},
+			}},
+			nil, nil, 0, true,
+		},
+		{"an adult in every room of the cart", models.Reservation{Adults: 2, Children: 2}, cart, []string{"1:1+1", "2:1+1"}, 0, false},
+		{"the cart fills in order", models.Reservation{Adults: 5}, cart, []string{"1:2+0", "2:3+0"}, 5000, false},
+		{"too many for the cart", models.Reservation{Adults: 5, Children: 2}, cart, nil, 0, true},
+	}
+
+	for _, tc := range testParties {
+		t.Run(tc.name, func(t *testing.T) {
+			res := tc.res
+			res.StartDate, res.EndDate = start, end
+
+			group, err := Repo.fitParty(&res, tc.cart)
+			if (err != nil) != tc.expectedError {
+				t.Fatalf("failed %s: expected error %v, but got %v", tc.name, tc.expectedError, err)
+			}
+
+			var got []string
+			for _, g := range group {
+				got = append(got, fmt.Sprintf("%d:%d+%d", g.RoomID, g.Adults, g.Children))
+			}
+			if !reflect.DeepEqual(got, tc.expectedRooms) {
+				t.Errorf("failed %s: expected rooms %v, but got %v", tc.name, tc.expectedRooms, got)
+			}
+
+			if !tc.expectedError && res.ExtraCharge != tc.expectedExtra {
+				t.Errorf("failed %s: expected an extra charge of %d, but got %d", tc.name, tc.expectedExtra, res.ExtraCharge)
+			}
+		})
+	}
+}
+
+func TestRepository_ChooseSplit(t *testing.T) {
+	testChoices := []struct {
+		name             string
+		query            string
+		resInSession     bool
+		expectedLocation string
+		segments         int
+	}{
+		{"two rooms", "room=1&change=2040-01-03&room=2", true, "/make-reservation", 2},
+		{"no reservation in the session", "room=1&change=2040-01-03&room=2", false, "/", 0},
+		{"one room", "room=1", true, "/search-availability", 0},
+		{"change outside the stay", "room=1&change=2040-01-09&room=2", true, "/search-availability", 0},
+		{"changes out of order", "room=1&change=2040-01-04&room=2&change=2040-01-03&room=1", true, "/search-availability", 0},
+		{"same room twice", "room=1&change=2040-01-03&room=1", true, "/search-availability", 0},
+		{"invalid room", "room=1&change=2040-01-03&room=x", true, "/search-availability", 0},
+		{"missing room", "room=1&change=2040-01-03&room=3", true, "/search-availability", 0},
+	}
+
+	for _, tc := range testChoices {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/choose-split?"+tc.query, nil)
+			ctx := getCtx(req)
+			req = req.WithContext(ctx)
+
+			if tc.resInSession {
+				session.Put(ctx, "reservation", models.Reservation{
+					StartDate: time.Date(2040, 1, 1, 0, 0, 0, 0, time.UTC),
+					EndDate:   time.Date(2040, 1, 6, 0, 0, 0, 0, time.UTC),
+				})
+			}
+
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(Repo.ChooseSplit).ServeHTTP(rr, req)
+
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != tc.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got %s", tc.name, tc.expectedLocation, actualLoc.String())
+			}
+
+			if tc.segments > 0 {
+				res, _ := session.Get(ctx, "reservation").(models.Reservation)
+				if len(res.Segments) != tc.segments || res.RoomID != 1 {
+					t.Errorf("failed %s: expected %d segments starting in room 1, but got %+v", tc.name, tc.segments, res.Segments)
+				}
+			}
+		})
+	}
+}
+
+func TestRepository_AdminSplitReservation(t *testing.T) {
+	testSplits := []struct {
+		name       string
+		id         string
+		postedData url.Values
+		flashType  string
+	}{
+		{"room change", "1", url.Values{"date": {"2040-01-03"}, "room_id": {"3"}, "src": {"cal"}, "y": {"2040"}, "m": {"01"}}, "flash"},
+		{"room taken", "1", url.Values{"date": {"2040-01-03"}, "room_id": {"2"}}, "error"},
+		{"not staying", "2", url.Values{"date": {"2040-01-03"}, "room_id": {"3"}}, "error"},
+		{"no date", "1", url.Values{"room_id": {"3"}}, "error"},
+		{"no room", "1", url.Values{"date": {"2040-01-03"}}, "error"},
+	}
+
+	for _, tc := range testSplits {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/admin/split-reservation/"+tc.id, strings.NewReader(tc.postedData.Encode()))
+			ctx := addURLParams(getCtx(req), map[string]string{"id": tc.id})
+			req = req.WithContext(ctx)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+
+			http.HandlerFunc(Repo.AdminSplitReservation).ServeHTTP(rr, req)
+
+			src := tc.postedData.Get("src")
+			if src == "" {
+				src = "all"
+			}
+			expected := fmt.Sprintf("/admin/reservations/%s/%s/show?y=%s&m=%s", src, tc.id, tc.postedData.Get("y"), tc.postedData.Get("m"))
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != expected {
+				t.Errorf("failed %s: expected location %s, but got %s", tc.name, expected, actualLoc.String())
+			}
+
+			if !session.Exists(ctx, tc.flashType) {
+				t.Errorf("failed %s: expected %s message in the session", tc.name, tc.flashType)
+			}
+		})
+	}
+}
+
+func TestRepository_ChooseRooms(t *testing.T) {
+	testChoices := []struct {
+		name             string
+		rooms            []string
+		quantities       []string
+		resInSession     bool
+		expectedLocation string
+		cart             int
+	}{
+		{"two rooms", []string{"1", "2"}, nil, true, "/make-reservation", 2},
+		{"one room", []string{"2"}, nil, true, "/make-reservation", 0},
+		{"two units of a type", []string{"1", "2"}, []string{"0", "2"}, true, "/make-reservation", 2},
+		{"a unit of each type and another", []string{"1", "2"}, []string{"1", "2"}, true, "/make-reservation", 3},
+		{"more units than the type has", []string{"1"}, []string{"2"}, true, "/search-availability", 0},
+		{"same type twice", []string{"1", "1"}, nil, true, "/search-availability", 0},
+		{"none of any type", []string{"1", "2"}, []string{"0", "0"}, true, "/search-availability", 0},
+		{"too many rooms", []string{"2"}, []string{"11"}, true, "/search-availability", 0},
+		{"no rooms", nil, nil, true, "/search-availability", 0},
+		{"no reservation in the session", []string{"1", "2"}, nil, false, "/", 0},
+		{"missing room", []string{"1", "3"}, nil, true, "/search-availability", 0},
+	}
+
+	for _, tc := range testChoices {
+		t.Run(tc.name, func(t *testing.T) {
+			postedData := url.Values{"room_id": tc.rooms, "quantity": tc.quantities}
+			req, _ := http.NewRequest("POST", "/choose-rooms", strings.NewReader(postedData.Encode()))
+			ctx := getCtx(req)
+			req = req.WithContext(ctx)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			if tc.resInSession {
+				session.Put(ctx, "reservation", models.Reservation{
+					StartDate: time.Date(2040, 1, 1, 0, 0, 0, 0, time.UTC),
+					EndDate:   time.Date(2040, 1, 3, 0, 0, 0, 0, time.UTC),
+				})
+			}
+
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(Repo.ChooseRooms).ServeHTTP(rr, req)
+
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != tc.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got %s", tc.name, tc.expectedLocation, actualLoc.String())
+			}
+
+			cart, _ := session.Get(ctx, "cart").([]models.Room)
+			if len(cart) != tc.cart {
+				t.Errorf("failed %s: expected %d rooms in the cart, but got %d", tc.name, tc.cart, len(cart))
+			}
+
+			// every room in the cart is a different unit
+			units := make(map[int]bool)
+			for _, room := range cart {
+				if units[room.ID] {
+					t.Errorf("failed %s: room %d is in the cart twice", tc.name, room.ID)
+				}
+				units[room.ID] = true
+			}
+		})
+	}
+}
+
+func TestRepository_CartRemove(t *testing.T) {
+	testRemovals := []struct {
+		name      string
+		id        string
+		cart      []models.Room
+		flashType string
+		left      int
+		roomID    int
+	}{
+		{"down to one room", "1", []models.Room{{ID: 1}, {ID: 2}}, "flash", 0, 2},
+		{"rooms left", "2", []models.Room{{ID: 1}, {ID: 2}, {ID: 3}}, "flash", 2, 1},
+		{"not in the cart", "3", []models.Room{{ID: 1}, {ID: 2}}, "error", 2, 1},
+		{"no cart", "1", nil, "error", 0, 1},
+		{"invalid id", "x", []models.Room{{ID: 1}, {ID: 2}}, "error", 2, 1},
+	}
+
+	for _, tc := range testRemovals {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/cart/remove/"+tc.id, nil)
+			ctx := addURLParams(getCtx(req), map[string]string{"id": tc.id})
+			req = req.WithContext(ctx)
+
+			session.Put(ctx, "reservation", models.Reservation{RoomID: 1})
+			if tc.cart != nil {
+				session.Put(ctx, "cart", tc.cart)
+			}
+
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(Repo.CartRemove).ServeHTTP(rr, req)
+
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != "/make-reservation" {
+				t.Errorf("failed %s: expected location /make-reservation, but got %s", tc.name, actualLoc.String())
+			}
+
+			if !session.Exists(ctx, tc.flashType) {
+				t.Errorf("failed %s: expected %s message in the session", tc.name, tc.flashType)
+			}
+
+			cart, _ := session.Get(ctx, "cart").([]models.Room)
+			res, _ := session.Get(ctx, "reservation").(models.Reservation)
+			if len(cart) != tc.left || res.RoomID != tc.roomID {
+				t.Errorf("failed %s: expected %d rooms in the cart and room %d, but got %d and room %d",
+					tc.name, tc.left, tc.roomID, len(cart), res.RoomID)
+			}
+		})
+	}
+}
+
+func TestRepository_PostReservationGroup(t *testing.T) {
+	// a buffered channel keeps the mail around to be counted
+	listened := app.MailChan
+	app.MailChan = make(chan models.MailData, 2)
+	defer func() { app.MailChan = listened }()
+
+	testGroups := []struct {
+		name             string
+		cart             []models.Room
+		expectedLocation string
+		expectedMail     int
+	}{
+		{"two rooms", []models.Room{{ID: 1, RoomName: "General's Quarters"}, {ID: 2, RoomName: "Major's Suite"}}, "/reservation-summary", 2},
+		{"room taken meanwhile", []models.Room{{ID: 1}, {ID: 3}}, "/search-availability", 0},
+	}
+
+	for _, tc := range testGroups {
+		t.Run(tc.name, func(t *testing.T) {
+			postedData := url.Values{
+				"first_name": {"John"},
+				"last_name":  {"Smith"},
+				"email":      {"john@smith.com"},
+				"phone":      {"555-555-5555"},
+			}
+			req, _ := http.NewRequest("POST", "/make-reservation", strings.NewReader(postedData.Encode()))
+			ctx := getCtx(req)
+			req = req.WithContext(ctx)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			session.Put(ctx, "reservation", models.Reservation{
+				RoomID:    1,
+				StartDate: time.Date(2040, 1, 1, 0, 0, 0, 0, time.UTC),
+				EndDate:   time.Date(2040, 1, 3, 0, 0, 0, 0, time.UTC),
+			})
+			session.Put(ctx, "cart", tc.cart)
+
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(Repo.PostReservation).ServeHTTP(rr, req)
+
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != tc.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got %s", tc.name, tc.expectedLocation, actualLoc.String())
+			}
+
+			if len(app.MailChan) != tc.expectedMail {
+				t.Errorf("failed %s: expected %d mails, but got %d", tc.name, tc.expectedMail, len(app.MailChan))
+			}
+			for len(app.MailChan) > 0 {
+				<-app.MailChan
+			}
+
+			if tc.expectedMail > 0 {
+				res, _ := session.Get(ctx, "reservation").(models.Reservation)
+				if res.GroupID != 1 {
+					t.Errorf("failed %s: expected group 1 in the session, but got %d", tc.name, res.GroupID)
+				}
+			}
+		})
+	}
+}
+
+func TestRepository_AdminCancelGroup(t *testing.T) {
+	testCancels := []struct {
+		name       string
+		id         string
+		postedData url.Values
+		flashType  string
+	}{
+		{"group cancelled", "1", url.Values{"reservation_id": {"6"}, "src": {"cal"}, "y": {"2040"}, "m": {"01"}}, "flash"},
+		{"nothing to cancel", "2", url.Values{"reservation_id": {"6"}}, "error"},
+	}
+
+	for _, tc := range testCancels {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/admin/cancel-group/"+tc.id, strings.NewReader(tc.postedData.Encode()))
+			ctx := addURLParams(getCtx(req), map[string]string{"id": tc.id})
+			req = req.WithContext(ctx)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+
+			http.HandlerFunc(Repo.AdminCancelGroup).ServeHTTP(rr, req)
+
+			src := tc.postedData.Get("src")
+			if src == "" {
+				src = "all"
+			}
+			expected := fmt.Sprintf("/admin/reservations/%s/6/show?y=%s&m=%s", src, tc.postedData.Get("y"), tc.postedData.Get("m"))
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != expected {
+				t.Errorf("failed %s: expected location %s, but got %s", tc.name, expected, actualLoc.String())
+			}
+
+			if !session.Exists(ctx, tc.flashType) {
+				t.Errorf("failed %s: expected %s message in the session", tc.name, tc.flashType)
+			}
+		})
+	}
+}
+
+func TestRepository_PostGroupBooking(t *testing.T) {
+	testCodes := []struct {
+		name               string
+		code               string
+		expectedStatusCode int
+		roomID             int
+	}{
+		{"valid code", "wedding ", http.StatusSeeOther, 1},
+		{"fully booked", "FULL", http.StatusOK, 0},
+		{"unknown code", "NOPE", http.StatusOK, 0},
+		{"no code", "", http.StatusOK, 0},
+	}
+
+	for _, tc := range testCodes {
+		t.Run(tc.name, func(t *testing.T) {
+			postedData := url.Values{"code": {tc.code}}
+			req, _ := http.NewRequest("POST", "/group-booking", strings.NewReader(postedData.Encode()))
+			ctx := getCtx(req)
+			req = req.WithContext(ctx)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+
+			http.HandlerFunc(Repo.PostGroupBooking).ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatusCode {
+				t.Errorf("failed %s: expected code %d, but got %d", tc.name, tc.expectedStatusCode, rr.Code)
+			}
+
+			if tc.roomID > 0 {
+				res, _ := session.Get(ctx, "reservation").(models.Reservation)
+				if res.RoomID != tc.roomID || res.AllotmentID != 1 {
+					t.Errorf("failed %s: expected room %d of allotment 1, but got %+v", tc.name, tc.roomID, res)
+				}
+			}
+		})
+	}
+}
+
+func TestRepository_PostReservationFromAllotment(t *testing.T) {
+	// a buffered channel keeps the mail around to be counted
+	listened := app.MailChan
+	app.MailChan = make(chan models.MailData, 2)
+	defer func() { app.MailChan = listened }()
+
+	testBookings := []struct {
+		name             string
+		allotmentID      int
+		adults           string
+		expectedLocation string
+		expectedMail     int
+	}{
+		{"room held", 1, "2", "/reservation-summary", 2},
+		{"fully booked meanwhile", 2, "2", "/group-booking", 0},
+		{"no room left sleeps the party", 1, "4", "/group-booking", 0},
+	}
+
+	for _, tc := range testBookings {
+		t.Run(tc.name, func(t *testing.T) {
+			postedData := url.Values{
+				"first_name": {"John"},
+				"last_name":  {"Smith"},
+				"email":      {"john@smith.com"},
+				"phone":      {"555-555-5555"},
+				"adults":     {tc.adults},
+			}
+			req, _ := http.NewRequest("POST", "/make-reservation", strings.NewReader(postedData.Encode()))
+			ctx := getCtx(req)
+			req = req.WithContext(ctx)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			session.Put(ctx, "reservation", models.Reservation{
+				RoomID:      2,
+				AllotmentID: tc.allotmentID,
+				StartDate:   time.Date(2040, 6, 1, 0, 0, 0, 0, time.UTC),
+				EndDate:     time.Date(2040, 6, 3, 0, 0, 0, 0, time.UTC),
+			})
+
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(Repo.PostReservation).ServeHTTP(rr, req)
+
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != tc.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got %s", tc.name, tc.expectedLocation, actualLoc.String())
+			}
+
+			if len(app.MailChan) != tc.expectedMail {
+				t.Errorf("failed %s: expected %d mails, but got %d", tc.name, tc.expectedMail, len(app.MailChan))
+			}
+			for len(app.MailChan) > 0 {
+				<-app.MailChan
+			}
+
+			// the allotment decides the room, not the session
+			if tc.expectedMail > 0 {
+				res, _ := session.Get(ctx, "reservation").(models.Reservation)
+				if res.RoomID != 1 || res.ID != 9 {
+					t.Errorf("failed %s: expected reservation 9 in room 1, but got %d in room %d", tc.name, res.ID, res.RoomID)
+				}
+			}
+		})
+	}
+}
+
+func TestRepository_AdminPostNewAllotment(t *testing.T) {
+	release := time.Now().AddDate(0, 1, 0).Format("2006-01-02")
+	start := time.Now().AddDate(0, 2, 0).Format("2006-01-02")
+	end := time.Now().AddDate(0, 2, 2).Format("2006-01-02")
+
+	with := func(changes map[string][]string) url.Values {
+		v := url.Values{
+			"name":         {"Smith wedding"},
+			"start_date":   {start},
+			"end_date":     {end},
+			"release_date": {release},
+			"room_id":      {"1"},
+		}
+		for key, value := range changes {
+			v[key] = value
+		}
+		return v
+	}
+
+	testAllotments := []struct {
+		name               string
+		postedData         url.Values
+		expectedStatusCode int
+		expectedLocation   string
+	}{
+		{"valid", with(nil), http.StatusSeeOther, "/admin/allotments/1"},
+		{"room taken", with(map[string][]string{"room_id": {"1", "2"}}), http.StatusOK, ""},
+		{"no rooms", with(map[string][]string{"room_id": nil}), http.StatusOK, ""},
+		{"no name", with(map[string][]string{"name": {""}}), http.StatusOK, ""},
+		{"end before start", with(map[string][]string{"end_date": {start}}), http.StatusOK, ""},
+		{"release after start", with(map[string][]string{"release_date": {end}}), http.StatusOK, ""},
+		{"release in the past", with(map[string][]string{"release_date": {"2020-01-01"}}), http.StatusOK, ""},
+		{"invalid release date", with(map[string][]string{"release_date": {"soon"}}), http.StatusOK, ""},
+	}
+
+	for _, tc := range testAllotments {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/admin/allotments/new", strings.NewReader(tc.postedData.Encode()))
+			ctx := getCtx(req)
+			req = req.WithContext(ctx)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+
+			http.HandlerFunc(Repo.AdminPostNewAllotment).ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatusCode {
+				t.Errorf("failed %s: expected code %d, but got %d", tc.name, tc.expectedStatusCode, rr.Code)
+			}
+
+			if tc.expectedLocation != "" {
+				actualLoc, _ := rr.Result().Location()
+				if actualLoc.String() != tc.expectedLocation {
+					t.Errorf("failed %s: expected location %s, but got %s", tc.name, tc.expectedLocation, actualLoc.String())
+				}
+			}
+		})
+	}
+}
+
+func TestRepository_AdminAssignUnit(t *testing.T) {
+	testAssignments := []struct {
+		name      string
+		id        string
+		roomID    string
+		flashType string
+	}{
+		{"unit assigned", "1", "1", "flash"},
+		{"unit taken", "1", "2", "error"},
+		{"reservation gone", "2", "1", "error"},
+		{"reservation not found", "500", "1", "error"},
+		{"unit of another type", "1", "3", "error"},
+		{"no unit", "1", "", "error"},
+	}
+
+	for _, tc := range testAssignments {
+		t.Run(tc.name, func(t *testing.T) {
+			postedData := url.Values{"room_id": {tc.roomID}, "date": {"2040-01-01"}}
+			req, _ := http.NewRequest("POST", "/admin/assign-unit/"+tc.id, strings.NewReader(postedData.Encode()))
+			ctx := addURLParams(getCtx(req), map[string]string{"id": tc.id})
+			req = req.WithContext(ctx)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+
+			http.HandlerFunc(Repo.AdminAssignUnit).ServeHTTP(rr, req)
+
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != "/admin/front-desk?date=2040-01-01" {
+				t.Errorf("failed %s: expected location /admin/front-desk?date=2040-01-01, but got %s", tc.name, actualLoc.String())
+			}
+
+			if !session.Exists(ctx, tc.flashType) {
+				t.Errorf("failed %s: expected %s message in the session", tc.name, tc.flashType)
+			}
+		})
+	}
+}
+
+func TestRepository_AdminPostRoom(t *testing.T) {
+	testRooms := []struct {
+		name       string
+		id         string
+		postedData url.Values
+		flashType  string
+	}{
+		{"rates changed", "2", url.Values{"nightly_rate": {"150"}, "max_occupancy": {"3"}}, "flash"},
+		{"nothing changed", "1", url.Values{}, "flash"},
+		{"missing unit", "100", url.Values{"nightly_rate": {"150"}}, "error"},
+		{"can't save", "1", url.Values{"nightly_rate": {"2000"}}, "error"},
+	}
+
+	for _, tc := range testRooms {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/admin/rooms/"+tc.id, strings.NewReader(tc.postedData.Encode()))
+			ctx := addURLParams(getCtx(req), map[string]string{"id": tc.id})
+			req = req.WithContext(ctx)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+
+			http.HandlerFunc(Repo.AdminPostRoom).ServeHTTP(rr, req)
+
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != "/admin/room-types" {
+				t.Errorf("failed %s: expected to go back to the room types, got %s", tc.name, actualLoc.String())
+			}
+
+			if !session.Exists(ctx, tc.flashType) {
+				t.Errorf("failed %s: expected %s message in the session", tc.name, tc.flashType)
+			}
+		})
+	}
+}
+
+func Test_roomRatesFromForm(t *testing.T) {
+	room := models.Room{NightlyRate: 10000, MaxOccupancy: 4, BaseOccupancy: 2, ExtraPersonRate: 2500}
+	roomRatesFromForm(url.Values{"nightly_rate": {"120"}, "max_occupancy": {"1"}, "extra_person_rate": {""}}, &room)
+
+	if room.NightlyRate != 12000 || room.MaxOccupancy != 1 || room.ExtraPersonRate != 2500 {
+		t.Errorf("got rate %d sleeping %d with extra guests at %d, wanted 12000 sleeping 1 with extra guests at 2500",
+			room.NightlyRate, room.MaxOccupancy, room.ExtraPersonRate)
+	}
+	if room.BaseOccupancy != 1 {
+		t.Errorf("got %d guests in the rate of a room sleeping 1", room.BaseOccupancy)
+	}
+}
+
+func TestRepository_AdminPostRoomType(t *testing.T) {
+	testTypes := []struct {
+		name               string
+		typeName           string
+		expectedStatusCode int
+	}{
+		{"new type", "Standard Double", http.StatusSeeOther},
+		{"no name", "", http.StatusOK},
+		{"existing type", "General's Quarters", http.StatusOK},
+	}
+
+	for _, tc := range testTypes {
+		t.Run(tc.name, func(t *testing.T) {
+			postedData := url.Values{"type_name": {tc.typeName}, "description": {"Two beds"}}
+			req, _ := http.NewRequest("POST", "/admin/room-types", strings.NewReader(postedData.Encode()))
+			ctx := getCtx(req)
+			req = req.WithContext(ctx)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+
+			http.HandlerFunc(Repo.AdminPostRoomType).ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatusCode {
+				t.Errorf("failed %s: expected code %d, but got %d", tc.name, tc.expectedStatusCode, rr.Code)
+			}
+		})
+	}
+}
+
+func TestRepository_AdminPostRoomTypeUnit(t *testing.T) {
+	testUnits := []struct {
+		name      string
+		typeID    string
+		roomName  string
+		flashType string
+	}{
+		{"unit added", "1", "Double 1", "flash"},
+		{"no name", "1", "", "error"},
+		{"missing type", "3", "Double 1", "error"},
+	}
+
+	for _, tc := range testUnits {
+		t.Run(tc.name, func(t *testing.T) {
+			postedData := url.Values{"room_name": {tc.roomName}, "nightly_rate": {"120"}}
+			req, _ := http.NewRequest("POST", "/admin/room-types/"+tc.typeID+"/units", strings.NewReader(postedData.Encode()))
+			ctx := addURLParams(getCtx(req), map[string]string{"id": tc.typeID})
+			req = req.WithContext(ctx)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+
+			http.HandlerFunc(Repo.AdminPostRoomTypeUnit).ServeHTTP(rr, req)
+
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != "/admin/room-types" {
+				t.Errorf("failed %s: expected location /admin/room-types, but got %s", tc.name, actualLoc.String())
+			}
+
+			if !session.Exists(ctx, tc.flashType) {
+				t.Errorf("failed %s: expected %s message in the session", tc.name, tc.flashType)
+			}
+		})
+	}
+}
+
+func TestRepository_AdminPostAmenity(t *testing.T) {
+	testAmenities := []struct {
+		name               string
+		amenity            string
+		category           string
+		expectedStatusCode int
+	}{
+		{"new amenity", "Balcony", "view", http.StatusSeeOther},
+		{"no name", "", "view", http.StatusOK},
+		{"unknown category", "Minibar", "kitchen", http.StatusOK},
+		{"existing amenity", "Bathtub", "bathroom", http.StatusOK},
+	}
+
+	for _, tc := range testAmenities {
+		t.Run(tc.name, func(t *testing.T) {
+			postedData := url.Values{"name": {tc.amenity}, "category": {tc.category}}
+			req, _ := http.NewRequest("POST", "/admin/amenities", strings.NewReader(postedData.Encode()))
+			ctx := getCtx(req)
+			req = req.WithContext(ctx)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+
+			http.HandlerFunc(Repo.AdminPostAmenity).ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatusCode {
+				t.Errorf("failed %s: expected code %d, but got %d", tc.name, tc.expectedStatusCode, rr.Code)
+			}
+		})
+	}
+}
+
+func TestRepository_AdminPostRoomAmenities(t *testing.T) {
+	testRooms := []struct {
+		name      string
+		roomID    string
+		flashType string
+	}{
+		{"amenities saved", "1", "flash"},
+		{"missing room", "3", "error"},
+	}
+
+	for _, tc := range testRooms {
+		t.Run(tc.name, func(t *testing.T) {
+			postedData := url.Values{"amenity": {"1", "3"}}
+			req, _ := http.NewRequest("POST", "/admin/rooms/"+tc.roomID+"/amenities", strings.NewReader(postedData.Encode()))
+			ctx := addURLParams(getCtx(req), map[string]string{"id": tc.roomID})
+			req = req.WithContext(ctx)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+
+			http.HandlerFunc(Repo.AdminPostRoomAmenities).ServeHTTP(rr, req)
+
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != "/admin/amenities" {
+				t.Errorf("failed %s: expected location /admin/amenities, but got %s", tc.name, actualLoc.String())
+			}
+
+			if !session.Exists(ctx, tc.flashType) {
+				t.Errorf("failed %s: expected %s message in the session", tc.name, tc.flashType)
+			}
+		})
+	}
+}
+
+func TestRepository_PostFlexibleSearch(t *testing.T) {
+	tests := []struct {
+		name           string
+		postedData     url.Values
+		expectedStatus int
+		expectedInBody string
+		notInBody      string
+	}{
+		{"a month", url.Values{"month": {"2040-03"}, "nights": {"3"}}, http.StatusOK, "/choose-room/1?s=2040-03-01&e=2040-03-04", ""},
+		{"the price", url.Values{"month": {"2040-03"}, "nights": {"3"}}, http.StatusOK, "300.00", ""},
+		{"a date range", url.Values{"start": {"2040-03-10"}, "end": {"2040-03-14"}, "nights": {"4"}}, http.StatusOK, "s=2040-03-10&e=2040-03-14", "s=2040-03-11"},
+		{"weekends only", url.Values{"month": {"2040-03"}, "nights": {"2"}, "weekends": {"1"}}, http.StatusOK, "s=2040-03-02&e=2040-03-04", "s=2040-03-01"},
+		{"under the weekend minimum", url.Values{"month": {"2040-03"}, "nights": {"1"}}, http.StatusOK, "s=2040-03-01&e=2040-03-02", "s=2040-03-02"},
+		{"nothing free", url.Values{"month": {"2050-03"}, "nights": {"2"}}, http.StatusOK, "No room is free", ""},
+		{"no dates", url.Values{"nights": {"2"}}, http.StatusSeeOther, "", ""},
+		{"invalid month", url.Values{"month": {"march"}, "nights": {"2"}}, http.StatusSeeOther, "", ""},
+		{"range too long", url.Values{"start": {"2040-01-01"}, "end": {"2040-06-01"}, "nights": {"2"}}, http.StatusSeeOther, "", ""},
+		{"no nights", url.Values{"month": {"2040-03"}}, http.StatusSeeOther, "", ""},
+		{"too many nights", url.Values{"month": {"2040-03"}, "nights": {"31"}}, http.StatusSeeOther, "", ""},
+		{"stay longer than the range", url.Values{"start": {"2040-03-10"}, "end": {"2040-03-12"}, "nights": {"3"}}, http.StatusSeeOther, "", ""},
+		{"month in the past", url.Values{"month": {"2020-01"}, "nights": {"2"}}, http.StatusSeeOther, "", ""},
+		{"party too large", url.Values{"month": {"2040-03"}, "nights": {"2"}, "adults": {"11"}}, http.StatusSeeOther, "", ""},
+		{"database error", url.Values{"start": {"2060-01-01"}, "end": {"2060-01-10"}, "nights": {"2"}}, http.StatusTemporaryRedirect, "", ""},
+	}
+
+	for _, tc := range tests {
+		req, _ := http.NewRequest("POST", "/flexible-search", strings.NewReader(tc.postedData.Encode()))
+		req = req.WithContext(getCtx(req))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PostFlexibleSearch)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != tc.expectedStatus {
+			t.Errorf("%s: got status %d, wanted %d", tc.name, rr.Code, tc.expectedStatus)
+		}
+		if tc.expectedInBody != "" && !strings.Contains(rr.Body.String(), tc.expectedInBody) {
+			t.Errorf("%s: expected %s in the page", tc.name, tc.expectedInBody)
+		}
+		if tc.notInBody != "" && strings.Contains(rr.Body.String(), tc.notInBody) {
+			t.Errorf("%s: didn't expect %s in the page", tc.name, tc.notInBody)
+		}
+	}
+}
+
+func TestRepository_AvailabilityCalendar(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		expectedOK bool
+		nights     int
+		night      string // a night to check, by date
+		available  bool
+		price      int
+		minStay    int
+	}{
+		{"a month", "room_id=1&from=2040-03", true, 31, "2040-03-20", true, 10000, 1},
+		{"a weekend arrival", "room_id=1&from=2040-03", true, 31, "2040-03-02", true, 10000, 2},
+		{"a booked night", "room_id=1&from=2040-03", true, 31, "2040-03-03", false, 10000, 2},
+		{"a checkout day is free", "room_id=1&from=2040-03", true, 31, "2040-03-05", true, 10000, 1},
+		{"several months", "room_id=1&from=2040-03&to=2040-05", true, 92, "2040-05-31", true, 10000, 1},
+		{"extra guests", "room_id=2&from=2040-03&guests=3", true, 31, "2040-03-03", true, 14500, 2},
+		{"the past", "room_id=2&from=2020-01", true, 31, "2020-01-15", false, 12000, 1},
+		{"invalid room id", "room_id=x&from=2040-03", false, 0, "", false, 0, 0},
+		{"unknown room", "room_id=3&from=2040-03", false, 0, "", false, 0, 0},
+		{"invalid from", "room_id=1&from=march", false, 0, "", false, 0, 0},
+		{"to before from", "room_id=1&from=2040-03&to=2040-02", false, 0, "", false, 0, 0},
+		{"too many months", "room_id=1&from=2040-01&to=2041-01", false, 0, "", false, 0, 0},
+	}
+
+	for _, tc := range tests {
+		req, _ := http.NewRequest("GET", "/availability-calendar?"+tc.query, nil)
+		req = req.WithContext(getCtx(req))
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AvailabilityCalendar)
+		handler.ServeHTTP(rr, req)
+
+		var resp calendarResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: failed to parse json: %v", tc.name, err)
+		}
+
+		if resp.OK != tc.expectedOK {
+			t.Errorf("%s: got ok %v, wanted %v", tc.name, resp.OK, tc.expectedOK)
+		}
+		if len(resp.Nights) != tc.nights {
+			t.Errorf("%s: got %d nights, wanted %d", tc.name, len(resp.Nights), tc.nights)
+		}
+
+		for _, n := range resp.Nights {
+			if n.Date != tc.night {
+				continue
+			}
+			if n.Available != tc.available {
+				t.Errorf("%s: got available %v on %s, wanted %v", tc.name, n.Available, n.Date, tc.available)
+			}
+			if n.Price != tc.price {
+				t.Errorf("%s: got price %d on %s, wanted %d", tc.name, n.Price, n.Date, tc.price)
+			}
+			if n.MinStay != tc.minStay {
+				t.Errorf("%s: got min stay %d on %s, wanted %d", tc.name, n.MinStay, n.Date, tc.minStay)
+			}
+		}
+	}
+}
+
+func TestRepository_PostWaitlist(t *testing.T) {
+	tests := []struct {
+		name             string
+		postedData       url.Values
+		expectedStatus   int
+		expectedLocation string
+	}{
+		{"joined", url.Values{"email": {"guest@here.com"}, "start": {"2050-01-01"}, "end": {"2050-01-03"}, "adults": {"2"}, "room_type_id": {"1"}}, http.StatusSeeOther, "/search-availability"},
+		{"any room", url.Values{"email": {"guest@here.com"}, "start": {"2050-01-01"}, "end": {"2050-01-03"}}, http.StatusSeeOther, "/search-availability"},
+		{"invalid email", url.Values{"email": {"guest"}, "start": {"2050-01-01"}, "end": {"2050-01-03"}}, http.StatusOK, ""},
+		{"no dates", url.Values{"email": {"guest@here.com"}}, http.StatusOK, ""},
+		{"invalid date", url.Values{"email": {"guest@here.com"}, "start": {"soon"}, "end": {"2050-01-03"}}, http.StatusOK, ""},
+		{"in the past", url.Values{"email": {"guest@here.com"}, "start": {"2020-01-01"}, "end": {"2020-01-03"}}, http.StatusOK, ""},
+		{"party too large", url.Values{"email": {"guest@here.com"}, "start": {"2050-01-01"}, "end": {"2050-01-03"}, "adults": {"11"}}, http.StatusOK, ""},
+		{"database error", url.Values{"email": {"full@here.com"}, "start": {"2050-01-01"}, "end": {"2050-01-03"}}, http.StatusSeeOther, "/search-availability"},
+	}
+
+	for _, tc := range tests {
+		req, _ := http.NewRequest("POST", "/waitlist", strings.NewReader(tc.postedData.Encode()))
+		req = req.WithContext(getCtx(req))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PostWaitlist)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != tc.expectedStatus {
+			t.Errorf("%s: got status %d, wanted %d", tc.name, rr.Code, tc.expectedStatus)
+		}
+		if tc.expectedLocation != "" {
+			if loc, _ := rr.Result().Location(); loc == nil || loc.String() != tc.expectedLocation {
+				t.Errorf("%s: expected location %s, got %v", tc.name, tc.expectedLocation, loc)
+			}
+		}
+	}
+}
+
+func TestRepository_NotifyWaitlist(t *testing.T) {
+	listened := app.MailChan
+	app.MailChan = make(chan models.MailData, 1)
+	defer func() { app.MailChan = listened }()
+
+	Repo.NotifyWaitlist()
+
+	if len(app.MailChan) != 1 {
+		t.Fatalf("expected 1 offer mailed, got %d", len(app.MailChan))
+	}
+	msg := <-app.MailChan
+	if msg.To != "waiting@here.com" {
+		t.Errorf("offer mailed to %s, wanted waiting@here.com", msg.To)
+	}
+	if !strings.Contains(msg.Content, "/waitlist/offer?token=") {
+		t.Errorf("offer mail has no booking link: %s", msg.Content)
+	}
+}
+
+func TestRepository_WaitlistOffer(t *testing.T) {
+	tests := []struct {
+		name             string
+		token            string
+		expectedLocation string
+	}{
+		{"live offer", helpers.SignToken("1", time.Minute), "/make-reservation"},
+		{"expired link", helpers.SignToken("1", -time.Minute), "/search-availability"},
+		{"tampered link", strings.Replace(helpers.SignToken("1", time.Minute), ".", ".x", 1), "/search-availability"},
+		{"expired offer", helpers.SignToken("2", time.Minute), "/search-availability"},
+		{"already booked", helpers.SignToken("3", time.Minute), "/search-availability"},
+		{"no room offered", helpers.SignToken("4", time.Minute), "/search-availability"},
+		{"unknown entry", helpers.SignToken("9", time.Minute), "/search-availability"},
+	}
+
+	for _, tc := range tests {
+		req, _ := http.NewRequest("GET", "/waitlist/offer?token="+url.QueryEscape(tc.token), nil)
+		req = req.WithContext(getCtx(req))
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.WaitlistOffer)
+		handler.ServeHTTP(rr, req)
+
+		if loc, _ := rr.Result().Location(); loc == nil || loc.String() != tc.expectedLocation {
+			t.Errorf("%s: expected location %s, got %v", tc.name, tc.expectedLocation, loc)
+		}
+
+		res, ok := session.Get(req.Context(), "reservation").(models.Reservation)
+		if tc.expectedLocation == "/make-reservation" {
+			if !ok || res.RoomID != 1 || res.Adults != 2 || res.Children != 1 || res.Email != "waiting@here.com" {
+				t.Errorf("%s: the offer wasn't put in the session: %+v", tc.name, res)
+			}
+			if session.GetInt(req.Context(), "waitlist_id") != 1 {
+				t.Errorf("%s: the waitlist entry wasn't put in the session", tc.name)
+			}
+			if holds, _ := session.Get(req.Context(), "holds").([]int); len(holds) != 1 || holds[0] != 201 {
+				t.Errorf("%s: expected the offer's hold to become the guest's, got holds %v", tc.name, holds)
+			}
+		}
+	}
+}
+
+func TestRepository_holds(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/book-room?s=2040-01-01&e=2040-01-03&id=1", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.BookRoom).ServeHTTP(rr, req)
+
+	holds, _ := session.Get(ctx, "holds").([]int)
+	if len(holds) != 1 || holds[0] != 101 {
+		t.Errorf("expected room 1 held, got holds %v", holds)
+	}
+	if !Repo.holdLasts(req) {
+		t.Error("expected the hold to last")
+	}
+
+	// the form counts down the hold
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(Repo.Reservation).ServeHTTP(rr, req)
+	if !strings.Contains(rr.Body.String(), `id="hold"`) {
+		t.Error("expected the hold countdown on the reservation form")
+	}
+
+	// searching again gives the room back
+	Repo.releaseHolds(req)
+	if session.Exists(ctx, "holds") || Repo.holdLasts(req) {
+		t.Error("expected the holds released")
+	}
+}
+
+func TestRepository_PostReservation_expiredHold(t *testing.T) {
+	tests := []struct {
+		name             string
+		roomID           int
+		holdExpires      time.Time
+		expectedLocation string
+		holdKept         bool
+	}{
+		{"hold lasts", 1, time.Now().Add(time.Minute), "/reservation-summary", false},
+		{"hold expired and the room was booked", 1, time.Now().Add(-time.Minute), "/search-availability", false},
+		{"never held and the room was booked", 1, time.Time{}, "/search-availability", false},
+		{"hold lasts but the reservation can't be saved", 2, time.Now().Add(time.Minute), "/", true},
+	}
+
+	for _, tc := range tests {
+		postedData := url.Values{}
+		postedData.Add("first_name", "John")
+		postedData.Add("last_name", "Smith")
+		postedData.Add("email", "john@smith.com")
+		postedData.Add("phone", "555-555-5555")
+
+		req, _ := http.NewRequest("POST", "/make-reservation", strings.NewReader(postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		// nothing is free after 2049 but the room held
+		session.Put(ctx, "reservation", models.Reservation{
+			RoomID:    tc.roomID,
+			Room:      models.Room{ID: tc.roomID, RoomName: "General's Quarters"},
+			StartDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+			EndDate:   time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
+		})
+		if !tc.holdExpires.IsZero() {
+			session.Put(ctx, "holds", []int{tc.roomID + 100})
+			session.Put(ctx, "hold_expires", tc.holdExpires.Unix())
+		}
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(Repo.PostReservation).ServeHTTP(rr, req)
+
+		if loc, _ := rr.Result().Location(); loc == nil || loc.String() != tc.expectedLocation {
+			t.Errorf("%s: expected location %s, got %v", tc.name, tc.expectedLocation, loc)
+		}
+		// the holds are booked, or kept for another try when saving fails
+		if session.Exists(ctx, "holds") != tc.holdKept {
+			t.Errorf("%s: expected the holds kept to be %t", tc.name, tc.holdKept)
+		}
+	}
+}
+
+func Test_reservationStays(t *testing.T) {
+	start := time.Date(2040, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2040, 1, 5, 0, 0, 0, 0, time.UTC)
+	res := models.Reservation{RoomID: 1, StartDate: start, EndDate: end}
+
+	if stays := reservationStays(res, nil); len(stays) != 1 || stays[0].RoomID != 1 || !stays[0].EndDate.Equal(end) {
+		t.Errorf("expected the whole stay in room 1, got %+v", stays)
+	}
+
+	cart := []models.Room{{ID: 1}, {ID: 2}}
+	if stays := reservationStays(res, cart); len(stays) != 2 || stays[1].RoomID != 2 || !stays[1].StartDate.Equal(start) {
+		t.Errorf("expected the whole stay in both rooms of the cart, got %+v", stays)
+	}
+
+	res.Segments = []models.StaySegment{
+		{RoomID: 1, StartDate: start, EndDate: start.AddDate(0, 0, 2)},
+		{RoomID: 2, StartDate: start.AddDate(0, 0, 2), EndDate: end},
+	}
+	if stays := reservationStays(res, nil); len(stays) != 2 || stays[1].RoomID != 2 {
+		t.Errorf("expected the segments of the split stay, got %+v", stays)
+	}
+}
+
+func Test_reservationFilterFromQuery(t *testing.T) {
+	q := url.Values{}
+	q.Set("from", "2050-01-01")
+	q.Set("to", "2050-01-31")
+	q.Set("room", "2")
+	q.Set("status", "processed")
+	q.Set("q", "  smith ")
+	q.Set("sort", "last_name")
+	q.Set("dir", "desc")
+
+	f := reservationFilterFromQuery(q)
+	if f.From.Format("2006-01-02") != "2050-01-01" || f.To.Format("2006-01-02") != "2050-01-31" {
+		t.Errorf("wrong date range %s - %s", f.From, f.To)
+	}
+	if f.RoomID != 2 || f.Status != "processed" || f.Search != "smith" || f.Sort != "last_name" || !f.Desc {
+		t.Errorf("wrong filter %+v", f)
+	}
+
+	r, _ := http.NewRequest("GET", "/admin/reservations/new", nil)
+	if gridQuery(r, "new").Get("status") != "new" {
+		t.Error("new reservations grid should default to new status")
+	}
+	r, _ = http.NewRequest("GET", "/admin/reservations/new?status=", nil)
+	if gridQuery(r, "new").Get("status") != "" {
+		t.Error("explicit status should not be overridden")
+	}
+}
+
+// putMagicLinkEmail unlocks the reservations of email in the session, as opening a magic link does
+func putMagicLinkEmail(ctx context.Context, email string) {
+	session.Put(ctx, "magic_email", email)
+	session.Put(ctx, "magic_expires", time.Now().Add(time.Hour).Unix())
+}
+
+// addURLParams adds chi url parameters to the context, as the router does
+func addURLParams(ctx context.Context, params map[string]string) context.Context {
+	rctx := chi.NewRouteContext()
+	for k, v := range params {
+		rctx.URLParams.Add(k, v)
+	}
+	return context.WithValue(ctx, chi.RouteCtxKey, rctx)
+}
+
 // getCtx creates a context with session support for testing
 func getCtx(req *http.Request) context.Context {
 	ctx, err := session.Load(req.Context(), req.Header.Get("X-Session"))
@@ -1,7 +1,9 @@
 package handlers
 
 import (
+	"context"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -16,6 +18,7 @@ import (
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/justinas/nosurf"
 	"github.com/kons77/room-bookings-app/internal/config"
+	"github.com/kons77/room-bookings-app/internal/helpers"
 	"github.com/kons77/room-bookings-app/internal/models"
 	"github.com/kons77/room-bookings-app/internal/render"
 )
@@ -28,6 +31,7 @@ var functions = template.FuncMap{
 	"humanDate":  render.HumanDate,
 	"formatDate": render.FormatDate,
 	"iterate":    render.Iterate,
+	"money":      render.Money,
 }
 
 // TestMain is part of the testing package available to us in the standard library
@@ -38,6 +42,7 @@ func TestMain(m *testing.M) {
 	gob.Register(models.Reservation{})
 	gob.Register(models.User{})
 	gob.Register(models.Room{})
+	gob.Register([]models.Room{})
 	gob.Register(models.Restriction{})
 	gob.Register(map[string]int{})
 
@@ -57,6 +62,15 @@ func TestMain(m *testing.M) {
 	session.Cookie.Secure = app.InProduction
 
 	app.Session = session
+	app.SigningKey = []byte("test-signing-key")
+	app.SSO = &testSSO{}
+	app.RetentionDays = 30
+
+	uploadDir, err := os.MkdirTemp("", "bookings-uploads")
+	if err != nil {
+		log.Fatal("cannot create upload directory")
+	}
+	app.UploadDir = uploadDir
 
 	mailChan := make(chan models.MailData)
 	app.MailChan = mailChan
@@ -76,9 +90,12 @@ func TestMain(m *testing.M) {
 	repo := NewTestRepo(&app)
 	NewHandlers(repo)
 	render.NewRenderer(&app)
+	helpers.NewHelpers(&app)
 
 	// Run tests
-	os.Exit(m.Run())
+	code := m.Run()
+	os.RemoveAll(uploadDir)
+	os.Exit(code)
 }
 
 func listenForMail() {
@@ -89,6 +106,33 @@ func listenForMail() {
 	}()
 }
 
+const testIssuer = "https://idp.example.com"
+
+// testSSO stands in for the identity provider; the authorization code picks the identity it returns
+type testSSO struct{}
+
+func (s *testSSO) AuthCodeURL(state, nonce string) string {
+	return "https://idp.example.com/auth?state=" + state + "&nonce=" + nonce
+}
+
+func (s *testSSO) Exchange(ctx context.Context, code, nonce string) (models.SSOIdentity, error) {
+	switch code {
+	case "admin":
+		return models.SSOIdentity{Issuer: testIssuer, Subject: "1", Email: "jane@company.com", EmailVerified: true, AccessLevel: 3}, nil
+	case "no-group":
+		return models.SSOIdentity{Issuer: testIssuer, Subject: "2", Email: "joe@company.com", EmailVerified: true, AccessLevel: 0}, nil
+	case "demoted":
+		return models.SSOIdentity{Issuer: testIssuer, Subject: "1", Email: "jane@company.com", EmailVerified: true, AccessLevel: 1}, nil
+	case "unverified":
+		return models.SSOIdentity{Issuer: testIssuer, Subject: "3", Email: "jane@company.com", AccessLevel: 3}, nil
+	case "taken":
+		return models.SSOIdentity{Issuer: testIssuer, Subject: "4", Email: "taken@company.com", EmailVerified: true, AccessLevel: 3}, nil
+	case "db-fail":
+		return models.SSOIdentity{Issuer: testIssuer, Subject: "5", Email: "fail@company.com", EmailVerified: true, AccessLevel: 3}, nil
+	}
+	return models.SSOIdentity{}, errors.New("invalid code")
+}
+
 // getRoutes sets up all application routes for testing
 func getRoutes() http.Handler {
 	mux := chi.NewRouter()
@@ -105,8 +149,19 @@ func getRoutes() http.Handler {
 	mux.Get("/search-availability", Repo.Availability)
 	mux.Post("/search-availability", Repo.PostAvailability)
 	mux.Post("/search-availability-json", Repo.AvailabilityJSON)
+	mux.Get("/availability-calendar", Repo.AvailabilityCalendar)
+	mux.Get("/flexible-search", Repo.FlexibleSearch)
+	mux.Post("/flexible-search", Repo.PostFlexibleSearch)
 	mux.Get("/choose-room/{id}", Repo.ChooseRoom)
+	mux.Get("/choose-split", Repo.ChooseSplit)
+	mux.Post("/choose-rooms", Repo.ChooseRooms)
+	mux.Get("/cart/remove/{id}", Repo.CartRemove)
+	mux.Get("/group-booking", Repo.GroupBooking)
+	mux.Post("/group-booking", Repo.PostGroupBooking)
 	mux.Get("/book-room", Repo.BookRoom)
+	mux.Get("/waitlist", Repo.Waitlist)
+	mux.Post("/waitlist", Repo.PostWaitlist)
+	mux.Get("/waitlist/offer", Repo.WaitlistOffer)
 
 	mux.Get("/contact", Repo.Contact)
 
@@ -117,19 +172,77 @@ func getRoutes() http.Handler {
 	mux.Get("/user/login", Repo.ShowLogin)
 	mux.Post("/user/login", Repo.PostShowLogin)
 	mux.Get("/user/logout", Repo.Logout)
+	mux.Get("/user/sso/login", Repo.SSOLogin)
+	mux.Get("/user/sso/callback", Repo.SSOCallback)
+
+	mux.Get("/guest/register", Repo.ShowGuestRegister)
+	mux.Post("/guest/register", Repo.PostGuestRegister)
+	mux.Get("/guest/verify", Repo.GuestVerify)
+	mux.Get("/guest/login", Repo.ShowGuestLogin)
+	mux.Post("/guest/login", Repo.PostGuestLogin)
+	mux.Get("/guest/logout", Repo.GuestLogout)
+	mux.Get("/guest/bookings", Repo.GuestBookings)
+
+	mux.Get("/my-reservations", Repo.ShowMyReservations)
+	mux.Post("/my-reservations", Repo.PostMyReservations)
+	mux.Get("/my-reservations/access", Repo.MagicLinkAccess)
+	mux.Get("/my-reservations/list", Repo.MyReservationsList)
+	mux.Get("/my-reservations/{id}/confirmation", Repo.MyReservationConfirmation)
+	mux.Post("/my-reservations/{id}/cancel", Repo.PostMyReservationCancel)
 
 	// tell our app where to find static files
 	fileServer := http.FileServer(http.Dir("./static/"))
 	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
 
 	mux.Get("/admin/dashboard", Repo.AdminDashboard)
+	mux.Get("/admin/front-desk", Repo.AdminFrontDesk)
+	mux.Get("/admin/front-desk/arrivals", Repo.AdminFrontDeskArrivals)
+	mux.Get("/admin/check-in/{id}/do", Repo.AdminCheckIn)
+	mux.Get("/admin/check-out/{id}/do", Repo.AdminCheckOut)
+	mux.Post("/admin/assign-unit/{id}", Repo.AdminAssignUnit)
+	mux.Get("/admin/housekeeping", Repo.AdminHousekeeping)
+	mux.Post("/admin/housekeeping/generate", Repo.AdminPostGenerateHousekeeping)
+	mux.Post("/admin/housekeeping/{id}/done", Repo.AdminCompleteHousekeepingTask)
+	mux.Post("/admin/rooms/{id}", Repo.AdminPostRoom)
+	mux.Post("/admin/rooms/{id}/status", Repo.AdminSetRoomStatus)
+	mux.Get("/admin/room-types", Repo.AdminRoomTypes)
+	mux.Post("/admin/room-types", Repo.AdminPostRoomType)
+	mux.Post("/admin/room-types/{id}/units", Repo.AdminPostRoomTypeUnit)
+	mux.Get("/admin/amenities", Repo.AdminAmenities)
+	mux.Post("/admin/amenities", Repo.AdminPostAmenity)
+	mux.Post("/admin/rooms/{id}/amenities", Repo.AdminPostRoomAmenities)
+	mux.Get("/admin/work-orders", Repo.AdminWorkOrders)
+	mux.Get("/admin/work-orders/new", Repo.AdminNewWorkOrder)
+	mux.Post("/admin/work-orders/new", Repo.AdminPostNewWorkOrder)
+	mux.Get("/admin/work-orders/photos/{file}", Repo.AdminWorkOrderPhoto)
+	mux.Get("/admin/work-orders/{id}", Repo.AdminShowWorkOrder)
+	mux.Post("/admin/work-orders/{id}", Repo.AdminPostWorkOrder)
+	mux.Post("/admin/work-orders/{id}/close", Repo.AdminCloseWorkOrder)
+	mux.Get("/admin/allotments", Repo.AdminAllotments)
+	mux.Get("/admin/allotments/new", Repo.AdminNewAllotment)
+	mux.Post("/admin/allotments/new", Repo.AdminPostNewAllotment)
+	mux.Get("/admin/allotments/{id}", Repo.AdminShowAllotment)
 	mux.Get("/admin/reservations/{src}", Repo.AdminReservationsGrid)
+	mux.Get("/admin/reservations-json", Repo.AdminReservationsJSON)
+	mux.Get("/admin/reservations-export", Repo.AdminExportReservations)
+	mux.Get("/admin/reservations/import", Repo.AdminReservationsImport)
+	mux.Post("/admin/reservations/import", Repo.AdminPostReservationsImport)
+	mux.Post("/admin/reservations/import/commit", Repo.AdminCommitReservationsImport)
+	mux.Get("/admin/reservations/book", Repo.AdminNewReservation)
+	mux.Post("/admin/reservations/book", Repo.AdminPostNewReservation)
+	mux.Get("/admin/reservations-availability", Repo.AdminReservationAvailability)
 	mux.Get("/admin/reservations/cal", Repo.AdminReservationsCalendar)
 	mux.Post("/admin/reservations/cal", Repo.AdminPostReservationsCalendar)
 	mux.Get("/admin/process-reservation/{src}/{id}/do", Repo.AdminProcessReservation)
 	mux.Get("/admin/delete-reservation/{src}/{id}/do", Repo.AdminDeleteReservation)
+	mux.Post("/admin/move-reservation/{id}", Repo.AdminMoveReservation)
+	mux.Post("/admin/split-reservation/{id}", Repo.AdminSplitReservation)
+	mux.Post("/admin/cancel-group/{id}", Repo.AdminCancelGroup)
+	mux.Get("/admin/reservations/trash", Repo.AdminReservationsTrash)
+	mux.Get("/admin/restore-reservation/{id}/do", Repo.AdminRestoreReservation)
 	mux.Get("/admin/reservations/{src}/{id}/show", Repo.AdminShowReservation)
 	mux.Post("/admin/reservations/{src}/{id}", Repo.AdminPostShowReservation)
+	mux.Get("/admin/audit", Repo.AdminAuditLog)
 	mux.Get("/generate-hashed-password", Repo.AdminHashPassword)
 	mux.Post("/generate-hashed-password", Repo.AdminPostHashPassword)
 
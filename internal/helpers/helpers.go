@@ -1,9 +1,19 @@
 package helpers
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/kons77/room-bookings-app/internal/config"
 	"golang.org/x/crypto/bcrypt"
@@ -33,6 +43,85 @@ func IsAuthenticated(r *http.Request) bool {
 	return exists
 }
 
+// IsGuest returns true if a guest account is logged in
+func IsGuest(r *http.Request) bool {
+	return app.Session.Exists(r.Context(), "guest_id")
+}
+
+// ClientIP returns the IP address the request came from
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// MagicLinkEmail returns the email a guest unlocked with a magic link, or "" once that access expired
+func MagicLinkEmail(r *http.Request) string {
+	if app.Session.GetInt64(r.Context(), "magic_expires") < time.Now().Unix() {
+		return ""
+	}
+	return app.Session.GetString(r.Context(), "magic_email")
+}
+
+// RandomToken returns a random hex string of n bytes, used for email verification links
+func RandomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// SignToken returns a url-safe token carrying subject that expires after ttl, signed with app.SigningKey
+func SignToken(subject string, ttl time.Duration) string {
+	payload := fmt.Sprintf("%s|%d", subject, time.Now().Add(ttl).Unix())
+	mac := hmac.New(sha256.New, app.SigningKey)
+	mac.Write([]byte(payload))
+
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ParseToken checks the signature and expiry of a token made by SignToken and returns its subject
+func ParseToken(token string) (string, error) {
+	encodedPayload, encodedSig, found := strings.Cut(token, ".")
+	if !found {
+		return "", errors.New("malformed token")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return "", err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, app.SigningKey)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return "", errors.New("invalid token signature")
+	}
+
+	// the subject may contain the separator itself, so the expiry is everything after the last one
+	sep := strings.LastIndex(string(payload), "|")
+	if sep < 0 {
+		return "", errors.New("malformed token")
+	}
+	expires, err := strconv.ParseInt(string(payload[sep+1:]), 10, 64)
+	if err != nil {
+		return "", err
+	}
+	if time.Now().Unix() > expires {
+		return "", errors.New("token expired")
+	}
+
+	return string(payload[:sep]), nil
+}
+
 func HashPassword(pswd string) ([]byte, error) {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(pswd), 12)
 	if err != nil {
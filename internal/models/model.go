@@ -27,14 +27,60 @@ type User struct {
 	UpdatedAt   time.Time
 }
 
-// Room is the room model
+// Guest is the guest account model, kept apart from staff users
+type Guest struct {
+	ID          int
+	FirstName   string
+	LastName    string
+	Email       string
+	Phone       string
+	Password    string
+	VerifyToken string
+	Verified    bool
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// Room is the room model, one unit of its room type
 type Room struct {
+	ID              int
+	RoomName        string
+	NightlyRate     int    // in cents
+	Status          string // housekeeping status, one of the RoomStatuses
+	RoomTypeID      int
+	MaxOccupancy    int // the most guests the room sleeps
+	BaseOccupancy   int // the guests the nightly rate covers
+	ExtraPersonRate int // in cents a night, for every guest over the base occupancy
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+	RoomType        RoomType
+}
+
+// RoomType is a kind of room guests book, with any number of identical units
+type RoomType struct {
+	ID          int
+	TypeName    string
+	Description string
+	Units       int // how many rooms of the type there are
+	Available   int // how many units are free every night of a searched stay
+	Sleeps      int // the most guests a unit of the type sleeps
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Amenities   []Amenity // the amenities every unit of the type has
+}
+
+// Amenity is a feature of a room from the catalogue guests can search by
+type Amenity struct {
 	ID        int
-	RoomName  string
+	Name      string
+	Category  string // one of the AmenityCategories
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
 
+// AmenityCategories lists the kinds of amenities in the order they are shown
+var AmenityCategories = []string{"bed", "view", "bathroom", "accessibility"}
+
 // Restriction is the restriction model
 type Restriction struct {
 	ID              int
@@ -45,20 +91,56 @@ type Restriction struct {
 
 // Reservation is the reservationr model
 type Reservation struct {
-	ID        int
-	FirstName string
-	LastName  string
-	Email     string
-	Phone     string
-	StartDate time.Time
-	EndDate   time.Time
+	ID             int
+	FirstName      string
+	LastName       string
+	Email          string
+	Phone          string
+	StartDate      time.Time
+	EndDate        time.Time
+	RoomID         int
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	Room           Room
+	Processed      int
+	GuestID        int
+	Cancelled      bool
+	DeletedAt      time.Time // zero unless the reservation is in the trash
+	DeletedBy      User
+	CheckedInAt    time.Time // zero until the guest checks in at the front desk
+	CheckedOutAt   time.Time
+	Source         string        // web, import or one of the ReservationSources of staff bookings
+	OverrideReason string        // why staff booked outside the stay rules, if they did
+	Segments       []StaySegment // the rooms of a split stay in order; empty when the whole stay is in Room
+	GroupID        int           // the booking group of a multi-room booking, zero for a single room
+	AllotmentID    int           // the allotment the guest booked from with its code, zero for none
+	UnitAssigned   bool          // false while the room is only provisional, until the front desk assigns the unit
+	Adults         int
+	Children       int
+	ExtraCharge    int // in cents, for the guests over the base occupancy of the rooms
+	RoomCharge     int // in cents, the nights at the rates of the rooms when it was booked
+}
+
+// StaySegment is the part of a split stay spent in one room, held by a room restriction of its own
+type StaySegment struct {
 	RoomID    int
-	CreatedAt time.Time
-	UpdatedAt time.Time
 	Room      Room
-	Processed int
+	StartDate time.Time
+	EndDate   time.Time
 }
 
+// StayOption is a room type free for a stay the guest can book, with what the stay costs
+type StayOption struct {
+	RoomType  RoomType // with the units free for the whole stay in Available
+	Room      Room     // the free unit the price is for
+	StartDate time.Time
+	EndDate   time.Time
+	Price     int // in cents, with the charge for guests over the base occupancy
+}
+
+// ReservationSources lists how a guest can book through the staff
+var ReservationSources = []string{"phone", "walk_in", "email"}
+
 // RoomRestriction is the room restriction model
 type RoomRestriction struct {
 	ID            int
@@ -67,6 +149,7 @@ type RoomRestriction struct {
 	RoomID        int
 	ReservationID int
 	RestrictionID int
+	AllotmentID   int // the allotment holding the room, zero for none
 	CreatedAt     time.Time
 	UpdatedAt     time.Time
 	Room          Room
@@ -74,6 +157,195 @@ type RoomRestriction struct {
 	Restriction   Restriction
 }
 
+// SSOIdentity is a staff user as described by the identity provider
+type SSOIdentity struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	FirstName     string
+	LastName      string
+	Groups        []string
+	AccessLevel   int
+}
+
+// ReservationFilter selects, orders and pages reservations for the admin grid; zero values match everything
+type ReservationFilter struct {
+	Page     int // starting at 1
+	PageSize int
+	Sort     string // column key, see the repository for the allowed ones
+	Desc     bool
+	From     time.Time // stays overlapping From..To
+	To       time.Time
+	RoomID   int
+	Status   string // new, processed or cancelled
+	Search   string // matched against name, email and phone
+}
+
+// RoomOccupancy is how one room was used over a report period, counted in nights
+type RoomOccupancy struct {
+	Room            Room
+	AvailableNights int // nights in the period less the owner blocks and the nights out of order
+	BookedNights    int
+	BlockedNights   int // owner blocks and nights out of order
+	Revenue         int // what the guests pay for the booked nights, as priced when they booked, in cents
+}
+
+// DailyOccupancy is the number of rooms booked for one night
+type DailyOccupancy struct {
+	Date     time.Time
+	Occupied int
+}
+
+// OccupancyReport aggregates the reservations of a period, From inclusive to To exclusive
+type OccupancyReport struct {
+	From          time.Time
+	To            time.Time
+	RoomID        int // 0 for all rooms
+	Rooms         []RoomOccupancy
+	Daily         []DailyOccupancy
+	Cancellations int
+	LeadTimes     map[string]int // bookings by days between booking and arrival, keyed by LeadTimeBuckets
+}
+
+// LeadTimeBuckets are the lead time ranges of an occupancy report, in days
+var LeadTimeBuckets = []string{"0-1", "2-7", "8-30", "31-90", "91+"}
+
+// the housekeeping statuses of a room
+const (
+	RoomClean      = "clean"
+	RoomDirty      = "dirty"
+	RoomInspected  = "inspected"
+	RoomOutOfOrder = "out_of_order"
+)
+
+// RoomStatuses lists the housekeeping statuses in the order they are offered
+var RoomStatuses = []string{RoomClean, RoomDirty, RoomInspected, RoomOutOfOrder}
+
+// HousekeepingTask is a room to be made up on a date, after a departure or for a guest staying over
+type HousekeepingTask struct {
+	ID            int
+	RoomID        int
+	Date          time.Time
+	Kind          string // checkout or stayover
+	ReservationID int
+	DoneAt        time.Time // zero until the room is done
+	DoneBy        User
+	Room          Room
+	Adults        int // the party staying in the room, zero when the task has no reservation
+	Children      int
+}
+
+// RestrictionOutOfOrder is the restriction of a room blocked by a work order
+const RestrictionOutOfOrder = 3
+
+// RestrictionAllotment is the restriction of a room held for an allotment until a guest books it or it's released
+const RestrictionAllotment = 4
+
+// RestrictionHold is the restriction of a room held for a guest filling in the reservation form, until it expires
+const RestrictionHold = 5
+
+// WaitlistEntry is a guest waiting for a room on dates that were fully booked
+type WaitlistEntry struct {
+	ID             int
+	Email          string
+	StartDate      time.Time
+	EndDate        time.Time
+	RoomTypeID     int // the room type the guest prefers, zero for any
+	Adults         int
+	Children       int
+	RoomID         int // the room offered to the guest, zero until one is
+	Room           Room
+	NotifiedAt     time.Time // zero until a room is offered
+	OfferExpiresAt time.Time
+	HoldID         int       // the hold keeping the room offered for the guest until the offer expires
+	BookedAt       time.Time // zero until the guest books the room offered
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// Allotment is a number of rooms held for a named group over the same dates. Guests of the group book them
+// with the code until the release date, when the rooms still held go back on sale
+type Allotment struct {
+	ID          int
+	Name        string
+	Code        string
+	Rooms       int // how many rooms were held
+	Booked      int // how many reservations were made from it and not cancelled
+	StartDate   time.Time
+	EndDate     time.Time
+	ReleaseDate time.Time
+	ReleasedAt  time.Time // zero until the rooms still held are released
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Held        []Room        // rooms still held for the group
+	PickedUp    []Reservation // reservations made from the allotment
+}
+
+// the priorities of a work order, lowest first
+var WorkOrderPriorities = []string{"low", "normal", "high", "urgent"}
+
+// WorkOrder is a maintenance ticket for a room. With dates it keeps the room out of order from StartDate
+// to EndDate through a room restriction that is released when the ticket is closed
+type WorkOrder struct {
+	ID            int
+	RoomID        int
+	Title         string
+	Description   string
+	Priority      string
+	AssigneeID    int
+	Status        string // open or closed
+	StartDate     time.Time
+	EndDate       time.Time
+	RestrictionID int // the out of order block, 0 for none
+	ClosedAt      time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	Room          Room
+	Assignee      User
+	Photos        []WorkOrderPhoto
+}
+
+// WorkOrderPhoto is a picture attached to a work order, stored in the upload directory
+type WorkOrderPhoto struct {
+	ID           int
+	WorkOrderID  int
+	FileName     string
+	OriginalName string
+	CreatedAt    time.Time
+}
+
+// FrontDeskDay is the front desk's view of one date
+type FrontDeskDay struct {
+	Date       time.Time
+	Arrivals   []Reservation
+	Departures []Reservation
+	StayOvers  []Reservation // in house before and after the date
+	Vacant     []Room        // neither booked nor blocked for the night of the date
+}
+
+// AuditEntry is one record of the append-only audit log of admin actions
+type AuditEntry struct {
+	ID        int
+	UserID    int
+	Action    string
+	Entity    string
+	EntityID  int
+	Before    string // JSON of the entity before the action, "" when created
+	After     string // JSON of the entity after the action, "" when deleted
+	IP        string
+	CreatedAt time.Time
+	User      User
+}
+
+// AuditFilter narrows down the audit log; zero values match everything
+type AuditFilter struct {
+	UserID int
+	Entity string
+	From   time.Time
+	To     time.Time
+}
+
 // MailData holds an email message
 type MailData struct {
 	To       string
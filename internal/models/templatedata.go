@@ -16,4 +16,5 @@ type TemplateData struct {
 	Error           string // message sending to users
 	Form            *forms.Form
 	IsAuthenticated int
+	IsGuest         int
 }
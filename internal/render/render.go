@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"text/template"
 	"time"
 
@@ -19,6 +20,7 @@ var functions = template.FuncMap{
 	"humanDate":  HumanDate,
 	"formatDate": FormatDate,
 	"iterate":    Iterate,
+	"money":      Money,
 	// "add": Add,
 }
 
@@ -56,6 +58,22 @@ func FormatDate(t time.Time, f string) string {
 	return t.Format(f)
 }
 
+// Money formats an amount in cents, e.g. 1234567 as 12,345.67
+func Money(cents int) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+
+	units := strconv.Itoa(cents / 100)
+	for i := len(units) - 3; i > 0; i -= 3 {
+		units = units[:i] + "," + units[i:]
+	}
+
+	return fmt.Sprintf("%s%s.%02d", sign, units, cents%100)
+}
+
 // AddDefaultData adds data for all templates (displayed on every page)
 func AddDefaultData(td *models.TemplateData, r *http.Request) *models.TemplateData {
 	td.Flash = app.Session.PopString(r.Context(), "flash")
@@ -65,6 +83,9 @@ func AddDefaultData(td *models.TemplateData, r *http.Request) *models.TemplateDa
 	if app.Session.Exists(r.Context(), "user_id") {
 		td.IsAuthenticated = 1
 	}
+	if app.Session.Exists(r.Context(), "guest_id") {
+		td.IsGuest = 1
+	}
 	return td
 }
 
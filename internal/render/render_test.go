@@ -52,6 +52,15 @@ func TestRenderTemplate(t *testing.T) {
 
 }
 
+func TestMoney(t *testing.T) {
+	tests := map[int]string{0: "0.00", 5: "0.05", 12345: "123.45", 123456789: "1,234,567.89", -100050: "-1,000.50"}
+	for cents, expected := range tests {
+		if got := Money(cents); got != expected {
+			t.Errorf("%d cents: expected %s, got %s", cents, expected, got)
+		}
+	}
+}
+
 func getSession() (*http.Request, error) {
 	r, err := http.NewRequest("GET", "/some-url", nil)
 	if err != nil {
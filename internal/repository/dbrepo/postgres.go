@@ -2,10 +2,15 @@ package dbrepo
 
 import (
 	"context"
+	"database/sql"
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/kons77/room-bookings-app/internal/models"
+	"github.com/kons77/room-bookings-app/internal/repository"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -22,8 +27,10 @@ func (m *postgresDBRepo) InsertReservation(res models.Reservation) (int, error)
 	var newID int // the ID of the newly inserted reservation
 
 	stmt := `insert into reservations 
-			(first_name, last_name, email, phone, start_date, end_date, room_id, created_at, updated_at)
-			values ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id`
+			(first_name, last_name, email, phone, start_date, end_date, room_id, created_at, updated_at, guest_id,
+			adults, children, extra_charge, room_charge)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, nullif($10, 0), $11, $12, $13,
+			($6::date - $5::date) * (select nightly_rate from rooms where id = $7)) returning id`
 
 	err := m.DB.QueryRowContext(ctx, stmt,
 		res.FirstName,
@@ -35,6 +42,10 @@ func (m *postgresDBRepo) InsertReservation(res models.Reservation) (int, error)
 		res.RoomID,
 		time.Now(),
 		time.Now(),
+		res.GuestID,
+		res.Adults,
+		res.Children,
+		res.ExtraCharge,
 	).Scan(&newID)
 
 	if err != nil {
@@ -86,7 +97,8 @@ func (m *postgresDBRepo) SearchAvailabilityByDatesByRoomID(start, end time.Time,
 			room_restrictions rr 
 		where 
 			room_id = $1 and 
-			$2 < rr.end_date and $3 > rr.start_date; `
+			$2 < rr.end_date and $3 > rr.start_date and
+			(rr.expires_at is null or rr.expires_at > now()); `
 
 	// $2 < rr.end_date and $3 > rr.start_date;   - author always choose departure as the next date after arrival but never the same date
 	// $2 <= rr.end_date and $3 >= rr.start_date;   -  if you want to allow same-day check-out and check-in
@@ -103,20 +115,22 @@ func (m *postgresDBRepo) SearchAvailabilityByDatesByRoomID(start, end time.Time,
 	return false, nil
 }
 
-// SearchAvailabilityForAllRooms returns a slice of available rooms, if any, for given date range
-func (m *postgresDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]models.Room, error) {
+// SearchAvailabilityForAllRooms returns a slice of available rooms, if any, for given date range that sleep
+// at least the given number of guests
+func (m *postgresDBRepo) SearchAvailabilityForAllRooms(start, end time.Time, guests int) ([]models.Room, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	var rooms []models.Room
 	query := `select 
-			r.id, r.room_name 
+			r.id, r.room_name, r.max_occupancy 
 		from 
 			rooms r 
-		where r.id not in 
-		(select rr.room_id from room_restrictions rr where $1 < rr.end_date and $2 > rr.start_date)`
+		where r.max_occupancy >= $3 and r.id not in 
+		(select rr.room_id from room_restrictions rr where $1 < rr.end_date and $2 > rr.start_date
+			and (rr.expires_at is null or rr.expires_at > now()))`
 
-	rows, err := m.DB.QueryContext(ctx, query, start, end)
+	rows, err := m.DB.QueryContext(ctx, query, start, end, guests)
 	if err != nil {
 		return rooms, err
 	}
@@ -127,6 +141,7 @@ func (m *postgresDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]
 		err := rows.Scan(
 			&room.ID,
 			&room.RoomName,
+			&room.MaxOccupancy,
 		)
 		if err != nil {
 			return rooms, err
@@ -148,7 +163,9 @@ func (m *postgresDBRepo) GetRoomByID(id int) (models.Room, error) {
 	var room models.Room
 
 	query := `
-		select id, room_name, created_at, updated_at from rooms where id = $1 
+		select id, room_name, created_at, updated_at, coalesce(room_type_id, 0), nightly_rate,
+		max_occupancy, base_occupancy, extra_person_rate
+		from rooms where id = $1 
 	`
 
 	row := m.DB.QueryRowContext(ctx, query, id)
@@ -157,6 +174,11 @@ func (m *postgresDBRepo) GetRoomByID(id int) (models.Room, error) {
 		&room.RoomName,
 		&room.CreatedAt,
 		&room.UpdatedAt,
+		&room.RoomTypeID,
+		&room.NightlyRate,
+		&room.MaxOccupancy,
+		&room.BaseOccupancy,
+		&room.ExtraPersonRate,
 	)
 
 	if err != nil {
@@ -243,26 +265,99 @@ func (m *postgresDBRepo) Authenticate(email, testPassword string) (int, string,
 	return id, hashedPassword, nil
 }
 
-// ReservationsForGrid returns a slice of all or new reservations depends of src
-// Param `displayAllReservations`, 1 means processed - shows all reservations, 0 means not processed - shows only new
-func (m *postgresDBRepo) ReservationsForGrid(displaysAllReservations int) ([]models.Reservation, error) {
+// reservationSortColumns maps the sort keys of the admin grid to columns, so no user input reaches the sql
+var reservationSortColumns = map[string]string{
+	"id":         "r.id",
+	"last_name":  "r.last_name",
+	"email":      "r.email",
+	"room":       "rm.room_name",
+	"start_date": "r.start_date",
+	"end_date":   "r.end_date",
+	"created_at": "r.created_at",
+}
+
+// reservationFilterWhere builds the where clause and its arguments for a reservation filter
+func reservationFilterWhere(f models.ReservationFilter) (string, []interface{}) {
+	where := " where r.deleted_at is null"
+	var args []interface{}
+
+	if !f.From.IsZero() {
+		args = append(args, f.From)
+		where += fmt.Sprintf(" and r.end_date >= $%d", len(args))
+	}
+	if !f.To.IsZero() {
+		args = append(args, f.To)
+		where += fmt.Sprintf(" and r.start_date <= $%d", len(args))
+	}
+	if f.RoomID > 0 {
+		args = append(args, f.RoomID)
+		where += fmt.Sprintf(" and r.room_id = $%d", len(args))
+	}
+
+	switch f.Status {
+	case "new":
+		where += " and r.processed = 0 and r.cancelled_at is null"
+	case "processed":
+		where += " and r.processed = 1 and r.cancelled_at is null"
+	case "cancelled":
+		where += " and r.cancelled_at is not null"
+	}
+
+	if search := strings.TrimSpace(f.Search); search != "" {
+		// the search is literal text, so escape the like wildcards
+		search = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(search)
+		args = append(args, "%"+search+"%")
+		n := len(args)
+		where += fmt.Sprintf(` and (r.first_name ilike $%d or r.last_name ilike $%d or r.email ilike $%d
+			or r.phone ilike $%d or (r.first_name || ' ' || r.last_name) ilike $%d)`, n, n, n, n, n)
+	}
+
+	return where, args
+}
+
+// SearchReservations returns one page of reservations matching the filter and the number of all matches
+func (m *postgresDBRepo) SearchReservations(f models.ReservationFilter) ([]models.Reservation, int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	var reservations []models.Reservation
+	var total int
+
+	where, args := reservationFilterWhere(f)
+
+	countQuery := `select count(r.id) from reservations r left join rooms rm on (r.room_id = rm.id)` + where
+	err := m.DB.QueryRowContext(ctx, countQuery, args...).Scan(&total)
+	if err != nil {
+		return reservations, 0, err
+	}
+
+	sortColumn, ok := reservationSortColumns[f.Sort]
+	if !ok {
+		sortColumn = "r.start_date"
+	}
+	direction := "asc"
+	if f.Desc {
+		direction = "desc"
+	}
+
+	if f.PageSize < 1 {
+		f.PageSize = 25
+	}
+	if f.Page < 1 {
+		f.Page = 1
+	}
 
 	query := `
 		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, 
-		r.room_id, r.created_at, r.updated_at, r.processed, rm.id, rm.room_name
+		r.room_id, r.created_at, r.updated_at, r.processed, rm.id, rm.room_name, r.cancelled_at is not null
 		from reservations r 
-		left join rooms rm on (r.room_id = rm.id)
-		where processed = 0 or processed = $1
-		order by r.start_date asc		
-	`
+		left join rooms rm on (r.room_id = rm.id)` + where +
+		fmt.Sprintf(" order by %s %s, r.id %s limit %d offset %d",
+			sortColumn, direction, direction, f.PageSize, (f.Page-1)*f.PageSize)
 
-	rows, err := m.DB.QueryContext(ctx, query, displaysAllReservations)
+	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
-		return reservations, err
+		return reservations, 0, err
 	}
 	defer rows.Close()
 
@@ -282,23 +377,98 @@ func (m *postgresDBRepo) ReservationsForGrid(displaysAllReservations int) ([]mod
 			&i.Processed,
 			&i.Room.ID,
 			&i.Room.RoomName,
+			&i.Cancelled,
 		)
 
 		if err != nil {
-			return reservations, err
+			return reservations, 0, err
 		}
 		reservations = append(reservations, i)
 	}
 
 	if err = rows.Err(); err != nil {
-		return reservations, err
+		return reservations, 0, err
 	}
 
-	return reservations, nil
+	return reservations, total, nil
+}
+
+// ExportReservations calls fn for every reservation matching the filter, in the filter's order,
+// reading the rows one at a time instead of collecting them
+func (m *postgresDBRepo) ExportReservations(f models.ReservationFilter, fn func(models.Reservation) error) error {
+	// an export may stream many rows to a slow client, so it gets more time than a page
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	where, args := reservationFilterWhere(f)
+
+	sortColumn, ok := reservationSortColumns[f.Sort]
+	if !ok {
+		sortColumn = "r.start_date"
+	}
+	direction := "asc"
+	if f.Desc {
+		direction = "desc"
+	}
+
+	query := `
+		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, 
+		r.room_id, r.created_at, r.updated_at, r.processed, rm.id, rm.room_name, r.cancelled_at is not null,
+		r.room_charge, r.extra_charge
+		from reservations r 
+		left join rooms rm on (r.room_id = rm.id)` + where +
+		fmt.Sprintf(" order by %s %s, r.id %s", sortColumn, direction, direction)
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i models.Reservation
+		err := rows.Scan(
+			&i.ID,
+			&i.FirstName,
+			&i.LastName,
+			&i.Email,
+			&i.Phone,
+			&i.StartDate,
+			&i.EndDate,
+			&i.RoomID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Processed,
+			&i.Room.ID,
+			&i.Room.RoomName,
+			&i.Cancelled,
+			&i.RoomCharge,
+			&i.ExtraCharge,
+		)
+		if err != nil {
+			return err
+		}
+
+		if err = fn(i); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
 }
 
-// GetReseravtionByID returns one reservation by ID
+// GetReseravtionByID returns one reservation by ID; reservations in the trash aren't found
 func (m *postgresDBRepo) GetReseravtionByID(id int) (models.Reservation, error) {
+	return m.getReservation("r.deleted_at is null", id)
+}
+
+// GetDeletedReservationByID returns one reservation in the trash by ID
+func (m *postgresDBRepo) GetDeletedReservationByID(id int) (models.Reservation, error) {
+	return m.getReservation("r.deleted_at is not null", id)
+}
+
+// getReservation returns the reservation with the id, if it also matches the where condition
+func (m *postgresDBRepo) getReservation(where string, id int) (models.Reservation, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
@@ -306,11 +476,15 @@ func (m *postgresDBRepo) GetReseravtionByID(id int) (models.Reservation, error)
 
 	query := `
 		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, 
-		r.room_id, r.created_at, r.updated_at, r.processed, rm.id, rm.room_name
+		r.room_id, r.created_at, r.updated_at, r.processed, rm.id, rm.room_name,
+		coalesce(r.guest_id, 0), r.cancelled_at is not null, r.deleted_at, r.checked_in_at, r.checked_out_at,
+		r.source, r.override_reason, coalesce(r.group_id, 0), r.unit_assigned, coalesce(rm.room_type_id, 0),
+		r.adults, r.children, r.extra_charge, r.room_charge
 		from reservations r 
 		left join rooms rm on (r.room_id = rm.id)
-		where r.id = $1
-	`
+		where r.id = $1 and ` + where
+
+	var deletedAt, checkedInAt, checkedOutAt sql.NullTime
 
 	row := m.DB.QueryRowContext(ctx, query, id)
 	err := row.Scan(
@@ -327,11 +501,57 @@ func (m *postgresDBRepo) GetReseravtionByID(id int) (models.Reservation, error)
 		&res.Processed,
 		&res.Room.ID,
 		&res.Room.RoomName,
+		&res.GuestID,
+		&res.Cancelled,
+		&deletedAt,
+		&checkedInAt,
+		&checkedOutAt,
+		&res.Source,
+		&res.OverrideReason,
+		&res.GroupID,
+		&res.UnitAssigned,
+		&res.Room.RoomTypeID,
+		&res.Adults,
+		&res.Children,
+		&res.ExtraCharge,
+		&res.RoomCharge,
 	)
 
 	if err != nil {
 		return res, err
 	}
+	res.DeletedAt = deletedAt.Time
+	res.CheckedInAt = checkedInAt.Time
+	res.CheckedOutAt = checkedOutAt.Time
+
+	rows, err := m.DB.QueryContext(ctx, `
+		select rr.room_id, rm.room_name, rr.start_date, rr.end_date
+		from room_restrictions rr
+		left join rooms rm on (rr.room_id = rm.id)
+		where rr.reservation_id = $1
+		order by rr.start_date
+	`, id)
+	if err != nil {
+		return res, err
+	}
+	defer rows.Close()
+
+	var segments []models.StaySegment
+	for rows.Next() {
+		var seg models.StaySegment
+		if err := rows.Scan(&seg.RoomID, &seg.Room.RoomName, &seg.StartDate, &seg.EndDate); err != nil {
+			return res, err
+		}
+		seg.Room.ID = seg.RoomID
+		segments = append(segments, seg)
+	}
+	if err = rows.Err(); err != nil {
+		return res, err
+	}
+
+	if len(segments) > 1 {
+		res.Segments = segments
+	}
 
 	return res, nil
 }
@@ -362,22 +582,41 @@ func (m *postgresDBRepo) UpdateReservation(u models.Reservation) error {
 	return nil
 }
 
-// DeleteReservation deletes reservation by ID
-func (m *postgresDBRepo) DeleteReservation(id int) error {
+// DeleteReservation moves a reservation to the trash and frees its room restrictions
+func (m *postgresDBRepo) DeleteReservation(id, deletedBy int) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	query := `
-		delete from reservations where id = $1
-	`
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	_, err := m.DB.ExecContext(ctx, query, id)
+	_, err = tx.ExecContext(ctx, `
+		update reservations set deleted_at = $1, deleted_by = nullif($2, 0), updated_at = $1
+		where id = $3 and deleted_at is null
+	`, time.Now(), deletedBy, id)
+	if err != nil {
+		return err
+	}
 
+	// the rooms of the stay, every room of a split stay, are kept aside to be booked again on restore
+	_, err = tx.ExecContext(ctx, `
+		insert into trashed_stays (reservation_id, room_id, start_date, end_date, created_at, updated_at)
+		select reservation_id, room_id, start_date, end_date, $2, $2 from room_restrictions
+		where reservation_id = $1 and restriction_id = 1
+	`, id, time.Now())
 	if err != nil {
 		return err
 	}
 
-	return nil
+	_, err = tx.ExecContext(ctx, "delete from room_restrictions where reservation_id = $1", id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 // UpdateProcessedForReservation updates processed for a reservation by id
@@ -405,9 +644,12 @@ func (m *postgresDBRepo) AllRooms() ([]models.Room, error) {
 	var rooms []models.Room
 
 	query := `
-		select id, room_name, created_at, updated_at 
-		from rooms
-		order by room_name
+		select rm.id, rm.room_name, rm.housekeeping_status, rm.created_at, rm.updated_at,
+		coalesce(rm.room_type_id, 0), coalesce(rt.type_name, ''), rm.nightly_rate, rm.max_occupancy,
+		rm.base_occupancy, rm.extra_person_rate
+		from rooms rm
+		left join room_types rt on (rm.room_type_id = rt.id)
+		order by rt.type_name, rm.room_name
 	`
 
 	rows, err := m.DB.QueryContext(ctx, query)
@@ -421,13 +663,21 @@ func (m *postgresDBRepo) AllRooms() ([]models.Room, error) {
 		err := rows.Scan(
 			&rm.ID,
 			&rm.RoomName,
+			&rm.Status,
 			&rm.CreatedAt,
 			&rm.UpdatedAt,
+			&rm.RoomTypeID,
+			&rm.RoomType.TypeName,
+			&rm.NightlyRate,
+			&rm.MaxOccupancy,
+			&rm.BaseOccupancy,
+			&rm.ExtraPersonRate,
 		)
 
 		if err != nil {
 			return rooms, err
 		}
+		rm.RoomType.ID = rm.RoomTypeID
 		rooms = append(rooms, rm)
 	}
 
@@ -446,9 +696,10 @@ func (m *postgresDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end tim
 	var restrictions []models.RoomRestriction
 
 	query := `
-		select id, coalesce(reservation_id, 0), restriction_id, room_id, start_date, end_date
+		select id, coalesce(reservation_id, 0), restriction_id, room_id, start_date, end_date,
+		coalesce(allotment_id, 0)
 		from room_restrictions where $1 < end_date and $2 >= start_date
-		and room_id = $3 
+		and room_id = $3 and (expires_at is null or expires_at > now())
 	`
 
 	rows, err := m.DB.QueryContext(ctx, query, start, end, roomID)
@@ -466,6 +717,7 @@ func (m *postgresDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end tim
 			&r.RoomID,
 			&r.StartDate,
 			&r.EndDate,
+			&r.AllotmentID,
 		)
 		if err != nil {
 			return nil, err
@@ -481,21 +733,22 @@ func (m *postgresDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end tim
 
 }
 
-// InsertBlockForRoom inserts a room restriction
-func (m *postgresDBRepo) InsertBlockForRoom(roomID int, startDate time.Time) error {
+// InsertBlockForRoom inserts a room restriction and returns its id
+func (m *postgresDBRepo) InsertBlockForRoom(roomID int, startDate time.Time) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	query := `
 		insert into room_restrictions (start_date, end_date, room_id, restriction_id, created_at, updated_at)
-		values ($1, $2, $3, $4, $5, $6)
+		values ($1, $2, $3, $4, $5, $6) returning id
 	`
 
-	_, err := m.DB.ExecContext(ctx, query, startDate, startDate.AddDate(0, 0, 1), roomID, 2, time.Now(), time.Now())
+	var id int
+	err := m.DB.QueryRowContext(ctx, query, startDate, startDate.AddDate(0, 0, 1), roomID, 2, time.Now(), time.Now()).Scan(&id)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+	return id, nil
 }
 
 // DeleteBlockByID deletes a room restriction
@@ -513,3 +766,3116 @@ func (m *postgresDBRepo) DeleteBlockByID(id int) error {
 	}
 	return nil
 }
+
+// InsertGuest inserts a new guest account and returns its id
+func (m *postgresDBRepo) InsertGuest(g models.Guest) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var newID int
+
+	query := `
+		insert into guests (first_name, last_name, email, phone, password, verify_token, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8) returning id
+	`
+
+	err := m.DB.QueryRowContext(ctx, query,
+		g.FirstName,
+		g.LastName,
+		g.Email,
+		g.Phone,
+		g.Password,
+		g.VerifyToken,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// GetGuestByID returns a guest account by id
+func (m *postgresDBRepo) GetGuestByID(id int) (models.Guest, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var g models.Guest
+
+	query := `
+		select id, first_name, last_name, email, phone, verified_at is not null, created_at, updated_at
+		from guests where id = $1
+	`
+
+	row := m.DB.QueryRowContext(ctx, query, id)
+	err := row.Scan(
+		&g.ID,
+		&g.FirstName,
+		&g.LastName,
+		&g.Email,
+		&g.Phone,
+		&g.Verified,
+		&g.CreatedAt,
+		&g.UpdatedAt,
+	)
+	if err != nil {
+		return g, err
+	}
+
+	return g, nil
+}
+
+// AuthenticateGuest authenticates a guest account with a confirmed email and returns its id
+func (m *postgresDBRepo) AuthenticateGuest(email, testPassword string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int
+	var hashedPassword string
+	var verified bool
+
+	query := "select id, password, verified_at is not null from guests where email = $1"
+	row := m.DB.QueryRowContext(ctx, query, email)
+	err := row.Scan(&id, &hashedPassword, &verified)
+	if err != nil {
+		return 0, err
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(testPassword))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return 0, errors.New("incorrect password")
+	} else if err != nil {
+		return 0, err
+	}
+
+	if !verified {
+		return 0, repository.ErrGuestNotVerified
+	}
+
+	return id, nil
+}
+
+// VerifyGuestEmail marks the guest owning token as verified and returns it
+func (m *postgresDBRepo) VerifyGuestEmail(token string) (models.Guest, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var g models.Guest
+
+	if token == "" {
+		return g, errors.New("empty verification token")
+	}
+
+	query := `
+		update guests set verified_at = $1, verify_token = '', updated_at = $1
+		where verify_token = $2
+		returning id, first_name, last_name, email, phone
+	`
+
+	row := m.DB.QueryRowContext(ctx, query, time.Now(), token)
+	err := row.Scan(
+		&g.ID,
+		&g.FirstName,
+		&g.LastName,
+		&g.Email,
+		&g.Phone,
+	)
+	if err != nil {
+		return g, err
+	}
+	g.Verified = true
+
+	return g, nil
+}
+
+// LinkReservationsToGuest attaches earlier reservations made with email to the guest account
+func (m *postgresDBRepo) LinkReservationsToGuest(guestID int, email string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		update reservations set guest_id = $1, updated_at = $2
+		where guest_id is null and lower(email) = lower($3)
+	`
+
+	_, err := m.DB.ExecContext(ctx, query, guestID, time.Now(), email)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ReservationsByGuestID returns all reservations of a guest account, latest arrival first;
+// bookings made with its confirmed email after verification count too
+func (m *postgresDBRepo) ReservationsByGuestID(guestID int) ([]models.Reservation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var reservations []models.Reservation
+
+	query := `
+		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, 
+		r.room_id, r.created_at, r.updated_at, r.processed, rm.id, rm.room_name, r.cancelled_at is not null
+		from reservations r 
+		left join rooms rm on (r.room_id = rm.id)
+		where (r.guest_id = $1 or (r.guest_id is null and lower(r.email) = (
+			select lower(g.email) from guests g where g.id = $1 and g.verified_at is not null
+		))) and r.deleted_at is null
+		order by r.start_date desc
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, guestID)
+	if err != nil {
+		return reservations, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i models.Reservation
+		err := rows.Scan(
+			&i.ID,
+			&i.FirstName,
+			&i.LastName,
+			&i.Email,
+			&i.Phone,
+			&i.StartDate,
+			&i.EndDate,
+			&i.RoomID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Processed,
+			&i.Room.ID,
+			&i.Room.RoomName,
+			&i.Cancelled,
+		)
+		if err != nil {
+			return reservations, err
+		}
+		i.GuestID = guestID
+		reservations = append(reservations, i)
+	}
+
+	if err = rows.Err(); err != nil {
+		return reservations, err
+	}
+
+	return reservations, nil
+}
+
+// ReservationsByEmail returns all reservations made with email, latest arrival first
+func (m *postgresDBRepo) ReservationsByEmail(email string) ([]models.Reservation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var reservations []models.Reservation
+
+	query := `
+		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, 
+		r.room_id, r.created_at, r.updated_at, r.processed, rm.id, rm.room_name,
+		coalesce(r.guest_id, 0), r.cancelled_at is not null
+		from reservations r 
+		left join rooms rm on (r.room_id = rm.id)
+		where lower(r.email) = lower($1) and r.deleted_at is null
+		order by r.start_date desc
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, email)
+	if err != nil {
+		return reservations, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i models.Reservation
+		err := rows.Scan(
+			&i.ID,
+			&i.FirstName,
+			&i.LastName,
+			&i.Email,
+			&i.Phone,
+			&i.StartDate,
+			&i.EndDate,
+			&i.RoomID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Processed,
+			&i.Room.ID,
+			&i.Room.RoomName,
+			&i.GuestID,
+			&i.Cancelled,
+		)
+		if err != nil {
+			return reservations, err
+		}
+		reservations = append(reservations, i)
+	}
+
+	if err = rows.Err(); err != nil {
+		return reservations, err
+	}
+
+	return reservations, nil
+}
+
+// CancelReservation marks a reservation as cancelled and frees its room restrictions
+func (m *postgresDBRepo) CancelReservation(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		update reservations set cancelled_at = $1, updated_at = $1
+		where id = $2 and cancelled_at is null
+	`, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "delete from room_restrictions where reservation_id = $1", id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UpsertSSOUser creates or refreshes a staff user logging in through single sign-on and returns its id.
+// Users are keyed by the issuer and subject of the identity; an existing account with the same email
+// is never taken over. The access level follows the groups on every login, so a user demoted or removed
+// from the groups at the identity provider loses access; a user with no access level isn't created and
+// gets id 0
+func (m *postgresDBRepo) UpsertSSOUser(u models.User, issuer, subject string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int
+
+	err = tx.QueryRowContext(ctx,
+		"select id from users where sso_issuer = $1 and sso_subject = $2 for update",
+		issuer, subject,
+	).Scan(&id)
+	switch {
+	case err == nil:
+		_, err = tx.ExecContext(ctx,
+			"update users set first_name = $1, last_name = $2, access_level = $3, updated_at = $4 where id = $5",
+			u.FirstName, u.LastName, u.AccessLevel, time.Now(), id,
+		)
+		if err != nil {
+			return 0, err
+		}
+		return id, tx.Commit()
+	case err != sql.ErrNoRows:
+		return 0, err
+	}
+
+	if u.AccessLevel == 0 {
+		return 0, nil
+	}
+
+	var taken int
+	err = tx.QueryRowContext(ctx, "select count(id) from users where lower(email) = lower($1)", u.Email).Scan(&taken)
+	if err != nil {
+		return 0, err
+	}
+	if taken > 0 {
+		return 0, repository.ErrSSOEmailTaken
+	}
+
+	// single sign-on users get no local password, so they can't use the login form
+	query := `
+		insert into users (first_name, last_name, email, password, access_level, sso_issuer, sso_subject, created_at, updated_at)
+		values ($1, $2, $3, '', $4, $5, $6, $7, $7)
+		returning id
+	`
+
+	err = tx.QueryRowContext(ctx, query,
+		u.FirstName,
+		u.LastName,
+		u.Email,
+		u.AccessLevel,
+		issuer,
+		subject,
+		time.Now(),
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+// InsertAuditEntry appends an entry to the audit log
+func (m *postgresDBRepo) InsertAuditEntry(e models.AuditEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		insert into audit_log (user_id, action, entity, entity_id, before_value, after_value, ip, created_at, updated_at)
+		values (nullif($1, 0), $2, $3, $4, $5, $6, $7, $8, $8)
+	`
+
+	_, err := m.DB.ExecContext(ctx, query,
+		e.UserID,
+		e.Action,
+		e.Entity,
+		e.EntityID,
+		e.Before,
+		e.After,
+		e.IP,
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AuditEntries returns the latest audit log entries matching the filter
+func (m *postgresDBRepo) AuditEntries(f models.AuditFilter) ([]models.AuditEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var entries []models.AuditEntry
+
+	query := `
+		select a.id, coalesce(a.user_id, 0), a.action, a.entity, a.entity_id, a.before_value, a.after_value,
+		a.ip, a.created_at, coalesce(u.first_name, ''), coalesce(u.last_name, ''), coalesce(u.email, '')
+		from audit_log a
+		left join users u on (a.user_id = u.id)
+		where 1 = 1
+	`
+
+	var args []interface{}
+	if f.UserID > 0 {
+		args = append(args, f.UserID)
+		query += fmt.Sprintf(" and a.user_id = $%d", len(args))
+	}
+	if f.Entity != "" {
+		args = append(args, f.Entity)
+		query += fmt.Sprintf(" and a.entity = $%d", len(args))
+	}
+	if !f.From.IsZero() {
+		args = append(args, f.From)
+		query += fmt.Sprintf(" and a.created_at >= $%d", len(args))
+	}
+	if !f.To.IsZero() {
+		// the To date is inclusive, so everything before the next midnight
+		args = append(args, f.To.AddDate(0, 0, 1))
+		query += fmt.Sprintf(" and a.created_at < $%d", len(args))
+	}
+	query += " order by a.created_at desc, a.id desc limit 500"
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return entries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e models.AuditEntry
+		err := rows.Scan(
+			&e.ID,
+			&e.UserID,
+			&e.Action,
+			&e.Entity,
+			&e.EntityID,
+			&e.Before,
+			&e.After,
+			&e.IP,
+			&e.CreatedAt,
+			&e.User.FirstName,
+			&e.User.LastName,
+			&e.User.Email,
+		)
+		if err != nil {
+			return entries, err
+		}
+		e.User.ID = e.UserID
+		entries = append(entries, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		return entries, err
+	}
+
+	return entries, nil
+}
+
+// AllStaffUsers returns all staff users ordered by last name
+func (m *postgresDBRepo) AllStaffUsers() ([]models.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var users []models.User
+
+	query := `
+		select id, first_name, last_name, email, access_level, created_at, updated_at
+		from users
+		order by last_name, first_name
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return users, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u models.User
+		err := rows.Scan(
+			&u.ID,
+			&u.FirstName,
+			&u.LastName,
+			&u.Email,
+			&u.AccessLevel,
+			&u.CreatedAt,
+			&u.UpdatedAt,
+		)
+		if err != nil {
+			return users, err
+		}
+		users = append(users, u)
+	}
+
+	if err = rows.Err(); err != nil {
+		return users, err
+	}
+
+	return users, nil
+}
+
+// DeletedReservations returns the reservations in the trash, most recently deleted first
+func (m *postgresDBRepo) DeletedReservations() ([]models.Reservation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var reservations []models.Reservation
+
+	query := `
+		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, 
+		r.room_id, r.created_at, r.updated_at, r.processed, rm.id, rm.room_name,
+		r.deleted_at, coalesce(u.id, 0), coalesce(u.first_name, ''), coalesce(u.last_name, '')
+		from reservations r 
+		left join rooms rm on (r.room_id = rm.id)
+		left join users u on (r.deleted_by = u.id)
+		where r.deleted_at is not null
+		order by r.deleted_at desc
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return reservations, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i models.Reservation
+		err := rows.Scan(
+			&i.ID,
+			&i.FirstName,
+			&i.LastName,
+			&i.Email,
+			&i.Phone,
+			&i.StartDate,
+			&i.EndDate,
+			&i.RoomID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Processed,
+			&i.Room.ID,
+			&i.Room.RoomName,
+			&i.DeletedAt,
+			&i.DeletedBy.ID,
+			&i.DeletedBy.FirstName,
+			&i.DeletedBy.LastName,
+		)
+		if err != nil {
+			return reservations, err
+		}
+		reservations = append(reservations, i)
+	}
+
+	if err = rows.Err(); err != nil {
+		return reservations, err
+	}
+
+	return reservations, nil
+}
+
+// RestoreReservation takes a reservation out of the trash and books its rooms again, each room of a split
+// stay for its own nights. It fails if another booking or block took one of them in the meantime
+func (m *postgresDBRepo) RestoreReservation(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var whole models.StaySegment
+	var cancelled bool
+
+	err = tx.QueryRowContext(ctx, `
+		update reservations set deleted_at = null, deleted_by = null, updated_at = $1
+		where id = $2 and deleted_at is not null
+		returning room_id, start_date, end_date, cancelled_at is not null
+	`, time.Now(), id).Scan(&whole.RoomID, &whole.StartDate, &whole.EndDate, &cancelled)
+	if err != nil {
+		return err
+	}
+
+	// a cancelled reservation had given its rooms back before it was trashed
+	if cancelled {
+		if _, err = tx.ExecContext(ctx, "delete from trashed_stays where reservation_id = $1", id); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		select room_id, start_date, end_date from trashed_stays where reservation_id = $1 order by start_date
+	`, id)
+	if err != nil {
+		return err
+	}
+
+	var stays []models.StaySegment
+	for rows.Next() {
+		var stay models.StaySegment
+		if err = rows.Scan(&stay.RoomID, &stay.StartDate, &stay.EndDate); err != nil {
+			rows.Close()
+			return err
+		}
+		stays = append(stays, stay)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	// reservations trashed before their rooms were kept aside take their room for the whole stay
+	if len(stays) == 0 {
+		stays = []models.StaySegment{whole}
+	}
+
+	for _, stay := range stays {
+		if err = lockRooms(ctx, tx, stay.RoomID); err != nil {
+			return err
+		}
+
+		var conflicts int
+		err = tx.QueryRowContext(ctx, `
+			select count(id) from room_restrictions
+			where room_id = $1 and $2 < end_date and $3 > start_date and (expires_at is null or expires_at > now())
+		`, stay.RoomID, stay.StartDate, stay.EndDate).Scan(&conflicts)
+		if err != nil {
+			return err
+		}
+		if conflicts > 0 {
+			return repository.ErrRoomTaken
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			insert into room_restrictions (start_date, end_date, room_id, reservation_id, restriction_id, created_at, updated_at)
+			values ($1, $2, $3, $4, 1, $5, $5)
+		`, stay.StartDate, stay.EndDate, stay.RoomID, id, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "delete from trashed_stays where reservation_id = $1", id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ImportReservations inserts the reservations with their room restrictions in one transaction and returns
+// their ids. If any of them conflicts with a restriction nothing is inserted
+func (m *postgresDBRepo) ImportReservations(reservations []models.Reservation) ([]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var ids []int
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return ids, err
+	}
+	defer tx.Rollback()
+
+	var roomIDs []int
+	for _, res := range reservations {
+		roomIDs = append(roomIDs, res.RoomID)
+	}
+	if err = lockRooms(ctx, tx, roomIDs...); err != nil {
+		return ids, err
+	}
+
+	for i, res := range reservations {
+		// checked inside the transaction, so earlier rows of the same import count as well
+		var conflicts int
+		err = tx.QueryRowContext(ctx, `
+			select count(id) from room_restrictions
+			where room_id = $1 and $2 < end_date and $3 > start_date
+			and (expires_at is null or expires_at > now())
+		`, res.RoomID, res.StartDate, res.EndDate).Scan(&conflicts)
+		if err != nil {
+			return ids, err
+		}
+		if conflicts > 0 {
+			return ids, fmt.Errorf("reservation %d of %s %s: room is not available for these dates",
+				i+1, res.FirstName, res.LastName)
+		}
+
+		var id int
+		err = tx.QueryRowContext(ctx, `
+			insert into reservations (first_name, last_name, email, phone, start_date, end_date, room_id, created_at, updated_at,
+				source, unit_assigned)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, 'import', true) returning id
+		`, res.FirstName, res.LastName, res.Email, res.Phone, res.StartDate, res.EndDate,
+			res.RoomID, time.Now(), time.Now()).Scan(&id)
+		if err != nil {
+			return ids, err
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			insert into room_restrictions (start_date, end_date, room_id, reservation_id, restriction_id, created_at, updated_at)
+			values ($1, $2, $3, $4, 1, $5, $5)
+		`, res.StartDate, res.EndDate, res.RoomID, id, time.Now())
+		if err != nil {
+			return ids, err
+		}
+
+		if err = priceReservation(ctx, tx, id); err != nil {
+			return ids, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return []int{}, err
+	}
+
+	return ids, nil
+}
+
+// CreateReservation inserts a reservation made by staff together with its room restriction,
+// checking inside the transaction that the room is still free
+func (m *postgresDBRepo) CreateReservation(res models.Reservation) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err = lockRooms(ctx, tx, res.RoomID); err != nil {
+		return 0, err
+	}
+
+	var conflicts int
+	err = tx.QueryRowContext(ctx, `
+		select count(id) from room_restrictions
+		where room_id = $1 and $2 < end_date and $3 > start_date
+		and (expires_at is null or expires_at > now())
+	`, res.RoomID, res.StartDate, res.EndDate).Scan(&conflicts)
+	if err != nil {
+		return 0, err
+	}
+	if conflicts > 0 {
+		return 0, errors.New("the room is not available for these dates")
+	}
+
+	var id int
+	err = tx.QueryRowContext(ctx, `
+		insert into reservations (first_name, last_name, email, phone, start_date, end_date, room_id,
+			created_at, updated_at, source, override_reason, unit_assigned, adults, children, extra_charge)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $8, $9, $10, true, $11, $12, $13) returning id
+	`, res.FirstName, res.LastName, res.Email, res.Phone, res.StartDate, res.EndDate, res.RoomID,
+		time.Now(), res.Source, res.OverrideReason, res.Adults, res.Children, res.ExtraCharge).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		insert into room_restrictions (start_date, end_date, room_id, reservation_id, restriction_id, created_at, updated_at)
+		values ($1, $2, $3, $4, 1, $5, $5)
+	`, res.StartDate, res.EndDate, res.RoomID, id, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	if err = priceReservation(ctx, tx, id); err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// InsertBookingGroup books several rooms for the same guest and dates as one group, a reservation and
+// room restriction per room, and returns the group id. The rooms the guest holds are turned into the
+// bookings. Nothing is booked unless every room is free
+func (m *postgresDBRepo) InsertBookingGroup(reservations []models.Reservation, holdIDs []int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var roomIDs []int
+	for _, res := range reservations {
+		roomIDs = append(roomIDs, res.RoomID)
+	}
+	if err = lockRooms(ctx, tx, roomIDs...); err != nil {
+		return 0, err
+	}
+
+	var groupID int
+	err = tx.QueryRowContext(ctx, `
+		insert into booking_groups (created_at, updated_at) values ($1, $1) returning id
+	`, time.Now()).Scan(&groupID)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, res := range reservations {
+		var id int
+		err = tx.QueryRowContext(ctx, `
+			insert into reservations (first_name, last_name, email, phone, start_date, end_date, room_id,
+				created_at, updated_at, guest_id, group_id, adults, children, extra_charge)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $8, nullif($9, 0), $10, $11, $12, $13) returning id
+		`, res.FirstName, res.LastName, res.Email, res.Phone, res.StartDate, res.EndDate, res.RoomID,
+			time.Now(), res.GuestID, groupID, res.Adults, res.Children, res.ExtraCharge).Scan(&id)
+		if err != nil {
+			return 0, err
+		}
+
+		stay := models.StaySegment{RoomID: res.RoomID, StartDate: res.StartDate, EndDate: res.EndDate}
+		if err = bookStay(ctx, tx, id, stay, holdIDs); err != nil {
+			return 0, err
+		}
+
+		if err = priceReservation(ctx, tx, id); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return groupID, nil
+}
+
+// InsertReservationStays inserts a reservation together with a room restriction for each of its stays, the
+// rooms of a split stay one after the other, and returns its id. The rooms the guest holds are turned into
+// the booking. Nothing is saved unless all of it is
+func (m *postgresDBRepo) InsertReservationStays(res models.Reservation, stays []models.StaySegment, holdIDs []int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var roomIDs []int
+	for _, stay := range stays {
+		roomIDs = append(roomIDs, stay.RoomID)
+	}
+	if err = lockRooms(ctx, tx, roomIDs...); err != nil {
+		return 0, err
+	}
+
+	var id int
+	err = tx.QueryRowContext(ctx, `
+		insert into reservations (first_name, last_name, email, phone, start_date, end_date, room_id,
+			created_at, updated_at, guest_id, adults, children, extra_charge)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $8, nullif($9, 0), $10, $11, $12) returning id
+	`, res.FirstName, res.LastName, res.Email, res.Phone, res.StartDate, res.EndDate, res.RoomID,
+		time.Now(), res.GuestID, res.Adults, res.Children, res.ExtraCharge).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, stay := range stays {
+		if err = bookStay(ctx, tx, id, stay, holdIDs); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = priceReservation(ctx, tx, id); err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// bookStay books the room of a stay for a reservation, in a transaction that locked the room. A hold of the
+// guest on that room and those dates becomes the booking; anything else on the room, but expired holds,
+// means it was taken
+func bookStay(ctx context.Context, tx *sql.Tx, reservationID int, stay models.StaySegment, holdIDs []int) error {
+	var heldID int
+	for _, id := range holdIDs {
+		err := tx.QueryRowContext(ctx, `
+			select id from room_restrictions
+			where id = $1 and restriction_id = $2 and room_id = $3 and start_date = $4 and end_date = $5
+		`, id, models.RestrictionHold, stay.RoomID, stay.StartDate, stay.EndDate).Scan(&heldID)
+		if err == nil {
+			break
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+	}
+
+	var conflicts int
+	err := tx.QueryRowContext(ctx, `
+		select count(id) from room_restrictions
+		where room_id = $1 and $2 < end_date and $3 > start_date and id <> $4
+		and (expires_at is null or expires_at > now())
+	`, stay.RoomID, stay.StartDate, stay.EndDate, heldID).Scan(&conflicts)
+	if err != nil {
+		return err
+	}
+	if conflicts > 0 {
+		return repository.ErrRoomTaken
+	}
+
+	if heldID > 0 {
+		_, err = tx.ExecContext(ctx, `
+			update room_restrictions set restriction_id = 1, reservation_id = $1, expires_at = null, updated_at = $2
+			where id = $3
+		`, reservationID, time.Now(), heldID)
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		insert into room_restrictions (start_date, end_date, room_id, reservation_id, restriction_id, created_at, updated_at)
+		values ($1, $2, $3, $4, 1, $5, $5)
+	`, stay.StartDate, stay.EndDate, stay.RoomID, reservationID, time.Now())
+	return err
+}
+
+// priceReservation stores what the nights of a reservation cost at the rates of its rooms when it is booked,
+// so changing a rate later doesn't change the revenue of the stays already sold
+func priceReservation(ctx context.Context, tx *sql.Tx, reservationID int) error {
+	_, err := tx.ExecContext(ctx, `
+		update reservations set room_charge = coalesce((
+			select sum((rr.end_date - rr.start_date) * rm.nightly_rate)
+			from room_restrictions rr
+			join rooms rm on (rm.id = rr.room_id)
+			where rr.reservation_id = $1 and rr.restriction_id = 1
+		), 0)
+		where id = $1
+	`, reservationID)
+	return err
+}
+
+// priceExtraGuests works out again what the guests over the base occupancy of its rooms add to a reservation
+// whose rooms or dates changed. The whole party stays in every room of a split stay
+func priceExtraGuests(ctx context.Context, tx *sql.Tx, reservationID int) error {
+	_, err := tx.ExecContext(ctx, `
+		update reservations r set extra_charge = coalesce((
+			select sum((rr.end_date - rr.start_date) * rm.extra_person_rate
+				* greatest(r.adults + r.children - rm.base_occupancy, 0))
+			from room_restrictions rr
+			join rooms rm on (rm.id = rr.room_id)
+			where rr.reservation_id = r.id and rr.restriction_id = 1
+		), 0)
+		where r.id = $1
+	`, reservationID)
+	return err
+}
+
+// GroupReservations returns the reservations of a booking group that are not in the trash
+func (m *postgresDBRepo) GroupReservations(groupID int) ([]models.Reservation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var reservations []models.Reservation
+
+	query := `
+		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date,
+		r.room_id, rm.id, rm.room_name, r.cancelled_at is not null
+		from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		where r.group_id = $1 and r.deleted_at is null
+		order by r.id
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, groupID)
+	if err != nil {
+		return reservations, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i models.Reservation
+		err := rows.Scan(
+			&i.ID,
+			&i.FirstName,
+			&i.LastName,
+			&i.Email,
+			&i.Phone,
+			&i.StartDate,
+			&i.EndDate,
+			&i.RoomID,
+			&i.Room.ID,
+			&i.Room.RoomName,
+			&i.Cancelled,
+		)
+		if err != nil {
+			return reservations, err
+		}
+		i.GroupID = groupID
+		reservations = append(reservations, i)
+	}
+
+	if err = rows.Err(); err != nil {
+		return reservations, err
+	}
+
+	return reservations, nil
+}
+
+// CancelBookingGroup cancels every reservation of a booking group and frees their rooms
+func (m *postgresDBRepo) CancelBookingGroup(groupID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+		update reservations set cancelled_at = $1, updated_at = $1
+		where group_id = $2 and cancelled_at is null and deleted_at is null
+	`, time.Now(), groupID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errors.New("the group has nothing left to cancel")
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		delete from room_restrictions
+		where reservation_id in (select id from reservations where group_id = $1)
+	`, groupID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MoveReservation puts a reservation and its room restriction in another room and/or on other dates,
+// provided the room is of the type booked, sleeps the party and nothing else holds it then, and prices
+// the stay again
+func (m *postgresDBRepo) MoveReservation(id, roomID int, start, end time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// locked, so two moves of the same reservation can't interleave
+	var current int
+	err = tx.QueryRowContext(ctx, `
+		select room_id from reservations
+		where id = $1 and deleted_at is null and cancelled_at is null and checked_out_at is null
+		for update
+	`, id).Scan(&current)
+	if err == sql.ErrNoRows {
+		return errors.New("the reservation can't be moved")
+	} else if err != nil {
+		return err
+	}
+
+	var segments int
+	err = tx.QueryRowContext(ctx, "select count(id) from room_restrictions where reservation_id = $1", id).Scan(&segments)
+	if err != nil {
+		return err
+	}
+	if segments > 1 {
+		return errors.New("the rooms of a split stay are changed on its reservation page")
+	}
+
+	if err = lockRooms(ctx, tx, roomID); err != nil {
+		return err
+	}
+
+	if err = checkUnit(ctx, tx, id, roomID); err != nil {
+		return err
+	}
+
+	var conflicts int
+	err = tx.QueryRowContext(ctx, `
+		select count(id) from room_restrictions
+		where room_id = $1 and $2 < end_date and $3 > start_date and coalesce(reservation_id, 0) <> $4
+		and (expires_at is null or expires_at > now())
+	`, roomID, start, end, id).Scan(&conflicts)
+	if err != nil {
+		return err
+	}
+	if conflicts > 0 {
+		return errors.New("the room is not available for these dates")
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		update reservations set room_id = $1, start_date = $2, end_date = $3, updated_at = $4, unit_assigned = true
+		where id = $5
+	`, roomID, start, end, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		update room_restrictions set room_id = $1, start_date = $2, end_date = $3, updated_at = $4
+		where reservation_id = $5
+	`, roomID, start, end, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	// the stay is charged for its new nights at the rates of its new room
+	if err = priceReservation(ctx, tx, id); err != nil {
+		return err
+	}
+	if err = priceExtraGuests(ctx, tx, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SplitReservation puts the guest in roomID from the night of on until the end of the part of the stay
+// that night falls in. Starting midway, that part ends on on and a new one in roomID takes over, and the
+// stay is priced again
+func (m *postgresDBRepo) SplitReservation(id int, on time.Time, roomID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var segmentID, currentRoom int
+	var segmentStart, segmentEnd time.Time
+	err = tx.QueryRowContext(ctx, `
+		select rr.id, rr.room_id, rr.start_date, rr.end_date
+		from room_restrictions rr
+		join reservations r on (r.id = rr.reservation_id)
+		where rr.reservation_id = $1 and rr.start_date <= $2 and rr.end_date > $2
+		and r.deleted_at is null and r.cancelled_at is null and r.checked_out_at is null
+		for update
+	`, id, on).Scan(&segmentID, &currentRoom, &segmentStart, &segmentEnd)
+	if err == sql.ErrNoRows {
+		return errors.New("the guest doesn't stay that night")
+	} else if err != nil {
+		return err
+	}
+	if currentRoom == roomID {
+		return errors.New("the guest is in that room already")
+	}
+
+	if err = lockRooms(ctx, tx, roomID); err != nil {
+		return err
+	}
+
+	var conflicts int
+	err = tx.QueryRowContext(ctx, `
+		select count(id) from room_restrictions
+		where room_id = $1 and $2 < end_date and $3 > start_date
+		and (expires_at is null or expires_at > now())
+	`, roomID, on, segmentEnd).Scan(&conflicts)
+	if err != nil {
+		return err
+	}
+	if conflicts > 0 {
+		return errors.New("the room is not available for these dates")
+	}
+
+	if segmentStart.Equal(on) {
+		_, err = tx.ExecContext(ctx, "update room_restrictions set room_id = $1, updated_at = $2 where id = $3",
+			roomID, time.Now(), segmentID)
+		if err != nil {
+			return err
+		}
+
+		// the reservation's room is the one the stay starts in
+		_, err = tx.ExecContext(ctx, `
+			update reservations set room_id = $1, updated_at = $2 where id = $3 and start_date = $4
+		`, roomID, time.Now(), id, on)
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err = tx.ExecContext(ctx, "update room_restrictions set end_date = $1, updated_at = $2 where id = $3",
+			on, time.Now(), segmentID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			insert into room_restrictions (start_date, end_date, room_id, reservation_id, restriction_id, created_at, updated_at)
+			values ($1, $2, $3, $4, 1, $5, $5)
+		`, on, segmentEnd, roomID, id, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	// the nights moved are charged at the rates of the room they moved to
+	if err = priceReservation(ctx, tx, id); err != nil {
+		return err
+	}
+	if err = priceExtraGuests(ctx, tx, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// PurgeDeletedReservations permanently removes reservations deleted before the given time
+func (m *postgresDBRepo) PurgeDeletedReservations(deletedBefore time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, "delete from reservations where deleted_at < $1", deletedBefore)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// OccupancyReport aggregates the room restrictions and reservations of the period from..to, for one room or,
+// with roomID 0, for all of them. Nights are counted only as far as they fall inside the period
+func (m *postgresDBRepo) OccupancyReport(from, to time.Time, roomID int) (models.OccupancyReport, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	report := models.OccupancyReport{
+		From:      from,
+		To:        to,
+		RoomID:    roomID,
+		LeadTimes: make(map[string]int),
+	}
+	days := int(to.Sub(from).Hours() / 24)
+
+	// reservations keep their restriction until they are cancelled or deleted, so the restrictions are what was sold.
+	// Owner blocks and rooms out of order can't be sold, so they aren't available; rooms an allotment holds
+	// for a group still are, and count once a guest of the group books them. Revenue is what the guests pay,
+	// as priced when they booked, spread evenly over the nights of their stay
+	rows, err := m.DB.QueryContext(ctx, `
+		select rm.id, rm.room_name, rm.nightly_rate,
+			coalesce(sum(least(rr.end_date, $2::date) - greatest(rr.start_date, $1::date))
+				filter (where rr.restriction_id = 1), 0),
+			coalesce(sum(least(rr.end_date, $2::date) - greatest(rr.start_date, $1::date))
+				filter (where rr.restriction_id in (2, $4)), 0),
+			coalesce(round(sum((least(rr.end_date, $2::date) - greatest(rr.start_date, $1::date))
+				* (r.room_charge + r.extra_charge)::numeric / greatest(r.end_date - r.start_date, 1))
+				filter (where rr.restriction_id = 1))::bigint, 0)
+		from rooms rm
+		left join room_restrictions rr on (rr.room_id = rm.id and rr.start_date < $2 and rr.end_date > $1)
+		left join reservations r on (r.id = rr.reservation_id)
+		where ($3 = 0 or rm.id = $3)
+		group by rm.id, rm.room_name, rm.nightly_rate
+		order by rm.room_name
+	`, from, to, roomID, models.RestrictionOutOfOrder)
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ro models.RoomOccupancy
+		err := rows.Scan(&ro.Room.ID, &ro.Room.RoomName, &ro.Room.NightlyRate, &ro.BookedNights, &ro.BlockedNights,
+			&ro.Revenue)
+		if err != nil {
+			return report, err
+		}
+		ro.AvailableNights = days - ro.BlockedNights
+		report.Rooms = append(report.Rooms, ro)
+	}
+	if err = rows.Err(); err != nil {
+		return report, err
+	}
+
+	daily, err := m.DB.QueryContext(ctx, `
+		select d::date, count(rr.id)
+		from generate_series($1::date, $2::date - 1, interval '1 day') d
+		left join room_restrictions rr on (rr.restriction_id = 1 and rr.start_date <= d and rr.end_date > d
+			and ($3 = 0 or rr.room_id = $3))
+		group by d
+		order by d
+	`, from, to, roomID)
+	if err != nil {
+		return report, err
+	}
+	defer daily.Close()
+
+	for daily.Next() {
+		var d models.DailyOccupancy
+		if err := daily.Scan(&d.Date, &d.Occupied); err != nil {
+			return report, err
+		}
+		report.Daily = append(report.Daily, d)
+	}
+	if err = daily.Err(); err != nil {
+		return report, err
+	}
+
+	err = m.DB.QueryRowContext(ctx, `
+		select count(id) from reservations
+		where cancelled_at >= $1 and cancelled_at < $2 and deleted_at is null and ($3 = 0 or room_id = $3)
+	`, from, to, roomID).Scan(&report.Cancellations)
+	if err != nil {
+		return report, err
+	}
+
+	leads, err := m.DB.QueryContext(ctx, `
+		select case
+				when start_date - created_at::date <= 1 then '0-1'
+				when start_date - created_at::date <= 7 then '2-7'
+				when start_date - created_at::date <= 30 then '8-30'
+				when start_date - created_at::date <= 90 then '31-90'
+				else '91+'
+			end, count(id)
+		from reservations
+		where start_date >= $1 and start_date < $2 and cancelled_at is null and deleted_at is null
+			and ($3 = 0 or room_id = $3)
+		group by 1
+	`, from, to, roomID)
+	if err != nil {
+		return report, err
+	}
+	defer leads.Close()
+
+	for leads.Next() {
+		var bucket string
+		var count int
+		if err := leads.Scan(&bucket, &count); err != nil {
+			return report, err
+		}
+		report.LeadTimes[bucket] = count
+	}
+
+	return report, leads.Err()
+}
+
+// FrontDesk returns the arrivals, departures, stay-overs and vacant rooms of a date
+func (m *postgresDBRepo) FrontDesk(date time.Time) (models.FrontDeskDay, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	day := models.FrontDeskDay{Date: date}
+
+	query := `
+		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date,
+		r.room_id, r.created_at, r.updated_at, r.processed, rm.id, rm.room_name, r.checked_in_at, r.checked_out_at,
+		r.unit_assigned, coalesce(rm.room_type_id, 0)
+		from reservations r
+		left join rooms rm on (rm.id = coalesce((
+			-- the room of a split stay is the one the guest is in that day
+			select rr.room_id from room_restrictions rr
+			where rr.reservation_id = r.id and rr.start_date <= $1
+			order by rr.start_date desc limit 1
+		), r.room_id))
+		where r.start_date <= $1 and r.end_date >= $1 and r.cancelled_at is null and r.deleted_at is null
+		order by rm.room_name, r.last_name
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, date)
+	if err != nil {
+		return day, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i models.Reservation
+		var checkedInAt, checkedOutAt sql.NullTime
+		err := rows.Scan(
+			&i.ID,
+			&i.FirstName,
+			&i.LastName,
+			&i.Email,
+			&i.Phone,
+			&i.StartDate,
+			&i.EndDate,
+			&i.RoomID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Processed,
+			&i.Room.ID,
+			&i.Room.RoomName,
+			&checkedInAt,
+			&checkedOutAt,
+			&i.UnitAssigned,
+			&i.Room.RoomTypeID,
+		)
+		if err != nil {
+			return day, err
+		}
+		i.CheckedInAt = checkedInAt.Time
+		i.CheckedOutAt = checkedOutAt.Time
+
+		switch {
+		case i.StartDate.Equal(date):
+			day.Arrivals = append(day.Arrivals, i)
+		case i.EndDate.Equal(date):
+			day.Departures = append(day.Departures, i)
+		default:
+			day.StayOvers = append(day.StayOvers, i)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return day, err
+	}
+
+	vacant, err := m.DB.QueryContext(ctx, `
+		select rm.id, rm.room_name from rooms rm
+		where not exists (
+			-- only a guest staying makes a room occupied; holds, blocks and allotments leave it empty
+			select 1 from room_restrictions rr
+			where rr.room_id = rm.id and rr.restriction_id = 1 and rr.start_date <= $1 and rr.end_date > $1
+		)
+		order by rm.room_name
+	`, date)
+	if err != nil {
+		return day, err
+	}
+	defer vacant.Close()
+
+	for vacant.Next() {
+		var room models.Room
+		if err := vacant.Scan(&room.ID, &room.RoomName); err != nil {
+			return day, err
+		}
+		day.Vacant = append(day.Vacant, room)
+	}
+
+	return day, vacant.Err()
+}
+
+// CheckInReservation records the guest's arrival, on the arrival date or later
+func (m *postgresDBRepo) CheckInReservation(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	result, err := m.DB.ExecContext(ctx, `
+		update reservations set checked_in_at = $1, updated_at = $1
+		where id = $2 and start_date <= $1::date
+		and checked_in_at is null and cancelled_at is null and deleted_at is null
+	`, now, id)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n > 0 {
+		return nil
+	}
+
+	var early bool
+	err = m.DB.QueryRowContext(ctx, `
+		select start_date > $1::date from reservations
+		where id = $2 and checked_in_at is null and cancelled_at is null and deleted_at is null
+	`, now, id).Scan(&early)
+	if err == nil && early {
+		return repository.ErrBeforeArrival
+	}
+	return errors.New("reservation can't be checked in")
+}
+
+// CheckOutReservation records the guest's departure and leaves the room dirty for housekeeping
+func (m *postgresDBRepo) CheckOutReservation(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var roomID int
+	err = tx.QueryRowContext(ctx, `
+		update reservations set checked_out_at = $1, updated_at = $1
+		where id = $2 and checked_in_at is not null and checked_out_at is null and deleted_at is null
+		returning coalesce((
+			select rr.room_id from room_restrictions rr where rr.reservation_id = reservations.id
+			order by rr.end_date desc limit 1
+		), room_id)
+	`, time.Now(), id).Scan(&roomID)
+	if err == sql.ErrNoRows {
+		return errors.New("reservation can't be checked out")
+	} else if err != nil {
+		return err
+	}
+
+	// a room out of order stays so until someone puts it back
+	_, err = tx.ExecContext(ctx, `
+		update rooms set housekeeping_status = $1, updated_at = $2
+		where id = $3 and housekeeping_status <> $4
+	`, models.RoomDirty, time.Now(), roomID, models.RoomOutOfOrder)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetRoomStatus sets the housekeeping status of a room
+func (m *postgresDBRepo) SetRoomStatus(roomID int, status string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, "update rooms set housekeeping_status = $1, updated_at = $2 where id = $3",
+		status, time.Now(), roomID)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errors.New("no such room")
+	}
+	return nil
+}
+
+// GenerateHousekeepingTasks makes the tasks of a date: a full clean for every room a guest leaves, the room change
+// of a split stay included, and a service for every guest staying over. The tasks not done yet are made again,
+// so a stay cancelled, moved or split since drops off the list, and it can run any number of times
+func (m *postgresDBRepo) GenerateHousekeepingTasks(date time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `delete from housekeeping_tasks where task_date = $1 and done_at is null`, date)
+	if err != nil {
+		return 0, err
+	}
+
+	// a room already done keeps its task
+	result, err := tx.ExecContext(ctx, `
+		insert into housekeeping_tasks (room_id, task_date, kind, reservation_id, created_at, updated_at)
+		select rr.room_id, $1::date, case when rr.end_date = $1 then 'checkout' else 'stayover' end, r.id, $2, $2
+		from room_restrictions rr
+		join reservations r on (r.id = rr.reservation_id)
+		where rr.start_date < $1 and rr.end_date >= $1 and r.cancelled_at is null and r.deleted_at is null
+		order by rr.end_date = $1 desc
+		on conflict (room_id, task_date) do nothing
+	`, date, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return n, tx.Commit()
+}
+
+// HousekeepingTasks returns the tasks of a date, the ones still to do first
+func (m *postgresDBRepo) HousekeepingTasks(date time.Time) ([]models.HousekeepingTask, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var tasks []models.HousekeepingTask
+
+	query := `
+		select t.id, t.room_id, t.task_date, t.kind, coalesce(t.reservation_id, 0), t.done_at,
+		coalesce(u.first_name, ''), coalesce(u.last_name, ''), rm.room_name, rm.housekeeping_status,
+		coalesce(r.adults, 0), coalesce(r.children, 0)
+		from housekeeping_tasks t
+		left join rooms rm on (t.room_id = rm.id)
+		left join users u on (t.done_by = u.id)
+		left join reservations r on (t.reservation_id = r.id)
+		where t.task_date = $1
+		order by t.done_at is not null, t.kind, rm.room_name
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, date)
+	if err != nil {
+		return tasks, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t models.HousekeepingTask
+		var doneAt sql.NullTime
+		err := rows.Scan(
+			&t.ID,
+			&t.RoomID,
+			&t.Date,
+			&t.Kind,
+			&t.ReservationID,
+			&doneAt,
+			&t.DoneBy.FirstName,
+			&t.DoneBy.LastName,
+			&t.Room.RoomName,
+			&t.Room.Status,
+			&t.Adults,
+			&t.Children,
+		)
+		if err != nil {
+			return tasks, err
+		}
+		t.DoneAt = doneAt.Time
+		t.Room.ID = t.RoomID
+		tasks = append(tasks, t)
+	}
+
+	return tasks, rows.Err()
+}
+
+// CompleteHousekeepingTask marks a task done by a user and the room clean
+func (m *postgresDBRepo) CompleteHousekeepingTask(id, userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var roomID int
+	err = tx.QueryRowContext(ctx, `
+		update housekeeping_tasks set done_at = $1, done_by = nullif($2, 0), updated_at = $1
+		where id = $3 and done_at is null
+		returning room_id
+	`, time.Now(), userID, id).Scan(&roomID)
+	if err == sql.ErrNoRows {
+		return errors.New("task is already done")
+	} else if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		update rooms set housekeeping_status = $1, updated_at = $2
+		where id = $3 and housekeeping_status <> $4
+	`, models.RoomClean, time.Now(), roomID, models.RoomOutOfOrder)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// lockRooms locks the rows of the rooms until the transaction ends, so that whoever checks next that they are
+// free for some dates waits until what this transaction books is visible. Rooms are locked in id order, so
+// two transactions locking several rooms can't deadlock
+func lockRooms(ctx context.Context, tx *sql.Tx, roomIDs ...int) error {
+	ids := append([]int(nil), roomIDs...)
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx, "select id from rooms where id = $1 for update", id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkUnit makes sure a room can take a reservation in place of the room it has: a unit of the room type
+// the guest booked, when the booking has one, that sleeps the whole party
+func checkUnit(ctx context.Context, tx *sql.Tx, reservationID, roomID int) error {
+	var bookedType, unitType, maxOccupancy, guests int
+	err := tx.QueryRowContext(ctx, `
+		select coalesce(cur.room_type_id, 0), coalesce(rm.room_type_id, 0), rm.max_occupancy, r.adults + r.children
+		from reservations r
+		join rooms cur on (cur.id = r.room_id)
+		join rooms rm on (rm.id = $2)
+		where r.id = $1
+	`, reservationID, roomID).Scan(&bookedType, &unitType, &maxOccupancy, &guests)
+	if err == sql.ErrNoRows {
+		return errors.New("no such room")
+	} else if err != nil {
+		return err
+	}
+
+	if bookedType > 0 && unitType != bookedType {
+		return errors.New("the room is not of the room type the guest booked")
+	}
+	if guests > maxOccupancy {
+		return fmt.Errorf("the room sleeps %d, the party is %d", maxOccupancy, guests)
+	}
+	return nil
+}
+
+// blockForWorkOrder puts the room of a work order out of order over its dates and returns the restriction id,
+// 0 when the work order has no dates. Reservations over those dates have to be moved first
+func blockForWorkOrder(ctx context.Context, tx *sql.Tx, w models.WorkOrder) (int, error) {
+	if w.StartDate.IsZero() || w.EndDate.IsZero() {
+		return 0, nil
+	}
+
+	if err := lockRooms(ctx, tx, w.RoomID); err != nil {
+		return 0, err
+	}
+
+	var conflicts int
+	err := tx.QueryRowContext(ctx, `
+		select count(id) from room_restrictions
+		where room_id = $1 and $2 < end_date and $3 > start_date
+		and (expires_at is null or expires_at > now())
+	`, w.RoomID, w.StartDate, w.EndDate).Scan(&conflicts)
+	if err != nil {
+		return 0, err
+	}
+	if conflicts > 0 {
+		return 0, repository.ErrRoomTaken
+	}
+
+	var id int
+	err = tx.QueryRowContext(ctx, `
+		insert into room_restrictions (start_date, end_date, room_id, restriction_id, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $5) returning id
+	`, w.StartDate, w.EndDate, w.RoomID, models.RestrictionOutOfOrder, time.Now()).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	// a block from today on puts the room out of order now; later ones do when their day comes
+	_, err = tx.ExecContext(ctx, `
+		update rooms set housekeeping_status = $1, updated_at = $2
+		where id = $3 and $4 <= current_date and $5 > current_date
+	`, models.RoomOutOfOrder, time.Now(), w.RoomID, w.StartDate, w.EndDate)
+	return id, err
+}
+
+// InsertWorkOrder inserts a work order, with its out of order block if it has dates, and returns its id
+func (m *postgresDBRepo) InsertWorkOrder(w models.WorkOrder) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	restrictionID, err := blockForWorkOrder(ctx, tx, w)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int
+	err = tx.QueryRowContext(ctx, `
+		insert into work_orders (room_id, title, description, priority, assignee_id, status, start_date, end_date,
+			restriction_id, created_at, updated_at)
+		values ($1, $2, $3, $4, nullif($5, 0), 'open', $6, $7, nullif($8, 0), $9, $9) returning id
+	`, w.RoomID, w.Title, w.Description, w.Priority, w.AssigneeID, nullDate(w.StartDate), nullDate(w.EndDate),
+		restrictionID, time.Now()).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+// UpdateWorkOrder updates an open work order and moves its out of order block to its new dates
+func (m *postgresDBRepo) UpdateWorkOrder(w models.WorkOrder) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var oldRestriction sql.NullInt64
+	err = tx.QueryRowContext(ctx, "select restriction_id from work_orders where id = $1 and status = 'open' for update",
+		w.ID).Scan(&oldRestriction)
+	if err == sql.ErrNoRows {
+		return errors.New("only open work orders can be changed")
+	} else if err != nil {
+		return err
+	}
+
+	// the old block goes first, so it doesn't count as a conflict with the new one
+	if oldRestriction.Valid {
+		if _, err = tx.ExecContext(ctx, "delete from room_restrictions where id = $1", oldRestriction.Int64); err != nil {
+			return err
+		}
+	}
+
+	restrictionID, err := blockForWorkOrder(ctx, tx, w)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		update work_orders set title = $1, description = $2, priority = $3, assignee_id = nullif($4, 0),
+			start_date = $5, end_date = $6, restriction_id = nullif($7, 0), updated_at = $8
+		where id = $9
+	`, w.Title, w.Description, w.Priority, w.AssigneeID, nullDate(w.StartDate), nullDate(w.EndDate),
+		restrictionID, time.Now(), w.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CloseWorkOrder closes a work order and releases its out of order block
+func (m *postgresDBRepo) CloseWorkOrder(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var restrictionID sql.NullInt64
+	err = tx.QueryRowContext(ctx, `
+		update work_orders w set status = 'closed', closed_at = $1, updated_at = $1, restriction_id = null
+		from work_orders old
+		where w.id = old.id and w.id = $2 and w.status = 'open'
+		returning old.restriction_id
+	`, time.Now(), id).Scan(&restrictionID)
+	if err == sql.ErrNoRows {
+		return errors.New("work order is already closed")
+	} else if err != nil {
+		return err
+	}
+
+	if restrictionID.Valid {
+		if _, err = tx.ExecContext(ctx, "delete from room_restrictions where id = $1", restrictionID.Int64); err != nil {
+			return err
+		}
+
+		// the room goes back to housekeeping, unless another work order keeps it out of order today
+		_, err = tx.ExecContext(ctx, `
+			update rooms set housekeeping_status = $1, updated_at = $2
+			where id = (select room_id from work_orders where id = $3) and housekeeping_status = $4
+			and not exists (
+				select 1 from room_restrictions rr
+				where rr.room_id = rooms.id and rr.restriction_id = $5 and rr.start_date <= current_date
+				and rr.end_date > current_date
+			)
+		`, models.RoomDirty, time.Now(), id, models.RoomOutOfOrder, models.RestrictionOutOfOrder)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// MarkOutOfOrderRooms puts the rooms a work order blocks on date out of order, and returns how many changed
+func (m *postgresDBRepo) MarkOutOfOrderRooms(date time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `
+		update rooms set housekeeping_status = $1, updated_at = $2
+		where housekeeping_status <> $1 and id in (
+			select room_id from room_restrictions
+			where restriction_id = $3 and start_date <= $4 and end_date > $4
+		)
+	`, models.RoomOutOfOrder, time.Now(), models.RestrictionOutOfOrder, date)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// GetWorkOrderByID returns a work order with its photos
+func (m *postgresDBRepo) GetWorkOrderByID(id int) (models.WorkOrder, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var w models.WorkOrder
+	var start, end, closedAt sql.NullTime
+
+	err := m.DB.QueryRowContext(ctx, `
+		select w.id, w.room_id, w.title, w.description, w.priority, coalesce(w.assignee_id, 0), w.status,
+		w.start_date, w.end_date, coalesce(w.restriction_id, 0), w.closed_at, w.created_at, w.updated_at,
+		rm.room_name, coalesce(u.first_name, ''), coalesce(u.last_name, '')
+		from work_orders w
+		left join rooms rm on (w.room_id = rm.id)
+		left join users u on (w.assignee_id = u.id)
+		where w.id = $1
+	`, id).Scan(
+		&w.ID,
+		&w.RoomID,
+		&w.Title,
+		&w.Description,
+		&w.Priority,
+		&w.AssigneeID,
+		&w.Status,
+		&start,
+		&end,
+		&w.RestrictionID,
+		&closedAt,
+		&w.CreatedAt,
+		&w.UpdatedAt,
+		&w.Room.RoomName,
+		&w.Assignee.FirstName,
+		&w.Assignee.LastName,
+	)
+	if err != nil {
+		return w, err
+	}
+	w.StartDate, w.EndDate, w.ClosedAt = start.Time, end.Time, closedAt.Time
+	w.Room.ID = w.RoomID
+	w.Assignee.ID = w.AssigneeID
+
+	rows, err := m.DB.QueryContext(ctx, `
+		select id, work_order_id, file_name, original_name, created_at
+		from work_order_photos where work_order_id = $1 order by id
+	`, id)
+	if err != nil {
+		return w, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p models.WorkOrderPhoto
+		if err := rows.Scan(&p.ID, &p.WorkOrderID, &p.FileName, &p.OriginalName, &p.CreatedAt); err != nil {
+			return w, err
+		}
+		w.Photos = append(w.Photos, p)
+	}
+
+	return w, rows.Err()
+}
+
+// WorkOrders returns the work orders of a room, or of all rooms for roomID 0, with the given status or any
+func (m *postgresDBRepo) WorkOrders(roomID int, status string) ([]models.WorkOrder, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var orders []models.WorkOrder
+
+	rows, err := m.DB.QueryContext(ctx, `
+		select w.id, w.room_id, w.title, w.priority, coalesce(w.assignee_id, 0), w.status,
+		w.start_date, w.end_date, w.created_at, rm.room_name, coalesce(u.first_name, ''), coalesce(u.last_name, '')
+		from work_orders w
+		left join rooms rm on (w.room_id = rm.id)
+		left join users u on (w.assignee_id = u.id)
+		where ($1 = 0 or w.room_id = $1) and ($2 = '' or w.status = $2)
+		order by w.status = 'closed',
+			array_position(array['urgent', 'high', 'normal', 'low'], w.priority::text), w.created_at
+	`, roomID, status)
+	if err != nil {
+		return orders, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var w models.WorkOrder
+		var start, end sql.NullTime
+		err := rows.Scan(&w.ID, &w.RoomID, &w.Title, &w.Priority, &w.AssigneeID, &w.Status, &start, &end,
+			&w.CreatedAt, &w.Room.RoomName, &w.Assignee.FirstName, &w.Assignee.LastName)
+		if err != nil {
+			return orders, err
+		}
+		w.StartDate, w.EndDate = start.Time, end.Time
+		w.Room.ID = w.RoomID
+		orders = append(orders, w)
+	}
+
+	return orders, rows.Err()
+}
+
+// InsertWorkOrderPhoto records a photo saved for a work order
+func (m *postgresDBRepo) InsertWorkOrderPhoto(p models.WorkOrderPhoto) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `
+		insert into work_order_photos (work_order_id, file_name, original_name, created_at, updated_at)
+		values ($1, $2, $3, $4, $4)
+	`, p.WorkOrderID, p.FileName, p.OriginalName, time.Now())
+	return err
+}
+
+// nullDate stores a zero time as null
+func nullDate(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// InsertAllotment holds the rooms for an allotment over its dates and returns its id. Nothing is held unless
+// every room is free
+func (m *postgresDBRepo) InsertAllotment(a models.Allotment, roomIDs []int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err = lockRooms(ctx, tx, roomIDs...); err != nil {
+		return 0, err
+	}
+
+	var id int
+	err = tx.QueryRowContext(ctx, `
+		insert into allotments (name, code, rooms, start_date, end_date, release_date, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $7) returning id
+	`, a.Name, a.Code, len(roomIDs), a.StartDate, a.EndDate, a.ReleaseDate, time.Now()).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, roomID := range roomIDs {
+		var conflicts int
+		err = tx.QueryRowContext(ctx, `
+			select count(id) from room_restrictions
+			where room_id = $1 and $2 < end_date and $3 > start_date
+			and (expires_at is null or expires_at > now())
+		`, roomID, a.StartDate, a.EndDate).Scan(&conflicts)
+		if err != nil {
+			return 0, err
+		}
+		if conflicts > 0 {
+			return 0, errors.New("one of the rooms is not available for these dates")
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			insert into room_restrictions (start_date, end_date, room_id, restriction_id, allotment_id, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $6)
+		`, a.StartDate, a.EndDate, roomID, models.RestrictionAllotment, id, time.Now())
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// Allotments returns all the allotments with how many of their rooms were booked, the latest first
+func (m *postgresDBRepo) Allotments() ([]models.Allotment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var allotments []models.Allotment
+
+	rows, err := m.DB.QueryContext(ctx, `
+		select a.id, a.name, a.code, a.rooms, a.start_date, a.end_date, a.release_date, a.released_at,
+		a.created_at, a.updated_at,
+		(select count(r.id) from reservations r
+			where r.allotment_id = a.id and r.cancelled_at is null and r.deleted_at is null)
+		from allotments a
+		order by a.start_date desc
+	`)
+	if err != nil {
+		return allotments, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a models.Allotment
+		var releasedAt sql.NullTime
+		err := rows.Scan(
+			&a.ID,
+			&a.Name,
+			&a.Code,
+			&a.Rooms,
+			&a.StartDate,
+			&a.EndDate,
+			&a.ReleaseDate,
+			&releasedAt,
+			&a.CreatedAt,
+			&a.UpdatedAt,
+			&a.Booked,
+		)
+		if err != nil {
+			return allotments, err
+		}
+		a.ReleasedAt = releasedAt.Time
+		allotments = append(allotments, a)
+	}
+
+	if err = rows.Err(); err != nil {
+		return allotments, err
+	}
+
+	return allotments, nil
+}
+
+// GetAllotmentByID returns an allotment with the rooms it still holds and the reservations made from it
+func (m *postgresDBRepo) GetAllotmentByID(id int) (models.Allotment, error) {
+	return m.getAllotment("a.id = $1", id)
+}
+
+// GetAllotmentByCode returns the allotment of a booking code, as long as its release date hasn't come
+func (m *postgresDBRepo) GetAllotmentByCode(code string) (models.Allotment, error) {
+	return m.getAllotment("a.code = $1 and a.released_at is null and a.release_date > current_date", code)
+}
+
+// getAllotment loads the allotment matching where, with the rooms it still holds and its reservations
+func (m *postgresDBRepo) getAllotment(where string, arg interface{}) (models.Allotment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var a models.Allotment
+	var releasedAt sql.NullTime
+
+	err := m.DB.QueryRowContext(ctx, `
+		select a.id, a.name, a.code, a.rooms, a.start_date, a.end_date, a.release_date, a.released_at,
+		a.created_at, a.updated_at
+		from allotments a
+		where `+where, arg).Scan(
+		&a.ID,
+		&a.Name,
+		&a.Code,
+		&a.Rooms,
+		&a.StartDate,
+		&a.EndDate,
+		&a.ReleaseDate,
+		&releasedAt,
+		&a.CreatedAt,
+		&a.UpdatedAt,
+	)
+	if err != nil {
+		return a, err
+	}
+	a.ReleasedAt = releasedAt.Time
+
+	rows, err := m.DB.QueryContext(ctx, `
+		select rm.id, rm.room_name
+		from room_restrictions rr
+		left join rooms rm on (rr.room_id = rm.id)
+		where rr.allotment_id = $1 and rr.restriction_id = $2
+		order by rm.room_name
+	`, a.ID, models.RestrictionAllotment)
+	if err != nil {
+		return a, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var room models.Room
+		if err := rows.Scan(&room.ID, &room.RoomName); err != nil {
+			return a, err
+		}
+		a.Held = append(a.Held, room)
+	}
+	if err = rows.Err(); err != nil {
+		return a, err
+	}
+
+	rows, err = m.DB.QueryContext(ctx, `
+		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date,
+		r.room_id, r.created_at, rm.id, rm.room_name, r.cancelled_at is not null
+		from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		where r.allotment_id = $1 and r.deleted_at is null
+		order by r.created_at
+	`, a.ID)
+	if err != nil {
+		return a, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i models.Reservation
+		err := rows.Scan(
+			&i.ID,
+			&i.FirstName,
+			&i.LastName,
+			&i.Email,
+			&i.Phone,
+			&i.StartDate,
+			&i.EndDate,
+			&i.RoomID,
+			&i.CreatedAt,
+			&i.Room.ID,
+			&i.Room.RoomName,
+			&i.Cancelled,
+		)
+		if err != nil {
+			return a, err
+		}
+		i.AllotmentID = a.ID
+		if !i.Cancelled {
+			a.Booked++
+		}
+		a.PickedUp = append(a.PickedUp, i)
+	}
+
+	return a, rows.Err()
+}
+
+// BookFromAllotment books one of the rooms an allotment still holds for the guest and returns the ids of
+// the reservation and the room. The hold becomes the reservation's room restriction
+func (m *postgresDBRepo) BookFromAllotment(allotmentID int, res models.Reservation) (int, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	// locked, so two guests of the group can't get the same room. The smallest room sleeping the party
+	// leaves the bigger ones to the bigger parties
+	guests := res.Adults + res.Children
+	var holdID, roomID, extraCharge int
+	var start, end time.Time
+	err = tx.QueryRowContext(ctx, `
+		select rr.id, rr.room_id, rr.start_date, rr.end_date,
+			greatest($3 - rm.base_occupancy, 0) * rm.extra_person_rate * (rr.end_date - rr.start_date)
+		from room_restrictions rr
+		join allotments a on (rr.allotment_id = a.id)
+		join rooms rm on (rr.room_id = rm.id)
+		where rr.allotment_id = $1 and rr.restriction_id = $2 and rm.max_occupancy >= $3
+		and a.released_at is null and a.release_date > current_date
+		order by rm.max_occupancy, rr.room_id
+		limit 1
+		for update of rr skip locked
+	`, allotmentID, models.RestrictionAllotment, guests).Scan(&holdID, &roomID, &start, &end, &extraCharge)
+	if err == sql.ErrNoRows {
+		var left int
+		err = tx.QueryRowContext(ctx, `
+			select count(id) from room_restrictions where allotment_id = $1 and restriction_id = $2
+		`, allotmentID, models.RestrictionAllotment).Scan(&left)
+		if err != nil {
+			return 0, 0, err
+		}
+		if left == 0 {
+			return 0, 0, errors.New("all the rooms of the group are booked")
+		}
+		return 0, 0, fmt.Errorf("none of the rooms left for the group sleeps %d guests", guests)
+	} else if err != nil {
+		return 0, 0, err
+	}
+
+	var id int
+	err = tx.QueryRowContext(ctx, `
+		insert into reservations (first_name, last_name, email, phone, start_date, end_date, room_id,
+			created_at, updated_at, guest_id, allotment_id, unit_assigned, adults, children, extra_charge)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $8, nullif($9, 0), $10, true, $11, $12, $13) returning id
+	`, res.FirstName, res.LastName, res.Email, res.Phone, start, end, roomID,
+		time.Now(), res.GuestID, allotmentID, res.Adults, res.Children, extraCharge).Scan(&id)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		update room_restrictions set restriction_id = 1, reservation_id = $1, updated_at = $2
+		where id = $3
+	`, id, time.Now(), holdID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err = priceReservation(ctx, tx, id); err != nil {
+		return 0, 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+
+	return id, roomID, nil
+}
+
+// ReleaseAllotments puts the rooms still held for allotments whose release date has come back on sale and
+// returns how many rooms were released
+func (m *postgresDBRepo) ReleaseAllotments(on time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+		delete from room_restrictions
+		where restriction_id = $1 and allotment_id in (
+			select id from allotments where release_date <= $2 and released_at is null)
+	`, models.RestrictionAllotment, on)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		update allotments set released_at = $1, updated_at = $1
+		where release_date <= $2 and released_at is null
+	`, time.Now(), on)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, tx.Commit()
+}
+
+// AllRoomTypes returns the room types with how many units each has
+func (m *postgresDBRepo) AllRoomTypes() ([]models.RoomType, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var types []models.RoomType
+
+	rows, err := m.DB.QueryContext(ctx, `
+		select rt.id, rt.type_name, rt.description, rt.created_at, rt.updated_at, count(rm.id)
+		from room_types rt
+		left join rooms rm on (rm.room_type_id = rt.id)
+		group by rt.id
+		order by rt.type_name
+	`)
+	if err != nil {
+		return types, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rt models.RoomType
+		err := rows.Scan(
+			&rt.ID,
+			&rt.TypeName,
+			&rt.Description,
+			&rt.CreatedAt,
+			&rt.UpdatedAt,
+			&rt.Units,
+		)
+		if err != nil {
+			return types, err
+		}
+		types = append(types, rt)
+	}
+
+	if err = rows.Err(); err != nil {
+		return types, err
+	}
+
+	return types, nil
+}
+
+// InsertRoomType adds a room type without units and returns its id
+func (m *postgresDBRepo) InsertRoomType(rt models.RoomType) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, `
+		insert into room_types (type_name, description, created_at, updated_at)
+		values ($1, $2, $3, $3) returning id
+	`, rt.TypeName, rt.Description, time.Now()).Scan(&id)
+
+	return id, err
+}
+
+// InsertRoom adds a unit to a room type and returns its id
+func (m *postgresDBRepo) InsertRoom(room models.Room) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, `
+		insert into rooms (room_name, room_type_id, nightly_rate, max_occupancy, base_occupancy, extra_person_rate,
+			created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $7) returning id
+	`, room.RoomName, room.RoomTypeID, room.NightlyRate, room.MaxOccupancy, room.BaseOccupancy, room.ExtraPersonRate,
+		time.Now()).Scan(&id)
+
+	return id, err
+}
+
+// UpdateRoom changes the name, rates and occupancy of a unit
+func (m *postgresDBRepo) UpdateRoom(room models.Room) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `
+		update rooms set room_name = $1, nightly_rate = $2, max_occupancy = $3, base_occupancy = $4,
+			extra_person_rate = $5, updated_at = $6
+		where id = $7
+	`, room.RoomName, room.NightlyRate, room.MaxOccupancy, room.BaseOccupancy, room.ExtraPersonRate, time.Now(), room.ID)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errors.New("no such room")
+	}
+	return nil
+}
+
+// RoomsByType returns the units of a room type
+func (m *postgresDBRepo) RoomsByType(typeID int) ([]models.Room, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var rooms []models.Room
+
+	rows, err := m.DB.QueryContext(ctx, `
+		select id, room_name, housekeeping_status, room_type_id, nightly_rate, max_occupancy, base_occupancy,
+		extra_person_rate
+		from rooms
+		where room_type_id = $1
+		order by room_name
+	`, typeID)
+	if err != nil {
+		return rooms, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rm models.Room
+		err := rows.Scan(
+			&rm.ID,
+			&rm.RoomName,
+			&rm.Status,
+			&rm.RoomTypeID,
+			&rm.NightlyRate,
+			&rm.MaxOccupancy,
+			&rm.BaseOccupancy,
+			&rm.ExtraPersonRate,
+		)
+		if err != nil {
+			return rooms, err
+		}
+		rooms = append(rooms, rm)
+	}
+
+	if err = rows.Err(); err != nil {
+		return rooms, err
+	}
+
+	return rooms, nil
+}
+
+// SearchAvailabilityByRoomType returns the room types with a unit free every night from start to end. A
+// type's availability is its inventory less the units booked or blocked, on the busiest of those nights,
+// counting only the units that sleep the guests and have all the amenities asked for
+func (m *postgresDBRepo) SearchAvailabilityByRoomType(start, end time.Time, guests int, amenityIDs []int) ([]models.RoomType, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var types []models.RoomType
+
+	amenities, args := hasAmenitiesWhere(amenityIDs, 4)
+
+	query := `
+		select rt.id, rt.type_name, rt.description, units.n, min(units.n - coalesce(taken.n, 0)), units.sleeps
+		from room_types rt
+		join (
+			select rm.room_type_id, count(rm.id) as n, max(rm.max_occupancy) as sleeps
+			from rooms rm
+			where rm.max_occupancy >= $3 and ` + amenities + `
+			group by rm.room_type_id
+		) units on (units.room_type_id = rt.id)
+		cross join generate_series($1::date, $2::date - 1, interval '1 day') d
+		left join lateral (
+			select count(distinct rr.room_id) as n
+			from room_restrictions rr
+			join rooms rm on (rr.room_id = rm.id)
+			where rm.room_type_id = rt.id and rm.max_occupancy >= $3 and ` + amenities + `
+			and rr.start_date <= d and rr.end_date > d and (rr.expires_at is null or rr.expires_at > now())
+		) taken on true
+		group by rt.id, units.n, units.sleeps
+		having min(units.n - coalesce(taken.n, 0)) > 0
+		order by rt.type_name
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, append([]interface{}{start, end, guests}, args...)...)
+	if err != nil {
+		return types, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rt models.RoomType
+		err := rows.Scan(
+			&rt.ID,
+			&rt.TypeName,
+			&rt.Description,
+			&rt.Units,
+			&rt.Available,
+			&rt.Sleeps,
+		)
+		if err != nil {
+			return types, err
+		}
+		types = append(types, rt)
+	}
+
+	if err = rows.Err(); err != nil {
+		return types, err
+	}
+
+	return types, nil
+}
+
+// AssignUnit puts the whole stay of a reservation in one unit of the room type booked that sleeps the party,
+// replacing its provisional room or rooms
+func (m *postgresDBRepo) AssignUnit(id, roomID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// locked, so the unit can't be assigned twice at once
+	var start, end time.Time
+	err = tx.QueryRowContext(ctx, `
+		select start_date, end_date from reservations
+		where id = $1 and deleted_at is null and cancelled_at is null and checked_out_at is null
+		for update
+	`, id).Scan(&start, &end)
+	if err == sql.ErrNoRows {
+		return errors.New("the reservation can't get a unit")
+	} else if err != nil {
+		return err
+	}
+
+	if err = lockRooms(ctx, tx, roomID); err != nil {
+		return err
+	}
+
+	if err = checkUnit(ctx, tx, id, roomID); err != nil {
+		return err
+	}
+
+	var conflicts int
+	err = tx.QueryRowContext(ctx, `
+		select count(id) from room_restrictions
+		where room_id = $1 and $2 < end_date and $3 > start_date and coalesce(reservation_id, 0) <> $4
+		and (expires_at is null or expires_at > now())
+	`, roomID, start, end, id).Scan(&conflicts)
+	if err != nil {
+		return err
+	}
+	if conflicts > 0 {
+		return errors.New("the unit is not free for the whole stay")
+	}
+
+	if _, err = tx.ExecContext(ctx, "delete from room_restrictions where reservation_id = $1", id); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		insert into room_restrictions (start_date, end_date, room_id, reservation_id, restriction_id, created_at, updated_at)
+		values ($1, $2, $3, $4, 1, $5, $5)
+	`, start, end, roomID, id, time.Now())
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		update reservations set room_id = $1, unit_assigned = true, updated_at = $2 where id = $3
+	`, roomID, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ShiftedStays returns stays as long as the one from start to end, moved up to days earlier or later and
+// not into the past, with a room free every night that sleeps the guests and has the amenities asked for.
+// There is one room for each window, nearest windows first
+func (m *postgresDBRepo) ShiftedStays(start, end time.Time, days, guests int, amenityIDs []int) ([]models.StaySegment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var stays []models.StaySegment
+
+	amenities, args := hasAmenitiesWhere(amenityIDs, 5)
+
+	query := `
+		select distinct on (abs(s.shift), s.shift)
+			rm.id, rm.room_name, $1::date + s.shift, $2::date + s.shift
+		from rooms rm
+		cross join generate_series(-$3::int, $3::int) s(shift)
+		where s.shift <> 0 and $1::date + s.shift >= current_date
+		and rm.max_occupancy >= $4 and ` + amenities + `
+		and not exists (
+			select 1 from room_restrictions rr
+			where rr.room_id = rm.id and rr.start_date < $2::date + s.shift and rr.end_date > $1::date + s.shift
+			and (rr.expires_at is null or rr.expires_at > now())
+		)
+		order by abs(s.shift), s.shift, rm.room_name
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, append([]interface{}{start, end, days, guests}, args...)...)
+	if err != nil {
+		return stays, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s models.StaySegment
+		err := rows.Scan(&s.RoomID, &s.Room.RoomName, &s.StartDate, &s.EndDate)
+		if err != nil {
+			return stays, err
+		}
+		s.Room.ID = s.RoomID
+		stays = append(stays, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return stays, err
+	}
+
+	return stays, nil
+}
+
+// PartialStays returns the runs of free nights from start to end in the rooms that sleep the guests and have
+// the amenities asked for, longest first
+func (m *postgresDBRepo) PartialStays(start, end time.Time, guests int, amenityIDs []int) ([]models.StaySegment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var stays []models.StaySegment
+
+	amenities, args := hasAmenitiesWhere(amenityIDs, 4)
+
+	// consecutive free nights of a room share the same night less its row number
+	query := `
+		with free as (
+			select rm.id, rm.room_name, d::date as night,
+				d::date - (row_number() over (partition by rm.id order by d))::int as run
+			from rooms rm
+			cross join generate_series($1::date, $2::date - 1, interval '1 day') d
+			where rm.max_occupancy >= $3 and ` + amenities + `
+			and not exists (
+				select 1 from room_restrictions rr
+				where rr.room_id = rm.id and rr.start_date <= d and rr.end_date > d
+				and (rr.expires_at is null or rr.expires_at > now())
+			)
+		)
+		select id, room_name, min(night), max(night) + 1
+		from free
+		group by id, room_name, run
+		order by max(night) - min(night) desc, min(night), room_name
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, append([]interface{}{start, end, guests}, args...)...)
+	if err != nil {
+		return stays, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s models.StaySegment
+		err := rows.Scan(&s.RoomID, &s.Room.RoomName, &s.StartDate, &s.EndDate)
+		if err != nil {
+			return stays, err
+		}
+		s.Room.ID = s.RoomID
+		stays = append(stays, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return stays, err
+	}
+
+	return stays, nil
+}
+
+// FlexibleStays returns every room type and arrival date for a stay of nights between from and to, by
+// arrival date, with the units of the type that sleep the guests, have the amenities asked for and are free
+// for the whole stay. With weekends the guests arrive on a Friday or a Saturday. The unit booking the type
+// gets, the first by name, comes with its rates for the price of the stay
+func (m *postgresDBRepo) FlexibleStays(from, to time.Time, nights, guests int, weekends bool, amenityIDs []int) ([]models.StayOption, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var stays []models.StayOption
+
+	amenities, args := hasAmenitiesWhere(amenityIDs, 6)
+
+	query := `
+		select * from (
+			select distinct on (s, rt.id) rt.id, rt.type_name, rt.description,
+				count(rm.id) over (partition by s, rt.id),
+				rm.id, rm.room_name, rm.nightly_rate, rm.max_occupancy, rm.base_occupancy, rm.extra_person_rate,
+				s::date as arrival, s::date + $3::int
+			from rooms rm
+			join room_types rt on (rt.id = rm.room_type_id)
+			cross join generate_series($1::date, $2::date - $3::int, interval '1 day') s
+			where rm.max_occupancy >= $4 and (not $5::bool or extract(isodow from s) in (5, 6))
+			and ` + amenities + `
+			and not exists (
+				select 1 from room_restrictions rr
+				where rr.room_id = rm.id and rr.start_date < s::date + $3::int and rr.end_date > s::date
+				and (rr.expires_at is null or rr.expires_at > now())
+			)
+			order by s, rt.id, rm.room_name
+		) stays
+		order by arrival, type_name
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, append([]interface{}{from, to, nights, guests, weekends}, args...)...)
+	if err != nil {
+		return stays, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s models.StayOption
+		err := rows.Scan(
+			&s.RoomType.ID,
+			&s.RoomType.TypeName,
+			&s.RoomType.Description,
+			&s.RoomType.Available,
+			&s.Room.ID,
+			&s.Room.RoomName,
+			&s.Room.NightlyRate,
+			&s.Room.MaxOccupancy,
+			&s.Room.BaseOccupancy,
+			&s.Room.ExtraPersonRate,
+			&s.StartDate,
+			&s.EndDate,
+		)
+		if err != nil {
+			return stays, err
+		}
+		s.Room.RoomTypeID = s.RoomType.ID
+		stays = append(stays, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return stays, err
+	}
+
+	return stays, nil
+}
+
+// hasAmenitiesWhere is the condition that the room rm has every amenity of ids, with its placeholders
+// numbered from n on, and the arguments it takes
+func hasAmenitiesWhere(ids []int, n int) (string, []interface{}) {
+	if len(ids) == 0 {
+		return "true", nil
+	}
+
+	var placeholders []string
+	var args []interface{}
+	for i, id := range ids {
+		placeholders = append(placeholders, fmt.Sprintf("$%d", n+i))
+		args = append(args, id)
+	}
+
+	where := fmt.Sprintf(`(select count(distinct ra.amenity_id) from room_amenities ra
+		where ra.room_id = rm.id and ra.amenity_id in (%s)) = %d`, strings.Join(placeholders, ", "), len(ids))
+	return where, args
+}
+
+// AllAmenities returns the amenity catalogue by category
+func (m *postgresDBRepo) AllAmenities() ([]models.Amenity, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var amenities []models.Amenity
+
+	rows, err := m.DB.QueryContext(ctx, `
+		select id, name, category, created_at, updated_at
+		from amenities
+		order by array_position(array['bed', 'view', 'bathroom', 'accessibility'], category), name
+	`)
+	if err != nil {
+		return amenities, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a models.Amenity
+		if err := rows.Scan(&a.ID, &a.Name, &a.Category, &a.CreatedAt, &a.UpdatedAt); err != nil {
+			return amenities, err
+		}
+		amenities = append(amenities, a)
+	}
+
+	if err = rows.Err(); err != nil {
+		return amenities, err
+	}
+
+	return amenities, nil
+}
+
+// InsertAmenity adds an amenity to the catalogue and returns its id
+func (m *postgresDBRepo) InsertAmenity(a models.Amenity) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, `
+		insert into amenities (name, category, created_at, updated_at)
+		values ($1, $2, $3, $3) returning id
+	`, a.Name, a.Category, time.Now()).Scan(&id)
+
+	return id, err
+}
+
+// AmenitiesByRoom returns the amenities of every room that has any, by room id
+func (m *postgresDBRepo) AmenitiesByRoom() (map[int][]models.Amenity, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	byRoom := make(map[int][]models.Amenity)
+
+	rows, err := m.DB.QueryContext(ctx, `
+		select ra.room_id, a.id, a.name, a.category
+		from room_amenities ra
+		join amenities a on (ra.amenity_id = a.id)
+		order by array_position(array['bed', 'view', 'bathroom', 'accessibility'], a.category), a.name
+	`)
+	if err != nil {
+		return byRoom, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var roomID int
+		var a models.Amenity
+		if err := rows.Scan(&roomID, &a.ID, &a.Name, &a.Category); err != nil {
+			return byRoom, err
+		}
+		byRoom[roomID] = append(byRoom[roomID], a)
+	}
+
+	return byRoom, rows.Err()
+}
+
+// SetRoomAmenities replaces the amenities of a room
+func (m *postgresDBRepo) SetRoomAmenities(roomID int, amenityIDs []int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `delete from room_amenities where room_id = $1`, roomID)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range amenityIDs {
+		_, err = tx.ExecContext(ctx, `
+			insert into room_amenities (room_id, amenity_id, created_at, updated_at)
+			values ($1, $2, $3, $3)
+		`, roomID, id, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// InsertWaitlistEntry puts a guest on the waitlist and returns the id of the entry
+func (m *postgresDBRepo) InsertWaitlistEntry(e models.WaitlistEntry) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var roomTypeID interface{}
+	if e.RoomTypeID > 0 {
+		roomTypeID = e.RoomTypeID
+	}
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, `
+		insert into waitlist_entries (email, start_date, end_date, room_type_id, adults, children, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $7) returning id
+	`, e.Email, e.StartDate, e.EndDate, roomTypeID, e.Adults, e.Children, time.Now()).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// GetWaitlistEntryByID returns a waitlist entry with the room offered, if any
+func (m *postgresDBRepo) GetWaitlistEntryByID(id int) (models.WaitlistEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var e models.WaitlistEntry
+	var notifiedAt, offerExpiresAt, bookedAt sql.NullTime
+
+	err := m.DB.QueryRowContext(ctx, `
+		select w.id, w.email, w.start_date, w.end_date, coalesce(w.room_type_id, 0), w.adults, w.children,
+		coalesce(w.room_id, 0), coalesce(rm.room_name, ''), w.notified_at, w.offer_expires_at,
+		coalesce(w.hold_id, 0), w.booked_at, w.created_at, w.updated_at
+		from waitlist_entries w
+		left join rooms rm on (rm.id = w.room_id)
+		where w.id = $1
+	`, id).Scan(
+		&e.ID,
+		&e.Email,
+		&e.StartDate,
+		&e.EndDate,
+		&e.RoomTypeID,
+		&e.Adults,
+		&e.Children,
+		&e.RoomID,
+		&e.Room.RoomName,
+		&notifiedAt,
+		&offerExpiresAt,
+		&e.HoldID,
+		&bookedAt,
+		&e.CreatedAt,
+		&e.UpdatedAt,
+	)
+	if err != nil {
+		return e, err
+	}
+	e.Room.ID = e.RoomID
+	e.NotifiedAt = notifiedAt.Time
+	e.OfferExpiresAt = offerExpiresAt.Time
+	e.BookedAt = bookedAt.Time
+
+	return e, nil
+}
+
+// OfferWaitlistRooms offers the rooms that are free to the guests waiting for them, in the order they joined
+// the waitlist. A guest is offered one room, free for the whole stay, of the type they prefer and sleeping
+// their party, held for them until expires so nobody else can book it meanwhile. It returns the entries
+// offered a room
+func (m *postgresDBRepo) OfferWaitlistRooms(expires time.Time) ([]models.WaitlistEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var offered []models.WaitlistEntry
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return offered, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	// locked, so two runs can't offer the same room. A guest whose offer ran out unbooked waits again,
+	// behind the guests who haven't had an offer yet
+	rows, err := tx.QueryContext(ctx, `
+		select id, email, start_date, end_date, coalesce(room_type_id, 0), adults, children
+		from waitlist_entries
+		where (notified_at is null or (booked_at is null and offer_expires_at <= $1)) and start_date >= current_date
+		order by notified_at is not null, created_at, id
+		for update
+	`, now)
+	if err != nil {
+		return offered, err
+	}
+
+	var waiting []models.WaitlistEntry
+	for rows.Next() {
+		var e models.WaitlistEntry
+		err := rows.Scan(&e.ID, &e.Email, &e.StartDate, &e.EndDate, &e.RoomTypeID, &e.Adults, &e.Children)
+		if err != nil {
+			rows.Close()
+			return offered, err
+		}
+		waiting = append(waiting, e)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return offered, err
+	}
+
+	for _, e := range waiting {
+		// the room is locked, so a guest can't hold it at the same time
+		err := tx.QueryRowContext(ctx, `
+			select rm.id, rm.room_name
+			from rooms rm
+			where ($3 = 0 or rm.room_type_id = $3) and rm.max_occupancy >= $4
+			and not exists (
+				select 1 from room_restrictions rr
+				where rr.room_id = rm.id and rr.start_date < $2 and rr.end_date > $1
+				and (rr.expires_at is null or rr.expires_at > now())
+			)
+			order by rm.room_name
+			limit 1
+			for update of rm
+		`, e.StartDate, e.EndDate, e.RoomTypeID, e.Adults+e.Children).Scan(&e.RoomID, &e.Room.RoomName)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return offered, err
+		}
+
+		err = tx.QueryRowContext(ctx, `
+			insert into room_restrictions (start_date, end_date, room_id, restriction_id, expires_at, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $6) returning id
+		`, e.StartDate, e.EndDate, e.RoomID, models.RestrictionHold, expires, now).Scan(&e.HoldID)
+		if err != nil {
+			return offered, err
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			update waitlist_entries set room_id = $1, notified_at = $2, offer_expires_at = $3, hold_id = $4,
+				updated_at = $2
+			where id = $5
+		`, e.RoomID, now, expires, e.HoldID, e.ID)
+		if err != nil {
+			return offered, err
+		}
+
+		e.Room.ID = e.RoomID
+		e.NotifiedAt = now
+		e.OfferExpiresAt = expires
+		offered = append(offered, e)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return offered, nil
+}
+
+// BookWaitlistEntry records that the guest booked the room offered to them
+func (m *postgresDBRepo) BookWaitlistEntry(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `
+		update waitlist_entries set booked_at = $1, updated_at = $1 where id = $2
+	`, time.Now(), id)
+
+	return err
+}
+
+// HoldRoom holds a room from start to end for a guest filling in the reservation form, until expires, and
+// returns the id of the hold. It fails if the room isn't free for the stay any more
+func (m *postgresDBRepo) HoldRoom(roomID int, start, end, expires time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// locked, so two guests can't hold the room at once
+	if err = lockRooms(ctx, tx, roomID); err != nil {
+		return 0, err
+	}
+
+	// holds that expired but aren't released yet don't count
+	var conflicts int
+	err = tx.QueryRowContext(ctx, `
+		select count(id) from room_restrictions
+		where room_id = $1 and $2 < end_date and $3 > start_date and (expires_at is null or expires_at > now())
+	`, roomID, start, end).Scan(&conflicts)
+	if err != nil {
+		return 0, err
+	}
+	if conflicts > 0 {
+		return 0, errors.New("the room is no longer free for the stay")
+	}
+
+	var id int
+	err = tx.QueryRowContext(ctx, `
+		insert into room_restrictions (start_date, end_date, room_id, restriction_id, expires_at, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $6) returning id
+	`, start, end, roomID, models.RestrictionHold, expires, time.Now()).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// ReleaseHold gives back a room held for a guest
+func (m *postgresDBRepo) ReleaseHold(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, "delete from room_restrictions where id = $1 and restriction_id = $2",
+		id, models.RestrictionHold)
+
+	return err
+}
+
+// ReleaseExpiredHolds gives back the rooms whose holds expired by now and returns how many
+func (m *postgresDBRepo) ReleaseExpiredHolds(now time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, "delete from room_restrictions where restriction_id = $1 and expires_at <= $2",
+		models.RestrictionHold, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -2,10 +2,12 @@ package dbrepo
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"time"
 
 	"github.com/kons77/room-bookings-app/internal/models"
+	"github.com/kons77/room-bookings-app/internal/repository"
 )
 
 func (m *testDBRepo) AllUsers() bool {
@@ -58,7 +60,7 @@ func (m *testDBRepo) SearchAvailabilityByDatesByRoomID(start, end time.Time, roo
 }
 
 // SearchAvailabilityForAllRooms returns a slice of available rooms, if any, for given date range
-func (m *testDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]models.Room, error) {
+func (m *testDBRepo) SearchAvailabilityForAllRooms(start, end time.Time, guests int) ([]models.Room, error) {
 	var rooms []models.Room
 
 	// if the start date is after 2049-12-31, then return empty slice,
@@ -84,15 +86,233 @@ func (m *testDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]mode
 		return rooms, nil
 	}
 
-	// otherwise, put an entry into the slice, indicating that some room is vailable for search dates
+	// otherwise, put an entry into the slice, indicating that some room is vailable for search dates;
+	// it sleeps two
+	if guests > 2 {
+		return rooms, nil
+	}
 	room := models.Room{
-		ID: 1,
+		ID:           1,
+		MaxOccupancy: 2,
 	}
 	rooms = append(rooms, room)
 
 	return rooms, nil
 }
 
+// SearchAvailabilityByRoomType returns the room types with a unit free every night of the date range
+func (m *testDBRepo) SearchAvailabilityByRoomType(start, end time.Time, guests int, amenityIDs []int) ([]models.RoomType, error) {
+	var types []models.RoomType
+
+	// the same dates as SearchAvailabilityForAllRooms: none free after 2049-12-31, an error on 2060-01-01
+	if start.Equal(time.Date(2060, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		return nil, errors.New("some error")
+	}
+	if start.After(time.Date(2049, 12, 31, 0, 0, 0, 0, time.UTC)) {
+		return types, nil
+	}
+
+	// type 1 sleeps two and type 2 four, both are free for a party of any size
+	switch {
+	case guests == 0:
+		types = append(types,
+			models.RoomType{ID: 1, TypeName: "General's Quarters", Units: 1, Available: 1, Sleeps: 2},
+			models.RoomType{ID: 2, TypeName: "Major's Suite", Units: 1, Available: 1, Sleeps: 4})
+	case guests > 4:
+	case guests > 2:
+		types = append(types, models.RoomType{ID: 2, TypeName: "Major's Suite", Units: 1, Available: 1, Sleeps: 4})
+	default:
+		types = append(types, models.RoomType{ID: 1, TypeName: "General's Quarters", Units: 1, Available: 1, Sleeps: 2})
+	}
+
+	// the only unit of a type is the room with the same id
+	byRoom, _ := m.AmenitiesByRoom()
+	var found []models.RoomType
+	for _, rt := range types {
+		has := make(map[int]bool)
+		for _, a := range byRoom[rt.ID] {
+			has[a.ID] = true
+		}
+
+		all := true
+		for _, id := range amenityIDs {
+			all = all && has[id]
+		}
+		if all {
+			found = append(found, rt)
+		}
+	}
+	return found, nil
+}
+
+// ShiftedStays returns the same stay moved to other dates: from 2055-01-01 room 1 is free three days later,
+// and there is an error on 2060-01-01
+func (m *testDBRepo) ShiftedStays(start, end time.Time, days, guests int, amenityIDs []int) ([]models.StaySegment, error) {
+	var stays []models.StaySegment
+
+	if start.Equal(time.Date(2060, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		return stays, errors.New("some error")
+	}
+	if start.Equal(time.Date(2055, 1, 1, 0, 0, 0, 0, time.UTC)) && days >= 3 && guests <= 2 {
+		stays = append(stays, models.StaySegment{
+			RoomID:    1,
+			Room:      models.Room{ID: 1, RoomName: "General's Quarters"},
+			StartDate: start.AddDate(0, 0, 3),
+			EndDate:   end.AddDate(0, 0, 3),
+		})
+	}
+
+	return stays, nil
+}
+
+// PartialStays returns the runs of free nights of a stay: from 2055-01-01 room 1 is free the first night
+func (m *testDBRepo) PartialStays(start, end time.Time, guests int, amenityIDs []int) ([]models.StaySegment, error) {
+	var stays []models.StaySegment
+
+	if start.Equal(time.Date(2055, 1, 1, 0, 0, 0, 0, time.UTC)) && end.After(start.AddDate(0, 0, 1)) && guests <= 2 {
+		stays = append(stays, models.StaySegment{
+			RoomID:    1,
+			Room:      models.Room{ID: 1, RoomName: "General's Quarters"},
+			StartDate: start,
+			EndDate:   start.AddDate(0, 0, 1),
+		})
+	}
+
+	return stays, nil
+}
+
+// FlexibleStays returns room type 1 with room 1 for every arrival date that fits, none after 2049-12-31 and an error from
+// 2060-01-01
+func (m *testDBRepo) FlexibleStays(from, to time.Time, nights, guests int, weekends bool, amenityIDs []int) ([]models.StayOption, error) {
+	var stays []models.StayOption
+
+	if from.Equal(time.Date(2060, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		return stays, errors.New("some error")
+	}
+	if from.After(time.Date(2049, 12, 31, 0, 0, 0, 0, time.UTC)) || guests > 2 {
+		return stays, nil
+	}
+
+	// room 1 has a king bed and a sea view
+	for _, id := range amenityIDs {
+		if id != 1 && id != 2 {
+			return stays, nil
+		}
+	}
+
+	room, _ := m.GetRoomByID(1)
+	for s := from; !s.AddDate(0, 0, nights).After(to); s = s.AddDate(0, 0, 1) {
+		if weekends && s.Weekday() != time.Friday && s.Weekday() != time.Saturday {
+			continue
+		}
+		stays = append(stays, models.StayOption{
+			RoomType:  models.RoomType{ID: 1, TypeName: "General's Quarters", Units: 1, Available: 1, Sleeps: 2},
+			Room:      room,
+			StartDate: s,
+			EndDate:   s.AddDate(0, 0, nights),
+		})
+	}
+
+	return stays, nil
+}
+
+// AllAmenities returns the amenity catalogue by category
+func (m *testDBRepo) AllAmenities() ([]models.Amenity, error) {
+	return testAmenities, nil
+}
+
+// testAmenities is the catalogue of the test repository
+var testAmenities = []models.Amenity{
+	{ID: 1, Name: "King bed", Category: "bed"},
+	{ID: 2, Name: "Sea view", Category: "view"},
+	{ID: 3, Name: "Bathtub", Category: "bathroom"},
+	{ID: 4, Name: "Wheelchair accessible", Category: "accessibility"},
+}
+
+// InsertAmenity adds an amenity to the catalogue and returns its id
+func (m *testDBRepo) InsertAmenity(a models.Amenity) (int, error) {
+	for _, existing := range testAmenities {
+		if existing.Name == a.Name {
+			return 0, errors.New("the amenity already exists")
+		}
+	}
+	return 5, nil
+}
+
+// AmenitiesByRoom returns the amenities of every room: a king bed and a sea view in room 1, a bathtub and
+// wheelchair access in room 2
+func (m *testDBRepo) AmenitiesByRoom() (map[int][]models.Amenity, error) {
+	return map[int][]models.Amenity{
+		1: {testAmenities[0], testAmenities[1]},
+		2: {testAmenities[2], testAmenities[3]},
+	}, nil
+}
+
+// SetRoomAmenities replaces the amenities of a room
+func (m *testDBRepo) SetRoomAmenities(roomID int, amenityIDs []int) error {
+	if roomID > 2 {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+// AllRoomTypes returns the room types with how many units each has
+func (m *testDBRepo) AllRoomTypes() ([]models.RoomType, error) {
+	return []models.RoomType{
+		{ID: 1, TypeName: "General's Quarters", Units: 1},
+		{ID: 2, TypeName: "Major's Suite", Units: 1},
+	}, nil
+}
+
+// InsertRoomType adds a room type and returns its id
+func (m *testDBRepo) InsertRoomType(rt models.RoomType) (int, error) {
+	if rt.TypeName == "General's Quarters" {
+		return 0, errors.New("the room type already exists")
+	}
+	return 3, nil
+}
+
+// UpdateRoom changes the name, rates and occupancy of a unit
+func (m *testDBRepo) UpdateRoom(room models.Room) error {
+	if room.NightlyRate > 100000 {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+// InsertRoom adds a unit to a room type and returns its id
+func (m *testDBRepo) InsertRoom(room models.Room) (int, error) {
+	if room.RoomTypeID > 2 {
+		return 0, errors.New("some error")
+	}
+	return 3, nil
+}
+
+// RoomsByType returns the units of a room type: room 1 of type 1, and rooms 2 and 4 of type 2
+func (m *testDBRepo) RoomsByType(typeID int) ([]models.Room, error) {
+	switch typeID {
+	case 1:
+		return []models.Room{testRoom(1)}, nil
+	case 2:
+		return []models.Room{testRoom(2), testRoom(4)}, nil
+	}
+	return nil, errors.New("some error")
+}
+
+// AssignUnit puts the whole stay of a reservation in one unit
+func (m *testDBRepo) AssignUnit(id, roomID int) error {
+	if id != 1 {
+		return errors.New("the reservation can't get a unit")
+	}
+	if roomID == 2 {
+		return errors.New("the unit is not free for the whole stay")
+	}
+	if roomID == 3 {
+		return errors.New("the room is not of the room type the guest booked")
+	}
+	return nil
+}
+
 // GetRoomByID gets a room by id
 func (m *testDBRepo) GetRoomByID(id int) (models.Room, error) {
 	var room models.Room
@@ -100,11 +320,26 @@ func (m *testDBRepo) GetRoomByID(id int) (models.Room, error) {
 		return room, errors.New("some error")
 	}
 
-	return room, nil
+	return testRoom(id), nil
+}
+
+// testRoom is room 1, sleeping two, or room 2 or 4, sleeping four with extra guests over two paying 25.00 a night
+func testRoom(id int) models.Room {
+	if id == 2 || id == 4 {
+		return models.Room{ID: id, RoomName: "Major's Suite", RoomTypeID: 2, NightlyRate: 12000,
+			MaxOccupancy: 4, BaseOccupancy: 2, ExtraPersonRate: 2500}
+	}
+	return models.Room{ID: id, RoomName: "General's Quarters", RoomTypeID: 1, NightlyRate: 10000,
+		MaxOccupancy: 2, BaseOccupancy: 2}
 }
 
 func (m *testDBRepo) GetUserByID(id int) (models.User, error) {
 	var u models.User
+	u.ID = id
+	u.AccessLevel = 3
+	if id == 2 {
+		u.AccessLevel = 1
+	}
 	return u, nil
 }
 
@@ -131,14 +366,81 @@ func (m *testDBRepo) AllNewReservations() ([]models.Reservation, error) {
 }
 */
 
-// ReservationsForGrid returns a slice of all or new reservations depends of src
-func (m *testDBRepo) ReservationsForGrid(displaysAllReservations int) ([]models.Reservation, error) {
+// SearchReservations returns one page of reservations matching the filter and the number of all matches
+func (m *testDBRepo) SearchReservations(f models.ReservationFilter) ([]models.Reservation, int, error) {
 	var reservations []models.Reservation
-	return reservations, nil
+	if f.Search == "fail" {
+		return reservations, 0, errors.New("some error")
+	}
+
+	first, _ := m.GetReseravtionByID(1)
+	second, _ := m.GetReseravtionByID(2)
+	reservations = append(reservations, first, second)
+	return reservations, len(reservations), nil
+}
+
+// ExportReservations calls fn for every reservation matching the filter
+func (m *testDBRepo) ExportReservations(f models.ReservationFilter, fn func(models.Reservation) error) error {
+	reservations, _, err := m.SearchReservations(f)
+	if err != nil {
+		return err
+	}
+
+	for _, res := range reservations {
+		if err := fn(res); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (m *testDBRepo) GetReseravtionByID(id int) (models.Reservation, error) {
 	var res models.Reservation
+	if id > 100 {
+		return res, errors.New("some error")
+	}
+
+	// reservation 1 is upcoming and reservation 2 has already started, both made by guest@here.com; the guest
+	// typed markup into the name of reservation 2
+	switch id {
+	case 1:
+		res = models.Reservation{ID: 1, Email: "guest@here.com", RoomID: 1, RoomCharge: 24000,
+			StartDate: time.Now().AddDate(0, 0, 10), EndDate: time.Now().AddDate(0, 0, 12)}
+	case 2:
+		res = models.Reservation{ID: 2, Email: "guest@here.com", RoomID: 1, FirstName: "Jane", LastName: "<script>Doe</script>",
+			RoomCharge: 20000, ExtraCharge: 5050, StartDate: time.Now().AddDate(0, 0, -1), EndDate: time.Now().AddDate(0, 0, 1)}
+	// reservations 3 to 5 and 7 are in the trash
+	case 3, 4, 5, 7:
+		return res, errors.New("sql: no rows in result set")
+	// reservation 6 is one room of booking group 1
+	case 6:
+		res = models.Reservation{ID: 6, Email: "guest@here.com", RoomID: 1, GroupID: 1,
+			StartDate: time.Now().AddDate(0, 0, 10), EndDate: time.Now().AddDate(0, 0, 12)}
+	}
+	return res, nil
+}
+
+// GetDeletedReservationByID returns a reservation in the trash by id
+func (m *testDBRepo) GetDeletedReservationByID(id int) (models.Reservation, error) {
+	var res models.Reservation
+
+	// 3 deleted long ago, 4 whose room was taken since, 5 restorable and 7, an upcoming stay of guest@here.com
+	switch id {
+	case 3:
+		res = models.Reservation{ID: 3, RoomID: 1, DeletedAt: time.Now().AddDate(-1, 0, 0),
+			StartDate: time.Date(2040, 1, 1, 0, 0, 0, 0, time.UTC), EndDate: time.Date(2040, 1, 2, 0, 0, 0, 0, time.UTC)}
+	case 4:
+		res = models.Reservation{ID: 4, RoomID: 1, DeletedAt: time.Now().AddDate(0, 0, -1),
+			StartDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC), EndDate: time.Date(2050, 1, 2, 0, 0, 0, 0, time.UTC)}
+	case 5:
+		res = models.Reservation{ID: 5, RoomID: 1, DeletedAt: time.Now().AddDate(0, 0, -1),
+			StartDate: time.Date(2040, 1, 1, 0, 0, 0, 0, time.UTC), EndDate: time.Date(2040, 1, 2, 0, 0, 0, 0, time.UTC)}
+	case 7:
+		res = models.Reservation{ID: 7, Email: "guest@here.com", RoomID: 1, DeletedAt: time.Now().AddDate(0, 0, -1),
+			StartDate: time.Now().AddDate(0, 0, 10), EndDate: time.Now().AddDate(0, 0, 12)}
+	default:
+		return res, errors.New("sql: no rows in result set")
+	}
 	return res, nil
 }
 
@@ -147,32 +449,601 @@ func (m *testDBRepo) UpdateReservation(u models.Reservation) error {
 	return nil
 }
 
-// DeleteReservation deletes reservation by ID
-func (m *testDBRepo) DeleteReservation(id int) error {
+// DeleteReservation moves a reservation to the trash
+func (m *testDBRepo) DeleteReservation(id, deletedBy int) error {
+	if id == 2 {
+		return errors.New("some error")
+	}
 	return nil
 }
 
 func (m *testDBRepo) UpdateProcessedForReservation(id, processed int) error {
+	if id == 2 {
+		return errors.New("some error")
+	}
 	return nil
 }
 
 func (m *testDBRepo) AllRooms() ([]models.Room, error) {
-	var rooms []models.Room
+	rooms := []models.Room{
+		{ID: 1, RoomName: "General's Quarters", Status: models.RoomDirty, RoomTypeID: 1, MaxOccupancy: 2,
+			RoomType: models.RoomType{ID: 1, TypeName: "General's Quarters"}},
+		{ID: 2, RoomName: "Major's Suite", Status: models.RoomClean, RoomTypeID: 2, MaxOccupancy: 4,
+			RoomType: models.RoomType{ID: 2, TypeName: "Major's Suite"}},
+	}
 	return rooms, nil
 }
 
 // GetRestrictionsForRoomByDate returns restrictions for a room by date range
 func (m *testDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
 	var restrictions []models.RoomRestriction
+	// room 1 has a stay early in every month
+	if roomID == 1 {
+		restrictions = append(restrictions, models.RoomRestriction{ID: 1, RoomID: 1, ReservationID: 1, RestrictionID: 1,
+			StartDate: start.AddDate(0, 0, 2), EndDate: start.AddDate(0, 0, 4)})
+	}
 	return restrictions, nil
 }
 
-// InsertBlockForRoom inserts a room restriction
-func (m *testDBRepo) InsertBlockForRoom(roomID int, startDate time.Time) error {
-	return nil
+// InsertBlockForRoom inserts a room restriction and returns its id
+func (m *testDBRepo) InsertBlockForRoom(roomID int, startDate time.Time) (int, error) {
+	return 1, nil
 }
 
 // DeleteBlockByID deletes a room restriction
 func (m *testDBRepo) DeleteBlockByID(id int) error {
 	return nil
 }
+
+// InsertGuest inserts a new guest account and returns its id
+func (m *testDBRepo) InsertGuest(g models.Guest) (int, error) {
+	// an already registered email fails, as the unique index would
+	if g.Email == "taken@here.com" {
+		return 0, errors.New("some error")
+	}
+	return 1, nil
+}
+
+// GetGuestByID returns a guest account by id
+func (m *testDBRepo) GetGuestByID(id int) (models.Guest, error) {
+	var g models.Guest
+	if id > 2 {
+		return g, errors.New("some error")
+	}
+
+	g = models.Guest{
+		ID:        id,
+		FirstName: "John",
+		LastName:  "Smith",
+		Email:     "guest@here.com",
+		Phone:     "555-555-5555",
+		Verified:  true,
+	}
+	return g, nil
+}
+
+// AuthenticateGuest authenticates a guest account and returns its id
+func (m *testDBRepo) AuthenticateGuest(email, testPassword string) (int, error) {
+	switch email {
+	case "guest@here.com":
+		return 1, nil
+	case "unverified@here.com":
+		return 0, repository.ErrGuestNotVerified
+	}
+	return 0, errors.New("some error")
+}
+
+// VerifyGuestEmail marks the guest owning token as verified and returns it
+func (m *testDBRepo) VerifyGuestEmail(token string) (models.Guest, error) {
+	if token != "valid" {
+		return models.Guest{}, errors.New("some error")
+	}
+	return models.Guest{ID: 1, Email: "guest@here.com", Verified: true}, nil
+}
+
+// LinkReservationsToGuest attaches earlier reservations made with email to the guest account
+func (m *testDBRepo) LinkReservationsToGuest(guestID int, email string) error {
+	return nil
+}
+
+// ReservationsByGuestID returns all reservations of a guest account
+func (m *testDBRepo) ReservationsByGuestID(guestID int) ([]models.Reservation, error) {
+	var reservations []models.Reservation
+	if guestID == 2 {
+		return reservations, errors.New("some error")
+	}
+
+	reservations = append(reservations,
+		models.Reservation{ID: 1, GuestID: guestID, StartDate: time.Now().AddDate(0, 0, 10), EndDate: time.Now().AddDate(0, 0, 12)},
+		models.Reservation{ID: 2, GuestID: guestID, StartDate: time.Now().AddDate(0, 0, -12), EndDate: time.Now().AddDate(0, 0, -10)},
+	)
+	return reservations, nil
+}
+
+// ReservationsByEmail returns all reservations made with email
+func (m *testDBRepo) ReservationsByEmail(email string) ([]models.Reservation, error) {
+	var reservations []models.Reservation
+	switch email {
+	case "fail@here.com":
+		return reservations, errors.New("some error")
+	case "guest@here.com":
+		first, _ := m.GetReseravtionByID(1)
+		second, _ := m.GetReseravtionByID(2)
+		reservations = append(reservations, first, second)
+	}
+	return reservations, nil
+}
+
+// CancelReservation marks a reservation as cancelled
+func (m *testDBRepo) CancelReservation(id int) error {
+	return nil
+}
+
+// UpsertSSOUser creates or refreshes a staff user logging in through single sign-on: user 1 at access level 3,
+// user 2 at access level 1, and none without an access level
+func (m *testDBRepo) UpsertSSOUser(u models.User, issuer, subject string) (int, error) {
+	if u.Email == "fail@company.com" {
+		return 0, errors.New("some error")
+	}
+	if u.Email == "taken@company.com" {
+		return 0, repository.ErrSSOEmailTaken
+	}
+	switch u.AccessLevel {
+	case 0:
+		return 0, nil
+	case 1:
+		return 2, nil
+	}
+	return 1, nil
+}
+
+// InsertAuditEntry appends an entry to the audit log
+func (m *testDBRepo) InsertAuditEntry(e models.AuditEntry) error {
+	return nil
+}
+
+// AuditEntries returns the latest audit log entries matching the filter
+func (m *testDBRepo) AuditEntries(f models.AuditFilter) ([]models.AuditEntry, error) {
+	var entries []models.AuditEntry
+	if f.Entity == "fail" {
+		return entries, errors.New("some error")
+	}
+
+	entries = append(entries, models.AuditEntry{
+		ID:       1,
+		UserID:   1,
+		Action:   "delete",
+		Entity:   "reservation",
+		EntityID: 1,
+		Before:   `{"ID":1}`,
+		IP:       "127.0.0.1",
+	})
+	return entries, nil
+}
+
+// AllStaffUsers returns all staff users
+func (m *testDBRepo) AllStaffUsers() ([]models.User, error) {
+	var users []models.User
+	users = append(users, models.User{ID: 1, FirstName: "Admin", Email: "me@here.com", AccessLevel: 3})
+	return users, nil
+}
+
+// DeletedReservations returns the reservations in the trash
+func (m *testDBRepo) DeletedReservations() ([]models.Reservation, error) {
+	var reservations []models.Reservation
+	for _, id := range []int{3, 4, 5} {
+		res, _ := m.GetReseravtionByID(id)
+		reservations = append(reservations, res)
+	}
+	return reservations, nil
+}
+
+// RestoreReservation takes a reservation out of the trash
+func (m *testDBRepo) RestoreReservation(id int) error {
+	if id == 4 {
+		return repository.ErrRoomTaken
+	}
+	return nil
+}
+
+// CreateReservation inserts a reservation made by staff together with its room restriction
+func (m *testDBRepo) CreateReservation(res models.Reservation) (int, error) {
+	if res.RoomID == 2 {
+		return 0, errors.New("the room is not available for these dates")
+	}
+	return 1, nil
+}
+
+// MoveReservation puts a reservation in another room and/or on other dates
+func (m *testDBRepo) MoveReservation(id, roomID int, start, end time.Time) error {
+	if id != 1 {
+		return errors.New("the reservation can't be moved")
+	}
+	if roomID == 2 {
+		return errors.New("the room is not available for these dates")
+	}
+	return nil
+}
+
+// SplitReservation puts the guest in another room from a night of the stay on
+func (m *testDBRepo) SplitReservation(id int, on time.Time, roomID int) error {
+	if id != 1 {
+		return errors.New("the guest doesn't stay that night")
+	}
+	if roomID == 2 {
+		return errors.New("the room is not available for these dates")
+	}
+	return nil
+}
+
+// InsertBookingGroup books several rooms as one group and returns the group id
+func (m *testDBRepo) InsertBookingGroup(reservations []models.Reservation, holdIDs []int) (int, error) {
+	for _, res := range reservations {
+		if res.RoomID > 2 {
+			return 0, errors.New("one of the rooms is no longer available for these dates")
+		}
+	}
+	return 1, nil
+}
+
+// InsertReservationStays inserts a reservation with a room restriction for each of its stays
+// Nothing is free after 2049 but the rooms held, which HoldRoom gives the id of the room plus 100
+func (m *testDBRepo) InsertReservationStays(res models.Reservation, stays []models.StaySegment, holdIDs []int) (int, error) {
+	if res.RoomID == 2 {
+		return 0, errors.New("some error")
+	}
+	for _, stay := range stays {
+		if stay.RoomID == 1000 {
+			return 0, errors.New("some error")
+		}
+
+		held := false
+		for _, id := range holdIDs {
+			if id == stay.RoomID+100 {
+				held = true
+			}
+		}
+		if !held && stay.StartDate.After(time.Date(2049, 12, 31, 0, 0, 0, 0, time.UTC)) {
+			return 0, repository.ErrRoomTaken
+		}
+	}
+	return 1, nil
+}
+
+// GroupReservations returns the reservations of a booking group
+func (m *testDBRepo) GroupReservations(groupID int) ([]models.Reservation, error) {
+	if groupID != 1 {
+		return nil, errors.New("some error")
+	}
+	start, end := time.Now().AddDate(0, 0, 10), time.Now().AddDate(0, 0, 12)
+	return []models.Reservation{
+		{ID: 6, RoomID: 1, Room: models.Room{ID: 1, RoomName: "General's Quarters"}, GroupID: 1, StartDate: start, EndDate: end},
+		{ID: 7, RoomID: 2, Room: models.Room{ID: 2, RoomName: "Major's Suite"}, GroupID: 1, StartDate: start, EndDate: end},
+	}, nil
+}
+
+// CancelBookingGroup cancels every reservation of a booking group
+func (m *testDBRepo) CancelBookingGroup(groupID int) error {
+	if groupID != 1 {
+		return errors.New("the group has nothing left to cancel")
+	}
+	return nil
+}
+
+// PurgeDeletedReservations permanently removes reservations deleted before the given time
+func (m *testDBRepo) PurgeDeletedReservations(deletedBefore time.Time) (int64, error) {
+	return 0, nil
+}
+
+// ImportReservations inserts the reservations in one transaction and returns their ids
+func (m *testDBRepo) ImportReservations(reservations []models.Reservation) ([]int, error) {
+	var ids []int
+	for i, res := range reservations {
+		if res.Email == "conflict@here.com" {
+			return []int{}, errors.New("room is not available for these dates")
+		}
+		ids = append(ids, i+100)
+	}
+	return ids, nil
+}
+
+// OccupancyReport aggregates the room restrictions and reservations of a period
+func (m *testDBRepo) OccupancyReport(from, to time.Time, roomID int) (models.OccupancyReport, error) {
+	report := models.OccupancyReport{From: from, To: to, RoomID: roomID, LeadTimes: map[string]int{"2-7": 3}}
+	if roomID > 2 {
+		return report, errors.New("some error")
+	}
+
+	days := int(to.Sub(from).Hours() / 24)
+	report.Rooms = []models.RoomOccupancy{
+		{Room: models.Room{ID: 1, RoomName: "General's Quarters", NightlyRate: 10000},
+			AvailableNights: days, BookedNights: days / 2, Revenue: days / 2 * 10000},
+	}
+	for d := from; d.Before(to); d = d.AddDate(0, 0, 1) {
+		report.Daily = append(report.Daily, models.DailyOccupancy{Date: d, Occupied: 1})
+	}
+	report.Cancellations = 1
+	return report, nil
+}
+
+// FrontDesk returns the arrivals, departures, stay-overs and vacant rooms of a date
+func (m *testDBRepo) FrontDesk(date time.Time) (models.FrontDeskDay, error) {
+	day := models.FrontDeskDay{Date: date}
+	if date.Year() == 2060 {
+		return day, errors.New("some error")
+	}
+
+	room := models.Room{ID: 1, RoomName: "General's Quarters", RoomTypeID: 1}
+	// the arrival booked the room type on the web, so the unit is still provisional
+	day.Arrivals = []models.Reservation{{ID: 1, FirstName: "John", LastName: "Smith", Email: "john@smith.com",
+		Phone: "555-555-5555", StartDate: date, EndDate: date.AddDate(0, 0, 2), RoomID: 1, Room: room}}
+	day.Departures = []models.Reservation{{ID: 2, LastName: "Jones", StartDate: date.AddDate(0, 0, -2), EndDate: date,
+		RoomID: 1, Room: room, CheckedInAt: date.AddDate(0, 0, -2)}}
+	day.Vacant = []models.Room{{ID: 2, RoomName: "Major's Suite"}}
+	return day, nil
+}
+
+// CheckInReservation records the guest's arrival; reservation 3 arrives later
+func (m *testDBRepo) CheckInReservation(id int) error {
+	if id == 3 {
+		return repository.ErrBeforeArrival
+	}
+	if id != 1 {
+		return errors.New("reservation can't be checked in")
+	}
+	return nil
+}
+
+// CheckOutReservation records the guest's departure
+func (m *testDBRepo) CheckOutReservation(id int) error {
+	if id != 2 {
+		return errors.New("reservation can't be checked out")
+	}
+	return nil
+}
+
+// SetRoomStatus sets the housekeeping status of a room
+func (m *testDBRepo) SetRoomStatus(roomID int, status string) error {
+	if roomID > 2 {
+		return errors.New("no such room")
+	}
+	return nil
+}
+
+// GenerateHousekeepingTasks makes the tasks of a date
+func (m *testDBRepo) GenerateHousekeepingTasks(date time.Time) (int64, error) {
+	if date.Year() == 2060 {
+		return 0, errors.New("some error")
+	}
+	return 2, nil
+}
+
+// MarkOutOfOrderRooms puts the rooms a work order blocks on date out of order
+func (m *testDBRepo) MarkOutOfOrderRooms(date time.Time) (int64, error) {
+	return 0, nil
+}
+
+// HousekeepingTasks returns the tasks of a date
+func (m *testDBRepo) HousekeepingTasks(date time.Time) ([]models.HousekeepingTask, error) {
+	if date.Year() == 2060 {
+		return nil, errors.New("some error")
+	}
+	tasks := []models.HousekeepingTask{
+		{ID: 1, RoomID: 1, Date: date, Kind: "checkout", ReservationID: 2,
+			Room: models.Room{ID: 1, RoomName: "General's Quarters", Status: models.RoomDirty}},
+		{ID: 2, RoomID: 2, Date: date, Kind: "stayover", ReservationID: 1, DoneAt: date, Adults: 2, Children: 1,
+			DoneBy: models.User{FirstName: "Jane"}, Room: models.Room{ID: 2, RoomName: "Major's Suite", Status: models.RoomClean}},
+	}
+	return tasks, nil
+}
+
+// CompleteHousekeepingTask marks a task done by a user and the room clean
+func (m *testDBRepo) CompleteHousekeepingTask(id, userID int) error {
+	if id != 1 {
+		return errors.New("task is already done")
+	}
+	return nil
+}
+
+// InsertWorkOrder inserts a work order and returns its id
+func (m *testDBRepo) InsertWorkOrder(w models.WorkOrder) (int, error) {
+	if w.StartDate.Year() == 2050 {
+		return 0, repository.ErrRoomTaken
+	}
+	return 1, nil
+}
+
+// UpdateWorkOrder updates an open work order
+func (m *testDBRepo) UpdateWorkOrder(w models.WorkOrder) error {
+	if w.StartDate.Year() == 2050 {
+		return repository.ErrRoomTaken
+	}
+	if w.ID != 1 {
+		return errors.New("only open work orders can be changed")
+	}
+	return nil
+}
+
+// CloseWorkOrder closes a work order and releases its out of order block
+func (m *testDBRepo) CloseWorkOrder(id int) error {
+	if id != 1 {
+		return errors.New("work order is already closed")
+	}
+	return nil
+}
+
+// GetWorkOrderByID returns a work order with its photos
+func (m *testDBRepo) GetWorkOrderByID(id int) (models.WorkOrder, error) {
+	w := models.WorkOrder{ID: id, RoomID: 1, Title: "Leaking tap", Priority: "high", Status: "open",
+		Room: models.Room{ID: 1, RoomName: "General's Quarters"}}
+	switch {
+	case id > 2:
+		return w, errors.New("some error")
+	case id == 1:
+		w.StartDate = time.Date(2040, 1, 1, 0, 0, 0, 0, time.UTC)
+		w.EndDate = time.Date(2040, 1, 3, 0, 0, 0, 0, time.UTC)
+		w.Photos = []models.WorkOrderPhoto{{ID: 1, WorkOrderID: 1, FileName: "abc.jpg", OriginalName: "tap.jpg"}}
+	case id == 2:
+		w.Status = "closed"
+	}
+	return w, nil
+}
+
+// WorkOrders returns the work orders of a room, or of all rooms for roomID 0
+func (m *testDBRepo) WorkOrders(roomID int, status string) ([]models.WorkOrder, error) {
+	var orders []models.WorkOrder
+	if roomID > 2 {
+		return orders, errors.New("some error")
+	}
+	w, _ := m.GetWorkOrderByID(1)
+	orders = append(orders, w)
+	return orders, nil
+}
+
+// InsertWorkOrderPhoto records a photo saved for a work order
+func (m *testDBRepo) InsertWorkOrderPhoto(p models.WorkOrderPhoto) error {
+	if p.OriginalName == "fail.png" {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+// InsertAllotment holds the rooms for an allotment and returns its id
+func (m *testDBRepo) InsertAllotment(a models.Allotment, roomIDs []int) (int, error) {
+	for _, roomID := range roomIDs {
+		if roomID == 2 {
+			return 0, errors.New("one of the rooms is not available for these dates")
+		}
+	}
+	return 1, nil
+}
+
+// Allotments returns all the allotments
+func (m *testDBRepo) Allotments() ([]models.Allotment, error) {
+	a, _ := m.GetAllotmentByID(1)
+	return []models.Allotment{a}, nil
+}
+
+// GetAllotmentByID returns an allotment with its held rooms and reservations
+func (m *testDBRepo) GetAllotmentByID(id int) (models.Allotment, error) {
+	// allotment 1 holds room 1 for a wedding and had room 2 booked from it, allotment 2 is fully booked
+	a := models.Allotment{ID: id, Name: "Smith wedding", Code: "WEDDING", Rooms: 2, Booked: 1,
+		StartDate:   time.Date(2040, 6, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:     time.Date(2040, 6, 3, 0, 0, 0, 0, time.UTC),
+		ReleaseDate: time.Date(2040, 5, 1, 0, 0, 0, 0, time.UTC),
+		Held:        []models.Room{{ID: 1, RoomName: "General's Quarters"}},
+		PickedUp: []models.Reservation{{ID: 8, FirstName: "Jane", LastName: "Doe", RoomID: 2,
+			Room: models.Room{ID: 2, RoomName: "Major's Suite"}, AllotmentID: id}},
+	}
+	switch {
+	case id > 2:
+		return a, errors.New("some error")
+	case id == 2:
+		a.Code = "FULL"
+		a.Held = nil
+		a.Booked = 2
+	}
+	return a, nil
+}
+
+// GetAllotmentByCode returns the allotment of a booking code
+func (m *testDBRepo) GetAllotmentByCode(code string) (models.Allotment, error) {
+	switch code {
+	case "WEDDING":
+		return m.GetAllotmentByID(1)
+	case "FULL":
+		return m.GetAllotmentByID(2)
+	}
+	return models.Allotment{}, errors.New("no such code")
+}
+
+// BookFromAllotment books one of the rooms an allotment still holds; allotment 1 holds room 1, sleeping two
+func (m *testDBRepo) BookFromAllotment(allotmentID int, res models.Reservation) (int, int, error) {
+	if allotmentID != 1 {
+		return 0, 0, errors.New("all the rooms of the group are booked")
+	}
+	if guests := res.Adults + res.Children; guests > 2 {
+		return 0, 0, fmt.Errorf("none of the rooms left for the group sleeps %d guests", guests)
+	}
+	return 9, 1, nil
+}
+
+// ReleaseAllotments releases the rooms of allotments whose release date has come
+func (m *testDBRepo) ReleaseAllotments(on time.Time) (int64, error) {
+	return 0, nil
+}
+
+// InsertWaitlistEntry puts a guest on the waitlist; full@here.com fails
+func (m *testDBRepo) InsertWaitlistEntry(e models.WaitlistEntry) (int, error) {
+	if e.Email == "full@here.com" {
+		return 0, errors.New("some error")
+	}
+	return 1, nil
+}
+
+// GetWaitlistEntryByID returns entry 1 with a live offer of room 1 held by hold 201, entry 2 with an expired
+// offer, entry 3 already booked and entry 4 without an offer
+func (m *testDBRepo) GetWaitlistEntryByID(id int) (models.WaitlistEntry, error) {
+	if id < 1 || id > 4 {
+		return models.WaitlistEntry{}, errors.New("some error")
+	}
+
+	e := models.WaitlistEntry{
+		ID:             id,
+		Email:          "waiting@here.com",
+		StartDate:      time.Date(2040, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:        time.Date(2040, 1, 3, 0, 0, 0, 0, time.UTC),
+		Adults:         2,
+		Children:       1,
+		RoomID:         1,
+		Room:           models.Room{ID: 1, RoomName: "General's Quarters"},
+		NotifiedAt:     time.Now(),
+		OfferExpiresAt: time.Now().Add(time.Hour),
+		HoldID:         201,
+	}
+
+	switch id {
+	case 2:
+		e.OfferExpiresAt = time.Now().Add(-time.Hour)
+	case 3:
+		e.BookedAt = time.Now()
+	case 4:
+		e.RoomID = 0
+		e.Room = models.Room{}
+		e.NotifiedAt = time.Time{}
+		e.OfferExpiresAt = time.Time{}
+		e.HoldID = 0
+	}
+
+	return e, nil
+}
+
+// OfferWaitlistRooms offers room 1 to the first guest on the waitlist
+func (m *testDBRepo) OfferWaitlistRooms(expires time.Time) ([]models.WaitlistEntry, error) {
+	e, _ := m.GetWaitlistEntryByID(1)
+	e.OfferExpiresAt = expires
+	return []models.WaitlistEntry{e}, nil
+}
+
+// BookWaitlistEntry records that the guest booked the room offered to them
+func (m *testDBRepo) BookWaitlistEntry(id int) error {
+	return nil
+}
+
+// HoldRoom holds a room for a guest; a stay from 2045-01-01 is already held by someone else
+func (m *testDBRepo) HoldRoom(roomID int, start, end, expires time.Time) (int, error) {
+	if start.Equal(time.Date(2045, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		return 0, errors.New("the room is no longer free for the stay")
+	}
+	return roomID + 100, nil
+}
+
+// ReleaseHold gives back a room held for a guest
+func (m *testDBRepo) ReleaseHold(id int) error {
+	return nil
+}
+
+// ReleaseExpiredHolds gives back the rooms whose holds expired
+func (m *testDBRepo) ReleaseExpiredHolds(now time.Time) (int64, error) {
+	return 0, nil
+}
@@ -1,29 +1,118 @@
 package repository
 
 import (
+	"errors"
 	"time"
 
 	"github.com/kons77/room-bookings-app/internal/models"
 )
 
+// ErrSSOEmailTaken is returned when a single sign-on login carries the email of an account it isn't linked to
+var ErrSSOEmailTaken = errors.New("an account with this email already exists")
+
+// ErrRoomTaken is returned when a room being booked was taken by another booking or block
+var ErrRoomTaken = errors.New("the room is no longer available for these dates")
+
+// ErrBeforeArrival is returned when a guest is checked in before the arrival date of their reservation
+var ErrBeforeArrival = errors.New("the guest can't check in before the arrival date")
+
+// ErrGuestNotVerified is returned when a guest logs in before confirming their email
+var ErrGuestNotVerified = errors.New("the email of this account isn't confirmed yet")
+
 type DatabaseRepo interface {
 	AllUsers() bool // this function is listed in the interface
 
 	InsertReservation(res models.Reservation) (int, error)
 	InsertRoomRestriction(res models.RoomRestriction) error
 	SearchAvailabilityByDatesByRoomID(start, end time.Time, roomID int) (bool, error)
-	SearchAvailabilityForAllRooms(start, end time.Time) ([]models.Room, error)
+	SearchAvailabilityForAllRooms(start, end time.Time, guests int) ([]models.Room, error)
 	GetRoomByID(id int) (models.Room, error)
+	AllRoomTypes() ([]models.RoomType, error)
+	InsertRoomType(rt models.RoomType) (int, error)
+	InsertRoom(room models.Room) (int, error)
+	UpdateRoom(room models.Room) error
+	RoomsByType(typeID int) ([]models.Room, error)
+	SearchAvailabilityByRoomType(start, end time.Time, guests int, amenityIDs []int) ([]models.RoomType, error)
+	AssignUnit(id, roomID int) error
+	ShiftedStays(start, end time.Time, days, guests int, amenityIDs []int) ([]models.StaySegment, error)
+	PartialStays(start, end time.Time, guests int, amenityIDs []int) ([]models.StaySegment, error)
+	FlexibleStays(from, to time.Time, nights, guests int, weekends bool, amenityIDs []int) ([]models.StayOption, error)
+	AllAmenities() ([]models.Amenity, error)
+	InsertAmenity(a models.Amenity) (int, error)
+	AmenitiesByRoom() (map[int][]models.Amenity, error)
+	SetRoomAmenities(roomID int, amenityIDs []int) error
 	GetUserByID(id int) (models.User, error)
 	UpdateUser(u models.User) error
 	Authenticate(email, testPassword string) (int, string, error)
-	ReservationsForGrid(displaysAllReservations int) ([]models.Reservation, error)
+	SearchReservations(f models.ReservationFilter) ([]models.Reservation, int, error)
+	ExportReservations(f models.ReservationFilter, fn func(models.Reservation) error) error
+	ImportReservations(reservations []models.Reservation) ([]int, error)
+	CreateReservation(res models.Reservation) (int, error)
+	MoveReservation(id, roomID int, start, end time.Time) error
+	SplitReservation(id int, on time.Time, roomID int) error
+	InsertBookingGroup(reservations []models.Reservation, holdIDs []int) (int, error)
+	InsertReservationStays(res models.Reservation, stays []models.StaySegment, holdIDs []int) (int, error)
+	GroupReservations(groupID int) ([]models.Reservation, error)
+	CancelBookingGroup(groupID int) error
+
+	InsertAllotment(a models.Allotment, roomIDs []int) (int, error)
+	Allotments() ([]models.Allotment, error)
+	GetAllotmentByID(id int) (models.Allotment, error)
+	GetAllotmentByCode(code string) (models.Allotment, error)
+	BookFromAllotment(allotmentID int, res models.Reservation) (int, int, error)
+	ReleaseAllotments(on time.Time) (int64, error)
+	OccupancyReport(from, to time.Time, roomID int) (models.OccupancyReport, error)
+
+	FrontDesk(date time.Time) (models.FrontDeskDay, error)
+	CheckInReservation(id int) error
+	CheckOutReservation(id int) error
+
+	SetRoomStatus(roomID int, status string) error
+	GenerateHousekeepingTasks(date time.Time) (int64, error)
+	MarkOutOfOrderRooms(date time.Time) (int64, error)
+	HousekeepingTasks(date time.Time) ([]models.HousekeepingTask, error)
+	CompleteHousekeepingTask(id, userID int) error
+
+	InsertWorkOrder(w models.WorkOrder) (int, error)
+	UpdateWorkOrder(w models.WorkOrder) error
+	CloseWorkOrder(id int) error
+	GetWorkOrderByID(id int) (models.WorkOrder, error)
+	WorkOrders(roomID int, status string) ([]models.WorkOrder, error)
+	InsertWorkOrderPhoto(p models.WorkOrderPhoto) error
 	GetReseravtionByID(id int) (models.Reservation, error)
+	GetDeletedReservationByID(id int) (models.Reservation, error)
 	UpdateReservation(u models.Reservation) error
-	DeleteReservation(id int) error
+	DeleteReservation(id, deletedBy int) error
 	UpdateProcessedForReservation(id, processed int) error
 	AllRooms() ([]models.Room, error)
 	GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error)
-	InsertBlockForRoom(roomID int, startDate time.Time) error
+	InsertBlockForRoom(roomID int, startDate time.Time) (int, error)
 	DeleteBlockByID(id int) error
+	HoldRoom(roomID int, start, end, expires time.Time) (int, error)
+	ReleaseHold(id int) error
+	ReleaseExpiredHolds(now time.Time) (int64, error)
+
+	InsertGuest(g models.Guest) (int, error)
+	GetGuestByID(id int) (models.Guest, error)
+	AuthenticateGuest(email, testPassword string) (int, error)
+	VerifyGuestEmail(token string) (models.Guest, error)
+	LinkReservationsToGuest(guestID int, email string) error
+	ReservationsByGuestID(guestID int) ([]models.Reservation, error)
+	ReservationsByEmail(email string) ([]models.Reservation, error)
+	CancelReservation(id int) error
+
+	UpsertSSOUser(u models.User, issuer, subject string) (int, error)
+
+	InsertAuditEntry(e models.AuditEntry) error
+	AuditEntries(f models.AuditFilter) ([]models.AuditEntry, error)
+	AllStaffUsers() ([]models.User, error)
+
+	InsertWaitlistEntry(e models.WaitlistEntry) (int, error)
+	GetWaitlistEntryByID(id int) (models.WaitlistEntry, error)
+	OfferWaitlistRooms(expires time.Time) ([]models.WaitlistEntry, error)
+	BookWaitlistEntry(id int) error
+
+	DeletedReservations() ([]models.Reservation, error)
+	RestoreReservation(id int) error
+	PurgeDeletedReservations(deletedBefore time.Time) (int64, error)
 }
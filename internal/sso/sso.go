@@ -0,0 +1,161 @@
+package sso
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/kons77/room-bookings-app/internal/config"
+	"github.com/kons77/room-bookings-app/internal/models"
+	"golang.org/x/oauth2"
+)
+
+// Provider logs staff in with an OpenID Connect identity provider using the authorization code flow
+type Provider struct {
+	cfg      config.OIDCConfig
+	oauth    oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// New discovers the identity provider at cfg.Issuer and returns a provider for it
+func New(ctx context.Context, cfg config.OIDCConfig) (*Provider, error) {
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+
+	return &Provider{
+		cfg: cfg,
+		oauth: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+	}, nil
+}
+
+// AuthCodeURL returns the identity provider login page to send the user to
+func (p *Provider) AuthCodeURL(state, nonce string) string {
+	return p.oauth.AuthCodeURL(state, oidc.Nonce(nonce))
+}
+
+// Exchange trades the authorization code for a verified ID token and maps its claims to an identity
+func (p *Provider) Exchange(ctx context.Context, code, nonce string) (models.SSOIdentity, error) {
+	var identity models.SSOIdentity
+
+	token, err := p.oauth.Exchange(ctx, code)
+	if err != nil {
+		return identity, err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return identity, errors.New("no id_token in token response")
+	}
+
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return identity, err
+	}
+
+	if idToken.Nonce != nonce {
+		return identity, errors.New("id_token nonce does not match")
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return identity, err
+	}
+
+	identity.Issuer = idToken.Issuer
+	identity.Subject = idToken.Subject
+	identity.Email = stringClaim(claims, "email")
+	identity.EmailVerified = boolClaim(claims, "email_verified")
+	identity.FirstName = stringClaim(claims, "given_name")
+	identity.LastName = stringClaim(claims, "family_name")
+	identity.Groups = groupsClaim(claims, p.cfg.GroupsClaim)
+	identity.AccessLevel = p.AccessLevel(identity.Groups)
+
+	if identity.Email == "" {
+		return identity, errors.New("id_token has no email claim")
+	}
+
+	return identity, nil
+}
+
+// AccessLevel returns the highest access level mapped to any of the groups, 0 if none is mapped
+func (p *Provider) AccessLevel(groups []string) int {
+	level := 0
+	for _, g := range groups {
+		if l, ok := p.cfg.GroupLevels[g]; ok && l > level {
+			level = l
+		}
+	}
+	return level
+}
+
+// ParseGroupLevels parses a "group:level,group:level" list as given on the command line
+func ParseGroupLevels(s string) (map[string]int, error) {
+	levels := make(map[string]int)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		sep := strings.LastIndex(pair, ":")
+		if sep < 1 {
+			return nil, fmt.Errorf("invalid group mapping %q, want group:level", pair)
+		}
+
+		level, err := strconv.Atoi(pair[sep+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid access level in %q: %w", pair, err)
+		}
+		levels[pair[:sep]] = level
+	}
+	return levels, nil
+}
+
+// boolClaim returns a boolean claim, which some providers send as the string "true", false if it's missing
+func boolClaim(claims map[string]interface{}, name string) bool {
+	switch v := claims[name].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// stringClaim returns a string claim or "" if it's missing or of another type
+func stringClaim(claims map[string]interface{}, name string) string {
+	v, _ := claims[name].(string)
+	return v
+}
+
+// groupsClaim accepts the groups claim both as a list and as a single string
+func groupsClaim(claims map[string]interface{}, name string) []string {
+	var groups []string
+	switch v := claims[name].(type) {
+	case string:
+		groups = append(groups, v)
+	case []interface{}:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+	return groups
+}
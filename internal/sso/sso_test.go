@@ -0,0 +1,215 @@
+package sso
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kons77/room-bookings-app/internal/config"
+)
+
+// mockIdP is a minimal OpenID Connect provider: discovery, signing keys and a token endpoint
+// that answers every authorization code with an ID token carrying claims
+type mockIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]interface{}
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &mockIdP{key: key}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"issuer":                                idp.server.URL,
+			"authorization_endpoint":                idp.server.URL + "/auth",
+			"token_endpoint":                        idp.server.URL + "/token",
+			"jwks_uri":                              idp.server.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": "test",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idp.sign(t),
+		})
+	})
+
+	idp.server = httptest.NewServer(mux)
+	return idp
+}
+
+// sign returns the claims as an RS256 signed JWT
+func (idp *mockIdP) sign(t *testing.T) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(idp.claims)
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signingInput))
+
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestProvider_Exchange(t *testing.T) {
+	idp := newMockIdP(t)
+	defer idp.server.Close()
+
+	p, err := New(context.Background(), config.OIDCConfig{
+		Issuer:      idp.server.URL,
+		ClientID:    "bookings",
+		RedirectURL: "http://localhost:8080/user/sso/callback",
+		GroupLevels: map[string]int{"staff": 2, "admins": 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":            idp.server.URL,
+			"aud":            "bookings",
+			"sub":            "123",
+			"exp":            time.Now().Add(time.Hour).Unix(),
+			"iat":            time.Now().Unix(),
+			"nonce":          "nonce",
+			"email":          "jane@company.com",
+			"email_verified": true,
+			"given_name":     "Jane",
+			"family_name":    "Doe",
+			"groups":         []string{"staff", "admins"},
+		}
+	}
+
+	tests := []struct {
+		name          string
+		change        func(map[string]interface{})
+		nonce         string
+		expectErr     bool
+		expectedLevel int
+		verified      bool
+	}{
+		{"admin group", func(c map[string]interface{}) {}, "nonce", false, 3, true},
+		{"group as a single string", func(c map[string]interface{}) { c["groups"] = "staff" }, "nonce", false, 2, true},
+		{"no mapped group", func(c map[string]interface{}) { c["groups"] = []string{"sales"} }, "nonce", false, 0, true},
+		{"verified as a string", func(c map[string]interface{}) { c["email_verified"] = "true" }, "nonce", false, 3, true},
+		{"unverified email", func(c map[string]interface{}) { c["email_verified"] = false }, "nonce", false, 3, false},
+		{"no email_verified claim", func(c map[string]interface{}) { delete(c, "email_verified") }, "nonce", false, 3, false},
+		{"wrong nonce", func(c map[string]interface{}) {}, "other", true, 0, false},
+		{"wrong audience", func(c map[string]interface{}) { c["aud"] = "someone-else" }, "nonce", true, 0, false},
+		{"expired token", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, "nonce", true, 0, false},
+		{"missing email", func(c map[string]interface{}) { delete(c, "email") }, "nonce", true, 0, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			idp.claims = validClaims()
+			tc.change(idp.claims)
+
+			identity, err := p.Exchange(context.Background(), "code", tc.nonce)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("expected an error but got identity %+v", identity)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if identity.Email != "jane@company.com" || identity.FirstName != "Jane" || identity.Subject != "123" {
+				t.Errorf("claims not mapped, got %+v", identity)
+			}
+			if identity.AccessLevel != tc.expectedLevel {
+				t.Errorf("expected access level %d, got %d", tc.expectedLevel, identity.AccessLevel)
+			}
+			if identity.EmailVerified != tc.verified {
+				t.Errorf("expected email verified %t, got %t", tc.verified, identity.EmailVerified)
+			}
+			if identity.Issuer != idp.server.URL {
+				t.Errorf("expected issuer %s, got %s", idp.server.URL, identity.Issuer)
+			}
+		})
+	}
+}
+
+func TestProvider_AuthCodeURL(t *testing.T) {
+	idp := newMockIdP(t)
+	defer idp.server.Close()
+
+	p, err := New(context.Background(), config.OIDCConfig{Issuer: idp.server.URL, ClientID: "bookings"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(p.AuthCodeURL("state", "nonce"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(u.String(), idp.server.URL+"/auth") {
+		t.Errorf("expected the IdP authorization endpoint, got %s", u.String())
+	}
+	q := u.Query()
+	if q.Get("state") != "state" || q.Get("nonce") != "nonce" || q.Get("response_type") != "code" {
+		t.Errorf("missing authorization parameters in %s", u.String())
+	}
+}
+
+func TestParseGroupLevels(t *testing.T) {
+	levels, err := ParseGroupLevels("staff:2, admins:3,,team:ops:3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(levels) != 3 || levels["staff"] != 2 || levels["admins"] != 3 || levels["team:ops"] != 3 {
+		t.Errorf("unexpected mapping %v", levels)
+	}
+
+	for _, bad := range []string{"staff", "staff:x", ":3"} {
+		if _, err := ParseGroupLevels(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
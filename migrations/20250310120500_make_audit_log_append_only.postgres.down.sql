@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS audit_log_append_only ON public.audit_log;
+DROP FUNCTION IF EXISTS audit_log_append_only();
@@ -0,0 +1,3 @@
+INSERT INTO public.restrictions (id,restriction_name,created_at,updated_at) VALUES
+	(3,'Out of Order','2025-04-05 00:00:00.000','2025-04-05 00:00:00.000');
+SELECT setval('restrictions_id_seq', (SELECT max(id) FROM restrictions));
@@ -0,0 +1,2 @@
+UPDATE rooms SET room_type_id = null;
+delete from room_types;
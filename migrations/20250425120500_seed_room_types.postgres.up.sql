@@ -0,0 +1,7 @@
+-- every existing room is the only unit of a type of its own, with the same id
+INSERT INTO public.room_types (id,type_name,created_at,updated_at)
+	SELECT id,room_name,created_at,updated_at FROM rooms;
+SELECT setval('room_types_id_seq', (SELECT coalesce(max(id), 1) FROM room_types));
+UPDATE rooms SET room_type_id = id;
+-- the reservations so far were made for their room
+UPDATE reservations SET unit_assigned = true;
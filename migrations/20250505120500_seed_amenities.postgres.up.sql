@@ -0,0 +1,10 @@
+-- the catalogue to start with, staff attach amenities to the rooms
+INSERT INTO public.amenities (name,category,created_at,updated_at) VALUES
+	('King bed','bed','2025-05-05 00:00:00.000','2025-05-05 00:00:00.000'),
+	('Twin beds','bed','2025-05-05 00:00:00.000','2025-05-05 00:00:00.000'),
+	('Sea view','view','2025-05-05 00:00:00.000','2025-05-05 00:00:00.000'),
+	('Garden view','view','2025-05-05 00:00:00.000','2025-05-05 00:00:00.000'),
+	('Bathtub','bathroom','2025-05-05 00:00:00.000','2025-05-05 00:00:00.000'),
+	('Walk-in shower','bathroom','2025-05-05 00:00:00.000','2025-05-05 00:00:00.000'),
+	('Wheelchair accessible','accessibility','2025-05-05 00:00:00.000','2025-05-05 00:00:00.000'),
+	('Step-free access','accessibility','2025-05-05 00:00:00.000','2025-05-05 00:00:00.000');
@@ -0,0 +1,2 @@
+delete from room_restrictions where restriction_id = 5;
+delete from restrictions where id = 5;
@@ -0,0 +1,4 @@
+delete from restrictions where id = 5;
+INSERT INTO public.restrictions (id,restriction_name,created_at,updated_at) VALUES
+	(5,'Hold','2025-05-15 00:00:00.000','2025-05-15 00:00:00.000');
+SELECT setval('restrictions_id_seq', (SELECT max(id) FROM restrictions));
@@ -0,0 +1 @@
+UPDATE reservations SET room_charge = 0;
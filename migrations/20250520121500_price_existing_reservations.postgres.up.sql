@@ -0,0 +1,7 @@
+-- the rates at booking time weren't kept before, today's rates are the best guess
+UPDATE reservations r SET room_charge = coalesce((
+	SELECT sum((rr.end_date - rr.start_date) * rm.nightly_rate)
+	FROM room_restrictions rr
+	JOIN rooms rm ON (rm.id = rr.room_id)
+	WHERE rr.reservation_id = r.id AND rr.restriction_id = 1
+), 0);
@@ -114,10 +114,45 @@ function Prompt() {
     }
 }
 
+// calendarNights fetches the nights of a room over the next year, with whether each is free and its minimum stay
+async function calendarNights(room_id) {
+    const now = new Date();
+    const month = (d) => `${d.getFullYear()}-${String(d.getMonth() + 1).padStart(2, "0")}`;
+    const from = month(now);
+    const to = month(new Date(now.getFullYear(), now.getMonth() + 11, 1));
+
+    try {
+        const response = await fetch(`/availability-calendar?room_id=${room_id}&from=${from}&to=${to}`);
+        const data = await response.json();
+        if (!data.ok) {
+            return [];
+        }
+        return data.nights;
+    } catch (err) {
+        return [];
+    }
+}
+
+// departureRange is the first and last departure for an arrival: after its minimum stay, and no later than
+// the morning of the first booked night after it
+function departureRange(nights, arrival) {
+    const i = nights.findIndex((n) => n.date === arrival);
+    if (i < 0) {
+        return {min: null, max: null};
+    }
+
+    const min = nights[Math.min(i + nights[i].min_stay, nights.length - 1)].date;
+    const next = nights.findIndex((n, j) => j > i && !n.available);
+    const max = next < 0 ? null : nights[next].date;
+    return {min: min, max: max};
+}
+
 function checkAvailability(room_id) {
-    document.getElementById("check-availability-button").addEventListener("click", function(){    
+    document.getElementById("check-availability-button").addEventListener("click", async function(){    
         
         const csrfToken = this.getAttribute("data-csrf");
+        const nights = await calendarNights(room_id);
+        const booked = nights.filter((n) => !n.available).map((n) => n.date);
 
         const html = `
         <form id="check-availability-form" action="" method="post" novalidate class="needs-validation">            
@@ -171,6 +206,18 @@ function checkAvailability(room_id) {
                     orientation: "auto top",
                     minDate: new Date(),
                 })
+                // a booked night can't be the arrival, but the guest can leave the morning it starts
+                rp.datepickers[0].setOptions({datesDisabled: booked});
+
+                // the departure comes after the minimum stay and before the next booked night
+                document.getElementById("start").addEventListener("changeDate", function(e) {
+                    if (!e.detail.date) {
+                        return;
+                    }
+                    const arrival = Datepicker.formatDate(e.detail.date, "yyyy-mm-dd");
+                    const range = departureRange(nights, arrival);
+                    rp.datepickers[1].setOptions({minDate: range.min || new Date(), maxDate: range.max});
+                });
             },
             
             didOpen: () => {